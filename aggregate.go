@@ -0,0 +1,149 @@
+package sod
+
+import (
+	"fmt"
+)
+
+// indexedValues returns the values indexed for field of the Objects found.
+// Objects not indexed by a partial index have no value.
+func (s *Search) indexedValues(field string) (values []*IndexedField, err error) {
+	s.db.RLock()
+	defer s.db.RUnlock()
+
+	var sch *Schema
+
+	s.resolve()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	if sch, err = s.db.schema(s.object); err != nil {
+		return
+	}
+
+	if _, ok := sch.ObjectIndex.Fields[field]; !ok {
+		return nil, fmt.Errorf("%s %w", field, ErrUnindexedField)
+	}
+
+	values = make([]*IndexedField, 0, len(s.fields))
+	for _, f := range s.fields {
+		if v, ok := sch.ObjectIndex.indexed(field, f.ObjectId); ok {
+			values = append(values, v)
+		}
+	}
+
+	return
+}
+
+// numeric returns the indexed value of f as a float64
+func numeric(f *IndexedField) (float64, error) {
+	switch v := f.Value.(type) {
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("%w, cannot cast %T(%v) to float64", ErrCasting, f.Value, f.Value)
+}
+
+// extremum returns the value of field the farthest in the direction of
+// farther among the Objects found
+func (s *Search) extremum(field string, farther func(f, other *IndexedField) bool) (v interface{}, err error) {
+	var values []*IndexedField
+	var ext *IndexedField
+
+	if values, err = s.indexedValues(field); err != nil {
+		return
+	}
+
+	for _, f := range values {
+		if ext == nil || farther(f, ext) {
+			ext = f
+		}
+	}
+
+	if ext == nil {
+		return nil, fmt.Errorf("%s %w with field %s", stype(s.object), ErrNoObjectFound, field)
+	}
+
+	return ext.Value, nil
+}
+
+/***** Public Methods ******/
+
+// Count returns the number of Objects found having a value indexed for
+// field, which is less than Len only if field has a partial index. As
+// other aggregations, it is computed from the index only and the limit
+// set on the search is ignored. ErrUnindexedField is returned if field
+// is not indexed.
+func (s *Search) Count(field string) (n int, err error) {
+	var values []*IndexedField
+
+	if values, err = s.indexedValues(field); err != nil {
+		return
+	}
+
+	return len(values), nil
+}
+
+// Sum returns the sum of the values of the numeric field of the Objects
+// found, see Count. Times are summed as nanoseconds since Unix epoch.
+func (s *Search) Sum(field string) (sum float64, err error) {
+	var values []*IndexedField
+
+	if values, err = s.indexedValues(field); err != nil {
+		return
+	}
+
+	for _, f := range values {
+		var v float64
+
+		if v, err = numeric(f); err != nil {
+			return
+		}
+		sum += v
+	}
+
+	return
+}
+
+// Avg returns the average of the values of the numeric field of the Objects
+// found, see Count. ErrNoObjectFound is returned if there is no value.
+func (s *Search) Avg(field string) (avg float64, err error) {
+	var values []*IndexedField
+
+	if values, err = s.indexedValues(field); err != nil {
+		return
+	}
+
+	if len(values) == 0 {
+		return 0, fmt.Errorf("%s %w with field %s", stype(s.object), ErrNoObjectFound, field)
+	}
+
+	for _, f := range values {
+		var v float64
+
+		if v, err = numeric(f); err != nil {
+			return
+		}
+		avg += v
+	}
+
+	return avg / float64(len(values)), nil
+}
+
+// Min returns the smallest value of field among the Objects found, see
+// Count. Values are the ones stored in the index so they are normalized
+// as explained in CollectWithValues. ErrNoObjectFound is returned if
+// there is no value.
+func (s *Search) Min(field string) (interface{}, error) {
+	return s.extremum(field, func(f, other *IndexedField) bool { return f.less(other) })
+}
+
+// Max returns the greatest value of field among the Objects found, see Min
+func (s *Search) Max(field string) (interface{}, error) {
+	return s.extremum(field, func(f, other *IndexedField) bool { return f.greater(other) })
+}
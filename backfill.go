@@ -0,0 +1,89 @@
+package sod
+
+// indexBuild is an index built from the Objects already in the collection
+type indexBuild struct {
+	// fill indexes an Object of the collection
+	fill func(o Object, objid uint64) error
+	// build completes the index once all the Objects are filled,
+	// it must not modify the schema
+	build func() error
+}
+
+// backfill gathers the indexes declared in a schema which must be built
+// from the Objects already in the collection, so that they are all built
+// in a single pass over the collection
+type backfill struct {
+	builds   []indexBuild
+	installs []func()
+	// field indexes being built, by field path
+	fields map[string]*fieldIndex
+}
+
+func newBackfill() *backfill {
+	return &backfill{fields: make(map[string]*fieldIndex)}
+}
+
+// add registers an index to build, build might be nil
+func (b *backfill) add(fill func(o Object, objid uint64) error, build func() error) {
+	b.builds = append(b.builds, indexBuild{fill, build})
+}
+
+// addField registers a field index to build
+func (b *backfill) addField(fi *fieldIndex, fill func(o Object, objid uint64) error, build func() error) {
+	b.fields[fi.Name] = fi
+	b.add(fill, build)
+}
+
+// install registers a modification of the schema made
+// once all the indexes are successfully built
+func (b *backfill) install(f func()) {
+	b.installs = append(b.installs, f)
+}
+
+// field returns the index of a field, the one being built if any
+func (b *backfill) field(s *Schema, field string) (fi *fieldIndex, ok bool) {
+	if fi, ok = b.fields[field]; ok {
+		return
+	}
+	fi, ok = s.ObjectIndex.Fields[field]
+	return
+}
+
+// backfill builds the indexes gathered in b reading every Object of the
+// collection once, the schema is modified only if all of them are built
+func (db *DB) backfill(s *Schema, b *backfill) (err error) {
+	var o Object
+
+	if len(b.builds) > 0 {
+		for uuid, objid := range s.ObjectIndex.uuids {
+			if o, err = db.getByUUID(newObject(s.object), uuid); err != nil {
+				return
+			}
+
+			for _, ib := range b.builds {
+				if err = ib.fill(o, objid); err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	for _, ib := range b.builds {
+		if ib.build == nil {
+			continue
+		}
+
+		if err = ib.build(); err != nil {
+			return
+		}
+	}
+
+	for _, install := range b.installs {
+		install()
+	}
+
+	// indexes built are partitioned as the ones of the schema
+	s.ObjectIndex.partitionBy(s.Partition)
+
+	return
+}
@@ -0,0 +1,100 @@
+package sod
+
+import (
+	"errors"
+)
+
+var (
+	ErrBatchClosed = errors.New("batch closed")
+)
+
+// Batch groups individual insertions whose index is committed at once.
+// Objects are written to disk as they are inserted but the schema, index
+// included, of every type inserted is only saved when the Batch is
+// committed. Objects written but not committed yet are found again by
+// DB.Repair if the process stops before. A Batch is safe for concurrent use.
+type Batch struct {
+	db *DB
+	// Objects of the types to commit by type
+	pending map[string]Object
+	closed  bool
+}
+
+/***** Private Methods ******/
+
+// commit commits the index of the types of Objects inserted
+func (b *Batch) commit() (last error) {
+	for key, o := range b.pending {
+		if err := b.db.commit(o); err != nil {
+			last = err
+			continue
+		}
+		delete(b.pending, key)
+	}
+	return
+}
+
+/***** Public Methods ******/
+
+// Batch returns a new Batch of insertions on db
+func (db *DB) Batch() *Batch {
+	return &Batch{db: db, pending: make(map[string]Object)}
+}
+
+// InsertOrUpdate inserts or updates a single Object like DB.InsertOrUpdate
+// does but the index is only committed by Commit or Close
+func (b *Batch) InsertOrUpdate(o Object) (err error) {
+	b.db.Lock()
+	defer b.db.Unlock()
+
+	var schema *Schema
+
+	if b.closed {
+		return ErrBatchClosed
+	}
+
+	if schema, err = b.db.schema(o); err != nil {
+		return
+	}
+
+	// making transformations prior to validation
+	o.Transform()
+	schema.transform(o)
+	if err = b.db.validate(o); err != nil {
+		return
+	}
+
+	if err = b.db.insertOrUpdate(schema, o, false); err != nil {
+		return
+	}
+
+	b.pending[stype(o)] = o
+	return
+}
+
+// Commit commits the index of all the types of Objects inserted since the
+// Batch was created or last committed. Batch can still be used afterwards.
+func (b *Batch) Commit() (last error) {
+	b.db.Lock()
+	defer b.db.Unlock()
+
+	if b.closed {
+		return ErrBatchClosed
+	}
+
+	return b.commit()
+}
+
+// Close commits the Batch, see Commit, and closes it. Any subsequent
+// call to the Batch fails with ErrBatchClosed.
+func (b *Batch) Close() (last error) {
+	b.db.Lock()
+	defer b.db.Unlock()
+
+	if b.closed {
+		return ErrBatchClosed
+	}
+
+	b.closed = true
+	return b.commit()
+}
@@ -0,0 +1,93 @@
+package sod
+
+import (
+	"bytes"
+)
+
+// CompactReport reports what DB.CompactAndVerify changed
+type CompactReport struct {
+	// Compacted is the number of Object files rewritten
+	Compacted int
+	// Reindexed is the number of Objects found on disk but not indexed
+	Reindexed int
+	// Unindexed is the number of Objects indexed but missing from disk
+	Unindexed int
+}
+
+// Changed returns true if any Object file or the index has been modified
+func (r CompactReport) Changed() bool {
+	return r.Compacted > 0 || r.Reindexed > 0 || r.Unindexed > 0
+}
+
+// CompactAndVerify is a maintenance operation to run after large deletions
+// or imports. It repairs the index of the Objects of the same type as of,
+// see DB.Repair, then rewrites in canonical format the Object files not in
+// it (i.e. indented or written with another encoder) and finally controls
+// and commits the index. The returned report tells what has been changed.
+func (db *DB) CompactAndVerify(of Object) (r CompactReport, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	// Objects waiting to be written must be on disk
+	if s.mustCache() {
+		if err = db.flushAll(of); err != nil {
+			return
+		}
+	}
+
+	if r.Reindexed, r.Unindexed, err = db.repair(of); err != nil {
+		return
+	}
+
+	if r.Compacted, err = db.compact(s, of); err != nil {
+		return
+	}
+
+	if err = s.control(); err != nil {
+		return
+	}
+
+	err = db.commit(of)
+	return
+}
+
+// compact rewrites the Object files whose content is not the one
+// they would be written with and returns the number of files rewritten
+func (db *DB) compact(s *Schema, of Object) (n int, err error) {
+	for uuid := range s.ObjectIndex.uuids {
+		var stored, data []byte
+
+		o := newObject(of)
+		o.Initialize(uuid)
+		path := db.oPath(s, o)
+
+		if stored, err = readJsonFile(db.storage, path); err != nil {
+			return
+		}
+
+		if err = s.decodeObject(stored, o, nil); err != nil {
+			return
+		}
+
+		if data, err = db.encodeObject(s, path, o); err != nil {
+			return
+		}
+
+		if bytes.Equal(stored, data) {
+			continue
+		}
+
+		if err = writeReader(db.storage, path, bytes.NewBuffer(data), DefaultPermissions, s.Compress); err != nil {
+			return
+		}
+		n++
+	}
+
+	return
+}
@@ -0,0 +1,232 @@
+package sod
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var (
+	ErrBadCompositeIndex = errors.New("bad composite index")
+
+	// upper bound of any hex encoded key starting with a given prefix
+	hexUpperBound = "g"
+)
+
+// compositeIndex indexes a tuple of fields. The tuple is encoded into a
+// string preserving the order of the values so that a query with equality
+// conditions on the first fields and a range condition on the last field
+// translates into a single range in the index.
+type compositeIndex struct {
+	Fields []string    `json:"fields"`
+	Casts  []string    `json:"casts"`
+	Index  *fieldIndex `json:"index"`
+	paths  [][]string
+}
+
+func compositeName(fields []string) string {
+	return strings.Join(fields, ",")
+}
+
+func newCompositeIndex(fields []string, descs FieldDescMap) (ci *compositeIndex, err error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%w %v: at least two fields are needed", ErrBadCompositeIndex, fields)
+	}
+
+	ci = &compositeIndex{
+		Fields: fields,
+		Casts:  make([]string, 0, len(fields)),
+		Index:  newFieldIndex(FieldDescriptor{Path: compositeName(fields), Type: "string"}),
+		paths:  make([][]string, 0, len(fields)),
+	}
+
+	for _, f := range fields {
+		if fd, ok := descs[f]; !ok {
+			return nil, fmt.Errorf("%w: unknown field %s", ErrBadCompositeIndex, f)
+		} else if cast, ok := fd.castType(); !ok {
+			return nil, fmt.Errorf("%w %s cannot index type %s", ErrBadCompositeIndex, f, fd.Type)
+		} else {
+			ci.Casts = append(ci.Casts, cast)
+			ci.paths = append(ci.paths, fieldPath(f))
+		}
+	}
+
+	return
+}
+
+func (ci *compositeIndex) UnmarshalJSON(data []byte) error {
+	type tmp compositeIndex
+	t := tmp{}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+
+	*ci = compositeIndex(t)
+	ci.paths = make([][]string, 0, len(ci.Fields))
+	for _, f := range ci.Fields {
+		ci.paths = append(ci.paths, fieldPath(f))
+	}
+
+	return nil
+}
+
+func (ci *compositeIndex) clone() *compositeIndex {
+	new := *ci
+	new.Index = ci.Index.clone()
+	return &new
+}
+
+// encodeKeyPart appends to buf a binary representation of f preserving order
+func encodeKeyPart(buf *bytes.Buffer, f *IndexedField) {
+	b := make([]byte, 8)
+
+	switch v := f.Value.(type) {
+	case int64:
+		binary.BigEndian.PutUint64(b, uint64(v)^(1<<63))
+		buf.Write(b)
+	case uint64:
+		binary.BigEndian.PutUint64(b, v)
+		buf.Write(b)
+	case float64:
+		// we don't want to distinguish -0 and +0
+		if v == 0 {
+			v = 0
+		}
+		bits := math.Float64bits(v)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		binary.BigEndian.PutUint64(b, bits)
+		buf.Write(b)
+	case string:
+		// escaping \x00 so that terminator always sorts first
+		buf.WriteString(strings.ReplaceAll(v, "\x00", "\x00\xff"))
+		buf.Write([]byte{0x00, 0x01})
+	default:
+		panic(fmt.Errorf("%w %T", ErrUnknownKeyType, f.Value))
+	}
+}
+
+// encode encodes values into a key, values are checked against index casts
+func (ci *compositeIndex) encode(values ...interface{}) (key string, err error) {
+	var f *IndexedField
+
+	buf := new(bytes.Buffer)
+	for i, v := range values {
+		if f, err = searchField(v); err != nil {
+			return
+		}
+
+		if f.valueTypeString() != ci.Casts[i] {
+			return "", fmt.Errorf("%w, cannot cast %T(%v) to %s", ErrCasting, v, v, ci.Casts[i])
+		}
+
+		encodeKeyPart(buf, f)
+	}
+
+	// hexadecimal encoding keeps ordering and produces valid JSON strings
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+func (ci *compositeIndex) objectKey(o Object) (key string, err error) {
+	values := make([]interface{}, 0, len(ci.paths))
+
+	for i, p := range ci.paths {
+		if v, ok := fieldByName(o, p); ok {
+			values = append(values, v)
+		} else {
+			return "", fmt.Errorf("%w %s", ErrUnkownField, ci.Fields[i])
+		}
+	}
+
+	return ci.encode(values...)
+}
+
+func (ci *compositeIndex) insert(o Object, objid uint64) (err error) {
+	var key string
+
+	if key, err = ci.objectKey(o); err != nil {
+		return
+	}
+
+	return ci.Index.Insert(key, objid)
+}
+
+func (ci *compositeIndex) update(o Object, objid uint64) (err error) {
+	var key string
+
+	if key, err = ci.objectKey(o); err != nil {
+		return
+	}
+
+	return ci.Index.Update(key, objid)
+}
+
+func (ci *compositeIndex) delete(objid uint64) {
+	ci.Index.Delete(objid)
+}
+
+// search returns the fields matching clauses if clauses can be answered
+// by the composite index. Clauses must contain equality conditions on
+// all fields but the last one which can be any comparison.
+func (ci *compositeIndex) search(clauses []*searchClause) (f []*IndexedField, ok bool) {
+	var prefix, full string
+	var lo, hi *IndexedField
+	var err error
+
+	if len(clauses) != len(ci.Fields) {
+		return
+	}
+
+	byField := make(map[string]*searchClause)
+	for _, c := range clauses {
+		byField[c.field] = c
+	}
+
+	values := make([]interface{}, 0, len(ci.Fields))
+	for i, field := range ci.Fields {
+		if c, ok := byField[field]; !ok {
+			return nil, false
+		} else if i < len(ci.Fields)-1 && c.operator != "=" {
+			return nil, false
+		} else {
+			values = append(values, c.value)
+		}
+	}
+
+	if prefix, err = ci.encode(values[:len(values)-1]...); err != nil {
+		return
+	}
+
+	if full, err = ci.encode(values...); err != nil {
+		return
+	}
+
+	loIncl, hiIncl := true, false
+	switch byField[ci.Fields[len(ci.Fields)-1]].operator {
+	case "=":
+		lo, hi = &IndexedField{Value: full}, &IndexedField{Value: full}
+		hiIncl = true
+	case ">":
+		lo, hi = &IndexedField{Value: full}, &IndexedField{Value: prefix + hexUpperBound}
+		loIncl = false
+	case ">=":
+		lo, hi = &IndexedField{Value: full}, &IndexedField{Value: prefix + hexUpperBound}
+	case "<":
+		lo, hi = &IndexedField{Value: prefix}, &IndexedField{Value: full}
+	case "<=":
+		lo, hi = &IndexedField{Value: prefix}, &IndexedField{Value: full}
+		hiIncl = true
+	default:
+		return
+	}
+
+	return ci.Index.SearchRange(lo, hi, loIncl, hiIncl), true
+}
@@ -0,0 +1,53 @@
+package sod
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/0xrawsec/toast"
+)
+
+func TestCompositeKeyOrder(t *testing.T) {
+	tt := toast.FromT(t)
+
+	desc := FieldDescMap{
+		"S": FieldDescriptor{Path: "S", Type: "string"},
+		"I": FieldDescriptor{Path: "I", Type: "int"},
+		"U": FieldDescriptor{Path: "U", Type: "uint"},
+		"F": FieldDescriptor{Path: "F", Type: "float64"},
+	}
+
+	ci, err := newCompositeIndex([]string{"S", "I", "U", "F"}, desc)
+	tt.CheckErr(err)
+
+	less := func(a, b []interface{}) bool {
+		ka, err := ci.encode(a...)
+		tt.CheckErr(err)
+		kb, err := ci.encode(b...)
+		tt.CheckErr(err)
+		return ka < kb
+	}
+
+	tt.Assert(less([]interface{}{"a", 0, uint(0), 0.0}, []interface{}{"b", 0, uint(0), 0.0}))
+	tt.Assert(less([]interface{}{"a", 42, uint(0), 0.0}, []interface{}{"ab", -42, uint(0), 0.0}))
+	tt.Assert(less([]interface{}{"a\x00", 0, uint(0), 0.0}, []interface{}{"a\x00\x00", -1, uint(0), 0.0}))
+	tt.Assert(less([]interface{}{"a", -42, uint(0), 0.0}, []interface{}{"a", 42, uint(0), 0.0}))
+	tt.Assert(less([]interface{}{"a", 0, uint(41), 0.0}, []interface{}{"a", 0, uint(42), 0.0}))
+	tt.Assert(less([]interface{}{"a", 0, uint(0), -42.42}, []interface{}{"a", 0, uint(0), -4.2}))
+	tt.Assert(less([]interface{}{"a", 0, uint(0), -4.2}, []interface{}{"a", 0, uint(0), 4.2}))
+	tt.Assert(!less([]interface{}{"a", 0, uint(0), 0.0}, []interface{}{"a", 0, uint(0), -0.0}))
+
+	// random integers must keep their order
+	for i := 0; i < 10000; i++ {
+		a, b := rand.Int63()-rand.Int63(), rand.Int63()-rand.Int63()
+		tt.Assert(less([]interface{}{"a", a, uint(0), 0.0}, []interface{}{"a", b, uint(0), 0.0}) == (a < b))
+	}
+
+	_, err = ci.encode("a", "b", uint(0), 0.0)
+	tt.ExpectErr(err, ErrCasting)
+
+	_, err = newCompositeIndex([]string{"S"}, desc)
+	tt.ExpectErr(err, ErrBadCompositeIndex)
+	_, err = newCompositeIndex([]string{"S", "Unknown"}, desc)
+	tt.ExpectErr(err, ErrBadCompositeIndex)
+}
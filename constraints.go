@@ -11,10 +11,14 @@ type Constraints struct {
 	Unique bool `json:"unique,omitempty"`
 	Upper  bool `json:"upper,omitempty"`
 	Lower  bool `json:"lower,omitempty"`
+	// SuffixIndex indexes the reversed values of a string field, in
+	// addition to the field index, so that the "$=" operator (ends with)
+	// is answered by a range search instead of scanning the whole index
+	SuffixIndex bool `json:"suffix-index,omitempty"`
 }
 
 func (c Constraints) String() string {
-	return fmt.Sprintf("index:%t unique:%t upper:%t lower:%t", c.Index, c.Unique, c.Upper, c.Lower)
+	return fmt.Sprintf("index:%t unique:%t upper:%t lower:%t suffix-index:%t", c.Index, c.Unique, c.Upper, c.Lower, c.SuffixIndex)
 }
 
 func (c *Constraints) Transform(i interface{}) {
@@ -55,14 +59,13 @@ func (c *Constraints) transform(v reflect.Value) {
 		switch v.Kind() {
 		case reflect.Interface:
 			// in case we passed a pointer to an interface which is a string
-			i := v.Elem().Interface()
-			if s, ok := i.(string); ok {
-				v.Set(reflect.ValueOf(strings.ToUpper(s)))
+			if e := v.Elem(); e.Kind() == reflect.String {
+				v.Set(reflect.ValueOf(strings.ToUpper(e.String())).Convert(e.Type()))
 			}
 
 		case reflect.String:
 			// can only apply upper transform to string
-			v.SetString(strings.ToUpper(v.Interface().(string)))
+			v.SetString(strings.ToUpper(v.String()))
 		}
 	}
 
@@ -71,14 +74,13 @@ func (c *Constraints) transform(v reflect.Value) {
 		switch v.Kind() {
 		case reflect.Interface:
 			// in case we passed a pointer to an interface which is a string
-			i := v.Elem().Interface()
-			if s, ok := i.(string); ok {
-				v.Set(reflect.ValueOf(strings.ToLower(s)))
+			if e := v.Elem(); e.Kind() == reflect.String {
+				v.Set(reflect.ValueOf(strings.ToLower(e.String())).Convert(e.Type()))
 			}
 
 		case reflect.String:
 			// can only apply upper transform to string
-			v.SetString(strings.ToLower(v.Interface().(string)))
+			v.SetString(strings.ToLower(v.String()))
 		}
 	}
 }
@@ -0,0 +1,56 @@
+package sod
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrBadContentAddressed = errors.New("bad content addressed schema")
+)
+
+// controlContentAddressed checks that Objects are not modified on every
+// insertion, otherwise identical Objects would never have the same UUID
+func (s *Schema) controlContentAddressed() error {
+	if !s.ContentAddressed {
+		return nil
+	}
+
+	if s.UpdatedAt != "" || s.Sequence != "" {
+		return fmt.Errorf("%w: updated at and sequence fields change the content of Objects", ErrBadContentAddressed)
+	}
+
+	return nil
+}
+
+// contentUUID returns the UUID derived from the SHA-256 of the canonical
+// JSON encoding of o, encoding/json being deterministic (fields in
+// structure order and map keys sorted)
+func contentUUID(o Object) (string, error) {
+	var u uuid.UUID
+
+	data, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	copy(u[:], sum[:])
+	// version 8 is the version of custom UUIDs (RFC 9562)
+	u[6] = (u[6] & 0x0f) | 0x80
+	u[8] = (u[8] & 0x3f) | 0x80
+
+	return u.String(), nil
+}
+
+// contentAddress sets the UUID of o from its content. Objects which cannot
+// be encoded keep their UUID as they fail to be written anyway.
+func (s *Schema) contentAddress(o Object) {
+	if uuid, err := contentUUID(o); err == nil {
+		o.Initialize(uuid)
+	}
+}
@@ -0,0 +1,55 @@
+package sod
+
+import (
+	"errors"
+)
+
+var (
+	ErrViewReadOnly = errors.New("db view is read only")
+)
+
+// DBView is a read only view of a DB passed to DBValidator. It is lock free
+// as the DB is locked by the caller, so it is only valid during the call.
+type DBView struct {
+	db *DB
+}
+
+// readOnly returns an error if db can only be read, that is if it is the
+// DB of a Snapshot or of a DBView
+func (db *DB) readOnly() error {
+	switch {
+	case db.snapshot != nil:
+		return ErrSnapshotReadOnly
+	case db.nolock:
+		return ErrViewReadOnly
+	}
+	return nil
+}
+
+/***** Public Methods ******/
+
+// Search Objects of the DB, see DB.Search. Objects
+// found cannot be deleted through the Search.
+func (v *DBView) Search(o Object, field, operator string, value interface{}) *Search {
+	return v.db.Search(o, field, operator, value)
+}
+
+// Get gets a single Object, see DB.Get
+func (v *DBView) Get(in Object) (out Object, err error) {
+	return v.db.Get(in)
+}
+
+// Exist returns true if the Object exists, see DB.Exist
+func (v *DBView) Exist(o Object) (ok bool, err error) {
+	return v.db.Exist(o)
+}
+
+// All returns all the Objects of the same type as of, see DB.All
+func (v *DBView) All(of Object) (out []Object, err error) {
+	return v.db.All(of)
+}
+
+// Count returns the number of Objects of the same type as of, see DB.Count
+func (v *DBView) Count(of Object) (n int, err error) {
+	return v.db.Count(of)
+}
@@ -0,0 +1,191 @@
+package sod
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrBadDerivedIndex   = errors.New("bad derived index")
+	ErrMissingDerivation = errors.New("derived index function not declared")
+)
+
+// DerivedIndex declares an index on a virtual field whose value is computed
+// from the Object by compute (i.e. a full name built from a first and a last
+// name). Derived values are not stored in Object files, they only live in the
+// index and are computed every time an Object is indexed, repairs included.
+// The virtual field is searched as any indexed field. Compute must return
+// values of the same type for all the Objects, the type indexed is the one
+// of the value computed for a zero Object. Field cannot be a field of the
+// Object.
+//
+// As predicates of partial indexes, compute functions cannot be stored in
+// the schema file so they must be declared every time the schema is created
+// with DB.Create, Objects cannot be written otherwise. A derived index not
+// declared anymore is dropped and one whose type changed is rebuilt.
+func (s *Schema) DerivedIndex(field string, compute func(o Object) interface{}) {
+	// map is copied not to modify copies of the schema
+	derived := make(map[string]func(o Object) interface{}, len(s.derived)+1)
+	for f, c := range s.derived {
+		derived[f] = c
+	}
+	derived[field] = compute
+	s.derived = derived
+}
+
+// value returns the value of the field indexed in o
+func (in *fieldIndex) value(o Object) (v interface{}, err error) {
+	var ok bool
+	var f *IndexedField
+
+	if !in.Derived {
+		if v, ok = fieldByName(o, in.nameSplit); !ok {
+			return nil, fmt.Errorf("%w %s", ErrUnkownField, in.Name)
+		}
+		return
+	}
+
+	if in.compute == nil {
+		return nil, fmt.Errorf("%w for field %s", ErrMissingDerivation, in.Name)
+	}
+
+	v = in.compute(o)
+	if f, err = newIndexedField(v, 0); err != nil {
+		return
+	}
+
+	if f.valueTypeString() != in.Cast {
+		return nil, fmt.Errorf("%w, cannot cast %T(%v) to %s", ErrCasting, v, v, in.Cast)
+	}
+
+	return
+}
+
+// controlDerivations checks that the functions of derived indexes are known
+func (in *objIndex) controlDerivations() error {
+	for fn, fi := range in.Fields {
+		if fi.Derived && fi.compute == nil {
+			return fmt.Errorf("%w for field %s", ErrMissingDerivation, fn)
+		}
+	}
+	return nil
+}
+
+// derivations returns the functions of the derived indexes by field
+func (in *objIndex) derivations() map[string]func(o Object) interface{} {
+	derivations := make(map[string]func(o Object) interface{})
+	for fn, fi := range in.Fields {
+		if fi.Derived {
+			derivations[fn] = fi.compute
+		}
+	}
+	return derivations
+}
+
+// copyDerived sets the functions of the derived indexes of from,
+// derived indexes missing from in are added empty
+func (in *objIndex) copyDerived(from *objIndex) {
+	for fn, ffi := range from.Fields {
+		if !ffi.Derived {
+			continue
+		}
+
+		if fi, ok := in.Fields[fn]; ok {
+			fi.compute = ffi.compute
+		} else {
+			in.Fields[fn] = newDerivedIndex(fn, ffi.Cast, ffi.compute)
+		}
+	}
+}
+
+func newDerivedIndex(field, cast string, compute func(o Object) interface{}) *fieldIndex {
+	return &fieldIndex{
+		Name:        field,
+		Cast:        cast,
+		Constraints: Constraints{Index: true},
+		Index:       make([]*IndexedField, 0),
+		Derived:     true,
+		objectIds:   make(map[uint64]*IndexedField),
+		nameSplit:   fieldPath(field),
+		compute:     compute,
+	}
+}
+
+// syncDerivedIndexes builds the derived indexes declared, rebuilds the ones
+// whose type changed and drops the ones not declared anymore. Indexes are
+// built and schema is modified by b (see DB.backfill).
+func (db *DB) syncDerivedIndexes(s *Schema, declaration map[string]func(o Object) interface{}, b *backfill) (err error) {
+	built := make(map[string]*fieldIndex)
+	for field, compute := range declaration {
+		var zero *IndexedField
+
+		if _, ok := fieldByName(s.object, fieldPath(field)); ok || field == UUIDField {
+			return fmt.Errorf("%w: %s is a field of %s", ErrBadDerivedIndex, field, stype(s.object))
+		}
+
+		if fi, ok := s.ObjectIndex.Fields[field]; ok && !fi.Derived {
+			return fmt.Errorf("%w: field %s is already indexed", ErrBadDerivedIndex, field)
+		}
+
+		if zero, err = newIndexedField(compute(newObject(s.object)), 0); err != nil {
+			return fmt.Errorf("%w: field %s: %s", ErrBadDerivedIndex, field, err)
+		}
+
+		// derived values of the Objects already indexed did not change,
+		// function is needed if the index is rebuilt (see syncPartialIndexes)
+		if fi, ok := s.ObjectIndex.Fields[field]; ok && fi.Cast == zero.valueTypeString() {
+			fi.compute = compute
+			continue
+		}
+
+		new := newDerivedIndex(field, zero.valueTypeString(), compute)
+		fields := make([]*IndexedField, 0, len(s.ObjectIndex.uuids))
+
+		b.addField(new, func(o Object, objid uint64) error {
+			// index might be made partial by syncPartialIndexes
+			if !new.indexes(o) {
+				return nil
+			}
+
+			v, err := new.value(o)
+			if err != nil {
+				return err
+			}
+
+			f, err := newIndexedField(v, objid)
+			if err != nil {
+				return err
+			}
+			fields = append(fields, f)
+			return nil
+		}, func() error {
+			new.replace(new.merged(fields))
+			return nil
+		})
+		built[field] = new
+	}
+
+	b.install(func() {
+		changed := len(built) > 0
+		for fn, fi := range s.ObjectIndex.Fields {
+			if _, ok := declaration[fn]; fi.Derived && !ok {
+				delete(s.ObjectIndex.Fields, fn)
+				changed = true
+			}
+		}
+
+		for fn, fi := range built {
+			s.ObjectIndex.Fields[fn] = fi
+		}
+
+		for fn, compute := range declaration {
+			s.ObjectIndex.Fields[fn].compute = compute
+		}
+
+		if changed {
+			s.queries.invalidate()
+		}
+	})
+
+	return
+}
@@ -0,0 +1,91 @@
+package sod
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+)
+
+// dirNames maps object types to the custom directory names
+// declared in their schema. The mapping is stored at the root
+// of the DB so that schemas can be found when DB is re-opened.
+type dirNames struct {
+	once sync.Once
+	err  error
+	m    map[string]string
+}
+
+func newDirNames() *dirNames {
+	return &dirNames{m: make(map[string]string)}
+}
+
+// load loads the mapping from DB root, it is done only once
+func (d *dirNames) load(st Storage, root string) error {
+	d.once.Do(func() {
+		path := filepath.Join(root, DirNamesFilename)
+		if isFileAndExist(st, path) {
+			d.err = unmarshalJsonFile(st, path, &d.m)
+		}
+	})
+	return d.err
+}
+
+func (d *dirNames) get(stype string) (dir string, ok bool) {
+	dir, ok = d.m[stype]
+	return
+}
+
+// owner returns the object type stored in dir
+func (d *dirNames) owner(dir string) (stype string, ok bool) {
+	for stype, name := range d.m {
+		if name == dir {
+			return stype, true
+		}
+	}
+	return
+}
+
+// set sets the directory name of an object type and saves the mapping
+func (d *dirNames) set(st Storage, root, stype, dir string) (err error) {
+	d.m[stype] = dir
+	// mapping must not be modified if it cannot be saved
+	defer func() {
+		if err != nil {
+			delete(d.m, stype)
+		}
+	}()
+
+	return d.save(st, root)
+}
+
+// remove removes the directory name of an object type and saves the mapping
+func (d *dirNames) remove(st Storage, root, stype string) (err error) {
+	dir, ok := d.m[stype]
+	if !ok {
+		return
+	}
+
+	delete(d.m, stype)
+	// mapping must not be modified if it cannot be saved
+	defer func() {
+		if err != nil {
+			d.m[stype] = dir
+		}
+	}()
+
+	return d.save(st, root)
+}
+
+func (d *dirNames) save(st Storage, root string) (err error) {
+	var data []byte
+
+	if err = st.MkdirAll(root, DefaultPermissions); err != nil {
+		return
+	}
+
+	if data, err = json.Marshal(d.m); err != nil {
+		return
+	}
+
+	return st.WriteFile(filepath.Join(root, DirNamesFilename), data, DefaultPermissions)
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,24 +16,88 @@ var (
 )
 
 type FieldDescriptor struct {
-	Path        string      `json:"path"`
-	Type        string      `json:"type"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+	// Kind is the underlying type of named types (i.e. type Status int)
+	Kind        string      `json:"kind,omitempty"`
 	Constraints Constraints `json:"constraints"`
+	// JSONKeys are the keys of the field in the JSON encoding of
+	// the Object, only set if they differ from the field path
+	// (i.e. json tags or embedded structures)
+	JSONKeys []string `json:"json_keys,omitempty"`
 }
 
 func (d *FieldDescriptor) cast() string {
-	switch d.Type {
+	if cast, ok := d.castType(); ok {
+		return cast
+	}
+	panic(fmt.Sprintf("unkwnown type to cast %s", d.Type))
+}
+
+// castType returns the type used to index the field and false
+// if the field type cannot be indexed
+func (d *FieldDescriptor) castType() (string, bool) {
+	typ := d.Type
+	if d.Kind != "" {
+		typ = d.Kind
+	}
+
+	switch typ {
 	case "int", "int8", "int16", "int32", "int64", "time.Time":
-		return "int64"
+		return "int64", true
 	case "uint", "uint8", "uint16", "uint32", "uint64":
-		return "uint64"
+		return "uint64", true
 	case "float32", "float64":
-		return "float64"
+		return "float64", true
 	case "string":
-		return d.Type
+		return typ, true
 	default:
-		panic(fmt.Sprintf("unkwnown type to cast %s", d.Type))
+		return "", false
+	}
+}
+
+// intSize returns the size in bits of field if it is an integer, named
+// integer types included
+func (d *FieldDescriptor) intSize() (int, bool) {
+	typ := d.Type
+	if d.Kind != "" {
+		typ = d.Kind
+	}
+
+	switch typ {
+	case "int8", "uint8":
+		return 8, true
+	case "int16", "uint16":
+		return 16, true
+	case "int32", "uint32":
+		return 32, true
+	case "int64", "uint64":
+		return 64, true
+	case "int", "uint":
+		return strconv.IntSize, true
 	}
+	return 0, false
+}
+
+// TypeCompatible returns true if both descriptors have the same type or if
+// other, the new descriptor, widens the integer type of d keeping the same
+// signedness (i.e. int32 to int64 or int and a named int type). Such type
+// changes are not breaking as integers are indexed the same way whatever
+// their size and values already stored fit in the new type.
+func (d *FieldDescriptor) TypeCompatible(other *FieldDescriptor) bool {
+	if d.Type == other.Type {
+		return true
+	}
+
+	size, ok := d.intSize()
+	osize, ook := other.intSize()
+	return ok && ook && d.cast() == other.cast() && osize >= size
+}
+
+// FieldCompatible returns true if descriptors have the same path
+// and compatible types
+func (d *FieldDescriptor) FieldCompatible(other *FieldDescriptor) bool {
+	return d.Path == other.Path && d.TypeCompatible(other)
 }
 
 func (d *FieldDescriptor) Transform(o interface{}) {
@@ -49,8 +114,10 @@ func (d *FieldDescriptor) FieldEqual(other *FieldDescriptor) bool {
 
 }
 
+// DeepEqual compares field, type and constraints of descriptors. Kind is
+// not compared as it derives from type.
 func (d *FieldDescriptor) DeepEqual(other *FieldDescriptor) bool {
-	return reflect.DeepEqual(d, other)
+	return d.FieldEqual(other) && reflect.DeepEqual(d.Constraints, other.Constraints)
 }
 
 func (d FieldDescriptor) String() string {
@@ -64,17 +131,21 @@ func FieldDescriptors(from Object) (desc FieldDescMap) {
 	sdesc := make([]FieldDescriptor, 0)
 	recFieldDescriptors(reflect.ValueOf(from), "", &sdesc)
 	for _, fd := range sdesc {
+		fd.JSONKeys = fieldJSONKeys(typeof(from), fd.Path)
 		desc[fd.Path] = fd
 	}
 	return
 }
 
+// CompatibleWith checks that descriptors have the same fields with
+// compatible types (see TypeCompatible) and the same constraints, target
+// being the new descriptors
 func (m FieldDescMap) CompatibleWith(target FieldDescMap) (err error) {
 
 	for p, fd := range m {
 		if ofd, ok := target[p]; !ok {
 			return fmt.Errorf("target %w %s", ErrUnkownField, p)
-		} else if !fd.DeepEqual(&ofd) {
+		} else if !fd.FieldCompatible(&ofd) || !reflect.DeepEqual(fd.Constraints, ofd.Constraints) {
 			return fmt.Errorf("%w %s", ErrFieldDescModif, ofd)
 		}
 	}
@@ -82,7 +153,7 @@ func (m FieldDescMap) CompatibleWith(target FieldDescMap) (err error) {
 	for p, ofd := range target {
 		if fd, ok := m[p]; !ok {
 			return fmt.Errorf("source %w %s", ErrUnkownField, p)
-		} else if !ofd.DeepEqual(&fd) {
+		} else if !fd.FieldCompatible(&ofd) || !reflect.DeepEqual(fd.Constraints, ofd.Constraints) {
 			return fmt.Errorf("%w %s", ErrFieldDescModif, fd)
 		}
 	}
@@ -90,12 +161,15 @@ func (m FieldDescMap) CompatibleWith(target FieldDescMap) (err error) {
 	return
 }
 
+// FieldsCompatibleWith checks that descriptors have the same fields
+// with compatible types (see TypeCompatible), target being the new
+// descriptors
 func (m FieldDescMap) FieldsCompatibleWith(target FieldDescMap) (err error) {
 
 	for p, fd := range m {
 		if ofd, ok := target[p]; !ok {
 			return fmt.Errorf("target %w %s", ErrUnkownField, p)
-		} else if !fd.FieldEqual(&ofd) {
+		} else if !fd.FieldCompatible(&ofd) {
 			return fmt.Errorf("%w %s", ErrFieldDescModif, ofd)
 		}
 	}
@@ -103,7 +177,7 @@ func (m FieldDescMap) FieldsCompatibleWith(target FieldDescMap) (err error) {
 	for p, ofd := range target {
 		if fd, ok := m[p]; !ok {
 			return fmt.Errorf("source %w %s", ErrUnkownField, p)
-		} else if !ofd.FieldEqual(&fd) {
+		} else if !fd.FieldCompatible(&ofd) {
 			return fmt.Errorf("%w %s", ErrFieldDescModif, fd)
 		}
 	}
@@ -111,6 +185,17 @@ func (m FieldDescMap) FieldsCompatibleWith(target FieldDescMap) (err error) {
 	return
 }
 
+// updateTypes updates the types of fields with the ones of target
+// if they are compatible (see TypeCompatible)
+func (m FieldDescMap) updateTypes(target FieldDescMap) {
+	for p, fd := range m {
+		if tfd, ok := target[p]; ok && fd.Type != tfd.Type && fd.TypeCompatible(&tfd) {
+			fd.Type, fd.Kind = tfd.Type, tfd.Kind
+			m[p] = fd
+		}
+	}
+}
+
 func (m FieldDescMap) Transformers() (t []FieldDescriptor) {
 	t = make([]FieldDescriptor, 0)
 	for _, fd := range m {
@@ -135,12 +220,32 @@ func (m FieldDescMap) Constraint(fpath string, c Constraints) (err error) {
 	return fmt.Errorf("%w %s", ErrUnkownField, fpath)
 }
 
+// lenDescriptor returns the descriptor of the indexed
+// virtual field holding the length of a field
+func lenDescriptor(lenPath string) FieldDescriptor {
+	return FieldDescriptor{
+		Path:        lenPath,
+		Type:        "int",
+		Constraints: Constraints{Index: true},
+	}
+}
+
 func fdFromType(path string, tag string, fieldType reflect.Type) FieldDescriptor {
 	fd := FieldDescriptor{
 		Path: path,
 		Type: fieldType.String(),
 	}
 
+	// named types of basic kinds are indexed as their underlying type
+	switch k := fieldType.Kind(); k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String:
+		if k.String() != fd.Type {
+			fd.Kind = k.String()
+		}
+	}
+
 	for _, tv := range strings.Split(tag, ",") {
 		switch tv {
 		case "index":
@@ -148,6 +253,9 @@ func fdFromType(path string, tag string, fieldType reflect.Type) FieldDescriptor
 		case "unique":
 			fd.Constraints.Index = true
 			fd.Constraints.Unique = true
+		case "suffix":
+			fd.Constraints.Index = true
+			fd.Constraints.SuffixIndex = true
 		case "lower":
 			fd.Constraints.Lower = true
 		case "upper":
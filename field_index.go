@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 )
 
 // fieldIndex structure
@@ -15,19 +17,69 @@ type fieldIndex struct {
 	// IndexedField.Value is an interface{}
 	Cast        string          `json:"cast"`
 	Constraints Constraints     `json:"constraints"`
-	Index       []*indexedField `json:"index"`
-	objectIds   map[uint64]*indexedField
+	Index       []*IndexedField `json:"index"`
+	// Partial is set if only the Objects satisfying predicate
+	// are indexed, see Schema.PartialIndex
+	Partial bool `json:"partial,omitempty"`
+	// Derived is set if values are computed by compute
+	// instead of being read, see Schema.DerivedIndex
+	Derived bool `json:"derived,omitempty"`
+	// partitioned is set if the entries of the index are in
+	// the indexes of the partitions, see objIndex.partitionBy
+	partitioned bool
+	objectIds   map[uint64]*IndexedField
 	nameSplit   []string
+	predicate   func(o Object) bool
+	compute     func(o Object) interface{}
 }
 
-func (i *fieldIndex) UnmarshalJSON(data []byte) error {
-	type tmp struct {
-		Name        string          `json:"name"`
-		Cast        string          `json:"cast"`
-		Constraints Constraints     `json:"constraints"`
-		Index       []*indexedField `json:"index"`
+// jsonFieldIndex is the on-disk representation of a fieldIndex. As index
+// is sorted, equal values are contiguous so values are run length encoded
+// (Values[i] is repeated Counts[i] times) and ObjectIds are stored apart.
+// Legacy format storing the full list of IndexedField is still decoded.
+type jsonFieldIndex struct {
+	Name        string            `json:"name"`
+	Cast        string            `json:"cast"`
+	Constraints Constraints       `json:"constraints"`
+	Values      []json.RawMessage `json:"values"`
+	Counts      []int             `json:"counts"`
+	ObjectIds   []uint64          `json:"object-ids"`
+	Partial     bool              `json:"partial,omitempty"`
+	Derived     bool              `json:"derived,omitempty"`
+	// legacy format
+	Index []*IndexedField `json:"index,omitempty"`
+}
+
+func (i *fieldIndex) MarshalJSON() ([]byte, error) {
+	t := jsonFieldIndex{
+		Name:        i.Name,
+		Cast:        i.Cast,
+		Constraints: i.Constraints,
+		Values:      make([]json.RawMessage, 0),
+		Counts:      make([]int, 0),
+		ObjectIds:   make([]uint64, 0, i.Len()),
+		Partial:     i.Partial,
+		Derived:     i.Derived,
+	}
+
+	for k, f := range i.Index {
+		if k == 0 || !f.equal(i.Index[k-1]) {
+			if v, err := json.Marshal(f.Value); err != nil {
+				return nil, err
+			} else {
+				t.Values = append(t.Values, v)
+				t.Counts = append(t.Counts, 0)
+			}
+		}
+		t.Counts[len(t.Counts)-1]++
+		t.ObjectIds = append(t.ObjectIds, f.ObjectId)
 	}
-	t := tmp{}
+
+	return json.Marshal(&t)
+}
+
+func (i *fieldIndex) UnmarshalJSON(data []byte) error {
+	t := jsonFieldIndex{}
 	if err := json.Unmarshal(data, &t); err != nil {
 		return err
 	}
@@ -35,14 +87,50 @@ func (i *fieldIndex) UnmarshalJSON(data []byte) error {
 	i.Name = t.Name
 	i.Cast = t.Cast
 	i.Constraints = t.Constraints
-	i.Index = t.Index
+	i.Partial = t.Partial
+	i.Derived = t.Derived
 	i.nameSplit = fieldPath(i.Name)
 
-	for _, f := range i.Index {
-		f.valueTypeFromString(i.Cast)
+	if t.Values != nil {
+		if len(t.Values) != len(t.Counts) {
+			return fmt.Errorf("malformed index %s: values and counts mismatch", i.Name)
+		}
+
+		i.Index = make([]*IndexedField, 0, len(t.ObjectIds))
+		for k, raw := range t.Values {
+			var value interface{}
+			var err error
+
+			if value, err = decodeIndexValue(raw, i.Cast); err != nil {
+				return err
+			}
+
+			for n := 0; n < t.Counts[k]; n++ {
+				if len(i.Index) == len(t.ObjectIds) {
+					return fmt.Errorf("malformed index %s: missing object ids", i.Name)
+				}
+				i.Index = append(i.Index, &IndexedField{value, t.ObjectIds[len(i.Index)]})
+			}
+		}
+
+		if len(i.Index) != len(t.ObjectIds) {
+			return fmt.Errorf("malformed index %s: too many object ids", i.Name)
+		}
+	} else {
+		// legacy format
+		i.Index = t.Index
+		if i.Index == nil {
+			i.Index = make([]*IndexedField, 0)
+		}
+
+		for _, f := range i.Index {
+			if err := f.valueTypeFromString(i.Cast); err != nil {
+				return err
+			}
+		}
 	}
 
-	i.objectIds = make(map[uint64]*indexedField)
+	i.objectIds = make(map[uint64]*IndexedField)
 	for _, k := range i.Index {
 		i.objectIds[k.ObjectId] = k
 	}
@@ -51,8 +139,8 @@ func (i *fieldIndex) UnmarshalJSON(data []byte) error {
 
 func emptyFieldIndex() *fieldIndex {
 	return &fieldIndex{
-		Index:     make([]*indexedField, 0),
-		objectIds: make(map[uint64]*indexedField),
+		Index:     make([]*IndexedField, 0),
+		objectIds: make(map[uint64]*IndexedField),
 	}
 }
 
@@ -68,19 +156,33 @@ func newFieldIndex(desc FieldDescriptor, opts ...int) *fieldIndex {
 	}
 	return &fieldIndex{
 		Name:        desc.Path,
-		Index:       make([]*indexedField, l, c),
+		Index:       make([]*IndexedField, l, c),
 		Constraints: desc.Constraints,
 		Cast:        desc.cast(),
-		objectIds:   make(map[uint64]*indexedField),
+		objectIds:   make(map[uint64]*IndexedField),
 		nameSplit:   fieldPath(desc.Path)}
 }
 
-func (in *fieldIndex) InsertionIndex(k *indexedField) int {
+// clone returns a copy of the index which is not modified
+// by further modifications of the original index
+func (in *fieldIndex) clone() *fieldIndex {
+	new := *in
+	new.Index = make([]*IndexedField, len(in.Index))
+	// IndexedFields are never modified once inserted so they can be shared
+	copy(new.Index, in.Index)
+	new.objectIds = make(map[uint64]*IndexedField, len(in.objectIds))
+	for id, f := range in.objectIds {
+		new.objectIds[id] = f
+	}
+	return &new
+}
+
+func (in *fieldIndex) InsertionIndex(k *IndexedField) int {
 	return in.insertionIndexRec(k, 0, in.Len())
 }
 
 // Recursive function to search for the next index less than Sortable
-func (in *fieldIndex) insertionIndexRec(k *indexedField, i, j int) int {
+func (in *fieldIndex) insertionIndexRec(k *IndexedField, i, j int) int {
 	// case where index is empty
 	if in.Len() == 0 {
 		return 0
@@ -113,7 +215,7 @@ func (in *fieldIndex) insertionIndexRec(k *indexedField, i, j int) int {
 	return in.insertionIndexRec(k, pivot, j)
 }
 
-func (in *fieldIndex) rangeEqual(k *indexedField) (i, j int) {
+func (in *fieldIndex) rangeEqual(k *IndexedField) (i, j int) {
 	j = in.InsertionIndex(k) - 1
 	for i = j; i >= 0 && in.Index[i].equal(k); i-- {
 	}
@@ -122,7 +224,7 @@ func (in *fieldIndex) rangeEqual(k *indexedField) (i, j int) {
 }
 
 // Satisfy checks whether the value satisfies the constraints fixed by index
-func (in *fieldIndex) Satisfy(objid uint64, exist bool, fvalue *indexedField) (err error) {
+func (in *fieldIndex) Satisfy(objid uint64, exist bool, fvalue *IndexedField) (err error) {
 
 	constraint := in.Constraints
 
@@ -144,46 +246,90 @@ func (in *fieldIndex) Satisfy(objid uint64, exist bool, fvalue *indexedField) (e
 	return
 }
 
-func (in *fieldIndex) Has(value *indexedField) bool {
+// Duplicates returns all the groups of fields sharing the same value
+func (in *fieldIndex) Duplicates() (dups [][]*IndexedField) {
+	dups = make([][]*IndexedField, 0)
+
+	for i := 0; i < in.Len(); {
+		// index is sorted so equal values are contiguous
+		equals := in.SearchEqual(in.Index[i])
+		if len(equals) > 1 {
+			dups = append(dups, equals)
+		}
+		i += len(equals)
+	}
+
+	return
+}
+
+func (in *fieldIndex) Has(value *IndexedField) bool {
 	return len(in.SearchEqual(value)) > 0
 }
 
-func (in *fieldIndex) SearchEqual(value *indexedField) []*indexedField {
+func (in *fieldIndex) SearchEqual(value *IndexedField) []*IndexedField {
 
 	i, j := in.rangeEqual(value)
 
 	if i == j {
 		if in.Len() > 0 {
-			return []*indexedField{in.Index[i]}
+			return []*IndexedField{in.Index[i]}
 		}
 	}
 
 	return in.Index[i : j+1]
 }
 
-func (in *fieldIndex) SearchNotEqual(value *indexedField) (f []*indexedField) {
+// SearchFirstEqual returns the first field equal to value in index order
+// (the last one if reverse is true) without walking all the matching fields
+func (in *fieldIndex) SearchFirstEqual(value *IndexedField, reverse bool) (f *IndexedField, ok bool) {
+	var i int
+
+	if reverse {
+		// index is in descending order so we search the last field not less than value
+		i = sort.Search(in.Len(), func(k int) bool { return in.Index[k].less(value) }) - 1
+	} else {
+		i = sort.Search(in.Len(), func(k int) bool { return !in.Index[k].greater(value) })
+	}
+
+	if i >= 0 && i < in.Len() && in.Index[i].equal(value) {
+		return in.Index[i], true
+	}
+
+	return nil, false
+}
+
+// CountEqual returns the number of fields equal to value
+func (in *fieldIndex) CountEqual(value *IndexedField) int {
+	// index is in descending order so equal fields are between
+	// the first one not greater and the first one less than value
+	i := sort.Search(in.Len(), func(k int) bool { return !in.Index[k].greater(value) })
+	j := sort.Search(in.Len(), func(k int) bool { return in.Index[k].less(value) })
+	return j - i
+}
+
+func (in *fieldIndex) SearchNotEqual(value *IndexedField) (f []*IndexedField) {
 
 	i, j := in.rangeEqual(value)
-	f = make([]*indexedField, len(in.Index[0:i]))
+	f = make([]*IndexedField, len(in.Index[0:i]))
 	copy(f, in.Index[0:i])
 	f = append(f, in.Index[j+1:]...)
 
 	return
 }
 
-func (in *fieldIndex) SearchGreaterOrEqual(value *indexedField) []*indexedField {
+func (in *fieldIndex) SearchGreaterOrEqual(value *IndexedField) []*IndexedField {
 
 	i := in.InsertionIndex(value)
 
 	// the only case when it is (logicaly) possible is when index is empty
 	if i == 0 {
-		return []*indexedField{}
+		return []*IndexedField{}
 	}
 
 	return in.Index[:i]
 }
 
-func (in *fieldIndex) SearchGreater(value *indexedField) (f []*indexedField) {
+func (in *fieldIndex) SearchGreater(value *IndexedField) (f []*IndexedField) {
 
 	i := in.InsertionIndex(value)
 	if i > in.lastIndex() {
@@ -200,24 +346,24 @@ func (in *fieldIndex) SearchGreater(value *indexedField) (f []*indexedField) {
 
 	if i == 0 {
 		if in.Len() > 0 && in.Index[0].greater(value) {
-			return []*indexedField{in.Index[0]}
+			return []*IndexedField{in.Index[0]}
 		}
 	}
 
 	return in.Index[:i+1]
 }
 
-func (in *fieldIndex) SearchLess(value *indexedField) []*indexedField {
+func (in *fieldIndex) SearchLess(value *IndexedField) []*IndexedField {
 
 	i := in.InsertionIndex(value)
 	if i > in.lastIndex() {
-		return []*indexedField{}
+		return []*IndexedField{}
 	}
 
 	return in.Index[i:]
 }
 
-func (in *fieldIndex) SearchLessOrEqual(value *indexedField) []*indexedField {
+func (in *fieldIndex) SearchLessOrEqual(value *IndexedField) []*IndexedField {
 
 	i := in.InsertionIndex(value)
 	if i > in.lastIndex() {
@@ -234,31 +380,87 @@ func (in *fieldIndex) SearchLessOrEqual(value *indexedField) []*indexedField {
 	return in.Index[i+1:]
 }
 
-func (in *fieldIndex) SearchByRegex(value *indexedField) (out []*indexedField, err error) {
+// SearchRange returns the fields between lo and hi, inclusive bounds are
+// controlled by loIncl and hiIncl
+func (in *fieldIndex) SearchRange(lo, hi *IndexedField, loIncl, hiIncl bool) []*IndexedField {
+	var i, j int
+
+	// index is in descending order so we first search the upper bound
+	if hiIncl {
+		i = sort.Search(in.Len(), func(k int) bool { return !in.Index[k].greater(hi) })
+	} else {
+		i = sort.Search(in.Len(), func(k int) bool { return in.Index[k].less(hi) })
+	}
+
+	if loIncl {
+		j = sort.Search(in.Len(), func(k int) bool { return in.Index[k].less(lo) })
+	} else {
+		j = sort.Search(in.Len(), func(k int) bool { return !in.Index[k].greater(lo) })
+	}
+
+	if i >= j {
+		return []*IndexedField{}
+	}
+
+	return in.Index[i:j]
+}
+
+// SearchByRegex returns the fields matching the regex value. It returns
+// ErrCasting if value or indexed fields are not strings, even if the
+// index is empty.
+func (in *fieldIndex) SearchByRegex(value *IndexedField) (out []*IndexedField, err error) {
 	var rex *regexp.Regexp
 
-	out = make([]*indexedField, 0)
+	sval, ok := value.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, value.Value, value.Value)
+	}
 
-	if sval, ok := value.Value.(string); ok {
-		if rex, err = regexp.Compile(sval); err != nil {
-			return
-		}
+	if rex, err = regexp.Compile(sval); err != nil {
+		return
 	}
 
+	out = make([]*IndexedField, 0)
+
 	for _, f := range in.Index {
 		if sval, ok := f.Value.(string); ok {
 			if rex.MatchString(sval) {
 				out = append(out, f)
 			}
 		} else {
-			return
+			return nil, fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, f.Value, f.Value)
 		}
 	}
 
 	return
 }
 
-func (in *fieldIndex) insert(field *indexedField) {
+// SearchContains returns the fields containing the substring value.
+// It returns ErrCasting if value or indexed fields are not strings.
+func (in *fieldIndex) SearchContains(value *IndexedField) (out []*IndexedField, err error) {
+	var substr string
+	var ok bool
+
+	if substr, ok = value.Value.(string); !ok {
+		return nil, fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, value.Value, value.Value)
+	}
+
+	out = make([]*IndexedField, 0)
+
+	for _, f := range in.Index {
+		if sval, ok := f.Value.(string); ok {
+			if strings.Contains(sval, substr) {
+				out = append(out, f)
+			}
+		} else {
+			return nil, fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, f.Value, f.Value)
+		}
+	}
+
+	return
+}
+
+func (in *fieldIndex) insert(field *IndexedField) {
 
 	i := in.InsertionIndex(field)
 
@@ -275,9 +477,38 @@ func (in *fieldIndex) insert(field *indexedField) {
 	in.objectIds[field.ObjectId] = field
 }
 
+// merged returns the fields of the index merged with new fields. Fields are
+// sorted once instead of being inserted one by one, which is faster when
+// many fields are inserted. The index is not modified.
+func (in *fieldIndex) merged(fields []*IndexedField) []*IndexedField {
+	index := make([]*IndexedField, 0, len(in.Index)+len(fields))
+	index = append(append(index, in.Index...), fields...)
+	// stable sort keeps equal values in insertion order as insert does
+	sort.SliceStable(index, func(i, j int) bool { return index[j].less(index[i]) })
+	return index
+}
+
+// hasDuplicates returns true if a sorted slice of fields contains equal values
+func hasDuplicates(sorted []*IndexedField) bool {
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].equal(sorted[i-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// replace replaces the fields of the index with sorted fields
+func (in *fieldIndex) replace(sorted []*IndexedField) {
+	in.Index = sorted
+	for _, f := range sorted {
+		in.objectIds[f.ObjectId] = f
+	}
+}
+
 // Insertion method in the slice for a structure implementing Sortable
 func (in *fieldIndex) Insert(value interface{}, objid uint64) (err error) {
-	var field *indexedField
+	var field *IndexedField
 
 	if field, err = newIndexedField(value, objid); err != nil {
 		return
@@ -288,6 +519,17 @@ func (in *fieldIndex) Insert(value interface{}, objid uint64) (err error) {
 	return
 }
 
+// unchanged returns true if value is the one indexed for objid
+func (in *fieldIndex) unchanged(objid uint64, value interface{}) bool {
+	cur, ok := in.objectIds[objid]
+	if !ok {
+		return false
+	}
+
+	f, err := newIndexedField(value, objid)
+	return err == nil && f.valueTypeString() == cur.valueTypeString() && f.equal(cur)
+}
+
 func (in *fieldIndex) lastIndex() int {
 	return in.Len() - 1
 }
@@ -301,7 +543,7 @@ func (in *fieldIndex) Update(value interface{}, objid uint64) (err error) {
 	return in.Insert(value, objid)
 }
 
-func (in *fieldIndex) SearchKey(k *indexedField) (i int, ok bool) {
+func (in *fieldIndex) SearchKey(k *IndexedField) (i int, ok bool) {
 
 	i, j := in.rangeEqual(k)
 	if i == j {
@@ -322,7 +564,7 @@ func (in *fieldIndex) Delete(objid uint64) {
 	if field, ok := in.objectIds[objid]; ok {
 		if i, ok := in.SearchKey(field); ok {
 			if len(in.Index) == 1 {
-				in.Index = make([]*indexedField, 0)
+				in.Index = make([]*IndexedField, 0)
 			} else {
 				in.Index = append(in.Index[:i], in.Index[i+1:]...)
 			}
@@ -338,7 +580,7 @@ func (in *fieldIndex) Delete(objid uint64) {
 // Constrain returns an index which intersects with other fields
 // we can build some query logic based on that function searching an
 // index from the result of another index
-func (in *fieldIndex) Constrain(fields []*indexedField) (new *fieldIndex) {
+func (in *fieldIndex) Constrain(fields []*IndexedField) (new *fieldIndex) {
 	new = emptyFieldIndex()
 	for _, fi := range fields {
 		if field, ok := in.objectIds[fi.ObjectId]; ok {
@@ -349,7 +591,7 @@ func (in *fieldIndex) Constrain(fields []*indexedField) (new *fieldIndex) {
 }
 
 // Slice returns the underlying slice
-func (in *fieldIndex) Slice() []*indexedField {
+func (in *fieldIndex) Slice() []*IndexedField {
 	return in.Index
 }
 
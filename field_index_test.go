@@ -2,7 +2,9 @@ package sod
 
 import (
 	"encoding/json"
+	"math"
 	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 
@@ -30,7 +32,7 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func searchFieldOrPanic(value interface{}) *indexedField {
+func searchFieldOrPanic(value interface{}) *IndexedField {
 	if sf, err := searchField(value); err != nil {
 		panic(err)
 	} else {
@@ -133,6 +135,120 @@ func TestIndexJsonMarshal(t *testing.T) {
 
 }
 
+func TestIndexJsonCompact(t *testing.T) {
+	var new *fieldIndex
+
+	tt := toast.FromT(t)
+	size := 1000
+
+	i := newFieldIndex(FieldDescriptor{Path: "M", Type: "time.Time"})
+	now := time.Now()
+	for k := 0; k < size; k++ {
+		// values with more than 53 bits must not loose precision
+		tt.CheckErr(i.Insert(now.Add(time.Duration(rand.Int()%42)), uint64(k)))
+	}
+
+	data, err := json.Marshal(i)
+	tt.CheckErr(err)
+	tt.CheckErr(json.Unmarshal(data, &new))
+
+	tt.Assert(new.Len() == i.Len())
+	for k := range i.Index {
+		tt.Assert(new.Index[k].deepEqual(i.Index[k]))
+	}
+
+	// legacy format must still be decoded
+	legacy := `{"name":"A","cast":"int64","constraints":{"index":true},"index":[[42,1],[41,0]]}`
+	tt.CheckErr(json.Unmarshal([]byte(legacy), &new))
+	tt.Assert(new.Len() == 2)
+	tt.Assert(new.Index[0].Value.(int64) == 42 && new.Index[0].ObjectId == 1)
+	tt.Assert(new.Control())
+
+	// integers greater than 2^53 must not lose precision
+	big := newFieldIndex(FieldDescriptor{Path: "N", Type: "uint64"})
+	for k := uint64(0); k < 10; k++ {
+		tt.CheckErr(big.Insert(uint64(math.MaxUint64)-k, k))
+		tt.CheckErr(big.Insert(uint64(1<<53)+k, k+10))
+	}
+	data, err = json.Marshal(big)
+	tt.CheckErr(err)
+	tt.CheckErr(json.Unmarshal(data, &new))
+	tt.Assert(new.Len() == big.Len())
+	for k := range big.Index {
+		tt.Assert(new.Index[k].deepEqual(big.Index[k]))
+	}
+	legacy = `{"name":"N","cast":"uint64","constraints":{"index":true},"index":[[18446744073709551615,9007199254740993],[9007199254740993,0]]}`
+	tt.CheckErr(json.Unmarshal([]byte(legacy), &new))
+	tt.Assert(new.Index[0].Value.(uint64) == math.MaxUint64 && new.Index[0].ObjectId == 1<<53+1)
+	tt.Assert(new.Index[1].Value.(uint64) == 1<<53+1)
+	legacy = `{"name":"A","cast":"int64","constraints":{"index":true},"index":[[-9007199254740993,1]]}`
+	tt.CheckErr(json.Unmarshal([]byte(legacy), &new))
+	tt.Assert(new.Index[0].Value.(int64) == -(1<<53 + 1))
+	tt.ExpectErr(json.Unmarshal([]byte(`{"name":"A","cast":"int64","index":[["42",1]]}`), &new), ErrCasting)
+
+	tt.Assert(json.Unmarshal([]byte(`{"name":"A","cast":"int64","values":[42],"counts":[2],"object-ids":[1]}`), &new) != nil)
+	tt.Assert(json.Unmarshal([]byte(`{"name":"A","cast":"int64","values":[42],"counts":[1],"object-ids":[1,2]}`), &new) != nil)
+}
+
+func TestObjIndexJsonCompact(t *testing.T) {
+	var new *objIndex
+
+	tt := toast.FromT(t)
+	in := newIndex(FieldDescriptors(&testStruct{}))
+
+	for o := range genTestStructs(1000) {
+		o.Initialize(uuidOrPanic())
+		tt.CheckErr(in.insertOrUpdate(o))
+	}
+
+	// making holes in object ids, last id is kept as
+	// next id to use is computed from the greatest one
+	for uuid, id := range in.uuids {
+		if id != in.i-1 && rand.Int()%2 == 0 {
+			in.deleteByUUID(uuid)
+		}
+	}
+
+	data, err := json.Marshal(in)
+	tt.CheckErr(err)
+	tt.CheckErr(json.Unmarshal(data, &new))
+	tt.CheckErr(new.control())
+	tt.Assert(reflect.DeepEqual(new.ObjectIds, in.ObjectIds))
+	tt.Assert(reflect.DeepEqual(new.uuids, in.uuids))
+	tt.Assert(new.i == in.i)
+
+	// legacy format must still be decoded
+	legacy := `{"fields":{},"object-ids":{"1":"foo","42":"bar"}}`
+	tt.CheckErr(json.Unmarshal([]byte(legacy), &new))
+	tt.Assert(new.ObjectIds[42] == "bar" && new.uuids["foo"] == 1 && new.i == 43)
+}
+
+func BenchmarkSchemaLoad(b *testing.B) {
+	var data []byte
+	var err error
+
+	in := newIndex(FieldDescriptors(&testStruct{}))
+	for o := range genTestStructs(100000) {
+		o.Initialize(uuidOrPanic())
+		if err = in.insertOrUpdate(o); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if data, err = json.Marshal(in); err != nil {
+		b.Fatal(err)
+	}
+	b.Logf("schema size: %d bytes", len(data))
+	b.ResetTimer()
+
+	for k := 0; k < b.N; k++ {
+		var new *objIndex
+		if err := json.Unmarshal(data, &new); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestIndexSearchGreaterOrEqual(t *testing.T) {
 	size := 1000
 	i := randomIndex(size)
@@ -227,6 +343,34 @@ func TestIndexSearchEqual(t *testing.T) {
 	}
 }
 
+func TestIndexSearchFirstEqual(t *testing.T) {
+	size := 10000
+	i := newFieldIndex(FieldDescriptor{Type: "int64"}, 0, size)
+	for k := 0; k < size; k++ {
+		i.Insert(rand.Int()%42, uint64(k))
+	}
+
+	tt := toast.FromT(t)
+
+	for j := 0; j < size; j++ {
+		sk := i.Index[rand.Int()%i.Len()]
+		s := i.SearchEqual(sk)
+
+		f, ok := i.SearchFirstEqual(sk, false)
+		tt.Assert(ok)
+		tt.Assert(f == s[0])
+
+		f, ok = i.SearchFirstEqual(sk, true)
+		tt.Assert(ok)
+		tt.Assert(f == s[len(s)-1])
+	}
+
+	_, ok := i.SearchFirstEqual(searchFieldOrPanic(42), false)
+	tt.Assert(!ok)
+	_, ok = i.SearchFirstEqual(searchFieldOrPanic(-1), true)
+	tt.Assert(!ok)
+}
+
 func TestIndexSearchNotEqual(t *testing.T) {
 	size := 1000
 	i := randomIndex(size)
@@ -286,7 +430,7 @@ func TestIndexEvaluate(t *testing.T) {
 	}
 }
 
-func newIndexedFieldOrPanic(i interface{}) *indexedField {
+func newIndexedFieldOrPanic(i interface{}) *IndexedField {
 	if f, err := newIndexedField(i, rand.Uint64()); err != nil {
 		panic(err)
 	} else {
@@ -295,8 +439,8 @@ func newIndexedFieldOrPanic(i interface{}) *indexedField {
 }
 
 func TestIndexEvaluateRegex(t *testing.T) {
-	var field *indexedField
-	var rex *indexedField
+	var field *IndexedField
+	var rex *IndexedField
 
 	field = newIndexedFieldOrPanic("Test")
 	rex = newIndexedFieldOrPanic("Test")
@@ -322,6 +466,17 @@ func TestIndexEvaluateRegex(t *testing.T) {
 	}
 }
 
+func TestIndexEvaluateContains(t *testing.T) {
+	tt := toast.FromT(t)
+	field := newIndexedFieldOrPanic("Test")
+
+	tt.Assert(field.evaluate("contains", newIndexedFieldOrPanic("es")))
+	tt.Assert(field.evaluate("contains", newIndexedFieldOrPanic("")))
+	tt.Assert(!field.evaluate("contains", newIndexedFieldOrPanic("test")))
+	tt.Assert(!field.evaluate("contains", newIndexedFieldOrPanic(42)))
+	tt.Assert(!newIndexedFieldOrPanic(42).evaluate("contains", newIndexedFieldOrPanic(42)))
+}
+
 func TestIndexDelete(t *testing.T) {
 	size := 10000
 	i := randomIndex(size)
@@ -421,3 +576,42 @@ func TestBuildFieldDescriptors(t *testing.T) {
 	//t.Log(FieldDescriptors(&testStruct{}).Fingerprint())
 
 }
+
+func TestEmptyFieldIndex(t *testing.T) {
+	tt := toast.FromT(t)
+
+	for _, v := range []interface{}{42, "foo", 4.2, time.Now()} {
+		in := newFieldIndex(FieldDescriptor{Type: reflect.TypeOf(v).String()})
+		k := searchFieldOrPanic(v)
+
+		tt.Assert(len(in.SearchEqual(k)) == 0)
+		tt.Assert(len(in.SearchNotEqual(k)) == 0)
+		tt.Assert(len(in.SearchGreater(k)) == 0)
+		tt.Assert(len(in.SearchGreaterOrEqual(k)) == 0)
+		tt.Assert(len(in.SearchLess(k)) == 0)
+		tt.Assert(len(in.SearchLessOrEqual(k)) == 0)
+		tt.Assert(len(in.SearchRange(k, k, true, true)) == 0)
+		tt.Assert(len(in.SearchRange(k, k, false, false)) == 0)
+		tt.Assert(in.CountEqual(k) == 0)
+		tt.Assert(!in.Has(k))
+		_, ok := in.SearchFirstEqual(k, false)
+		tt.Assert(!ok)
+		_, ok = in.SearchFirstEqual(k, true)
+		tt.Assert(!ok)
+		tt.Assert(len(in.Constrain([]*IndexedField{k}).Slice()) == 0)
+
+		if _, ok := v.(string); ok {
+			f, err := in.SearchByRegex(k)
+			tt.CheckErr(err)
+			tt.Assert(len(f) == 0)
+			f, err = in.SearchContains(k)
+			tt.CheckErr(err)
+			tt.Assert(len(f) == 0)
+		} else {
+			_, err := in.SearchByRegex(k)
+			tt.ExpectErr(err, ErrCasting)
+			_, err = in.SearchContains(k)
+			tt.ExpectErr(err, ErrCasting)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package sod
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HistoryDirname is the directory, in the directory of an Object
+	// type, where previous versions of Objects are kept
+	HistoryDirname = "history"
+)
+
+var (
+	ErrNoSuchVersion = errors.New("no such version")
+)
+
+// historyDir returns the directory where previous versions of o are kept
+func (db *DB) historyDir(o Object) string {
+	return filepath.Join(db.oDir(o), HistoryDirname, o.UUID())
+}
+
+// versions returns the sorted version numbers and file names
+// of the previous versions of o kept on disk
+func (db *DB) versions(o Object) (versions []int, names map[int]string, err error) {
+	var entries []fs.DirEntry
+
+	versions = make([]int, 0)
+	names = make(map[int]string)
+
+	if entries, err = db.storage.ReadDir(db.historyDir(o)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if v, e := strconv.Atoi(strings.SplitN(entry.Name(), ".", 2)[0]); e == nil && entry.Type().IsRegular() {
+			versions = append(versions, v)
+			names[v] = entry.Name()
+		}
+	}
+
+	sort.Ints(versions)
+	return
+}
+
+// archive keeps the file stored at path as the latest previous version
+// of o and removes versions exceeding the number of versions to keep
+func (db *DB) archive(s *Schema, o Object, path string) (err error) {
+	var data []byte
+	var versions []int
+	var names map[int]string
+
+	if data, err = db.storage.ReadFile(path); err != nil {
+		// new object
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+
+	if versions, names, err = db.versions(o); err != nil {
+		return
+	}
+
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1] + 1
+	}
+
+	dir := db.historyDir(o)
+	if err = db.storage.MkdirAll(dir, DefaultPermissions); err != nil {
+		return
+	}
+
+	// file is copied as is, so it keeps its extension
+	name := strconv.Itoa(next) + strings.TrimPrefix(filepath.Base(path), o.UUID())
+	if err = db.storage.WriteFile(filepath.Join(dir, name), data, DefaultPermissions); err != nil {
+		return
+	}
+
+	versions = append(versions, next)
+	for len(versions) > s.KeepHistory {
+		if err = db.storage.Remove(filepath.Join(dir, names[versions[0]])); err != nil {
+			return
+		}
+		versions = versions[1:]
+	}
+
+	return
+}
+
+// unarchive removes the previous versions of o newer than version, i.e.
+// archived by writes which are reverted
+func (db *DB) unarchive(o Object, version int) (err error) {
+	var versions []int
+	var names map[int]string
+
+	if versions, names, err = db.versions(o); err != nil {
+		return
+	}
+
+	for _, v := range versions {
+		if v > version {
+			if err = db.storage.Remove(filepath.Join(db.historyDir(o), names[v])); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// history returns the previous versions of o, from the oldest to the newest
+func (db *DB) history(o Object) (out []Object, err error) {
+	var s *Schema
+	var versions []int
+	var names map[int]string
+
+	if s, err = db.schema(o); err != nil {
+		return
+	}
+
+	if versions, names, err = db.versions(o); err != nil {
+		return
+	}
+
+	out = make([]Object, 0, len(versions))
+	for _, v := range versions {
+		prev := newObject(o)
+		prev.Initialize(o.UUID())
+		if err = db.readObject(s, filepath.Join(db.historyDir(o), names[v]), prev, nil); err != nil {
+			return
+		}
+		out = append(out, prev)
+	}
+
+	return
+}
+
+/***** Public Methods ******/
+
+// History returns the previous versions of o, from the oldest to the
+// newest, kept when the schema keeps history (see Schema.KeepHistory).
+// Only o.UUID() is used to find the versions of the Object.
+func (db *DB) History(o Object) (out []Object, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.history(o)
+}
+
+// RollbackTo updates o with one of its previous versions. Version is the
+// index of the version in the slice returned by History. The previous
+// version is transformed and validated as by InsertOrUpdate, and the
+// current version of o is kept in history as any updated Object is.
+func (db *DB) RollbackTo(o Object, version int) (err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+	var versions []Object
+
+	if s, err = db.schema(o); err != nil {
+		return
+	}
+
+	if !s.isUUIDIndexed(o.UUID()) {
+		return noObjectFoundErr(o, fs.ErrNotExist)
+	}
+
+	if versions, err = db.history(o); err != nil {
+		return
+	}
+
+	if version < 0 || version >= len(versions) {
+		return fmt.Errorf("%s %w %d for object uuid=%s", stype(o), ErrNoSuchVersion, version, o.UUID())
+	}
+
+	// previous version is written as any updated Object is
+	prev := versions[version]
+	prev.Transform()
+	s.transform(prev)
+	if err = db.validate(prev); err != nil {
+		return
+	}
+
+	return db.insertOrUpdate(s, prev, true)
+}
@@ -2,7 +2,13 @@ package sod
 
 import (
 	"errors"
+	"fmt"
 	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -91,6 +97,190 @@ func TestSearchOr(t *testing.T) {
 	}
 }
 
+func TestSearchBox(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+
+	var wide, narrow, unindexed int
+	for _, o := range all {
+		ts := o.(*testStruct)
+		if ts.A >= 5 && ts.A <= 35 && ts.B >= 10 && ts.B <= 12 {
+			wide++
+		}
+		if ts.A >= 20 && ts.A <= 20 && ts.B >= 0 && ts.B <= 41 {
+			narrow++
+		}
+		if ts.A >= 5 && ts.A <= 35 && ts.N >= 10 && ts.N <= 12 {
+			unindexed++
+		}
+	}
+
+	// most selective field first or last
+	for _, s := range []*Search{
+		db.SearchBox(&testStruct{}, "A", 5, 35, "B", 10, 12),
+		db.SearchBox(&testStruct{}, "B", 10, 12, "A", 5, 35),
+	} {
+		tt.CheckErr(s.Err())
+		tt.Assert(s.Len() == wide, s.Len(), wide)
+		objects, err := s.Collect()
+		tt.CheckErr(err)
+		for _, o := range objects {
+			ts := o.(*testStruct)
+			tt.Assert(ts.A >= 5 && ts.A <= 35 && ts.B >= 10 && ts.B <= 12)
+		}
+	}
+
+	s := db.SearchBox(&testStruct{}, "A", 20, 20, "B", 0, 41)
+	tt.CheckErr(s.Err())
+	tt.Assert(s.Len() == narrow, s.Len(), narrow)
+
+	// bounds are inverted
+	tt.Assert(db.SearchBox(&testStruct{}, "A", 35, 5, "B", 0, 41).Len() == 0)
+
+	// unindexed fields are searched as usual
+	s = db.SearchBox(&testStruct{}, "A", 5, 35, "N", uint(10), uint(12))
+	tt.CheckErr(s.Err())
+	tt.Assert(s.Len() == unindexed, s.Len(), unindexed)
+
+	tt.ExpectErr(db.SearchBox(&testStruct{}, "A", 5, 35, "B", 1.0, 2.0).Err(), ErrCasting)
+	tt.ExpectErr(db.SearchBox(&testStruct{}, "A", 5, 35, "Unknown", 1, 2).Err(), ErrUnkownField)
+}
+
+func TestSearchEmptyIndex(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(0, DefaultSchema)
+	defer db.Drop()
+
+	for _, tc := range []struct {
+		field    string
+		operator string
+		value    interface{}
+		err      error
+	}{
+		// indexed fields
+		{"A", "=", 42, nil},
+		{"A", "!=", 42, nil},
+		{"A", "<", 42, nil},
+		{"A", "<=", 42, nil},
+		{"A", ">", 42, nil},
+		{"A", ">=", 42, nil},
+		{"A", "~=", 42, ErrCasting},
+		{"A", "in", []string{}, ErrUnknownKeyType},
+		{"C", "~=", "^f", nil},
+		{"C", "~in", []string{"^f", "r$"}, nil},
+		{"C", "contains", "o", nil},
+		{"C", "$=", "oo", nil},
+		{"C", "in", []string{"foo"}, ErrUnknownKeyType},
+		{"K", ">=", 4.2, nil},
+		{"M", "<", time.Now(), nil},
+		{"Upper", "=", "upper", nil},
+		// unindexed fields
+		{"N", "=", uint(42), nil},
+		{"N", "!=", uint(42), nil},
+		{"N", "<", uint(42), nil},
+		{"N", ">=", uint(42), nil},
+		{"O", "~=", "^f", nil},
+		{"O", "contains", "o", nil},
+		{"O", "$=", "oo", nil},
+		{"Nested.A", "=", 42, nil},
+		// virtual UUID field
+		{UUIDField, "=", "00000000-0000-4000-8000-000000000000", nil},
+		{UUIDField, ">", "0", nil},
+		{UUIDField, "<=", "f", nil},
+		{UUIDField, "~=", "^0", nil},
+		{UUIDField, "in", []string{"00000000-0000-4000-8000-000000000000"}, nil},
+		// unknown fields and operators
+		{"Unknown", "=", 42, ErrUnkownField},
+		{"A", "unknown", 42, ErrUnkownSearchOperator},
+	} {
+		s := db.Search(&testStruct{}, tc.field, tc.operator, tc.value)
+
+		if tc.err != nil {
+			tt.ExpectErr(s.Err(), tc.err)
+			continue
+		}
+
+		tt.CheckErr(s.Err())
+		tt.Assert(s.Len() == 0, tc.field, tc.operator)
+		objects, err := s.Collect()
+		tt.CheckErr(err)
+		tt.Assert(len(objects) == 0)
+		_, err = s.One()
+		tt.ExpectErr(err, ErrNoObjectFound)
+
+		// chained with other searches
+		tt.Assert(db.Search(&testStruct{}, tc.field, tc.operator, tc.value).And("A", ">", 0).Len() == 0)
+		tt.Assert(db.Search(&testStruct{}, "A", ">", 0).Or(tc.field, tc.operator, tc.value).Len() == 0)
+		tt.Assert(db.Search(&testStruct{}, tc.field, tc.operator, tc.value).Reverse().Limit(10).Len() == 0)
+	}
+}
+
+func TestSearchNot(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+
+	var andNot, orNot, composite int
+	for _, o := range all {
+		ts := o.(*testStruct)
+		if ts.A < 21 && !(ts.C == "bar") {
+			andNot++
+		}
+		if ts.A < 21 || !(ts.B > 10) {
+			orNot++
+		}
+		if ts.A < 21 && ts.B < 21 && !(ts.C == "bar") {
+			composite++
+		}
+	}
+
+	s := db.Search(&testStruct{}, "A", "<", 21).AndNot("C", "=", "bar")
+	tt.CheckErr(s.Err())
+	tt.Assert(s.Len() == andNot, s.Len(), andNot)
+	objects, err := s.Collect()
+	tt.CheckErr(err)
+	for _, o := range objects {
+		ts := o.(*testStruct)
+		tt.Assert(ts.A < 21 && ts.C != "bar")
+	}
+
+	s = db.Search(&testStruct{}, "A", "<", 21).OrNot("B", ">", 10)
+	tt.CheckErr(s.Err())
+	tt.Assert(s.Len() == orNot, s.Len(), orNot)
+	objects, err = s.Collect()
+	tt.CheckErr(err)
+	for _, o := range objects {
+		ts := o.(*testStruct)
+		tt.Assert(ts.A < 21 || ts.B <= 10)
+	}
+
+	// pending clauses are evaluated before the difference
+	s = db.Search(&testStruct{}, "A", "<", 21).And("B", "<", 21).AndNot("C", "=", "bar")
+	tt.Assert(s.Len() == composite, s.Len(), composite)
+
+	// not indexed fields are searched in the whole collection
+	n := db.Search(&testStruct{}, "A", "<", 21).AndNot("N", ">=", 0).Len()
+	tt.Assert(n == 0, n)
+
+	tt.ExpectErr(db.Search(&testStruct{}, "A", "<", 21).AndNot("Unknown", "=", 0).Err(), ErrUnkownField)
+	tt.ExpectErr(db.Search(&testStruct{}, "Unknown", "=", 0).OrNot("A", "<", 21).Err(), ErrUnkownField)
+}
+
 func TestSearchDeleteObject(t *testing.T) {
 	var s *Schema
 	var err error
@@ -195,3 +385,1109 @@ func TestFieldPath(t *testing.T) {
 	tt.Assert(ok)
 
 }
+
+type Embedded struct {
+	X int
+}
+
+type reflectStruct struct {
+	Item
+	*Embedded
+	hidden inner
+	Any    interface{}
+	Ptr    *int
+	N      int
+}
+
+func TestFieldPathReflection(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+
+	s := &reflectStruct{}
+	s.hidden.D = 42
+
+	// none of these paths must panic
+	for _, fp := range []string{"hidden", "hidden.D", "Any.D", "N.D", "X", "Ptr.D", "Unknown.D"} {
+		_, ok := fieldByName(s, fieldPath(fp))
+		tt.Assert(!ok, fp)
+	}
+
+	// nil pointers have zero values
+	i, ok := fieldByName(s, fieldPath("Ptr"))
+	tt.Assert(ok)
+	tt.Assert(i.(int) == 0)
+
+	k := 42
+	s.Ptr = &k
+	s.Any = &inner{D: 43}
+	s.Embedded = &Embedded{X: 44}
+
+	i, ok = fieldByName(s, fieldPath("Ptr"))
+	tt.Assert(ok && i.(int) == 42)
+	i, ok = fieldByName(s, fieldPath("Any.D"))
+	tt.Assert(ok && i.(float64) == 43)
+	i, ok = fieldByName(s, fieldPath("X"))
+	tt.Assert(ok && i.(int) == 44)
+
+	s.Any = inner{D: 45}
+	i, ok = fieldByName(s, fieldPath("Any.D"))
+	tt.Assert(ok && i.(float64) == 45)
+
+	// searching a non indexed field goes through the objects
+	db := Open(randDBPath())
+	defer db.Drop()
+	tt.CheckErr(db.Create(&reflectStruct{}, DefaultSchema))
+	tt.CheckErr(db.InsertOrUpdate(&reflectStruct{}))
+	tt.ExpectErr(db.Search(&reflectStruct{}, "hidden.D", "=", 42).Err(), ErrUnkownField)
+	tt.ExpectErr(db.Search(&reflectStruct{}, "Any.D", "=", 42).Err(), ErrUnkownField)
+}
+
+func TestSearchOneFastPath(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(1000, DefaultSchema)
+	defer db.Close()
+
+	for _, a := range []int{0, 21, 41} {
+		// fast path
+		o, err := db.Search(&testStruct{}, "A", "=", a).One()
+		tt.CheckErr(err)
+		tt.Assert(o.(*testStruct).A == a)
+
+		// search fully evaluated
+		s := db.Search(&testStruct{}, "A", "=", a)
+		tt.Assert(s.Len() > 0)
+		all, err := s.Collect()
+		tt.CheckErr(err)
+		tt.Assert(o.UUID() == all[0].UUID())
+
+		o, err = db.Search(&testStruct{}, "A", "=", a).Reverse().One()
+		tt.CheckErr(err)
+		tt.Assert(o.UUID() == all[len(all)-1].UUID())
+
+		// limit applies to every call
+		_, err = s.One()
+		tt.CheckErr(err)
+		again, err := s.Collect()
+		tt.CheckErr(err)
+		tt.Assert(len(again) == len(all))
+		s = db.Search(&testStruct{}, "A", "=", a).Limit(2)
+		for i := 0; i < 2; i++ {
+			uuids, err := s.UUIDs()
+			tt.CheckErr(err)
+			tt.Assert(len(uuids) == 2)
+			values, err := s.CollectWithValues()
+			tt.CheckErr(err)
+			tt.Assert(len(values) == 2)
+			objs, err := s.Collect()
+			tt.CheckErr(err)
+			tt.Assert(len(objs) == 2)
+		}
+	}
+
+	// a search shared between goroutines is evaluated once
+	s := db.Search(&testStruct{}, "A", "<", 10).And("B", ">", 10)
+	wg := sync.WaitGroup{}
+	lens := make([]int, 8)
+	for i := range lens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lens[i] = s.Len()
+		}(i)
+	}
+	wg.Wait()
+	for _, l := range lens {
+		tt.Assert(l == lens[0] && l > 0)
+	}
+
+	_, err := db.Search(&testStruct{}, "A", "=", 42).One()
+	tt.ExpectErr(err, ErrNoObjectFound)
+	// errors must be the same as the ones of the regular path
+	_, err = db.Search(&testStruct{}, "A", "=", "42").One()
+	tt.ExpectErr(err, ErrCasting)
+}
+
+func BenchmarkSearchOne(b *testing.B) {
+	db := createFreshTestDb(10000, DefaultSchema)
+	defer db.Close()
+
+	// C field only takes two values so searching one of them matches
+	// half of the collection
+	b.Run("FastPath", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Search(&testStruct{}, "C", "=", "foo").One(); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+
+	b.Run("FullEvaluation", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			// Collect evaluates the whole search before applying limit
+			if _, err := db.Search(&testStruct{}, "C", "=", "foo").Limit(1).Collect(); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func TestSearchRange(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(1000, DefaultSchema)
+	defer db.Close()
+
+	uuids := func(s *Search) string {
+		all, err := s.Collect()
+		tt.CheckErr(err)
+		out := make([]string, 0, len(all))
+		for _, o := range all {
+			out = append(out, o.UUID())
+		}
+		return strings.Join(out, ",")
+	}
+
+	ops := []string{"=", ">", ">=", "<", "<="}
+	values := []int{-1, 0, 10, 20, 41, 42}
+
+	for _, op1 := range ops {
+		for _, op2 := range ops {
+			for _, v1 := range values {
+				for _, v2 := range values {
+					// clauses are collapsed into a range search
+					_, ok := db.searchRange(&testStruct{}, &searchClause{"A", op1, v1}, &searchClause{"A", op2, v2}, nil)
+					tt.Assert(ok)
+
+					collapsed := db.Search(&testStruct{}, "A", op1, v1).And("A", op2, v2)
+					// first search is evaluated before ANDing the second one
+					chained := db.Search(&testStruct{}, "A", op1, v1)
+					chained.Len()
+					chained = chained.And("A", op2, v2)
+
+					tt.Assert(uuids(collapsed) == uuids(chained), op1, v1, op2, v2)
+				}
+			}
+		}
+	}
+
+	// range search constrained by a previous search
+	collapsed := db.Search(&testStruct{}, "C", "=", "foo").And("A", ">=", 10).And("A", "<", 20)
+	chained := db.Search(&testStruct{}, "C", "=", "foo").And("A", ">=", 10)
+	chained.Len()
+	chained = chained.And("A", "<", 20)
+	tt.Assert(collapsed.Len() > 0)
+	tt.Assert(uuids(collapsed) == uuids(chained))
+
+	// clauses which cannot be collapsed
+	_, ok := db.searchRange(&testStruct{}, &searchClause{"A", "!=", 10}, &searchClause{"A", "<", 20}, nil)
+	tt.Assert(!ok)
+	_, ok = db.searchRange(&testStruct{}, &searchClause{"A", ">", 10}, &searchClause{"B", "<", 20}, nil)
+	tt.Assert(!ok)
+	_, ok = db.searchRange(&testStruct{}, &searchClause{"A", ">", 10}, &searchClause{"A", "<", "20"}, nil)
+	tt.Assert(!ok)
+
+	// errors are the ones of the regular search path
+	tt.ExpectErr(db.Search(&testStruct{}, "A", ">", 10).And("A", "<", "20").Err(), ErrCasting)
+}
+
+func BenchmarkSearchRange(b *testing.B) {
+	db := createFreshTestDb(10000, DefaultSchema)
+	defer db.Close()
+
+	b.Run("Range", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			db.Search(&testStruct{}, "A", ">=", 10).And("A", "<", 20).Len()
+		}
+	})
+
+	b.Run("Chained", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s := db.Search(&testStruct{}, "A", ">=", 10)
+			s.Len()
+			s.And("A", "<", 20).Len()
+		}
+	})
+}
+
+func TestCompositeIndex(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+
+	type query struct {
+		op    string
+		value int
+	}
+
+	queries := []query{{"=", 21}, {">", 21}, {">=", 21}, {"<", 21}, {"<=", 21}, {"<", 0}, {">", 41}}
+
+	expected := make(map[query]int)
+	for _, q := range queries {
+		expected[q] = db.Search(&testStruct{}, "C", "=", "foo").And("A", q.op, q.value).Len()
+	}
+
+	// composite index is built on an existing collection
+	s := DefaultSchema
+	s.CompositeIndex("C", "A")
+	tt.CheckErr(db.Create(&testStruct{}, s))
+
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(sch.ObjectIndex.Composites) == 1)
+
+	check := func() {
+		for _, q := range queries {
+			var out []*testStruct
+
+			// composite index must be used
+			_, ok := db.searchComposite(&testStruct{}, []*searchClause{{"C", "=", "foo"}, {"A", q.op, q.value}})
+			tt.Assert(ok)
+
+			search := db.Search(&testStruct{}, "C", "=", "foo").And("A", q.op, q.value)
+			tt.Assert(search.Len() == expected[q], q, search.Len(), expected[q])
+			tt.CheckErr(search.Assign(&out))
+			for i, ts := range out {
+				tt.Assert(ts.C == "foo")
+				tt.Assert((&IndexedField{Value: int64(ts.A)}).evaluate(q.op, &IndexedField{Value: int64(q.value)}))
+				// results are ordered by A
+				if i > 0 {
+					tt.Assert(out[i-1].A >= ts.A)
+				}
+			}
+			// clauses order does not matter
+			tt.Assert(db.Search(&testStruct{}, "A", q.op, q.value).And("C", "=", "foo").Len() == expected[q])
+		}
+	}
+
+	check()
+
+	// composite index must be persisted
+	db = closeAndReOpen(db)
+	controlDB(t, db)
+	check()
+
+	// composite index must be maintained on updates and deletions
+	var out []*testStruct
+	tt.CheckErr(db.Search(&testStruct{}, "C", "=", "foo").And("A", "=", 21).Assign(&out))
+	for _, ts := range out {
+		ts.A = 42
+		tt.CheckErr(db.InsertOrUpdate(ts))
+	}
+	tt.Assert(db.Search(&testStruct{}, "C", "=", "foo").And("A", "=", 21).Len() == 0)
+	tt.Assert(db.Search(&testStruct{}, "C", "=", "foo").And("A", "=", 42).Len() == len(out))
+	tt.CheckErr(db.Search(&testStruct{}, "C", "=", "foo").And("A", "=", 42).Delete())
+	tt.Assert(db.Search(&testStruct{}, "C", "=", "foo").And("A", "=", 42).Len() == 0)
+	controlDB(t, db)
+
+	// composite index is dropped if not declared anymore
+	tt.CheckErr(db.Create(&testStruct{}, DefaultSchema))
+	sch, err = db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(sch.ObjectIndex.Composites) == 0)
+
+	// declaring composite index on unknown field must fail
+	s = DefaultSchema
+	s.CompositeIndex("C", "Unknown")
+	tt.ExpectErr(db.Create(&testStruct{}, s), ErrBadCompositeIndex)
+	controlDB(t, db)
+}
+
+func TestSearchCollectWithValues(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(1000, DefaultSchema)
+	defer db.Close()
+
+	check := func(s *Search, n int) {
+		values, err := s.CollectWithValues()
+		tt.CheckErr(err)
+		tt.Assert(len(values) == n)
+		for _, ov := range values {
+			tt.Assert(ov.Value.(int64) == int64(ov.Object.(*testStruct).A))
+		}
+	}
+
+	// indexed field
+	s := db.Search(&testStruct{}, "C", "=", "foo").And("A", "<", 21)
+	check(s, s.Len())
+	check(db.Search(&testStruct{}, "A", ">=", 21).Reverse().Limit(10), 10)
+
+	// value of the last field searched is returned
+	v, err := db.Search(&testStruct{}, "A", "<", 21).And("B", ">", 10).CollectWithValues()
+	tt.CheckErr(err)
+	for _, ov := range v {
+		tt.Assert(ov.Value.(int64) == int64(ov.Object.(*testStruct).B))
+	}
+
+	// composite index
+	sch := DefaultSchema
+	sch.CompositeIndex("C", "A")
+	tt.CheckErr(db.Create(&testStruct{}, sch))
+	s = db.Search(&testStruct{}, "C", "=", "foo").And("A", "<", 21)
+	check(s, s.Len())
+
+	_, err = db.Search(&testStruct{}, "A", "=", "42").CollectWithValues()
+	tt.ExpectErr(err, ErrCasting)
+
+	// objects missing from disk are skipped with read repair
+	rdb := Open(randDBPath())
+	defer rdb.Drop()
+	sch = DefaultSchema
+	sch.ReadRepair = true
+	tt.CheckErr(rdb.Create(&testStruct{}, sch))
+	for i := 0; i < 10; i++ {
+		tt.CheckErr(rdb.InsertOrUpdate(&testStruct{A: i}))
+	}
+	o, err := rdb.Search(&testStruct{}, "A", "=", 1).One()
+	tt.CheckErr(err)
+	rs, err := rdb.Schema(&testStruct{})
+	tt.CheckErr(err)
+	tt.CheckErr(os.Remove(rdb.oPath(rs, o)))
+	check(rdb.Search(&testStruct{}, "A", "<", 5), 4)
+	check(rdb.Search(&testStruct{}, "A", "<", 5).Reverse(), 4)
+}
+
+func TestSchemaQueryIndex(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(1000, DefaultSchema)
+	defer db.Close()
+
+	s, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+
+	db.RLock()
+	f, err := s.QueryIndex("A", "<", 21, nil)
+	tt.CheckErr(err)
+	f, err = s.QueryIndex("C", "=", "foo", f)
+	tt.CheckErr(err)
+	uuids := make(map[string]bool)
+	for _, field := range f {
+		uuid, ok := s.ObjectUUID(field.ObjectId)
+		tt.Assert(ok)
+		uuids[uuid] = true
+	}
+	_, err = s.QueryIndex("A", "=", "42", nil)
+	tt.ExpectErr(err, ErrCasting)
+	db.RUnlock()
+
+	objs, err := db.Search(&testStruct{}, "A", "<", 21).And("C", "=", "foo").Collect()
+	tt.CheckErr(err)
+	tt.Assert(len(objs) == len(f))
+	for _, o := range objs {
+		tt.Assert(uuids[o.UUID()])
+	}
+}
+
+func TestIsIndexed(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s, err := NewSchemaBuilder(&person{}).Index("Age").Unique("Email").IndexLen("Tags").Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&person{}, s))
+
+	fields, err := db.IndexedFields(&person{})
+	tt.CheckErr(err)
+	expected := make([]string, 0)
+	for _, fd := range s.Fields {
+		if fd.Constraints.Index {
+			expected = append(expected, fd.Path)
+		}
+	}
+	expected = append(expected, LenPath("Tags"))
+	sort.Strings(expected)
+	tt.Assert(reflect.DeepEqual(fields, expected), fields, expected)
+
+	for _, f := range fields {
+		ok, err := db.IsIndexed(&person{}, f)
+		tt.CheckErr(err)
+		tt.Assert(ok)
+	}
+
+	for _, f := range []string{"Unknown", UUIDField, "Tags", "Name"} {
+		ok, err := db.IsIndexed(&person{}, f)
+		tt.CheckErr(err)
+		tt.Assert(!ok)
+	}
+
+	_, err = db.IsIndexed(&testStruct{}, "A")
+	tt.ExpectErr(err, ErrSchemaNotCreated)
+	_, err = db.IndexedFields(&testStruct{})
+	tt.ExpectErr(err, ErrSchemaNotCreated)
+}
+
+func TestSearchGroupBy(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Close()
+
+	expected, err := db.Search(&testStruct{}, "A", "<", 21).Collect()
+	tt.CheckErr(err)
+
+	// indexed field
+	groups, err := db.Search(&testStruct{}, "A", "<", 21).GroupBy("C")
+	tt.CheckErr(err)
+	n := 0
+	for key, objects := range groups {
+		for _, o := range objects {
+			tt.Assert(o.(*testStruct).C == key)
+			tt.Assert(o.(*testStruct).A < 21)
+		}
+		n += len(objects)
+	}
+	tt.Assert(n == len(expected))
+
+	// field not indexed, values are normalized
+	groups, err = db.Search(&testStruct{}, "A", "<", 21).GroupBy("N")
+	tt.CheckErr(err)
+	n = 0
+	for key, objects := range groups {
+		for _, o := range objects {
+			tt.Assert(uint64(o.(*testStruct).N) == key.(uint64))
+		}
+		n += len(objects)
+	}
+	tt.Assert(n == len(expected))
+
+	// limit applies to the objects grouped
+	groups, err = db.Search(&testStruct{}, "A", "<", 21).Limit(10).GroupBy("A")
+	tt.CheckErr(err)
+	n = 0
+	for _, objects := range groups {
+		n += len(objects)
+	}
+	tt.Assert(n == 10)
+
+	_, err = db.Search(&testStruct{}, "A", "<", 21).GroupBy("Unknown")
+	tt.ExpectErr(err, ErrUnkownField)
+	_, err = db.Search(&testStruct{}, "A", "<", "21").GroupBy("C")
+	tt.ExpectErr(err, ErrCasting)
+}
+
+func TestSearchConditions(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Close()
+
+	conds := []Condition{{"A", ">", 10}, {"A", "<", 100}, {"C", "~=", "^[a-f]"}}
+
+	expected, err := db.Search(&testStruct{}, "A", ">", 10).And("A", "<", 100).And("C", "~=", "^[a-f]").UUIDs()
+	tt.CheckErr(err)
+	uuids, err := db.SearchConditions(&testStruct{}, conds, "and").UUIDs()
+	tt.CheckErr(err)
+	tt.Assert(reflect.DeepEqual(uuids, expected))
+
+	expected, err = db.Search(&testStruct{}, "A", ">", 10).Or("A", "<", 100).Or("C", "~=", "^[a-f]").UUIDs()
+	tt.CheckErr(err)
+	uuids, err = db.SearchConditions(&testStruct{}, conds, "||").UUIDs()
+	tt.CheckErr(err)
+	tt.Assert(reflect.DeepEqual(uuids, expected))
+
+	// errors are reported before searching
+	tt.ExpectErr(db.SearchConditions(&testStruct{}, nil, "and").Err(), ErrNoCondition)
+	tt.ExpectErr(db.SearchConditions(&testStruct{}, conds, "xor").Err(), ErrUnknownOperator)
+	tt.ExpectErr(db.SearchConditions(&testStruct{}, append(conds, Condition{"A", "=~", 1}), "and").Err(), ErrUnkownSearchOperator)
+	// errors of the conditions are reported
+	tt.ExpectErr(db.SearchConditions(&testStruct{}, append(conds, Condition{"Unknown", "=", 1}), "and").Err(), ErrUnkownField)
+}
+
+func TestSearchUUID(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Close()
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+	uuids := make([]string, 0, len(all))
+	for _, o := range all {
+		uuids = append(uuids, o.UUID())
+	}
+	sort.Strings(uuids)
+
+	check := func() {
+		o, err := db.Search(&testStruct{}, UUIDField, "=", uuids[42]).One()
+		tt.CheckErr(err)
+		tt.Assert(o.UUID() == uuids[42])
+
+		tt.Assert(db.Search(&testStruct{}, UUIDField, "in", uuids[:10]).Len() == 10)
+		tt.Assert(db.Search(&testStruct{}, UUIDField, "in", []string{uuids[0], "unknown"}).Len() == 1)
+		tt.Assert(db.Search(&testStruct{}, UUIDField, "!=", uuids[0]).Len() == size-1)
+
+		// keyset pagination
+		page := 100
+		cursor := ""
+		for i := 0; i < size; i += page {
+			objs, err := db.Search(&testStruct{}, UUIDField, ">", cursor).Reverse().Limit(uint64(page)).Collect()
+			tt.CheckErr(err)
+			tt.Assert(len(objs) == page)
+			for k, o := range objs {
+				tt.Assert(o.UUID() == uuids[i+k])
+			}
+			cursor = objs[len(objs)-1].UUID()
+		}
+		tt.Assert(db.Search(&testStruct{}, UUIDField, ">", cursor).Len() == 0)
+
+		// UUID can be combined with other fields
+		s := db.Search(&testStruct{}, "A", "<", 21).And(UUIDField, "<=", uuids[size/2])
+		objs, err := s.Collect()
+		tt.CheckErr(err)
+		for _, o := range objs {
+			tt.Assert(o.(*testStruct).A < 21 && o.UUID() <= uuids[size/2])
+		}
+
+		_, err = db.Search(&testStruct{}, UUIDField, "=", 42).Collect()
+		tt.ExpectErr(err, ErrCasting)
+		_, err = db.Search(&testStruct{}, UUIDField, "in", uuids[0]).Collect()
+		tt.ExpectErr(err, ErrCasting)
+	}
+
+	check()
+
+	// UUID index is rebuilt when index is loaded
+	db = closeAndReOpen(db)
+	check()
+
+	// UUID index is maintained on deletions
+	tt.CheckErr(db.Search(&testStruct{}, UUIDField, "in", uuids[:10]).Delete())
+	tt.Assert(db.Search(&testStruct{}, UUIDField, "<=", uuids[9]).Len() == 0)
+	controlDBSize(t, db, &testStruct{}, size-10)
+}
+
+func TestSearchContains(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Close()
+
+	// C is indexed and O is not
+	for _, field := range []string{"C", "O"} {
+		eq, err := db.Search(&testStruct{}, field, "=", "foo").Collect()
+		tt.CheckErr(err)
+		objs, err := db.Search(&testStruct{}, field, "contains", "oo").Collect()
+		tt.CheckErr(err)
+		tt.Assert(len(objs) == len(eq))
+		tt.Assert(db.Search(&testStruct{}, field, "contains", "").Len() == size)
+		tt.Assert(db.Search(&testStruct{}, field, "contains", "foobar").Len() == 0)
+
+		_, err = db.Search(&testStruct{}, field, "contains", 42).Collect()
+		tt.ExpectErr(err, ErrCasting)
+	}
+
+	// contains can be combined with other operators
+	objs, err := db.Search(&testStruct{}, "A", "<", 21).And("C", "contains", "ba").Collect()
+	tt.CheckErr(err)
+	for _, o := range objs {
+		tt.Assert(o.(*testStruct).A < 21 && o.(*testStruct).C == "bar")
+	}
+
+	// contains does not apply to non string fields
+	_, err = db.Search(&testStruct{}, "A", "contains", 42).Collect()
+	tt.ExpectErr(err, ErrCasting)
+	_, err = db.Search(&testStruct{}, "N", "contains", uint(42)).Collect()
+	tt.ExpectErr(err, ErrCasting)
+
+	tt.Assert(db.Search(&testStruct{}, UUIDField, "contains", "-").Len() == size)
+}
+
+func TestSearchRegexAny(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Close()
+
+	// C is indexed and O is not
+	for _, field := range []string{"C", "O"} {
+		tt.Assert(db.Search(&testStruct{}, field, "~in", []string{"^foo$", "(?i)^BAR$"}).Len() == size)
+		tt.Assert(db.Search(&testStruct{}, field, "~in", []string{"^foo$", "^baz$"}).Len() == db.Search(&testStruct{}, field, "=", "foo").Len())
+		tt.Assert(db.Search(&testStruct{}, field, "~in", []string{"^f"}).Len() == db.Search(&testStruct{}, field, "~=", "^f").Len())
+		tt.Assert(db.Search(&testStruct{}, field, "~in", []string{}).Len() == 0)
+
+		_, err := db.Search(&testStruct{}, field, "~in", []string{"^foo$", "(bar"}).Collect()
+		tt.Assert(err != nil)
+		_, err = db.Search(&testStruct{}, field, "~in", "^foo$").Collect()
+		tt.ExpectErr(err, ErrCasting)
+	}
+
+	// an invalid pattern cannot alter the others
+	tt.Assert(db.Search(&testStruct{}, "C", "~in", []string{"^foo$)|(^bar$"}).Err() != nil)
+
+	tt.Assert(db.Search(&testStruct{}, UUIDField, "~in", []string{"^[0-9a-f]", "^[^0-9a-f]"}).Len() == size)
+	_, err := db.Search(&testStruct{}, "A", "~in", []string{"42"}).Collect()
+	tt.ExpectErr(err, ErrCasting)
+}
+
+func TestSearchDeleteInBatches(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	expected := db.Search(&testStruct{}, "A", "<", 21).Len()
+
+	n, err := db.Search(&testStruct{}, "A", "<", 21).DeleteInBatches(7)
+	tt.CheckErr(err)
+	tt.Assert(n == expected)
+	tt.Assert(db.Search(&testStruct{}, "A", "<", 21).Len() == 0)
+	controlDB(t, db)
+	controlDBSize(t, db, &testStruct{}, size-expected)
+
+	// deletions are committed
+	db = closeAndReOpen(db)
+	controlDB(t, db)
+	controlDBSize(t, db, &testStruct{}, size-expected)
+
+	// objects not matching anymore when their batch is deleted are kept
+	search := db.Search(&testStruct{}, "A", ">=", 21).And("A", "<", 30)
+	matches, err := search.Collect()
+	tt.CheckErr(err)
+	tt.Assert(len(matches) > 1)
+	moved := matches[len(matches)-1].(*testStruct)
+	moved.A = 42
+	tt.CheckErr(db.InsertOrUpdate(moved))
+	n, err = search.DeleteInBatches(1)
+	tt.CheckErr(err)
+	tt.Assert(n == len(matches)-1)
+	tt.Assert(db.Search(&testStruct{}, UUIDField, "=", moved.UUID()).Len() == 1)
+	controlDB(t, db)
+	expected += n
+
+	// batches still delete the objects found once the index is vacuumed
+	or := db.Search(&testStruct{}, "A", "=", 30).Or("A", "=", 31)
+	uuids, err := or.resultUUIDs()
+	tt.CheckErr(err)
+	tt.Assert(len(uuids) > 0)
+	tt.CheckErr(db.Search(&testStruct{}, "A", ">=", 32).Delete())
+	tt.CheckErr(db.Vacuum(&testStruct{}))
+	kept := db.Search(&testStruct{}, "A", ">=", 21).Len()
+	n, err = or.deleteBatch(uuids)
+	tt.CheckErr(err)
+	tt.Assert(n == len(uuids))
+	tt.Assert(db.Search(&testStruct{}, "A", "=", 30).Or("A", "=", 31).Len() == 0)
+	tt.Assert(db.Search(&testStruct{}, "A", ">=", 21).Len() == kept-n)
+	controlDB(t, db)
+	expected = size - (kept - n)
+
+	n, err = db.Search(&testStruct{}, "A", ">=", 21).DeleteInBatches(0)
+	tt.CheckErr(err)
+	tt.Assert(n == size-expected)
+	controlDBSize(t, db, &testStruct{}, 0)
+
+	_, err = db.Search(&testStruct{}, "A", "=", "21").DeleteInBatches(10)
+	tt.ExpectErr(err, ErrCasting)
+
+	sn, err := db.Snapshot(&testStruct{})
+	tt.CheckErr(err)
+	defer sn.Close()
+	_, err = sn.Search("A", ">=", 0).DeleteInBatches(10)
+	tt.ExpectErr(err, ErrSnapshotReadOnly)
+}
+
+func TestSearchLen(t *testing.T) {
+	t.Parallel()
+
+	type tagged struct {
+		Item
+		Age   int
+		Tags  []string
+		Attrs map[string]int
+	}
+
+	tt := toast.FromT(t)
+	size := 500
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	tt.CheckErr(db.Create(&tagged{}, DefaultSchema))
+	objs := make([]Object, 0, size)
+	for i := 0; i < size; i++ {
+		o := &tagged{Age: i, Tags: make([]string, i%10), Attrs: make(map[string]int)}
+		for k := 0; k < i%5; k++ {
+			o.Attrs[fmt.Sprintf("%d", k)] = k
+		}
+		objs = append(objs, o)
+	}
+	_, err := db.InsertOrUpdateMany(objs...)
+	tt.CheckErr(err)
+
+	check := func() {
+		tt.Assert(db.Search(&tagged{}, LenPath("Tags"), ">", 3).Len() == size*6/10)
+		tt.Assert(db.Search(&tagged{}, "Tags.len", "=", 0).Len() == size/10)
+		tt.Assert(db.Search(&tagged{}, "Attrs.len", "<", 2).And("Tags.len", "<", 5).Len() == size*2/10)
+		objs, err := db.Search(&tagged{}, "Tags.len", ">=", 8).Collect()
+		tt.CheckErr(err)
+		for _, o := range objs {
+			tt.Assert(len(o.(*tagged).Tags) >= 8)
+		}
+		_, err = db.Search(&tagged{}, "Age.len", ">", 1).Collect()
+		tt.ExpectErr(err, ErrUnkownField)
+	}
+
+	// searching length of fields not indexed
+	check()
+
+	s := DefaultSchema
+	s.IndexLen("Tags", "Attrs", "Tags")
+	tt.Assert(len(s.LenIndexes) == 2)
+	tt.CheckErr(db.Create(&tagged{}, s))
+	sch, err := db.Schema(&tagged{})
+	tt.CheckErr(err)
+	tt.Assert(len(sch.Indexed()) == 2)
+	_, err = sch.QueryIndex("Tags.len", "=", 0, nil)
+	tt.CheckErr(err)
+	check()
+
+	// length is updated
+	o, err := db.Search(&tagged{}, "Age", "=", 0).One()
+	tt.CheckErr(err)
+	o.(*tagged).Tags = make([]string, 42)
+	tt.CheckErr(db.InsertOrUpdate(o))
+	tt.Assert(db.Search(&tagged{}, "Tags.len", "=", 42).Len() == 1)
+	o.(*tagged).Tags = nil
+	tt.CheckErr(db.InsertOrUpdate(o))
+	controlDB(t, db)
+
+	db = closeAndReOpen(db)
+	controlDB(t, db)
+	check()
+
+	// length indexes not declared anymore are dropped
+	tt.CheckErr(db.Create(&tagged{}, DefaultSchema))
+	sch, err = db.Schema(&tagged{})
+	tt.CheckErr(err)
+	tt.Assert(len(sch.Indexed()) == 0)
+	check()
+
+	s = DefaultSchema
+	s.IndexLen("Age")
+	tt.ExpectErr(db.Create(&tagged{}, s), ErrUnindexableField)
+	s = DefaultSchema
+	s.IndexLen("Unknown")
+	tt.ExpectErr(db.Create(&tagged{}, s), ErrUnindexableField)
+}
+
+func TestSearchHasKey(t *testing.T) {
+	t.Parallel()
+
+	type attributed struct {
+		Item
+		Age   int `sod:"index"`
+		Attrs map[string]int
+	}
+
+	tt := toast.FromT(t)
+	size := 500
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s := DefaultSchema
+	tt.CheckErr(db.Create(&attributed{}, s))
+	objs := make([]Object, 0, size)
+	for i := 0; i < size; i++ {
+		o := &attributed{Age: i, Attrs: make(map[string]int)}
+		for k := 0; k < i%5; k++ {
+			o.Attrs[fmt.Sprintf("k%d", k)] = k
+		}
+		objs = append(objs, o)
+	}
+	_, err := db.InsertOrUpdateMany(objs...)
+	tt.CheckErr(err)
+
+	check := func() {
+		tt.Assert(db.Search(&attributed{}, "Attrs", HasKeyOperator, "k0").Len() == size*4/5)
+		tt.Assert(db.Search(&attributed{}, "Attrs", "haskey", "k3").Len() == size/5)
+		tt.Assert(db.Search(&attributed{}, "Attrs", "haskey", "unknown").Len() == 0)
+		tt.Assert(db.Search(&attributed{}, "Age", "<", 100).And("Attrs", "haskey", "k3").Len() == 20)
+		tt.Assert(db.Search(&attributed{}, "Age", "<", 10).And("Attrs", "haskey", "k0").Len() == 8)
+		objs, err := db.Search(&attributed{}, "Attrs", "haskey", "k2").Collect()
+		tt.CheckErr(err)
+		for _, o := range objs {
+			_, ok := o.(*attributed).Attrs["k2"]
+			tt.Assert(ok)
+		}
+		_, err = db.Search(&attributed{}, "Age", "haskey", "k0").Collect()
+		tt.ExpectErr(err, ErrCasting)
+		_, err = db.Search(&attributed{}, "Attrs", "haskey", 42).Collect()
+		tt.ExpectErr(err, ErrCasting)
+		_, err = db.Search(&attributed{}, "Unknown", "haskey", "k0").Collect()
+		tt.ExpectErr(err, ErrUnkownField)
+	}
+
+	// searching keys of maps not indexed
+	check()
+
+	s.KeyIndex("Attrs", "Attrs")
+	tt.Assert(len(s.KeyIndexes) == 1)
+	tt.CheckErr(db.Create(&attributed{}, s))
+	sch, err := db.Schema(&attributed{})
+	tt.CheckErr(err)
+	tt.Assert(len(sch.ObjectIndex.Keys) == 1)
+	check()
+
+	// results are in index order
+	uuids, err := db.Search(&attributed{}, "Attrs", "haskey", "k1").Reverse().UUIDs()
+	tt.CheckErr(err)
+	tt.Assert(len(uuids) == size*3/5)
+	tt.Assert(sort.StringsAreSorted(uuids))
+	uuids, err = db.Search(&attributed{}, "Age", "<", 10).And("Attrs", "haskey", "k1").Reverse().UUIDs()
+	tt.CheckErr(err)
+	tt.Assert(len(uuids) == 6)
+	tt.Assert(sort.StringsAreSorted(uuids))
+
+	// keys are updated
+	o, err := db.Search(&attributed{}, "Age", "=", 0).One()
+	tt.CheckErr(err)
+	o.(*attributed).Attrs["new"] = 42
+	tt.CheckErr(db.InsertOrUpdate(o))
+	tt.Assert(db.Search(&attributed{}, "Attrs", "haskey", "new").Len() == 1)
+	o.(*attributed).Attrs = nil
+	tt.CheckErr(db.InsertOrUpdate(o))
+	tt.Assert(db.Search(&attributed{}, "Attrs", "haskey", "new").Len() == 0)
+
+	// keys of deleted objects are removed
+	tt.CheckErr(db.Search(&attributed{}, "Age", ">=", 400).Delete())
+	size = 400
+	check()
+	controlDB(t, db)
+
+	db = closeAndReOpen(db)
+	controlDB(t, db)
+	check()
+
+	tt.CheckErr(db.Vacuum(&attributed{}))
+	controlDB(t, db)
+	check()
+
+	// key indexes not declared anymore are dropped
+	tt.CheckErr(db.Create(&attributed{}, DefaultSchema))
+	sch, err = db.Schema(&attributed{})
+	tt.CheckErr(err)
+	tt.Assert(len(sch.ObjectIndex.Keys) == 0)
+
+	s = DefaultSchema
+	s.KeyIndex("Age")
+	tt.ExpectErr(db.Create(&attributed{}, s), ErrUnindexableField)
+	s = DefaultSchema
+	s.KeyIndex("Unknown")
+	tt.ExpectErr(db.Create(&attributed{}, s), ErrUnindexableField)
+}
+
+func TestBulkInsert(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	fields := FieldDescriptors(&testStruct{})
+	serial, bulk := newIndex(fields), newIndex(fields)
+	for _, in := range []*objIndex{serial, bulk} {
+		ci, err := newCompositeIndex([]string{"C", "A"}, fields)
+		tt.CheckErr(err)
+		in.Composites[compositeName(ci.Fields)] = ci
+	}
+
+	objects := make([]Object, 0, size)
+	for o := range genTestStructs(size) {
+		o.Initialize(uuidOrPanic())
+		objects = append(objects, o)
+	}
+
+	// half of the objects are inserted before bulk insertion
+	for _, o := range objects {
+		tt.CheckErr(serial.insertOrUpdate(o))
+	}
+	for _, o := range objects[:size/2] {
+		tt.CheckErr(bulk.insertOrUpdate(o))
+	}
+	tt.CheckErr(bulk.bulkInsert(objects[size/2:]))
+	tt.CheckErr(bulk.control())
+
+	// bulk insertion builds the same index as serial insertions
+	tt.Assert(bulk.len() == serial.len())
+	for fn, fi := range serial.Fields {
+		tt.Assert(len(bulk.Fields[fn].Index) == len(fi.Index))
+		for i, f := range fi.Index {
+			tt.Assert(bulk.Fields[fn].Index[i].equal(f), fn, i)
+		}
+	}
+	tt.Assert(len(bulk.Composites["C,A"].Index.Index) == size)
+
+	// objects already indexed are rejected
+	tt.CheckErr(bulk.bulkInsert(nil))
+	tt.Assert(bulk.bulkInsert(objects[:1]) != nil)
+	tt.Assert(bulk.len() == size)
+
+	// unique constraints are checked and index is left untouched
+	u := newIndex(FieldDescriptors(&testStructUnique{}))
+	dups := []Object{&testStructUnique{A: 1, B: 1, C: "a"}, &testStructUnique{A: 2, B: 2, C: "b"}, &testStructUnique{A: 3, B: 1, C: "c"}}
+	for _, o := range dups {
+		o.Initialize(uuidOrPanic())
+	}
+	tt.ExpectErr(u.bulkInsert(dups), ErrConstraintUnique)
+	tt.Assert(u.len() == 0)
+	tt.CheckErr(u.bulkInsert(dups[:2]))
+	tt.ExpectErr(u.bulkInsert(dups[2:]), ErrConstraintUnique)
+	tt.Assert(u.len() == 2)
+}
+
+func TestSearchGlobal(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 50
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	tt.CheckErr(db.Create(&testStructUnique{}, DefaultSchema))
+	tt.CheckErr(db.Create(&person{}, DefaultSchema))
+	tt.CheckErr(db.InsertOrUpdate(&testStruct{C: "needle"}))
+	tt.CheckErr(db.InsertOrUpdate(&testStructUnique{A: 1, B: 1, C: "needle"}))
+	tt.CheckErr(db.InsertOrUpdate(&testStructUnique{A: 2, B: 2, C: "haystack"}))
+	tt.CheckErr(db.InsertOrUpdate(&person{Name: "needle"}))
+
+	found, err := db.SearchGlobal("C", "=", "needle")
+	tt.CheckErr(err)
+	tt.Assert(len(found) == 2, found)
+	tt.Assert(len(found[stype(&testStruct{})]) == 1)
+	tt.Assert(len(found[stype(&testStructUnique{})]) == 1)
+	tt.Assert(found[stype(&testStructUnique{})][0].(*testStructUnique).A == 1)
+
+	// types not indexing the field are skipped
+	found, err = db.SearchGlobal("Name", "=", "needle")
+	tt.CheckErr(err)
+	tt.Assert(len(found) == 0)
+
+	// types whose field cannot be compared to value are skipped
+	found, err = db.SearchGlobal("A", "~=", "^1$")
+	tt.CheckErr(err)
+	tt.Assert(len(found) == 0, found)
+
+	found, err = db.SearchGlobal("A", ">=", 2)
+	tt.CheckErr(err)
+	tt.Assert(len(found[stype(&testStructUnique{})]) == 1)
+}
+
+func TestEstimateMatches(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	for _, op := range []string{"=", "!=", "<", "<=", ">", ">=", "~="} {
+		for _, v := range []interface{}{-1, 0, 21, 41, 42} {
+			value := v
+			if op == "~=" {
+				value = fmt.Sprintf("^%d", v)
+			}
+
+			n, err := db.EstimateMatches(&testStruct{}, "A", op, value)
+			if op == "~=" {
+				// regex only applies to strings
+				tt.ExpectErr(err, ErrCasting)
+				continue
+			}
+			tt.CheckErr(err)
+			tt.Assert(n == db.Search(&testStruct{}, "A", op, value).Len(), op, value, n)
+		}
+	}
+
+	n, err := db.EstimateMatches(&testStruct{}, "C", "~=", "^[a-f]")
+	tt.CheckErr(err)
+	tt.Assert(n == db.Search(&testStruct{}, "C", "~=", "^[a-f]").Len())
+
+	_, err = db.EstimateMatches(&testStruct{}, "N", "=", uint(42))
+	tt.ExpectErr(err, ErrUnindexedField)
+	_, err = db.EstimateMatches(&testStruct{}, "A", "=", "42")
+	tt.ExpectErr(err, ErrCasting)
+	_, err = db.EstimateMatches(&testStruct{}, "A", "?", 42)
+	tt.ExpectErr(err, ErrUnkownSearchOperator)
+}
+
+func TestSearchAggregations(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 500
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	var sum float64
+	var min, max int64
+	var n int
+	all, err := db.Search(&testStruct{}, "A", "<", 21).Collect()
+	tt.CheckErr(err)
+	for k, o := range all {
+		ts := o.(*testStruct)
+		sum += float64(ts.B)
+		if k == 0 || int64(ts.B) < min {
+			min = int64(ts.B)
+		}
+		if k == 0 || int64(ts.B) > max {
+			max = int64(ts.B)
+		}
+		n++
+	}
+
+	s := func() *Search { return db.Search(&testStruct{}, "A", "<", 21) }
+
+	count, err := s().Count("B")
+	tt.CheckErr(err)
+	tt.Assert(count == n)
+	total, err := s().Sum("B")
+	tt.CheckErr(err)
+	tt.Assert(total == sum, total, sum)
+	avg, err := s().Avg("B")
+	tt.CheckErr(err)
+	tt.Assert(avg == sum/float64(n))
+	v, err := s().Min("B")
+	tt.CheckErr(err)
+	tt.Assert(v == min, v, min)
+	v, err = s().Max("B")
+	tt.CheckErr(err)
+	tt.Assert(v == max, v, max)
+	v, err = s().Max("C")
+	tt.CheckErr(err)
+	_, ok := v.(string)
+	tt.Assert(ok)
+
+	_, err = s().Sum("N")
+	tt.ExpectErr(err, ErrUnindexedField)
+	_, err = s().Sum("C")
+	tt.ExpectErr(err, ErrCasting)
+	_, err = db.Search(&testStruct{}, "A", "<", 0).Avg("B")
+	tt.ExpectErr(err, ErrNoObjectFound)
+	_, err = db.Search(&testStruct{}, "A", "<", 0).Min("B")
+	tt.ExpectErr(err, ErrNoObjectFound)
+	total, err = db.Search(&testStruct{}, "A", "<", 0).Sum("B")
+	tt.CheckErr(err)
+	tt.Assert(total == 0)
+	_, err = db.Search(&testStruct{}, "Unknown", "=", 0).Sum("B")
+	tt.ExpectErr(err, ErrUnkownField)
+}
@@ -1,10 +1,14 @@
 package sod
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,7 +16,11 @@ var (
 	ErrUnknownKeyType = errors.New("unknown key type")
 )
 
-type indexedField struct {
+// IndexedField is an entry of a field index. It associates the value of
+// a field, normalized as explained in newIndexedField, to the ObjectId of
+// the Object holding that value. ObjectIds can be resolved to Object UUIDs
+// through Schema.ObjectUUID.
+type IndexedField struct {
 	// the value we want to index
 	Value interface{}
 	// the ObjectId of the object in the list of object
@@ -20,30 +28,52 @@ type indexedField struct {
 	ObjectId uint64
 }
 
-func (f *indexedField) MarshalJSON() ([]byte, error) {
+func (f *IndexedField) MarshalJSON() ([]byte, error) {
 	return json.Marshal([]interface{}{f.Value, f.ObjectId})
 }
 
-func (f *indexedField) UnmarshalJSON(data []byte) error {
+func (f *IndexedField) UnmarshalJSON(data []byte) (err error) {
 	var tuple []interface{}
-	if err := json.Unmarshal(data, &tuple); err != nil {
-		return err
+	var objid uint64
+
+	// numbers are decoded as json.Number not to lose
+	// the precision of integers greater than 2^53
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(&tuple); err != nil {
+		return
+	}
+
+	if len(tuple) != 2 {
+		return fmt.Errorf("malformed indexed field %s", data)
+	}
+
+	if n, ok := tuple[1].(json.Number); !ok {
+		return fmt.Errorf("malformed indexed field %s: bad object id", data)
+	} else if objid, err = strconv.ParseUint(string(n), 10, 64); err != nil {
+		return
 	}
+
 	f.Value = tuple[0]
-	// Json unmarshals integer to interface{} as float64
-	f.ObjectId = uint64(tuple[1].(float64))
+	f.ObjectId = objid
 	return nil
 }
 
-func (f *indexedField) String() string {
+func (f *IndexedField) String() string {
 	return fmt.Sprintf("(%v, %d)", f.Value, f.ObjectId)
 }
 
-func searchField(value interface{}) (k *indexedField, err error) {
+func searchField(value interface{}) (k *IndexedField, err error) {
 	return newIndexedField(value, 0)
 }
 
-func newIndexedField(value interface{}, objid uint64) (*indexedField, error) {
+// newIndexedField creates a new IndexedField from a value. Values are cast to
+// the widest type of their kind. A time.Time is converted to its number of
+// nanoseconds since Unix epoch which identifies an instant regardless of
+// the time zone, so indexed times and search values are comparable whatever
+// location they are expressed in. The same conversion is used for indexed
+// values and search values.
+func newIndexedField(value interface{}, objid uint64) (*IndexedField, error) {
 	var err error
 
 	switch k := value.(type) {
@@ -70,28 +100,74 @@ func newIndexedField(value interface{}, objid uint64) (*indexedField, error) {
 	case string, float64, uint64, int64:
 		value = k
 	default:
-		err = fmt.Errorf("%w %T", ErrUnknownKeyType, value)
+		// handling named types (i.e. type Status int) by their kind
+		v := reflect.ValueOf(value)
+		switch {
+		case v.CanInt():
+			value = v.Int()
+		case v.CanUint():
+			value = v.Uint()
+		case v.CanFloat():
+			value = v.Float()
+		case v.Kind() == reflect.String:
+			value = v.String()
+		default:
+			err = fmt.Errorf("%w %T", ErrUnknownKeyType, value)
+		}
+	}
+	return &IndexedField{value, objid}, err
+}
+
+// decodeIndexValue decodes a raw JSON value according to the cast of
+// the index. Numbers are parsed from their text representation to
+// prevent any loss of precision.
+func decodeIndexValue(raw json.RawMessage, cast string) (value interface{}, err error) {
+	switch cast {
+	case "float64":
+		return strconv.ParseFloat(string(raw), 64)
+	case "int64":
+		return strconv.ParseInt(string(raw), 10, 64)
+	case "uint64":
+		return strconv.ParseUint(string(raw), 10, 64)
+	case "string":
+		var s string
+		err = json.Unmarshal(raw, &s)
+		return s, err
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnknownKeyType, cast)
 	}
-	return &indexedField{value, objid}, err
 }
 
-func (f *indexedField) valueTypeFromString(t string) {
-	// we cast everything to float64 because json unmarshal interface{}
-	// to float64 and that is a current limitation of the indexing
+// valueTypeFromString casts the json.Number decoded by UnmarshalJSON to t
+func (f *IndexedField) valueTypeFromString(t string) (err error) {
+	n, isNumber := f.Value.(json.Number)
+
+	switch t {
+	case "float64", "int64", "uint64":
+		if !isNumber {
+			return fmt.Errorf("%w, cannot cast %T(%v) to %s", ErrCasting, f.Value, f.Value, t)
+		}
+	}
+
 	switch t {
 	case "float64":
-		f.Value = f.Value.(float64)
+		f.Value, err = n.Float64()
 	case "int64":
-		f.Value = int64(f.Value.(float64))
+		f.Value, err = n.Int64()
 	case "uint64":
-		f.Value = uint64(f.Value.(float64))
+		f.Value, err = strconv.ParseUint(string(n), 10, 64)
 	case "string":
+		if _, ok := f.Value.(string); !ok {
+			return fmt.Errorf("%w, cannot cast %T(%v) to %s", ErrCasting, f.Value, f.Value, t)
+		}
 	default:
-		panic(fmt.Errorf("%w %s", ErrUnknownKeyType, t))
+		return fmt.Errorf("%w %s", ErrUnknownKeyType, t)
 	}
+
+	return
 }
 
-func (f *indexedField) valueTypeString() string {
+func (f *IndexedField) valueTypeString() string {
 	switch f.Value.(type) {
 	case float64:
 		return "float64"
@@ -106,7 +182,7 @@ func (f *indexedField) valueTypeString() string {
 	}
 }
 
-func (f *indexedField) equal(other *indexedField) bool {
+func (f *IndexedField) equal(other *IndexedField) bool {
 	switch kt := f.Value.(type) {
 	case int64:
 		return kt == other.Value.(int64)
@@ -121,18 +197,18 @@ func (f *indexedField) equal(other *indexedField) bool {
 	}
 }
 
-func (f *indexedField) deepEqual(other *indexedField) bool {
+func (f *IndexedField) deepEqual(other *IndexedField) bool {
 	if f.ObjectId != other.ObjectId {
 		return false
 	}
 	return f.equal(other)
 }
 
-func (f *indexedField) greater(other *indexedField) bool {
+func (f *IndexedField) greater(other *IndexedField) bool {
 	return !f.less(other) && !f.equal(other)
 }
 
-func (f *indexedField) less(other *indexedField) bool {
+func (f *IndexedField) less(other *IndexedField) bool {
 	switch kt := f.Value.(type) {
 	case int64:
 		return kt < other.Value.(int64)
@@ -147,7 +223,7 @@ func (f *indexedField) less(other *indexedField) bool {
 	}
 }
 
-func (f *indexedField) evaluate(operator string, other *indexedField) bool {
+func (f *IndexedField) evaluate(operator string, other *IndexedField) bool {
 	switch operator {
 	case "!=":
 		return !f.equal(other)
@@ -175,6 +251,20 @@ func (f *indexedField) evaluate(operator string, other *indexedField) bool {
 			return rex.MatchString(sv)
 		}
 
+		return false
+	case "contains":
+		if sov, ok := other.Value.(string); ok {
+			if sv, ok := f.Value.(string); ok {
+				return strings.Contains(sv, sov)
+			}
+		}
+		return false
+	case "$=":
+		if sov, ok := other.Value.(string); ok {
+			if sv, ok := f.Value.(string); ok {
+				return strings.HasSuffix(sv, sov)
+			}
+		}
 		return false
 	default:
 		panic(ErrUnkownSearchOperator)
@@ -2,6 +2,7 @@ package sod
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 )
 
@@ -10,9 +11,11 @@ var (
 )
 
 type iterator struct {
-	db      *DB
-	t       reflect.Type
-	i       int
+	db *DB
+	t  reflect.Type
+	i  int
+	// pos is the position in uuids of the last Object returned by next
+	pos     int
 	reverse bool
 	uuids   []string
 }
@@ -40,18 +43,40 @@ func (it *iterator) object() Object {
 
 // next return the next Object of Iterator. It returns
 // ErrEOI when no more objects are available.
+// Objects missing from disk are skipped if schema does read repair.
+// If the directory Objects are stored in is missing, an error wrapping
+// ErrIndexCorrupted is returned.
 func (it *iterator) next() (o Object, err error) {
-	if it.i < len(it.uuids) && it.i >= 0 {
+	for it.i < len(it.uuids) && it.i >= 0 {
 		o = it.object()
 		o.Initialize(it.uuids[it.i])
 		o, err = it.db.get(o)
+		it.pos = it.i
 		if it.reverse {
 			it.i--
 		} else {
 			it.i++
 		}
+
+		if errors.Is(err, ErrNoObjectFound) {
+			// directory is checked only when an object is missing
+			if dir := it.db.oDir(it.object()); !isDirAndExist(it.db.storage, dir) {
+				err = fmt.Errorf("%s %w: object directory %s is missing", it.t, ErrIndexCorrupted, dir)
+				it.db.logger.Warnf("%s", err)
+				return nil, err
+			}
+
+			if it.readRepair() {
+				continue
+			}
+		}
 		return
 	}
-	err = ErrEOI
-	return
+	return nil, ErrEOI
+}
+
+// readRepair returns true if the schema of iterated Objects does read repair
+func (it *iterator) readRepair() bool {
+	s, err := it.db.schema(it.object())
+	return err == nil && s.ReadRepair
 }
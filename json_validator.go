@@ -0,0 +1,39 @@
+package sod
+
+import (
+	"encoding/json"
+)
+
+// validateJSON validates the JSON encoding of o, as written in Object
+// files, with the JSON validator of s if any
+func (s *Schema) validateJSON(o Object) (err error) {
+	var data []byte
+
+	if s.jsonValidator == nil {
+		return
+	}
+
+	if data, err = json.Marshal(o); err != nil {
+		return
+	}
+
+	if data, err = s.encodeTimes(data); err != nil {
+		return
+	}
+
+	return s.jsonValidator(data)
+}
+
+/***** Public Methods ******/
+
+// SetJSONValidator sets a function validating the JSON encoding of Objects,
+// as written in Object files, before they are inserted or updated. An error
+// returned by validate makes the insertion fail with an error wrapping
+// ErrInvalidObject. It is the integration point of a JSON Schema validation
+// library, i.e. validate can validate data against a JSON Schema compiled
+// once, without sod depending on such a library. As other functions of a
+// Schema, validate is not stored in the schema file so it must be set each
+// time the schema is created.
+func (s *Schema) SetJSONValidator(validate func(data []byte) error) {
+	s.jsonValidator = validate
+}
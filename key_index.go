@@ -0,0 +1,317 @@
+package sod
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// HasKeyOperator is the search operator matching the Objects whose map
+// field has a key, whatever the value associated to it
+const HasKeyOperator = "haskey"
+
+// keyIndex indexes the Objects by the keys of a map field. Contrary to a
+// field index, an Object is indexed as many times as its map has keys.
+type keyIndex struct {
+	// ObjectIds by key
+	keys map[string]map[uint64]bool
+	// keys by ObjectId, to unindex Objects
+	objKeys map[uint64][]string
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		keys:    make(map[string]map[uint64]bool),
+		objKeys: make(map[uint64][]string),
+	}
+}
+
+// MarshalJSON encodes the index as the sorted ObjectIds by key
+func (ki *keyIndex) MarshalJSON() ([]byte, error) {
+	keys := make(map[string][]uint64, len(ki.keys))
+
+	for key, ids := range ki.keys {
+		sorted := make([]uint64, 0, len(ids))
+		for id := range ids {
+			sorted = append(sorted, id)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		keys[key] = sorted
+	}
+
+	return json.Marshal(keys)
+}
+
+func (ki *keyIndex) UnmarshalJSON(data []byte) error {
+	var keys map[string][]uint64
+
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+
+	*ki = *newKeyIndex()
+	for key, ids := range keys {
+		for _, id := range ids {
+			ki.insert(key, id)
+		}
+	}
+
+	return nil
+}
+
+func (ki *keyIndex) insert(key string, objid uint64) {
+	if _, ok := ki.keys[key]; !ok {
+		ki.keys[key] = make(map[uint64]bool)
+	}
+	ki.keys[key][objid] = true
+	ki.objKeys[objid] = append(ki.objKeys[objid], key)
+}
+
+// index replaces the keys indexed for objid
+func (ki *keyIndex) index(objid uint64, keys []string) {
+	ki.unindex(objid)
+	for _, key := range keys {
+		ki.insert(key, objid)
+	}
+}
+
+func (ki *keyIndex) unindex(objid uint64) {
+	for _, key := range ki.objKeys[objid] {
+		delete(ki.keys[key], objid)
+		if len(ki.keys[key]) == 0 {
+			delete(ki.keys, key)
+		}
+	}
+	delete(ki.objKeys, objid)
+}
+
+// remapped returns a copy of the index whose ObjectIds are replaced
+// according to ids, the index returned is a copy when ids is nil
+func (ki *keyIndex) remapped(ids map[uint64]uint64) *keyIndex {
+	new := newKeyIndex()
+	for objid, keys := range ki.objKeys {
+		if ids != nil {
+			objid = ids[objid]
+		}
+		for _, key := range keys {
+			new.insert(key, objid)
+		}
+	}
+	return new
+}
+
+// mapValue returns the map field of o. It returns an error wrapping
+// ErrUnkownField if the field does not exist and ErrCasting if it
+// is not a map with string keys.
+func mapValue(o Object, field string) (v reflect.Value, err error) {
+	var ok bool
+
+	if v, ok = valueFieldByName(reflect.ValueOf(o), fieldPath(field)); !ok {
+		return v, fmt.Errorf("%w %s for object %T", ErrUnkownField, field, o)
+	}
+
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return v, fmt.Errorf("%w, field %s of type %s is not a map with string keys", ErrCasting, field, v.Type())
+	}
+
+	return
+}
+
+// mapKeys returns the keys of the map field of o
+func mapKeys(o Object, field string) (keys []string, err error) {
+	var v reflect.Value
+
+	if v, err = mapValue(o, field); err != nil {
+		return
+	}
+
+	keys = make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+
+	return
+}
+
+// objectKeys returns the keys of the map fields of o having a key index
+func (in *objIndex) objectKeys(o Object) (keys map[string][]string, err error) {
+	keys = make(map[string][]string, len(in.Keys))
+	for field := range in.Keys {
+		if keys[field], err = mapKeys(o, field); err != nil {
+			// field is promoted through a nil embedded pointer
+			if errors.Is(err, ErrUnkownField) {
+				err = nil
+				continue
+			}
+			return
+		}
+	}
+	return
+}
+
+// indexKeys indexes the keys of the map fields of o having a key index
+func (in *objIndex) indexKeys(o Object, objid uint64) (err error) {
+	var keys map[string][]string
+
+	if keys, err = in.objectKeys(o); err != nil {
+		return
+	}
+
+	for field, ki := range in.Keys {
+		ki.index(objid, keys[field])
+	}
+
+	return
+}
+
+// searchKey returns the fields of the UUID index (possibly constrained) of
+// the Objects whose map field has key. Only the smallest of the Objects
+// having key and the constrain is walked.
+func (in *objIndex) searchKey(ki *keyIndex, key string, constrain []*IndexedField) (f []*IndexedField) {
+	ids := ki.keys[key]
+
+	if constrain != nil && len(constrain) < len(ids) {
+		f = make([]*IndexedField, 0, len(constrain))
+		for _, c := range constrain {
+			if field, ok := in.uuidIndex.objectIds[c.ObjectId]; ok && ids[c.ObjectId] {
+				f = append(f, field)
+			}
+		}
+	} else {
+		var allowed map[uint64]bool
+
+		if constrain != nil {
+			allowed = make(map[uint64]bool, len(constrain))
+			for _, c := range constrain {
+				allowed[c.ObjectId] = true
+			}
+		}
+
+		f = make([]*IndexedField, 0, len(ids))
+		for objid := range ids {
+			if field, ok := in.uuidIndex.objectIds[objid]; ok && (allowed == nil || allowed[objid]) {
+				f = append(f, field)
+			}
+		}
+	}
+
+	// results are kept in index order, the smallest value at the end
+	sort.Slice(f, func(i, j int) bool { return f[j].less(f[i]) })
+
+	return
+}
+
+// searchKey searches the Objects whose map field has the key value, using
+// the key index of field if there is one or going through the Objects
+func (db *DB) searchKey(s *Schema, o Object, field string, value interface{}, constrain []*IndexedField) *Search {
+	var key string
+	var ok bool
+	var iter *iterator
+	var err error
+
+	if _, err = mapValue(o, field); err != nil {
+		return &Search{db: db, err: err}
+	}
+
+	if key, ok = value.(string); !ok {
+		return &Search{db: db, err: fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, value, value)}
+	}
+
+	if ki, ok := s.ObjectIndex.Keys[field]; ok {
+		return newSearch(db, o, s.ObjectIndex.searchKey(ki, key, constrain), nil)
+	}
+
+	// building up the iterator out of constrain
+	if constrain != nil {
+		uuids := make([]string, 0, len(constrain))
+		for _, c := range constrain {
+			uuids = append(uuids, s.ObjectIndex.ObjectIds[c.ObjectId])
+		}
+		iter = newIterator(db, o, uuids)
+	} else if iter, err = db.Iterator(o); err != nil {
+		return &Search{db: db, err: err}
+	}
+
+	f := make([]*IndexedField, 0)
+	for obj, err := iter.next(); err == nil; obj, err = iter.next() {
+		var m reflect.Value
+
+		if m, err = mapValue(obj, field); err != nil {
+			return &Search{db: db, err: err}
+		}
+
+		if m.MapIndex(reflect.ValueOf(key).Convert(m.Type().Key())).IsValid() {
+			objid := s.ObjectIndex.uuids[obj.UUID()]
+			f = append(f, s.ObjectIndex.uuidIndex.objectIds[objid])
+		}
+	}
+
+	return newSearch(db, o, f, nil)
+}
+
+// syncKeyIndexes builds the key indexes declared but not existing yet in
+// schema and drops the ones not declared anymore. Indexes are built and
+// schema is modified by b (see DB.backfill).
+func (db *DB) syncKeyIndexes(s *Schema, declaration []string, b *backfill) (err error) {
+	declared := make(map[string]bool)
+	built := make(map[string]*keyIndex)
+	for _, field := range declaration {
+		declared[field] = true
+
+		if _, ok := s.ObjectIndex.Keys[field]; ok {
+			continue
+		}
+
+		if _, err = mapValue(newObject(s.object), field); err != nil {
+			return fmt.Errorf("%w %s: %s", ErrUnindexableField, field, err)
+		}
+
+		ki := newKeyIndex()
+		field := field
+
+		b.add(func(o Object, objid uint64) error {
+			keys, err := mapKeys(o, field)
+			if err != nil && !errors.Is(err, ErrUnkownField) {
+				return err
+			}
+			ki.index(objid, keys)
+			return nil
+		}, nil)
+		built[field] = ki
+	}
+
+	b.install(func() {
+		for field := range s.ObjectIndex.Keys {
+			if !declared[field] {
+				delete(s.ObjectIndex.Keys, field)
+			}
+		}
+
+		for field, ki := range built {
+			s.ObjectIndex.Keys[field] = ki
+		}
+
+		s.KeyIndexes = declaration
+	})
+
+	return
+}
+
+/***** Public Methods ******/
+
+// KeyIndex declares an index on the keys of map fields with string keys, so
+// that searches with HasKeyOperator do not go through all the Objects, i.e.
+// Search(o, "Attributes", "haskey", "color").
+func (s *Schema) KeyIndex(fields ...string) {
+next:
+	for _, f := range fields {
+		for _, ki := range s.KeyIndexes {
+			if ki == f {
+				continue next
+			}
+		}
+		s.KeyIndexes = append(s.KeyIndexes, f)
+	}
+}
@@ -0,0 +1,43 @@
+package sod
+
+import (
+	"runtime"
+)
+
+var (
+	// TraceLocks enables the tracing of DB locks through the
+	// Debugf method of the DB Logger
+	TraceLocks = false
+)
+
+// Logger is the interface used by the DB to report internal events such
+// as async writes flush errors, repair progress or index corruption. Any
+// logger having these methods (i.e. a wrapper around the logger of an
+// application) can be used.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// nopLogger is the default Logger discarding all messages
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, v ...interface{}) {}
+func (nopLogger) Infof(format string, v ...interface{})  {}
+func (nopLogger) Warnf(format string, v ...interface{})  {}
+func (nopLogger) Errorf(format string, v ...interface{}) {}
+
+// traceLock logs a lock operation along with the function requesting it
+func (db *DB) traceLock(lock string) {
+	if !TraceLocks {
+		return
+	}
+
+	if pc, _, _, ok := runtime.Caller(2); ok {
+		db.logger.Debugf("%s: %s", lock, runtime.FuncForPC(pc).Name())
+	} else {
+		db.logger.Debugf("%s", lock)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package sod
+
+import "os"
+
+// MapFile reads the file at path as mmap is not supported on this platform
+func (MmapStorage) MapFile(path string) (data []byte, unmap func() error, err error) {
+	if data, err = os.ReadFile(path); err != nil {
+		return
+	}
+	return data, func() error { return nil }, nil
+}
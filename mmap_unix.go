@@ -0,0 +1,34 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package sod
+
+import (
+	"os"
+	"syscall"
+)
+
+// MapFile maps the file at path in memory, empty files are not mapped
+func (MmapStorage) MapFile(path string) (data []byte, unmap func() error, err error) {
+	var f *os.File
+	var stat os.FileInfo
+
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	// mapping remains valid once the file is closed
+	defer f.Close()
+
+	if stat, err = f.Stat(); err != nil {
+		return
+	}
+
+	if stat.Size() == 0 {
+		return []byte{}, func() error { return nil }, nil
+	}
+
+	if data, err = syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
+		return
+	}
+
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -14,6 +14,12 @@ func validationErr(o Object, err error) error {
 	return fmt.Errorf("%s %w: %s", stype(o), ErrInvalidObject, err)
 }
 
+// noObjectFoundErr returns an error matching ErrNoObjectFound
+// while still wrapping the underlying error
+func noObjectFoundErr(o Object, err error) error {
+	return &sentinelErr{ErrNoObjectFound, fmt.Sprintf("%s %s uuid=%s", stype(o), ErrNoObjectFound, o.UUID()), err}
+}
+
 /*
 Recursive method to clone structures. The idea is to have a similar
 behaviour as if we would json back and forth a structure.
@@ -90,6 +96,8 @@ func cloneValue(src interface{}, dst interface{}) {
 		// we deep copy structure
 		// warning: unexported pointers are copied here
 		dstVal.Elem().Set(srcVal)
+		// fields are walked by position as source and destination have the
+		// same type, field order never matters across structure versions
 		for i := 0; i < srcVal.NumField(); i++ {
 			structField := srcType.Field(i)
 			srcField := srcVal.Field(i)
@@ -136,6 +144,31 @@ type Object interface {
 	Validate() error
 }
 
+// DBValidator is an optional interface an Object can implement in order
+// to be validated against other Objects of the DB (cross-object validation).
+// ValidateWithDB is called after Validate every time an Object is inserted
+// and if an error is returned the Object will not be inserted. As the DB is
+// locked for writing during validation, the DB is passed as a read only view
+// only valid during the call, it must not be kept after the call returns.
+type DBValidator interface {
+	ValidateWithDB(db *DBView) error
+}
+
+// PostLoader is an optional interface an Object can implement in order to
+// be modified after being read from disk (i.e. to decrypt or decode
+// fields). PostLoad is called right after an Object file is decoded and
+// before the Object is cached, so cached Objects read from disk are in their
+// post-loaded form while Objects cached when inserted are cached as inserted.
+// It is not called on partially decoded Objects (see DB.GetFields).
+// Transform can be used to revert PostLoad modifications before writing.
+type PostLoader interface {
+	PostLoad()
+}
+
+// MergeFunc merges an incoming Object with the existing Object
+// having the same UUID and returns the Object to store
+type MergeFunc func(existing, incoming Object) Object
+
 // Item is a base structure implementing Object interface
 type Item struct {
 	uuid string
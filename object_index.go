@@ -5,6 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// UUIDField is the name of the virtual field used to search Objects by UUID
+	UUIDField = "UUID"
+	// LenField is the suffix of the virtual field holding the length of a
+	// slice, array, map or string field (i.e. Tags.len)
+	LenField = "len"
 )
 
 var (
@@ -21,33 +31,97 @@ func IsUnique(err error) bool {
 }
 
 func valueFieldByName(v reflect.Value, fields []string) (out reflect.Value, ok bool) {
+	var sf reflect.StructField
+	var err error
+
+	if len(fields) == 0 {
+		return
+	}
 
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
 
-	out = v.FieldByName(fields[0])
+	// only structures have fields
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	if sf, ok = v.Type().FieldByName(fields[0]); !ok || !sf.IsExported() {
+		return reflect.Value{}, false
+	}
+
+	// fails if the field is promoted through a nil embedded pointer
+	if out, err = v.FieldByIndexErr(sf.Index); err != nil {
+		return reflect.Value{}, false
+	}
+
+	// interfaces are walked through if not nil
+	if out.Kind() == reflect.Interface && len(fields) > 1 {
+		if out.IsNil() {
+			return reflect.Value{}, false
+		}
+		out = out.Elem()
+	}
 
 	// if pointer we dereference
 	if out.Kind() == reflect.Ptr {
 		if out.IsZero() {
-			out = reflect.New(out.Type().Elem())
+			out = reflect.New(out.Type().Elem()).Elem()
 		} else {
 			out = out.Elem()
 		}
-		return valueFieldByName(out, fields[1:])
+		if len(fields) > 1 {
+			return valueFieldByName(out, fields[1:])
+		}
 	}
 
 	if out.Kind() == reflect.Struct && len(fields) > 1 {
 		return valueFieldByName(out, fields[1:])
 	}
 
-	return out, out.IsValid()
+	// path goes through a value which is not a structure
+	if len(fields) > 1 {
+		return reflect.Value{}, false
+	}
+
+	return out, out.IsValid() && out.CanInterface()
+}
+
+// LenPath returns the path of the virtual field holding the length of field
+func LenPath(field string) string {
+	return joinFieldPath(field, LenField)
+}
+
+// isLenPath returns true if fpath is the path of a length virtual field
+func isLenPath(fpath []string) bool {
+	return len(fpath) > 1 && fpath[len(fpath)-1] == LenField
+}
+
+// lenByName returns the length of the field designated by fpath
+func lenByName(o Object, fpath []string) (i interface{}, ok bool) {
+	var v reflect.Value
+
+	if v, ok = valueFieldByName(reflect.ValueOf(o), fpath); !ok {
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		return v.Len(), true
+	}
+
+	return nil, false
 }
 
 func fieldByName(o Object, fpath []string) (i interface{}, ok bool) {
 	v := reflect.ValueOf(o)
 
+	// virtual field holding the length of a field
+	if isLenPath(fpath) {
+		return lenByName(o, fpath[:len(fpath)-1])
+	}
+
 	v, ok = valueFieldByName(v, fpath)
 	if !ok {
 		return nil, ok
@@ -56,9 +130,18 @@ func fieldByName(o Object, fpath []string) (i interface{}, ok bool) {
 	return v.Interface(), ok
 }
 
+// jsonObjIndex is the on-disk representation of an objIndex. ObjectIds
+// map is stored as two parallel arrays where ids are sorted and delta
+// encoded. Legacy format storing ObjectIds map is still decoded.
 type jsonObjIndex struct {
-	Fields    map[string]*fieldIndex `json:"fields"`
-	ObjectIds map[uint64]string      `json:"object-ids"`
+	Fields     map[string]*fieldIndex     `json:"fields"`
+	Composites map[string]*compositeIndex `json:"composites,omitempty"`
+	Keys       map[string]*keyIndex       `json:"keys,omitempty"`
+	Partitions map[string]*objIndex       `json:"partitions,omitempty"`
+	Ids        []uint64                   `json:"ids"`
+	UUIDs      []string                   `json:"uuids"`
+	// legacy format
+	ObjectIds map[uint64]string `json:"object-ids,omitempty"`
 }
 
 type objIndex struct {
@@ -68,12 +151,53 @@ type objIndex struct {
 	uuids map[string]uint64
 
 	Fields map[string]*fieldIndex
+	// composite indexes by name
+	Composites map[string]*compositeIndex
+	// key indexes by map field
+	Keys map[string]*keyIndex
 	// mapping ObjectId -> Object UUID
 	ObjectIds map[uint64]string
+	// index of Object UUIDs, built in memory
+	uuidIndex *fieldIndex
+	// indexes of reversed string values by field, built in memory
+	suffixes map[string]*fieldIndex
+	// field indexes by partition if Objects are partitioned, Fields then
+	// only hold the definitions of the indexes (see partitionBy)
+	Partitions map[string]*objIndex
+	// partitioning of the Objects
+	partition *Partition
+	// mapping ObjectId -> partition of the Object
+	partOf map[uint64]string
+}
+
+func newUUIDIndex() *fieldIndex {
+	return newFieldIndex(FieldDescriptor{Path: UUIDField, Type: "string"})
 }
 
 func (in *objIndex) MarshalJSON() ([]byte, error) {
-	return json.Marshal(&jsonObjIndex{Fields: in.Fields, ObjectIds: in.ObjectIds})
+	ids := make([]uint64, 0, len(in.ObjectIds))
+	for id := range in.ObjectIds {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	t := jsonObjIndex{
+		Fields:     in.Fields,
+		Composites: in.Composites,
+		Keys:       in.Keys,
+		Partitions: in.Partitions,
+		Ids:        make([]uint64, 0, len(ids)),
+		UUIDs:      make([]string, 0, len(ids)),
+	}
+
+	prev := uint64(0)
+	for _, id := range ids {
+		t.Ids = append(t.Ids, id-prev)
+		t.UUIDs = append(t.UUIDs, in.ObjectIds[id])
+		prev = id
+	}
+
+	return json.Marshal(&t)
 }
 
 func (in *objIndex) UnmarshalJSON(data []byte) error {
@@ -84,44 +208,114 @@ func (in *objIndex) UnmarshalJSON(data []byte) error {
 
 	in.i = 0
 	in.Fields = tmp.Fields
+	in.Composites = tmp.Composites
+	in.Keys = tmp.Keys
+	in.Partitions = tmp.Partitions
 	in.ObjectIds = tmp.ObjectIds
 	in.uuids = make(map[string]uint64)
 
+	if tmp.UUIDs != nil {
+		if len(tmp.Ids) != len(tmp.UUIDs) {
+			return fmt.Errorf("malformed index: ids and uuids mismatch")
+		}
+
+		in.ObjectIds = make(map[uint64]string, len(tmp.UUIDs))
+		id := uint64(0)
+		for k, uuid := range tmp.UUIDs {
+			id += tmp.Ids[k]
+			in.ObjectIds[id] = uuid
+		}
+	}
+
+	if in.ObjectIds == nil {
+		in.ObjectIds = make(map[uint64]string)
+	}
+
+	if in.Composites == nil {
+		in.Composites = make(map[string]*compositeIndex)
+	}
+
+	if in.Keys == nil {
+		in.Keys = make(map[string]*keyIndex)
+	}
+
 	// we search next index to use for object
+	in.uuidIndex = newUUIDIndex()
 	for i, uuid := range in.ObjectIds {
 		if i > in.i {
 			in.i = i
 		}
 		in.uuids[uuid] = i
+		f := &IndexedField{Value: uuid, ObjectId: i}
+		in.uuidIndex.Index = append(in.uuidIndex.Index, f)
+		in.uuidIndex.objectIds[i] = f
 	}
 	// we don't want to reuse an existing index
 	in.i++
 
+	in.buildSuffixIndexes()
+
+	// entries of the field indexes are in the ones of the partitions
+	in.partOf = make(map[uint64]string)
+	for name, part := range in.Partitions {
+		for id := range part.ObjectIds {
+			in.partOf[id] = name
+		}
+	}
+
+	if in.Partitions != nil {
+		for _, fi := range in.Fields {
+			fi.partitioned = true
+		}
+	}
+
+	// by convention the smallest value is at the end
+	sort.Slice(in.uuidIndex.Index, func(i, j int) bool {
+		return in.uuidIndex.Index[j].less(in.uuidIndex.Index[i])
+	})
+
 	return nil
 }
 
 func newIndex(fields FieldDescMap) *objIndex {
 	i := &objIndex{i: 0,
-		uuids:     make(map[string]uint64),
-		Fields:    make(map[string]*fieldIndex),
-		ObjectIds: make(map[uint64]string)}
+		uuids:      make(map[string]uint64),
+		Fields:     make(map[string]*fieldIndex),
+		Composites: make(map[string]*compositeIndex),
+		Keys:       make(map[string]*keyIndex),
+		ObjectIds:  make(map[uint64]string),
+		uuidIndex:  newUUIDIndex()}
 
 	for _, fd := range fields {
-		if fd.Constraints.Index || fd.Constraints.Unique {
+		if fd.Constraints.Index || fd.Constraints.Unique || fd.Constraints.SuffixIndex {
 			i.Fields[fd.Path] = newFieldIndex(fd)
 		}
 	}
 
+	i.buildSuffixIndexes()
+
 	return i
 }
 
 func (in *objIndex) satisfyAll(o Object) (err error) {
+	// unique constraints hold across partitions
+	for _, part := range in.Partitions {
+		if err = part.satisfyAll(o); err != nil {
+			return
+		}
+	}
+
 	for fn, fi := range in.Fields {
-		if v, ok := fieldByName(o, fi.nameSplit); ok {
-			var iField *indexedField
+		// uniqueness is only required among the Objects indexed
+		if !fi.indexes(o) {
+			continue
+		}
+
+		if v, err := fi.value(o); err == nil {
+			var iField *IndexedField
 
 			if iField, err = searchField(v); err != nil {
-				return
+				return err
 			}
 
 			// check constraint on value
@@ -130,63 +324,473 @@ func (in *objIndex) satisfyAll(o Object) (err error) {
 				return fmt.Errorf("field %s does not satisfy %w", fn, err)
 			}
 		} else {
-			return fmt.Errorf("cannot satisfy constraint %w %s", ErrUnkownField, fn)
+			return fmt.Errorf("cannot satisfy constraint %w", err)
 		}
 	}
 	return
 }
 
+// verifyConstraints returns an error for every value violating
+// the unique constraint of an indexed field
+func (in *objIndex) verifyConstraints() (errs []error) {
+	errs = make([]error, 0)
+
+	for fn, fi := range in.Fields {
+		if !fi.Constraints.Unique {
+			continue
+		}
+
+		// unique constraints hold across partitions
+		fi, _ = in.field(fn)
+		for _, dup := range fi.Duplicates() {
+			uuids := make([]string, 0, len(dup))
+			for _, f := range dup {
+				uuids = append(uuids, in.ObjectIds[f.ObjectId])
+			}
+			sort.Strings(uuids)
+			errs = append(errs, fmt.Errorf("field %s does not satisfy %w: value %v shared by %s", fn, ErrConstraintUnique, dup[0].Value, strings.Join(uuids, ",")))
+		}
+	}
+
+	return
+}
+
+// duplicates returns the groups of UUIDs of Objects sharing the same values
+// for all the fields passed as parameter. Groups are computed from the equal
+// runs of the first field index and split according to the equal runs of the
+// other field indexes. UUIDs are sorted within groups and groups are sorted
+// by their first UUID.
+func (in *objIndex) duplicates(fields []string) (groups [][]string, err error) {
+	var ids [][]uint64
+
+	for k, fn := range fields {
+		fi, ok := in.field(fn)
+		if !ok {
+			return nil, fmt.Errorf("%w %s", ErrFieldNotIndexed, fn)
+		}
+
+		// run identifier of the Objects sharing a value with other Objects
+		dups := fi.Duplicates()
+		runs := make(map[uint64]int)
+		for r, dup := range dups {
+			for _, f := range dup {
+				runs[f.ObjectId] = r
+			}
+		}
+
+		if k == 0 {
+			ids = make([][]uint64, len(dups))
+			for id, r := range runs {
+				ids[r] = append(ids[r], id)
+			}
+			continue
+		}
+
+		// splitting groups according to the runs of the field
+		split := make([][]uint64, 0, len(ids))
+		for _, group := range ids {
+			byRun := make(map[int][]uint64)
+			for _, id := range group {
+				if r, ok := runs[id]; ok {
+					byRun[r] = append(byRun[r], id)
+				}
+			}
+			for _, sub := range byRun {
+				if len(sub) > 1 {
+					split = append(split, sub)
+				}
+			}
+		}
+		ids = split
+	}
+
+	groups = make([][]string, 0, len(ids))
+	for _, group := range ids {
+		uuids := make([]string, 0, len(group))
+		for _, id := range group {
+			uuids = append(uuids, in.ObjectIds[id])
+		}
+		sort.Strings(uuids)
+		groups = append(groups, uuids)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+
+	return
+}
+
 func (in *objIndex) insertOrUpdate(o Object) (err error) {
+	if err = in.controlPredicates(); err != nil {
+		return
+	}
+
+	if err = in.controlDerivations(); err != nil {
+		return
+	}
+
 	// check constraint on all index first to prevent
 	// inconsistencies across indexes
 	if err = in.satisfyAll(o); err != nil {
 		return
 	}
 
-	// the object is already known, we update
-	if i, ok := in.uuids[o.UUID()]; ok {
-		for fn, fi := range in.Fields {
-			if v, ok := fieldByName(o, fi.nameSplit); ok {
-				if err = fi.Update(v, i); err != nil {
-					return
-				}
-			} else {
-				return fmt.Errorf("%w %s", ErrUnkownField, fn)
+	i, exists := in.uuids[o.UUID()]
+	if !exists {
+		i = in.i
+	}
+
+	// field indexes of partitioned Objects are the ones of their partition
+	if in.Partitions != nil {
+		err = in.indexPartition(o, i)
+	} else {
+		err = in.indexFields(o, i, exists)
+	}
+
+	if err != nil {
+		return
+	}
+
+	for _, ci := range in.Composites {
+		if exists {
+			err = ci.update(o, i)
+		} else {
+			err = ci.insert(o, i)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	if err = in.indexKeys(o, i); err != nil {
+		return
+	}
+
+	// the object is already known
+	if exists {
+		return
+	}
+
+	if err = in.uuidIndex.Insert(o.UUID(), i); err != nil {
+		return
+	}
+	// we insert after any potential error
+	in.ObjectIds[i] = o.UUID()
+	in.uuids[o.UUID()] = i
+	in.i++
+
+	return
+}
+
+// indexFields indexes the values of o in the field indexes, if o is already
+// indexed only the values which changed are indexed again
+func (in *objIndex) indexFields(o Object, objid uint64, exists bool) error {
+	for _, fi := range in.Fields {
+		// Object might satisfy a partial index predicate or not anymore
+		if !fi.indexes(o) {
+			fi.unindex(objid)
+			continue
+		}
+
+		v, err := fi.value(o)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			// only the values which changed are indexed again
+			if fi.unchanged(objid, v) {
+				continue
 			}
+			fi.unindex(objid)
 		}
-	} else {
-		for fn, fi := range in.Fields {
-			if v, ok := fieldByName(o, fi.nameSplit); ok {
-				if err = fi.Insert(v, in.i); err != nil {
-					return
+
+		if err = fi.Insert(v, objid); err != nil {
+			return err
+		}
+	}
+
+	in.indexSuffixes(objid)
+
+	return nil
+}
+
+// bulkInsert inserts Objects not indexed yet. Field indexes are sorted
+// once all the values are appended, instead of doing one sorted insertion
+// per value. Unique constraints are checked on the sorted indexes and the
+// index is not modified if an error is returned.
+func (in *objIndex) bulkInsert(objects []Object) (err error) {
+	if err = in.controlPredicates(); err != nil {
+		return
+	}
+
+	if err = in.controlDerivations(); err != nil {
+		return
+	}
+
+	ids := make(map[string]uint64, len(objects))
+	fields := make(map[*fieldIndex][]*IndexedField)
+	keys := make(map[uint64]map[string][]string)
+	// partitions created and partition of the Objects inserted by ObjectId
+	created := make(map[string]*objIndex)
+	members := make(map[uint64]string)
+
+	for k, o := range objects {
+		objid := in.i + uint64(k)
+		idx := in
+
+		if _, ok := in.uuids[o.UUID()]; ok {
+			return fmt.Errorf("object uuid=%s is already indexed", o.UUID())
+		}
+
+		if _, ok := ids[o.UUID()]; ok {
+			return fmt.Errorf("object uuid=%s is inserted twice", o.UUID())
+		}
+		ids[o.UUID()] = objid
+
+		// field indexes of partitioned Objects are the ones of their partition
+		if in.Partitions != nil {
+			name, ok := in.partition.of(o)
+			if !ok {
+				return fmt.Errorf("%w: object uuid=%s has no %s", ErrBadPartition, o.UUID(), in.partition.Field)
+			}
+
+			if idx, ok = in.Partitions[name]; !ok {
+				if idx, ok = created[name]; !ok {
+					idx = in.newPartition()
+					created[name] = idx
 				}
-			} else {
-				return fmt.Errorf("%w %s", ErrUnkownField, fn)
 			}
+			members[objid] = name
+
+			f, _ := newIndexedField(o.UUID(), objid)
+			fields[idx.uuidIndex] = append(fields[idx.uuidIndex], f)
+		}
+
+		for _, fi := range idx.Fields {
+			var v interface{}
+			var f *IndexedField
+
+			if !fi.indexes(o) {
+				continue
+			}
+
+			if v, err = fi.value(o); err != nil {
+				return
+			} else if f, err = newIndexedField(v, objid); err != nil {
+				return
+			}
+			fields[fi] = append(fields[fi], f)
+		}
+
+		for fn, si := range idx.suffixes {
+			indexed := fields[idx.Fields[fn]]
+			// Object not indexed by a partial index
+			if len(indexed) == 0 || indexed[len(indexed)-1].ObjectId != objid {
+				continue
+			}
+			f := indexed[len(indexed)-1]
+			fields[si] = append(fields[si], &IndexedField{Value: reverse(f.Value.(string)), ObjectId: objid})
+		}
+
+		for _, ci := range in.Composites {
+			var key string
+			var f *IndexedField
+
+			if key, err = ci.objectKey(o); err != nil {
+				return
+			}
+			if f, err = newIndexedField(key, objid); err != nil {
+				return
+			}
+			fields[ci.Index] = append(fields[ci.Index], f)
 		}
-		// we insert after any potential error
-		in.ObjectIds[in.i] = o.UUID()
-		in.uuids[o.UUID()] = in.i
-		in.i++
+
+		if len(in.Keys) > 0 {
+			if keys[objid], err = in.objectKeys(o); err != nil {
+				return
+			}
+		}
+
+		f, _ := newIndexedField(o.UUID(), objid)
+		fields[in.uuidIndex] = append(fields[in.uuidIndex], f)
 	}
-	return nil
+
+	sorted := make(map[*fieldIndex][]*IndexedField, len(fields))
+	for fi, new := range fields {
+		sorted[fi] = fi.merged(new)
+	}
+
+	// unique constraints are checked before modifying anything
+	for fn, fi := range in.Fields {
+		if fi.Constraints.Unique && hasDuplicates(in.bulkValues(fn, sorted, created)) {
+			return fmt.Errorf("field %s does not satisfy %w", fn, ErrConstraintUnique)
+		}
+	}
+
+	for fi, s := range sorted {
+		fi.replace(s)
+	}
+
+	for name, part := range created {
+		in.Partitions[name] = part
+	}
+
+	for uuid, objid := range ids {
+		in.ObjectIds[objid] = uuid
+		in.uuids[uuid] = objid
+
+		if name, ok := members[objid]; ok {
+			in.Partitions[name].ObjectIds[objid] = uuid
+			in.Partitions[name].uuids[uuid] = objid
+			in.partOf[objid] = name
+		}
+	}
+	in.i += uint64(len(objects))
+
+	for objid, okeys := range keys {
+		for field, ki := range in.Keys {
+			ki.index(objid, okeys[field])
+		}
+	}
+
+	return
+}
+
+// check checks that the values of an indexed Object are the ones indexed
+func (in *objIndex) check(o Object) (err error) {
+	objid, ok := in.uuids[o.UUID()]
+	if !ok {
+		return fmt.Errorf("is not indexed")
+	}
+
+	expect := func(fi *fieldIndex, value interface{}) error {
+		if f, err := newIndexedField(value, objid); err != nil {
+			return err
+		} else if indexed, ok := fi.objectIds[objid]; !ok {
+			return fmt.Errorf("is missing from %s index", fi.Name)
+		} else if !indexed.equal(f) {
+			return fmt.Errorf("field %s value %v differs from indexed value %v", fi.Name, f.Value, indexed.Value)
+		}
+		return nil
+	}
+
+	// field indexes of partitioned Objects are the ones of their partition
+	idx := in
+	if in.Partitions != nil {
+		name, _ := in.partition.of(o)
+		if idx, ok = in.Partitions[in.partOf[objid]]; !ok || in.partOf[objid] != name {
+			return fmt.Errorf("is missing from partition %s", name)
+		}
+	}
+
+	for _, fi := range idx.Fields {
+		if fi.Partial {
+			_, indexed := fi.objectIds[objid]
+			if fi.predicate != nil && indexed != fi.predicate(o) {
+				return fmt.Errorf("partial index %s does not match predicate", fi.Name)
+			}
+			if !indexed {
+				continue
+			}
+		}
+
+		// derived values cannot be computed
+		if fi.Derived && fi.compute == nil {
+			continue
+		}
+
+		if v, err := fi.value(o); err != nil {
+			return err
+		} else if err = expect(fi, v); err != nil {
+			return err
+		}
+	}
+
+	for _, ci := range in.Composites {
+		var key string
+
+		if key, err = ci.objectKey(o); err != nil {
+			return
+		}
+		if err = expect(ci.Index, key); err != nil {
+			return
+		}
+	}
+
+	for fn, si := range idx.suffixes {
+		if _, ok := idx.Fields[fn].objectIds[objid]; !ok {
+			continue
+		}
+		if err = expect(si, idx.reversedField(fn, objid).Value); err != nil {
+			return
+		}
+	}
+
+	return
 }
 
 func (in *objIndex) deleteByUUID(uuid string) {
 	if index, ok := in.uuids[uuid]; ok {
+		in.unindexPartition(index)
 		for _, fi := range in.Fields {
-			fi.Delete(index)
+			fi.unindex(index)
+		}
+		for _, ci := range in.Composites {
+			ci.delete(index)
+		}
+		for _, ki := range in.Keys {
+			ki.unindex(index)
+		}
+		for _, si := range in.suffixes {
+			si.unindex(index)
 		}
+		in.uuidIndex.Delete(index)
 		delete(in.ObjectIds, index)
 		delete(in.uuids, uuid)
 	}
 }
 
-func (in *objIndex) search(o Object, field string, operator string, value interface{}, constrain []*indexedField) ([]*indexedField, error) {
-	var iField *indexedField
+func (in *objIndex) search(o Object, field string, operator string, value interface{}, constrain []*IndexedField) (f []*IndexedField, err error) {
+	// search is validated against the field indexes of in, which are
+	// empty if Objects are partitioned, as there might be no partition
+	if f, err = in.searchIndex(o, field, operator, value, constrain); err != nil || in.Partitions == nil {
+		return
+	}
+
+	// virtual UUID field
+	if _, ok := in.Fields[field]; !ok {
+		return
+	}
+
+	results := make([][]*IndexedField, 0, len(in.Partitions))
+	for _, part := range in.relevant([]*searchClause{{field, operator, value}}, constrain) {
+		if f, err = part.searchIndex(o, field, operator, value, constrain); err != nil {
+			return
+		}
+		results = append(results, f)
+	}
+
+	return mergeResults(results), nil
+}
+
+// searchIndex searches the field indexes of in
+func (in *objIndex) searchIndex(o Object, field string, operator string, value interface{}, constrain []*IndexedField) ([]*IndexedField, error) {
+	var iField *IndexedField
 	var err error
 
-	if _, ok := fieldByName(o, fieldPath(field)); ok {
+	_, ok := fieldByName(o, fieldPath(field))
+
+	// virtual field of a derived index
+	if fi, indexed := in.Fields[field]; indexed && fi.Derived {
+		ok = true
+	}
+
+	// virtual UUID field, unless Object has a field with the same name
+	if !ok && field == UUIDField {
+		return in.searchUUID(operator, value, constrain)
+	}
+
+	if ok {
 
 		if iField, err = searchField(value); err != nil {
 			return nil, err
@@ -217,6 +821,10 @@ func (in *objIndex) search(o Object, field string, operator string, value interf
 				return fi.SearchLessOrEqual(iField), nil
 			case "~=":
 				return fi.SearchByRegex(iField)
+			case "contains":
+				return fi.SearchContains(iField)
+			case "$=":
+				return in.searchSuffix(field, fi, iField)
 			default:
 				return nil, fmt.Errorf("%w %s", ErrUnkownSearchOperator, operator)
 			}
@@ -227,16 +835,310 @@ func (in *objIndex) search(o Object, field string, operator string, value interf
 	}
 }
 
+// estimate returns the number of entries of the field index matching
+// operator and value. Comparisons are answered from the boundaries of
+// the sorted index, other operators are evaluated.
+func (in *objIndex) estimate(o Object, field string, operator string, value interface{}) (n int, err error) {
+	// estimate is validated against the field indexes of in, which are
+	// empty if Objects are partitioned, as there might be no partition
+	if n, err = in.estimateIndex(o, field, operator, value); err != nil || in.Partitions == nil {
+		return
+	}
+
+	for _, part := range in.relevant([]*searchClause{{field, operator, value}}, nil) {
+		var m int
+
+		if m, err = part.estimateIndex(o, field, operator, value); err != nil {
+			return
+		}
+		n += m
+	}
+
+	return
+}
+
+// estimateIndex estimates the number of entries of a field index of in
+func (in *objIndex) estimateIndex(o Object, field string, operator string, value interface{}) (n int, err error) {
+	var iField *IndexedField
+	var f []*IndexedField
+
+	fi, ok := in.Fields[field]
+	if !ok {
+		return 0, fmt.Errorf("%s %w", field, ErrUnindexedField)
+	}
+
+	if iField, err = searchField(value); err != nil {
+		return
+	}
+
+	if fi.Cast != iField.valueTypeString() {
+		return 0, fmt.Errorf("%w, cannot cast %T(%v) to %s", ErrCasting, value, value, fi.Cast)
+	}
+
+	switch operator {
+	case "=":
+		return fi.CountEqual(iField), nil
+	case "!=":
+		return fi.Len() - fi.CountEqual(iField), nil
+	case ">":
+		return len(fi.SearchGreater(iField)), nil
+	case ">=":
+		return len(fi.SearchGreaterOrEqual(iField)), nil
+	case "<":
+		return len(fi.SearchLess(iField)), nil
+	case "<=":
+		return len(fi.SearchLessOrEqual(iField)), nil
+	}
+
+	if f, err = in.searchIndex(o, field, operator, value, nil); err != nil {
+		return
+	}
+
+	return len(f), nil
+}
+
+// searchUUID searches Objects by UUID
+func (in *objIndex) searchUUID(operator string, value interface{}, constrain []*IndexedField) (f []*IndexedField, err error) {
+	fi := in.uuidIndex
+
+	if constrain != nil {
+		fi = fi.Constrain(constrain)
+	}
+
+	if operator == "in" {
+		var uuids []string
+		var ok bool
+
+		if uuids, ok = value.([]string); !ok {
+			return nil, fmt.Errorf("%w, cannot cast %T(%v) to []string", ErrCasting, value, value)
+		}
+
+		// results are kept in index order
+		marked := make(map[uint64]bool)
+		for _, uuid := range uuids {
+			if id, ok := in.uuids[uuid]; ok {
+				marked[id] = true
+			}
+		}
+
+		f = make([]*IndexedField, 0, len(marked))
+		for _, field := range fi.Index {
+			if marked[field.ObjectId] {
+				f = append(f, field)
+			}
+		}
+		return
+	}
+
+	if _, ok := value.(string); !ok {
+		return nil, fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, value, value)
+	}
+
+	iField := &IndexedField{Value: value}
+	switch operator {
+	case "!=":
+		return fi.SearchNotEqual(iField), nil
+	case "=":
+		return fi.SearchEqual(iField), nil
+	case ">":
+		return fi.SearchGreater(iField), nil
+	case ">=":
+		return fi.SearchGreaterOrEqual(iField), nil
+	case "<":
+		return fi.SearchLess(iField), nil
+	case "<=":
+		return fi.SearchLessOrEqual(iField), nil
+	case "~=":
+		return fi.SearchByRegex(iField)
+	case "contains":
+		return fi.SearchContains(iField)
+	case "$=":
+		return fi.SearchSuffix(iField)
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnkownSearchOperator, operator)
+	}
+}
+
+// searchComposite searches clauses using a composite index. It returns
+// false if no composite index can answer the clauses.
+func (in *objIndex) searchComposite(clauses []*searchClause) ([]*IndexedField, bool) {
+	for _, ci := range in.Composites {
+		if f, ok := ci.search(clauses); ok {
+			return f, ok
+		}
+	}
+	return nil, false
+}
+
+// searchRange searches two clauses on the same indexed field with a single
+// range search instead of intersecting the results of two searches. It
+// returns false if the clauses cannot be collapsed into a range.
+func (in *objIndex) searchRange(a, b *searchClause, constrain []*IndexedField) (f []*IndexedField, ok bool) {
+	// clauses are checked against the field indexes of in, which are
+	// empty if Objects are partitioned, as there might be no partition
+	if f, ok = in.searchRangeIndex(a, b, constrain); !ok || in.Partitions == nil {
+		return
+	}
+
+	results := make([][]*IndexedField, 0, len(in.Partitions))
+	for _, part := range in.relevant([]*searchClause{a, b}, constrain) {
+		f, _ = part.searchRangeIndex(a, b, constrain)
+		results = append(results, f)
+	}
+
+	return mergeResults(results), true
+}
+
+// searchRangeIndex searches a range in the field indexes of in
+func (in *objIndex) searchRangeIndex(a, b *searchClause, constrain []*IndexedField) (f []*IndexedField, ok bool) {
+	var lo, hi *IndexedField
+	var loIncl, hiIncl bool
+	var fi *fieldIndex
+
+	if a.field != b.field {
+		return
+	}
+
+	if fi, ok = in.Fields[a.field]; !ok {
+		return
+	}
+
+	for _, c := range []*searchClause{a, b} {
+		v, err := searchField(c.value)
+		// errors are left to the regular search path
+		if err != nil || v.valueTypeString() != fi.Cast {
+			return nil, false
+		}
+
+		switch c.operator {
+		case "=", ">", ">=", "<", "<=":
+		default:
+			return nil, false
+		}
+
+		// the tightest bounds are kept
+		if c.operator != "<" && c.operator != "<=" {
+			incl := c.operator != ">"
+			if lo == nil || v.greater(lo) || (v.equal(lo) && !incl) {
+				lo, loIncl = v, incl
+			}
+		}
+
+		if c.operator != ">" && c.operator != ">=" {
+			incl := c.operator != "<"
+			if hi == nil || v.less(hi) || (v.equal(hi) && !incl) {
+				hi, hiIncl = v, incl
+			}
+		}
+	}
+
+	if constrain != nil {
+		fi = fi.Constrain(constrain)
+	}
+
+	switch {
+	case lo == nil && hiIncl:
+		return fi.SearchLessOrEqual(hi), true
+	case lo == nil:
+		return fi.SearchLess(hi), true
+	case hi == nil && loIncl:
+		return fi.SearchGreaterOrEqual(lo), true
+	case hi == nil:
+		return fi.SearchGreater(lo), true
+	default:
+		return fi.SearchRange(lo, hi, loIncl, hiIncl), true
+	}
+}
+
 func (in *objIndex) control() error {
 	for fn := range in.Fields {
 		if !in.Fields[fn].Control() {
 			return fmt.Errorf("field index %s is not ordered", fn)
 		}
-		if in.Fields[fn].Len() != in.len() {
+		// entries of partitioned indexes are in the ones of the partitions
+		if fi := in.Fields[fn]; fi.partitioned && fi.Len() > 0 {
+			return fmt.Errorf("field index %s is partitioned but not empty", fn)
+		}
+		// partial indexes only index some of the Objects
+		if fi := in.Fields[fn]; !fi.partitioned && (fi.Len() > in.len() || !fi.Partial && fi.Len() != in.len()) {
 			return fmt.Errorf("index and fields index must have the same size, len(index)=%d len(index[%s])=%d", in.len(), fn, in.Fields[fn].Len())
 		}
 	}
-	return nil
+	if !in.uuidIndex.Control() || in.uuidIndex.Len() != in.len() {
+		return fmt.Errorf("uuid index is not consistent with index")
+	}
+	for cn, ci := range in.Composites {
+		if !ci.Index.Control() {
+			return fmt.Errorf("composite index %s is not ordered", cn)
+		}
+		if ci.Index.Len() != in.len() {
+			return fmt.Errorf("index and composite index must have the same size, len(index)=%d len(composite[%s])=%d", in.len(), cn, ci.Index.Len())
+		}
+	}
+	for fn, si := range in.suffixes {
+		if !si.Control() {
+			return fmt.Errorf("suffix index %s is not ordered", fn)
+		}
+		if si.Len() != in.Fields[fn].Len() {
+			return fmt.Errorf("field and suffix index must have the same size, len(index[%s])=%d len(suffix[%s])=%d", fn, in.Fields[fn].Len(), fn, si.Len())
+		}
+	}
+	for fn, ki := range in.Keys {
+		for objid := range ki.objKeys {
+			if _, ok := in.ObjectIds[objid]; !ok {
+				return fmt.Errorf("key index %s references unknown object id %d", fn, objid)
+			}
+		}
+	}
+	return in.controlPartitions()
+}
+
+// clone returns a copy of the index which is not modified
+// by further modifications of the original index
+func (in *objIndex) clone() *objIndex {
+	new := &objIndex{
+		i:          in.i,
+		uuids:      make(map[string]uint64, len(in.uuids)),
+		Fields:     make(map[string]*fieldIndex, len(in.Fields)),
+		Composites: make(map[string]*compositeIndex, len(in.Composites)),
+		Keys:       make(map[string]*keyIndex, len(in.Keys)),
+		ObjectIds:  make(map[uint64]string, len(in.ObjectIds)),
+		suffixes:   make(map[string]*fieldIndex, len(in.suffixes)),
+	}
+
+	for uuid, id := range in.uuids {
+		new.uuids[uuid] = id
+	}
+	for fn, fi := range in.Fields {
+		new.Fields[fn] = fi.clone()
+	}
+	for cn, ci := range in.Composites {
+		new.Composites[cn] = ci.clone()
+	}
+	for field, ki := range in.Keys {
+		new.Keys[field] = ki.remapped(nil)
+	}
+	for fn, si := range in.suffixes {
+		new.suffixes[fn] = si.clone()
+	}
+	for id, uuid := range in.ObjectIds {
+		new.ObjectIds[id] = uuid
+	}
+	new.uuidIndex = in.uuidIndex.clone()
+
+	if in.Partitions != nil {
+		new.Partitions = make(map[string]*objIndex, len(in.Partitions))
+		for name, part := range in.Partitions {
+			new.Partitions[name] = part.clone()
+		}
+	}
+	new.partOf = make(map[uint64]string, len(in.partOf))
+	for id, name := range in.partOf {
+		new.partOf[id] = name
+	}
+	new.partition = in.partition
+
+	return new
 }
 
 func (in *objIndex) len() int {
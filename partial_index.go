@@ -0,0 +1,172 @@
+package sod
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrBadPartialIndex  = errors.New("bad partial index")
+	ErrMissingPredicate = errors.New("partial index predicate not declared")
+)
+
+// PartialIndex makes the index of field partial, only the Objects for which
+// predicate returns true are indexed. It saves the memory used to index
+// Objects never searched by that field (i.e. inactive ones). Searches on
+// field only return Objects satisfying predicate, even with operators like
+// "!=", and unique constraints only apply among these Objects. Field must
+// be indexed.
+//
+// Predicates cannot be stored in the schema file so they must be declared
+// every time the schema is created with DB.Create, Objects cannot be
+// written otherwise. Predicate of an existing partial index is assumed
+// not to change, the field index is only rebuilt when it becomes partial
+// or stops being partial.
+func (s *Schema) PartialIndex(field string, predicate func(o Object) bool) {
+	// map is copied not to modify copies of the schema
+	partials := make(map[string]func(o Object) bool, len(s.partials)+1)
+	for f, p := range s.partials {
+		partials[f] = p
+	}
+	partials[field] = predicate
+	s.partials = partials
+}
+
+// indexes returns true if o must be indexed in the field index
+func (in *fieldIndex) indexes(o Object) bool {
+	return !in.Partial || in.predicate(o)
+}
+
+// unindex deletes objid from the index if it is indexed
+func (in *fieldIndex) unindex(objid uint64) {
+	if _, ok := in.objectIds[objid]; ok {
+		in.Delete(objid)
+	}
+}
+
+// controlPredicates checks that the predicates of partial indexes are known
+func (in *objIndex) controlPredicates() error {
+	for fn, fi := range in.Fields {
+		if fi.Partial && fi.predicate == nil {
+			return fmt.Errorf("%w for field %s", ErrMissingPredicate, fn)
+		}
+	}
+	return nil
+}
+
+// predicates returns the predicates of the partial indexes by field
+func (in *objIndex) predicates() map[string]func(o Object) bool {
+	predicates := make(map[string]func(o Object) bool)
+	for fn, fi := range in.Fields {
+		if fi.Partial {
+			predicates[fn] = fi.predicate
+		}
+	}
+	return predicates
+}
+
+// copyPartials makes the field indexes partial as the ones of from
+func (in *objIndex) copyPartials(from *objIndex) {
+	for fn, fi := range in.Fields {
+		if ffi, ok := from.Fields[fn]; ok {
+			fi.Partial, fi.predicate = ffi.Partial, ffi.predicate
+		}
+	}
+}
+
+// syncPartialIndexes rebuilds the field indexes becoming partial and the ones
+// not partial anymore and sets the predicates of partial indexes. Indexes
+// are rebuilt and schema is modified by b (see DB.backfill).
+func (db *DB) syncPartialIndexes(s *Schema, declaration map[string]func(o Object) bool, b *backfill) (err error) {
+	for field := range declaration {
+		if _, ok := b.field(s, field); !ok {
+			return fmt.Errorf("%w: field %s is not indexed", ErrBadPartialIndex, field)
+		}
+
+		if field == s.Sequence || s.Partition != nil && field == s.Partition.Field {
+			return fmt.Errorf("%w: field %s index must be complete", ErrBadPartialIndex, field)
+		}
+	}
+
+	names := make(map[string]bool)
+	for fn := range s.ObjectIndex.Fields {
+		names[fn] = true
+	}
+	for fn := range b.fields {
+		names[fn] = true
+	}
+
+	rebuilt := make(map[string]*fieldIndex)
+	for fn := range names {
+		fi, _ := b.field(s, fn)
+		predicate, partial := declaration[fn]
+
+		// indexes being built are directly built as declared
+		if _, ok := b.fields[fn]; ok {
+			fi.Partial, fi.predicate = partial, predicate
+			continue
+		}
+
+		if partial == fi.Partial {
+			continue
+		}
+
+		new := &fieldIndex{
+			Name:        fi.Name,
+			Cast:        fi.Cast,
+			Constraints: fi.Constraints,
+			Index:       make([]*IndexedField, 0),
+			Partial:     partial,
+			Derived:     fi.Derived,
+			objectIds:   make(map[uint64]*IndexedField),
+			nameSplit:   fi.nameSplit,
+			predicate:   predicate,
+			compute:     fi.compute,
+		}
+		fields := make([]*IndexedField, 0)
+		fn := fn
+
+		b.add(func(o Object, objid uint64) error {
+			if !new.indexes(o) {
+				return nil
+			}
+
+			v, err := new.value(o)
+			if err != nil {
+				return err
+			}
+
+			f, err := newIndexedField(v, objid)
+			if err != nil {
+				return err
+			}
+			fields = append(fields, f)
+			return nil
+		}, func() error {
+			sorted := new.merged(fields)
+			if new.Constraints.Unique && hasDuplicates(sorted) {
+				return fmt.Errorf("field %s does not satisfy %w", fn, ErrConstraintUnique)
+			}
+			new.replace(sorted)
+			return nil
+		})
+		rebuilt[fn] = new
+	}
+
+	b.install(func() {
+		for fn, fi := range rebuilt {
+			s.ObjectIndex.Fields[fn] = fi
+		}
+
+		for fn, fi := range s.ObjectIndex.Fields {
+			fi.predicate = declaration[fn]
+		}
+
+		if len(rebuilt) > 0 {
+			s.ObjectIndex.buildSuffixIndexes()
+			s.queries.invalidate()
+		}
+	})
+
+	return
+}
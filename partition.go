@@ -0,0 +1,656 @@
+package sod
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	PartitionDay   = "day"
+	PartitionMonth = "month"
+	PartitionYear  = "year"
+)
+
+var (
+	ErrBadPartition    = errors.New("bad partition")
+	ErrNotPartitioned  = errors.New("objects are not partitioned")
+	partitionLayouts   = map[string]string{PartitionDay: "2006-01-02", PartitionMonth: "2006-01", PartitionYear: "2006"}
+	partitionIncrement = map[string][3]int{PartitionDay: {0, 0, 1}, PartitionMonth: {0, 1, 0}, PartitionYear: {1, 0, 0}}
+	// range of the times indexed as nanoseconds since Unix epoch
+	minIndexedTime = time.Unix(0, math.MinInt64)
+	maxIndexedTime = time.Unix(0, math.MaxInt64)
+)
+
+// Partition stores the Objects of a type in sub-directories of the
+// type directory according to the value of an indexed time.Time field.
+// Every sub-directory holds the Objects of a period (UTC), so that the
+// Objects of a period can be dropped at once with DB.DropPartition.
+//
+// Every partition has its own field indexes, searches on a field are made
+// in the indexes of the partitions which might hold Objects matching and
+// their results are merged, so partitions are transparent to searches.
+// Partitions are selected according to the time range searched on the
+// partition field and, for clauses ANDed, according to the Objects found
+// by the previous clauses. Object ids, the UUID index, composite and key
+// indexes are not partitioned and unique constraints hold across partitions.
+type Partition struct {
+	// Field is the path of the time.Time field Objects are partitioned by
+	Field string `json:"field"`
+	// Period is one of PartitionDay, PartitionMonth or PartitionYear
+	Period string `json:"period"`
+}
+
+func (p *Partition) validate(fields FieldDescMap) (err error) {
+	var fd FieldDescriptor
+	var ok bool
+
+	if _, ok = partitionLayouts[p.Period]; !ok {
+		return fmt.Errorf("%w: unknown period %q", ErrBadPartition, p.Period)
+	}
+
+	if fd, ok = fields.GetDescriptor(p.Field); !ok {
+		return fmt.Errorf("%w: unknown field %s", ErrBadPartition, p.Field)
+	}
+
+	if fd.Type != "time.Time" || !fd.Constraints.Index {
+		return fmt.Errorf("%w: %s must be an indexed time.Time field", ErrBadPartition, p.Field)
+	}
+
+	return
+}
+
+func (p *Partition) equal(other *Partition) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	return *p == *other
+}
+
+// name returns the name of the partition t belongs to
+func (p *Partition) name(t time.Time) string {
+	return t.UTC().Format(partitionLayouts[p.Period])
+}
+
+// period returns the start and the end of the period of a partition
+func (p *Partition) period(name string) (start, end time.Time, err error) {
+	if start, err = time.Parse(partitionLayouts[p.Period], name); err != nil {
+		return
+	}
+	inc := partitionIncrement[p.Period]
+	return start, start.AddDate(inc[0], inc[1], inc[2]), nil
+}
+
+// end returns the end of the period of a partition
+func (p *Partition) end(name string) (t time.Time, err error) {
+	_, t, err = p.period(name)
+	return
+}
+
+// of returns the name of the partition o belongs to
+func (p *Partition) of(o Object) (name string, ok bool) {
+	var i interface{}
+	var t time.Time
+
+	if i, ok = fieldByName(o, fieldPath(p.Field)); !ok {
+		return
+	}
+
+	if t, ok = i.(time.Time); !ok {
+		return
+	}
+
+	return p.name(t), true
+}
+
+// overlaps returns false if none of the Objects of a partition can match
+// all the clauses made on the partition field
+func (p *Partition) overlaps(name string, clauses []*searchClause) bool {
+	start, end, err := p.period(name)
+
+	// times are indexed as nanoseconds which cannot represent all the periods
+	if err != nil || start.Before(minIndexedTime) || end.After(maxIndexedTime) {
+		return true
+	}
+
+	lo, hi := start.UnixNano(), end.UnixNano()
+	for _, c := range clauses {
+		var f *IndexedField
+
+		if c.field != p.Field {
+			continue
+		}
+
+		if f, err = searchField(c.value); err != nil {
+			continue
+		}
+
+		ns, ok := f.Value.(int64)
+		if !ok {
+			continue
+		}
+
+		// partition holds values in [lo, hi)
+		switch c.operator {
+		case "=":
+			if ns < lo || ns >= hi {
+				return false
+			}
+		case ">":
+			if ns >= hi-1 {
+				return false
+			}
+		case ">=":
+			if ns >= hi {
+				return false
+			}
+		case "<":
+			if ns <= lo {
+				return false
+			}
+		case "<=":
+			if ns < lo {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// partitionOf returns the name of the partition o must be stored in
+func (s *Schema) partitionOf(o Object) (name string, ok bool) {
+	if s.Partition == nil {
+		return
+	}
+
+	return s.Partition.of(o)
+}
+
+// partitionFromIndex returns the name of the partition an indexed
+// Object is stored in
+func (s *Schema) partitionFromIndex(uuid string) (name string, ok bool) {
+	var objid uint64
+
+	if s.Partition == nil {
+		return
+	}
+
+	if objid, ok = s.ObjectIndex.uuids[uuid]; !ok {
+		return
+	}
+
+	name, ok = s.ObjectIndex.partOf[objid]
+	return
+}
+
+// emptied returns an empty index with the same definition as in
+func (in *fieldIndex) emptied() *fieldIndex {
+	new := *in
+	new.Index = make([]*IndexedField, 0)
+	new.objectIds = make(map[uint64]*IndexedField)
+	new.partitioned = false
+	return &new
+}
+
+// newPartition returns an empty partition index
+func (in *objIndex) newPartition() *objIndex {
+	part := &objIndex{
+		uuids:      make(map[string]uint64),
+		Fields:     make(map[string]*fieldIndex),
+		Composites: make(map[string]*compositeIndex),
+		Keys:       make(map[string]*keyIndex),
+		ObjectIds:  make(map[uint64]string),
+		uuidIndex:  newUUIDIndex(),
+	}
+	in.inherit(part)
+	return part
+}
+
+// inherit makes the field indexes of a partition the ones of in. Indexes
+// missing are added empty, the ones dropped are removed and definitions,
+// predicates and functions of derived indexes are copied.
+func (in *objIndex) inherit(part *objIndex) {
+	for fn, fi := range in.Fields {
+		pfi, ok := part.Fields[fn]
+		if !ok {
+			part.Fields[fn] = fi.emptied()
+			continue
+		}
+
+		pfi.Name, pfi.nameSplit, pfi.Cast, pfi.Constraints = fi.Name, fi.nameSplit, fi.Cast, fi.Constraints
+		pfi.Partial, pfi.Derived, pfi.predicate, pfi.compute = fi.Partial, fi.Derived, fi.predicate, fi.compute
+	}
+
+	for fn := range part.Fields {
+		if _, ok := in.Fields[fn]; !ok {
+			delete(part.Fields, fn)
+		}
+	}
+
+	part.buildSuffixIndexes()
+}
+
+// partitionBy partitions the field indexes of in according to p. Objects
+// not assigned to a partition yet (i.e. index written before its Objects
+// were partitioned) are assigned according to the value indexed for the
+// partition field. Entries of the field indexes not partitioned yet (i.e.
+// indexes just built) are moved to the indexes of the partitions, which
+// are then made the same as the ones of in.
+func (in *objIndex) partitionBy(p *Partition) {
+	if in.partition = p; p == nil {
+		return
+	}
+
+	if in.Partitions == nil {
+		in.Partitions = make(map[string]*objIndex)
+	}
+
+	if in.partOf == nil {
+		in.partOf = make(map[uint64]string)
+	}
+
+	if fi, ok := in.Fields[p.Field]; ok && !fi.partitioned {
+		uuids := make(map[*objIndex][]*IndexedField)
+		for objid, uuid := range in.ObjectIds {
+			if _, ok := in.partOf[objid]; ok {
+				continue
+			}
+
+			f, ok := fi.objectIds[objid]
+			if !ok {
+				continue
+			}
+
+			ns, ok := f.Value.(int64)
+			if !ok {
+				continue
+			}
+
+			name := p.name(time.Unix(0, ns))
+			part, ok := in.Partitions[name]
+			if !ok {
+				part = in.newPartition()
+				in.Partitions[name] = part
+			}
+
+			part.ObjectIds[objid] = uuid
+			part.uuids[uuid] = objid
+			in.partOf[objid] = name
+			uuids[part] = append(uuids[part], &IndexedField{Value: uuid, ObjectId: objid})
+		}
+
+		for part, f := range uuids {
+			part.uuidIndex.replace(part.uuidIndex.merged(f))
+		}
+	}
+
+	for fn, fi := range in.Fields {
+		if fi.partitioned {
+			continue
+		}
+
+		// index is sorted so entries of partitions are sorted too
+		entries := make(map[string][]*IndexedField)
+		for _, f := range fi.Index {
+			if name, ok := in.partOf[f.ObjectId]; ok {
+				entries[name] = append(entries[name], f)
+			}
+		}
+
+		for name, part := range in.Partitions {
+			pfi := fi.emptied()
+			if f, ok := entries[name]; ok {
+				pfi.replace(f)
+			}
+			part.Fields[fn] = pfi
+		}
+
+		fi.Index = make([]*IndexedField, 0)
+		fi.objectIds = make(map[uint64]*IndexedField)
+		fi.partitioned = true
+	}
+
+	in.buildSuffixIndexes()
+	for _, part := range in.Partitions {
+		in.inherit(part)
+	}
+}
+
+// indexPartition indexes o in the field indexes of the partition it belongs
+// to, o is removed from the partition it was in if it moved
+func (in *objIndex) indexPartition(o Object, objid uint64) (err error) {
+	var part *objIndex
+
+	name, ok := in.partition.of(o)
+	if !ok {
+		return fmt.Errorf("%w: object uuid=%s has no %s", ErrBadPartition, o.UUID(), in.partition.Field)
+	}
+
+	if cur, ok := in.partOf[objid]; ok && cur != name {
+		in.unindexPartition(objid)
+	}
+
+	if part, ok = in.Partitions[name]; !ok {
+		part = in.newPartition()
+		in.Partitions[name] = part
+	}
+
+	_, exists := part.uuids[o.UUID()]
+	if err = part.indexFields(o, objid, exists); err != nil {
+		return
+	}
+
+	if !exists {
+		if err = part.uuidIndex.Insert(o.UUID(), objid); err != nil {
+			return
+		}
+		part.ObjectIds[objid] = o.UUID()
+		part.uuids[o.UUID()] = objid
+		in.partOf[objid] = name
+	}
+
+	return
+}
+
+// unindexPartition removes an Object from the field indexes of its
+// partition, partitions left empty are dropped
+func (in *objIndex) unindexPartition(objid uint64) {
+	if name, ok := in.partOf[objid]; ok {
+		part := in.Partitions[name]
+		part.deleteByUUID(part.ObjectIds[objid])
+		delete(in.partOf, objid)
+
+		if part.len() == 0 {
+			delete(in.Partitions, name)
+		}
+	}
+}
+
+// partitionNames returns the names of the partitions, the most recent first
+func (in *objIndex) partitionNames() []string {
+	names := make([]string, 0, len(in.Partitions))
+	for name := range in.Partitions {
+		names = append(names, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names
+}
+
+// relevant returns the partitions which might hold Objects matching all
+// the clauses, among the partitions of the Objects of constrain if not nil
+func (in *objIndex) relevant(clauses []*searchClause, constrain []*IndexedField) (parts []*objIndex) {
+	var marked map[string]bool
+
+	if constrain != nil {
+		marked = make(map[string]bool)
+		for _, f := range constrain {
+			marked[in.partOf[f.ObjectId]] = true
+		}
+	}
+
+	parts = make([]*objIndex, 0, len(in.Partitions))
+	for _, name := range in.partitionNames() {
+		if marked != nil && !marked[name] {
+			continue
+		}
+
+		if in.partition.overlaps(name, clauses) {
+			parts = append(parts, in.Partitions[name])
+		}
+	}
+
+	return
+}
+
+// mergeResults merges the results of a search made in several partitions,
+// results are ordered as in a field index
+func mergeResults(results [][]*IndexedField) (f []*IndexedField) {
+	if len(results) == 1 {
+		return results[0]
+	}
+
+	n := 0
+	for _, r := range results {
+		n += len(r)
+	}
+
+	f = make([]*IndexedField, 0, n)
+	for _, r := range results {
+		f = append(f, r...)
+	}
+
+	// stable sort keeps partitions order among equal values
+	sort.SliceStable(f, func(i, j int) bool { return f[j].less(f[i]) })
+
+	return
+}
+
+// field returns the index of a field, the one of partitioned Objects
+// is merged from the indexes of the partitions
+func (in *objIndex) field(fn string) (fi *fieldIndex, ok bool) {
+	if fi, ok = in.Fields[fn]; !ok || in.Partitions == nil {
+		return
+	}
+
+	results := make([][]*IndexedField, 0, len(in.Partitions))
+	for _, name := range in.partitionNames() {
+		results = append(results, in.Partitions[name].Fields[fn].Index)
+	}
+
+	merged := fi.emptied()
+	merged.replace(mergeResults(results))
+
+	return merged, true
+}
+
+// indexed returns the value indexed for an Object in the index of a field
+func (in *objIndex) indexed(fn string, objid uint64) (f *IndexedField, ok bool) {
+	var fi *fieldIndex
+
+	idx := in
+	if in.Partitions != nil {
+		if idx, ok = in.Partitions[in.partOf[objid]]; !ok {
+			return
+		}
+	}
+
+	if fi, ok = idx.Fields[fn]; !ok {
+		return
+	}
+
+	f, ok = fi.objectIds[objid]
+	return
+}
+
+// bulkValues returns the values of the index of field fn once merged with the
+// values inserted in bulk, found in sorted by field index. Values of
+// partitioned Objects are merged across partitions, created ones included.
+// It returns nil if no value is inserted.
+func (in *objIndex) bulkValues(fn string, sorted map[*fieldIndex][]*IndexedField, created map[string]*objIndex) []*IndexedField {
+	if in.Partitions == nil {
+		return sorted[in.Fields[fn]]
+	}
+
+	inserted := false
+	results := make([][]*IndexedField, 0, len(in.Partitions)+len(created))
+	for _, parts := range []map[string]*objIndex{in.Partitions, created} {
+		for _, part := range parts {
+			pfi := part.Fields[fn]
+			if f, ok := sorted[pfi]; ok {
+				results = append(results, f)
+				inserted = true
+			} else {
+				results = append(results, pfi.Index)
+			}
+		}
+	}
+
+	if !inserted {
+		return nil
+	}
+
+	return mergeResults(results)
+}
+
+// controlPartitions controls that the partitions hold all the Objects
+// indexed, each in the partition it is assigned to
+func (in *objIndex) controlPartitions() error {
+	if in.Partitions == nil {
+		return nil
+	}
+
+	n := 0
+	for name, part := range in.Partitions {
+		if err := part.control(); err != nil {
+			return fmt.Errorf("partition %s: %s", name, err)
+		}
+
+		for objid, uuid := range part.ObjectIds {
+			if in.partOf[objid] != name || in.ObjectIds[objid] != uuid {
+				return fmt.Errorf("partition %s references object id %d not assigned to it", name, objid)
+			}
+		}
+
+		for fn := range in.Fields {
+			if _, ok := part.Fields[fn]; !ok {
+				return fmt.Errorf("partition %s has no index for field %s", name, fn)
+			}
+		}
+
+		n += part.len()
+	}
+
+	if n != in.len() || len(in.partOf) != in.len() {
+		return fmt.Errorf("index and partitions must have the same size, len(index)=%d len(partitions)=%d", in.len(), n)
+	}
+
+	return nil
+}
+
+// objectFiles returns the paths of the Object files found on disk by UUID,
+// looking into partitions if Objects are partitioned
+func (db *DB) objectFiles(s *Schema, of Object) (files map[string]string, err error) {
+	var entries []fs.DirEntry
+
+	dir := db.oDir(of)
+	files = make(map[string]string)
+
+	if entries, err = db.storage.ReadDir(dir); err != nil {
+		return
+	}
+
+	dirs := []string{dir}
+	for _, entry := range entries {
+		if entry.IsDir() && s.Partition != nil {
+			if _, e := s.Partition.end(entry.Name()); e == nil {
+				dirs = append(dirs, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+
+	for _, d := range dirs {
+		var uuids map[string]bool
+
+		if uuids, err = uuidsFromDir(db.storage, d); err != nil {
+			return
+		}
+
+		for uuid := range uuids {
+			files[uuid] = filepath.Join(d, s.filenameFromUUID(uuid))
+		}
+	}
+
+	return
+}
+
+// partitions returns the sorted names of the partitions found on disk
+func (db *DB) partitions(s *Schema, of Object) (names []string, err error) {
+	var entries []fs.DirEntry
+
+	names = make([]string, 0)
+
+	if entries, err = db.storage.ReadDir(db.oDir(of)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if _, e := s.Partition.end(entry.Name()); e == nil && entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	sort.Strings(names)
+	return
+}
+
+/***** Public Methods ******/
+
+// DropPartition deletes the Objects of the same type as of stored in the
+// partitions whose period ends before the time passed as parameter and
+// removes those partitions. It returns the number of Objects deleted and
+// ErrNotPartitioned if the schema does not partition Objects.
+func (db *DB) DropPartition(of Object, before time.Time) (n int, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+	var names []string
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	if s.Partition == nil {
+		return 0, fmt.Errorf("%s %w", stype(of), ErrNotPartitioned)
+	}
+
+	dropped := func(name string) bool {
+		end, err := s.Partition.end(name)
+		return err == nil && !end.After(before)
+	}
+
+	// objects are found from the index as some might not be written yet
+	uuids := make([]string, 0)
+	for name, part := range s.ObjectIndex.Partitions {
+		if dropped(name) {
+			for _, uuid := range part.ObjectIds {
+				uuids = append(uuids, uuid)
+			}
+		}
+	}
+
+	for _, uuid := range uuids {
+		o := newObject(of)
+		o.Initialize(uuid)
+		if err = db.delete(o); err != nil {
+			return
+		}
+		n++
+	}
+
+	if names, err = db.partitions(s, of); err != nil {
+		return
+	}
+
+	for _, name := range names {
+		if dropped(name) {
+			if err = db.storage.RemoveAll(filepath.Join(db.oDir(of), name)); err != nil {
+				return
+			}
+		}
+	}
+
+	if n > 0 {
+		err = db.commit(of)
+	}
+
+	return
+}
@@ -0,0 +1,76 @@
+package sod
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// cachedQuery holds the results of a search, results are the
+// index entries found (i.e. Object ids) and not the Objects
+type cachedQuery struct {
+	fields         []*IndexedField
+	compositeField string
+}
+
+// queryCache caches search results by query. As any write to the Objects
+// of a type may change the results of any search, the whole cache is
+// invalidated on every write. Searches are evaluated under the DB read
+// lock so the cache has its own lock.
+type queryCache struct {
+	sync.Mutex
+	m map[string]*cachedQuery
+}
+
+func newQueryCache() *queryCache {
+	return &queryCache{m: make(map[string]*cachedQuery)}
+}
+
+// queryKey returns a key identifying a set of ANDed clauses
+func queryKey(clauses []*searchClause) string {
+	parts := make([]string, 0, len(clauses))
+	for _, c := range clauses {
+		// Go syntax representation distinguishes values of different types
+		parts = append(parts, fmt.Sprintf("%q %q %#v", c.field, c.operator, c.value))
+	}
+	return strings.Join(parts, " && ")
+}
+
+func (c *queryCache) get(key string) (q *cachedQuery, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	q, ok = c.m[key]
+	return
+}
+
+// put caches the results of a query, an arbitrary query
+// is evicted if the cache already holds max queries
+func (c *queryCache) put(key string, q *cachedQuery, max int) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.m[key]; !ok && len(c.m) >= max {
+		for k := range c.m {
+			delete(c.m, k)
+			break
+		}
+	}
+
+	// results are copied not to share the index backing array
+	q.fields = append(make([]*IndexedField, 0, len(q.fields)), q.fields...)
+	c.m[key] = q
+}
+
+func (c *queryCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.m) > 0 {
+		c.m = make(map[string]*cachedQuery)
+	}
+}
+
+func (c *queryCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.m)
+}
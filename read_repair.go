@@ -0,0 +1,76 @@
+package sod
+
+import (
+	"errors"
+	"sync"
+)
+
+// readRepairs holds the index repairs found to be needed while reading
+// Objects. Repairs cannot be applied under a read lock so they are queued
+// and applied at the next commit, under the write lock.
+type readRepairs struct {
+	sync.Mutex
+	// Objects to re-index by UUID, a nil Object must be un-indexed
+	m map[string]Object
+}
+
+func newReadRepairs() *readRepairs {
+	return &readRepairs{m: make(map[string]Object)}
+}
+
+func (r *readRepairs) queue(uuid string, o Object) {
+	r.Lock()
+	defer r.Unlock()
+	r.m[uuid] = o
+}
+
+// take returns and clears queued repairs
+func (r *readRepairs) take() (m map[string]Object) {
+	r.Lock()
+	defer r.Unlock()
+	m = r.m
+	r.m = make(map[string]Object)
+	return
+}
+
+// readRepair queues the repair of the index entry of an Object found,
+// or not found, on disk while reading it
+func (db *DB) readRepair(s *Schema, o Object, found bool) {
+	// snapshots have their own index
+	if !s.ReadRepair || db.snapshot != nil {
+		return
+	}
+
+	switch indexed := s.isUUIDIndexed(o.UUID()); {
+	case found && !indexed:
+		s.repairs.queue(o.UUID(), o)
+	case !found && indexed:
+		s.repairs.queue(o.UUID(), nil)
+	}
+}
+
+// applyReadRepairs applies the repairs queued while reading Objects. The
+// DB is checked again as it might have been modified in the meantime.
+func (db *DB) applyReadRepairs(s *Schema, of Object) {
+	if !s.ReadRepair {
+		return
+	}
+
+	for uuid, o := range s.repairs.take() {
+		cur := newObject(of)
+		cur.Initialize(uuid)
+		_, err := db.get(cur)
+
+		switch {
+		case o == nil && errors.Is(err, ErrNoObjectFound) && s.isUUIDIndexed(uuid):
+			s.unindexByUUID(uuid)
+			db.logger.Warnf("%s read repair: object uuid=%s not found on disk, removed from index", stype(of), uuid)
+		case o != nil && err == nil && !s.isUUIDIndexed(uuid):
+			if err = s.index(o); err != nil {
+				db.logger.Errorf("%s read repair: failed to index object uuid=%s: %s", stype(of), uuid, err)
+				continue
+			}
+			db.logger.Warnf("%s read repair: object uuid=%s found on disk, added to index", stype(of), uuid)
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package sod
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const (
+	// suffixes of the directories used while renaming a field
+	renameSuffix    = ".rename"
+	renameOldSuffix = ".rename-old"
+)
+
+var (
+	ErrBadRename = errors.New("bad field rename")
+)
+
+// inField returns true if fpath is field or a field of the structure field
+func inField(fpath, field string) bool {
+	return fpath == field || strings.HasPrefix(fpath, field+".")
+}
+
+// renamedPath returns the path of fpath once the field oldPath is renamed
+// to newPath and false if fpath is not affected by the rename
+func renamedPath(fpath, oldPath, newPath string) (string, bool) {
+	if !inField(fpath, oldPath) {
+		return fpath, false
+	}
+	return newPath + strings.TrimPrefix(fpath, oldPath), true
+}
+
+// jsonFieldKeys returns the JSON keys leading to the field designated by fpath
+// in structure t. Fields of embedded structures are promoted in JSON so
+// embedded structures have no key. Fields unknown to t keep their name.
+func jsonFieldKeys(t reflect.Type, fpath []string) (keys []string) {
+	keys = make([]string, 0, len(fpath))
+
+	for _, name := range fpath {
+		var sf reflect.StructField
+		var ok bool
+
+		for t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		if t != nil && t.Kind() == reflect.Struct {
+			sf, ok = t.FieldByName(name)
+		}
+
+		if !ok {
+			keys = append(keys, name)
+			t = nil
+			continue
+		}
+
+		t = sf.Type
+		tag := strings.Split(sf.Tag.Get("json"), ",")[0]
+
+		switch {
+		case tag != "" && tag != "-":
+			keys = append(keys, tag)
+		case sf.Anonymous && tag == "" && (t.Kind() == reflect.Struct ||
+			t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct):
+			continue
+		default:
+			keys = append(keys, name)
+		}
+	}
+
+	return
+}
+
+// fieldJSONKeys returns the JSON keys of the field fpath of structure t
+// or nil if they are the names of the fields found in fpath
+func fieldJSONKeys(t reflect.Type, fpath string) []string {
+	split := fieldPath(fpath)
+	keys := jsonFieldKeys(t, split)
+
+	if len(keys) == len(split) {
+		for i := range keys {
+			if keys[i] != split[i] {
+				return keys
+			}
+		}
+		return nil
+	}
+
+	return keys
+}
+
+// jsonObject decodes the JSON object data, ok is false if data is not an object
+func jsonObject(data []byte) (m map[string]json.RawMessage, ok bool, err error) {
+	var ute *json.UnmarshalTypeError
+
+	if err = json.Unmarshal(data, &m); err != nil {
+		if errors.As(err, &ute) {
+			err = nil
+		}
+		return
+	}
+
+	// null is decoded as a nil map
+	return m, m != nil, nil
+}
+
+// popJSON removes the value found at keys from the JSON object data
+func popJSON(data []byte, keys []string) (out []byte, value json.RawMessage, ok bool, err error) {
+	var m map[string]json.RawMessage
+	var sub json.RawMessage
+
+	out = data
+
+	if m, ok, err = jsonObject(data); !ok || err != nil {
+		return
+	}
+
+	if sub, ok = m[keys[0]]; !ok {
+		return
+	}
+
+	if len(keys) == 1 {
+		value = sub
+		delete(m, keys[0])
+	} else {
+		if sub, value, ok, err = popJSON(sub, keys[1:]); !ok || err != nil {
+			return
+		}
+		m[keys[0]] = sub
+	}
+
+	out, err = json.Marshal(m)
+	return
+}
+
+// pushJSON sets value at keys in the JSON object data, intermediate
+// objects are created if missing
+func pushJSON(data []byte, keys []string, value json.RawMessage) (out []byte, err error) {
+	var m map[string]json.RawMessage
+	var ok bool
+
+	if m, ok, err = jsonObject(data); err != nil {
+		return
+	} else if !ok {
+		if string(bytes.TrimSpace(data)) != "null" {
+			return nil, fmt.Errorf("%w: %s is not a JSON object", ErrBadRename, keys[0])
+		}
+		m = make(map[string]json.RawMessage)
+	}
+
+	if len(keys) == 1 {
+		m[keys[0]] = value
+	} else {
+		sub, ok := m[keys[0]]
+		if !ok {
+			sub = json.RawMessage("null")
+		}
+		if m[keys[0]], err = pushJSON(sub, keys[1:], value); err != nil {
+			return
+		}
+	}
+
+	return json.Marshal(m)
+}
+
+// moveJSON moves the value found at keys from to keys to in the JSON
+// object data, data is returned unchanged if there is no value to move
+func moveJSON(data []byte, from, to []string) (out []byte, err error) {
+	var value json.RawMessage
+	var ok bool
+
+	if out, value, ok, err = popJSON(data, from); !ok || err != nil {
+		return data, err
+	}
+
+	return pushJSON(out, to, value)
+}
+
+// validateRename checks that oldPath is a field of the schema
+// and that newPath is the same field in the structure of of
+func (s *Schema) validateRename(of Object, oldPath, newPath string) (err error) {
+	var found bool
+
+	if oldPath == newPath || inField(oldPath, newPath) || inField(newPath, oldPath) {
+		return fmt.Errorf("%w: cannot rename %s to %s", ErrBadRename, oldPath, newPath)
+	}
+
+	current := FieldDescriptors(of)
+
+	for fpath := range s.Fields {
+		if inField(fpath, newPath) {
+			return fmt.Errorf("%w: field %s already exists", ErrBadRename, fpath)
+		}
+	}
+
+	for fpath, fd := range s.Fields {
+		npath, ok := renamedPath(fpath, oldPath, newPath)
+		if !ok {
+			continue
+		}
+
+		found = true
+		if cfd, ok := current[npath]; !ok {
+			return fmt.Errorf("%T %w %s", of, ErrUnkownField, npath)
+		} else if !fd.TypeCompatible(&cfd) {
+			return fmt.Errorf("%w %s", ErrFieldDescModif, cfd)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("schema %w %s", ErrUnkownField, oldPath)
+	}
+
+	return
+}
+
+// renameJSONKeys returns the JSON keys of the field oldPath as recorded in
+// the schema, once the field is renamed to newPath in the structure of of.
+// It returns nil if the schema does not record the JSON keys of the field.
+func (s *Schema) renameJSONKeys(of Object, oldPath, newPath string) (keys []string) {
+	var leaf string
+
+	// any field contained in oldPath is fine, the first one is
+	// taken so that keys do not depend on map iteration
+	for fpath := range s.Fields {
+		if inField(fpath, oldPath) && (leaf == "" || fpath < leaf) {
+			leaf = fpath
+		}
+	}
+
+	if keys = s.Fields[leaf].JSONKeys; keys == nil {
+		return
+	}
+
+	// keys of the fields contained in oldPath are dropped, they did not
+	// change as the structure of the field cannot change with a rename
+	npath, _ := renamedPath(leaf, oldPath, newPath)
+	inner := len(jsonFieldKeys(typeof(of), fieldPath(npath))) - len(jsonFieldKeys(typeof(of), fieldPath(newPath)))
+
+	return keys[:len(keys)-inner]
+}
+
+// renameField renames the field oldPath, and the fields it contains if
+// it is a structure, everywhere it is referenced in the schema
+func (s *Schema) renameField(oldPath, newPath string) {
+	rename := func(paths []string) []string {
+		out := make([]string, 0, len(paths))
+		for _, p := range paths {
+			p, _ = renamedPath(p, oldPath, newPath)
+			out = append(out, p)
+		}
+		return out
+	}
+
+	fields := make(FieldDescMap, len(s.Fields))
+	for fpath, fd := range s.Fields {
+		fd.Path, _ = renamedPath(fpath, oldPath, newPath)
+		fields[fd.Path] = fd
+	}
+	s.Fields = fields
+
+	for i, ci := range s.CompositeIndexes {
+		s.CompositeIndexes[i] = rename(ci)
+	}
+	s.LenIndexes = rename(s.LenIndexes)
+	s.KeyIndexes = rename(s.KeyIndexes)
+	s.UpdatedAt, _ = renamedPath(s.UpdatedAt, oldPath, newPath)
+	s.Sequence, _ = renamedPath(s.Sequence, oldPath, newPath)
+	if s.Partition != nil {
+		s.Partition.Field, _ = renamedPath(s.Partition.Field, oldPath, newPath)
+	}
+
+	if s.ObjectIndex == nil {
+		return
+	}
+
+	in := s.ObjectIndex
+	renameFields := func(fields map[string]*fieldIndex) map[string]*fieldIndex {
+		findexes := make(map[string]*fieldIndex, len(fields))
+		for fn, fi := range fields {
+			if npath, ok := renamedPath(fn, oldPath, newPath); ok {
+				fn, fi.Name, fi.nameSplit = npath, npath, fieldPath(npath)
+			}
+			findexes[fn] = fi
+		}
+		return findexes
+	}
+	in.Fields = renameFields(in.Fields)
+
+	for _, part := range in.Partitions {
+		part.Fields = renameFields(part.Fields)
+		part.buildSuffixIndexes()
+	}
+
+	composites := make(map[string]*compositeIndex, len(in.Composites))
+	for _, ci := range in.Composites {
+		ci.Fields = rename(ci.Fields)
+		ci.paths = make([][]string, 0, len(ci.Fields))
+		for _, f := range ci.Fields {
+			ci.paths = append(ci.paths, fieldPath(f))
+		}
+		ci.Index.Name = compositeName(ci.Fields)
+		composites[ci.Index.Name] = ci
+	}
+	in.Composites = composites
+
+	keys := make(map[string]*keyIndex, len(in.Keys))
+	for fn, ki := range in.Keys {
+		fn, _ = renamedPath(fn, oldPath, newPath)
+		keys[fn] = ki
+	}
+	in.Keys = keys
+
+	in.buildSuffixIndexes()
+}
+
+// diskSchema returns the schema stored on disk for of. It is neither
+// initialized nor controlled so it is returned even if structure changed.
+func (db *DB) diskSchema(of Object) (s *Schema, err error) {
+	if err = db.dirs.load(db.storage, db.root); err != nil {
+		return
+	}
+
+	if s, _, err = db.readSchema(db.oDir(of)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = &sentinelErr{ErrSchemaNotCreated, fmt.Sprintf("%s %s", stype(of), ErrSchemaNotCreated), err}
+		}
+	}
+
+	return
+}
+
+func (db *DB) copyFile(src, dst string) (err error) {
+	var data []byte
+
+	if data, err = db.storage.ReadFile(src); err != nil {
+		return
+	}
+
+	return db.storage.WriteFile(dst, data, DefaultPermissions)
+}
+
+// copyDir copies recursively the directory src to dst using copyFile
+func (db *DB) copyDir(src, dst string, copyFile func(src, dst string) error) (err error) {
+	var entries []fs.DirEntry
+
+	if entries, err = db.storage.ReadDir(src); err != nil {
+		return
+	}
+
+	if err = db.storage.MkdirAll(dst, DefaultPermissions); err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		s, d := filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())
+		if entry.IsDir() {
+			err = db.copyDir(s, d, copyFile)
+		} else {
+			err = copyFile(s, d)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// swapDir replaces dir with tmp. The swap is atomic if the storage
+// implements Renamer, otherwise files of tmp are copied over the ones
+// of dir, which is only safe as long as no file has to be deleted.
+func (db *DB) swapDir(dir, tmp string) (err error) {
+	if r, ok := renamer(db.storage); ok {
+		old := dir + renameOldSuffix
+
+		if err = db.storage.RemoveAll(old); err != nil {
+			return
+		}
+
+		if err = r.Rename(dir, old); err != nil {
+			return
+		}
+
+		if err = r.Rename(tmp, dir); err != nil {
+			// original directory is restored
+			if e := r.Rename(old, dir); e != nil {
+				db.logger.Errorf("failed to restore %s from %s: %s", dir, old, e)
+			}
+			return
+		}
+
+		return db.storage.RemoveAll(old)
+	}
+
+	if err = db.copyDir(tmp, dir, db.copyFile); err != nil {
+		return
+	}
+
+	return db.storage.RemoveAll(tmp)
+}
+
+func (db *DB) renameField(of Object, oldPath, newPath string) (err error) {
+	var s *Schema
+	var data []byte
+
+	// pending writes are done with the schema in memory
+	if _, ok := db.schemas[stype(of)]; ok {
+		if err = db.flushAllAndCommit(of); err != nil {
+			return
+		}
+	}
+
+	if s, err = db.diskSchema(of); err != nil {
+		return
+	}
+
+	if err = s.validateRename(of, oldPath, newPath); err != nil {
+		return
+	}
+
+	oldSplit, newSplit := fieldPath(oldPath), fieldPath(newPath)
+	common := 0
+	for common < len(oldSplit)-1 && common < len(newSplit)-1 && oldSplit[common] == newSplit[common] {
+		common++
+	}
+
+	to := jsonFieldKeys(typeof(of), newSplit)
+	from := s.renameJSONKeys(of, oldPath, newPath)
+	if from == nil {
+		// schema does not know JSON keys, those of the old
+		// field are assumed to be its field names
+		from = append(jsonFieldKeys(typeof(of), oldSplit[:common]), oldSplit[common:]...)
+	}
+
+	dir := db.oDir(of)
+	tmp := dir + renameSuffix
+
+	// staging directory might be left by a failed rename
+	if err = db.storage.RemoveAll(tmp); err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			db.storage.RemoveAll(tmp)
+		}
+	}()
+
+	// Objects, and their previous versions, are rewritten in a staging directory
+	err = db.copyDir(dir, tmp, func(src, dst string) (err error) {
+		var raw []byte
+
+		name := strings.TrimSuffix(filepath.Base(src), compressedExtension)
+		if name == SchemaFilename || !strings.HasSuffix(name, s.Extension) {
+			return db.copyFile(src, dst)
+		}
+
+		if raw, err = readJsonFile(db.storage, src); err != nil {
+			return
+		}
+
+		if raw, err = moveJSON(raw, from, to); err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+
+		compressed := strings.HasSuffix(dst, compressedExtension)
+		return writeReader(db.storage, strings.TrimSuffix(dst, compressedExtension), bytes.NewReader(raw), DefaultPermissions, compressed)
+	})
+
+	if err != nil {
+		return
+	}
+
+	s.renameField(oldPath, newPath)
+
+	// JSON keys of renamed fields are the ones of the structure
+	for fpath, fd := range s.Fields {
+		if inField(fpath, newPath) {
+			fd.JSONKeys = fieldJSONKeys(typeof(of), fpath)
+			s.Fields[fpath] = fd
+		}
+	}
+
+	if data, err = json.Marshal(s); err != nil {
+		return
+	}
+
+	// schema file copied is overwritten as compression cannot change
+	if err = writeReader(db.storage, filepath.Join(tmp, SchemaFilename), bytes.NewReader(data), DefaultPermissions, s.CompressSchema); err != nil {
+		return
+	}
+
+	if err = db.swapDir(dir, tmp); err != nil {
+		return
+	}
+
+	// schema and Objects are loaded again from disk
+	delete(db.schemas, stype(of))
+	db.cache.drop(of)
+
+	return
+}
+
+/***** Public Methods ******/
+
+// RenameField renames the field oldPath of the Objects of the type of of
+// to newPath, once the field has been renamed in the structure. The key of
+// the field is renamed in the Object files and the field is renamed in
+// the schema, so that the schema matches the structure again. The old key
+// is the one recorded in the schema (see FieldDescriptor.JSONKeys). Object files
+// are rewritten in a staging directory swapped with the Object directory
+// at the end, atomically if the storage implements Renamer. A structure
+// field can be renamed, in which case all its fields are renamed.
+func (db *DB) RenameField(of Object, oldPath, newPath string) (err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.renameField(of, oldPath, newPath)
+}
@@ -0,0 +1,141 @@
+package sod
+
+const (
+	replaceSuffix = ".replace"
+	// number of Objects inserted at once in the staging directory
+	replaceChunkSize = 1000
+)
+
+// stagingSchema returns a copy of s without any Object indexed
+func stagingSchema(s *Schema) (staging Schema) {
+	staging = *s
+	staging.db, staging.object = nil, nil
+	staging.repairs, staging.queries = nil, nil
+	staging.ObjectIndex = nil
+	staging.derived = s.ObjectIndex.derivations()
+	staging.partials = s.ObjectIndex.predicates()
+	staging.Fields = make(FieldDescMap, len(s.Fields))
+	for fpath, fd := range s.Fields {
+		staging.Fields[fpath] = fd
+	}
+	if s.Partition != nil {
+		p := *s.Partition
+		staging.Partition = &p
+	}
+	return
+}
+
+// stage inserts objects in a DB rooted at root with schema s and
+// returns the directory the Objects have been written to
+func (db *DB) stage(root string, of Object, s Schema, objects chan Object) (dir string, err error) {
+	sdb := OpenWithStorage(root, db.storage)
+	sdb.logger = db.logger
+
+	defer func() {
+		if e := sdb.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if err = sdb.Create(of, s); err != nil {
+		return
+	}
+
+	if _, err = sdb.InsertOrUpdateBulk(objects, replaceChunkSize); err != nil {
+		return
+	}
+
+	return sdb.oDir(of), nil
+}
+
+// replace swaps the Object directory of of with dir
+func (db *DB) replace(of Object, dir string) (err error) {
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	// Objects waiting to be written must not be written after the swap
+	if s.mustCache() {
+		if err = db.flushAll(of); err != nil {
+			return
+		}
+	}
+
+	// opened snapshots keep seeing replaced Objects
+	if len(db.snapshots[stype(of)]) > 0 {
+		for uuid := range s.ObjectIndex.uuids {
+			o := newObject(of)
+			o.Initialize(uuid)
+			db.preserve(o)
+		}
+	}
+
+	// files of replaced Objects must not be left over
+	if _, ok := renamer(db.storage); !ok {
+		if err = db.storage.RemoveAll(db.oDir(of)); err != nil {
+			return
+		}
+	}
+
+	if err = db.swapDir(db.oDir(of), dir); err != nil {
+		return
+	}
+
+	// schema and Objects are loaded again from disk
+	_, err = db.reloadSchema(of)
+
+	return
+}
+
+/***** Public Methods ******/
+
+// ReplaceAll replaces all the Objects of the same type as of by the ones
+// received from objects. The new collection and its index are built, with
+// the schema in use, in a staging directory swapped with the Object
+// directory once objects is closed. DB lock is only held during the swap,
+// so readers see either all the Objects replaced or all the new ones but
+// never a collection partially rebuilt. The swap survives a crash only if
+// the storage implements Renamer. If an error occurs, e.g. a constraint is
+// not satisfied, the Objects are not replaced. Previous versions of the
+// replaced Objects (see Schema.KeepHistory) are not kept.
+func (db *DB) ReplaceAll(of Object, objects chan Object) (err error) {
+	var s *Schema
+	var staging Schema
+	var root, dir string
+
+	if db.snapshot != nil {
+		return ErrSnapshotReadOnly
+	}
+
+	db.RLock()
+	if s, err = db.schema(of); err == nil {
+		staging = stagingSchema(s)
+		root = db.oDir(of) + replaceSuffix
+		// staging index needs the functions of derived and partial indexes
+		if err = s.ObjectIndex.controlDerivations(); err == nil {
+			err = s.ObjectIndex.controlPredicates()
+		}
+	}
+	db.RUnlock()
+
+	if err != nil {
+		return
+	}
+
+	// staging directory might be left by a failed replace
+	if err = db.storage.RemoveAll(root); err != nil {
+		return
+	}
+	defer db.storage.RemoveAll(root)
+
+	if dir, err = db.stage(root, of, staging, objects); err != nil {
+		return
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	return db.replace(of, dir)
+}
@@ -0,0 +1,67 @@
+package sod
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	ErrReflection = errors.New("reflection error")
+)
+
+// isReflectPanic returns true if r, a value recovered from a panic, has been
+// raised by the reflect package and not by a documented check
+func isReflectPanic(r interface{}) bool {
+	switch v := r.(type) {
+	case *reflect.ValueError:
+		return true
+	case string:
+		return strings.HasPrefix(v, "reflect")
+	}
+	return false
+}
+
+// safeReflectEnabled returns true if reflection panics must be returned
+// as errors, see SetSafeReflect
+func (db *DB) safeReflectEnabled() bool {
+	return atomic.LoadInt32(&db.safeReflect) == 1
+}
+
+// recoverReflect converts a reflection panic into an ErrReflection assigned
+// to err if safe reflection is enabled (see SetSafeReflect). Deferred by a
+// public method, it must be deferred before any lock is taken so that locks
+// are released first.
+func (db *DB) recoverReflect(err *error) {
+	if !db.safeReflectEnabled() {
+		return
+	}
+
+	if r := recover(); r != nil {
+		if !isReflectPanic(r) {
+			panic(r)
+		}
+		*err = fmt.Errorf("%w: %v", ErrReflection, r)
+	}
+}
+
+/***** Public Methods ******/
+
+// SetSafeReflect makes, if enabled, the reflection heavy methods of the DB
+// (assignments, searches, GroupBy, GetFields ...) return an error wrapping
+// ErrReflection instead of panicking when reflection fails, i.e. on a
+// target slice whose elements cannot hold the values assigned. It prevents
+// a single bad query built from dynamic input from crashing the process.
+// Documented programmer errors, like a target not being a pointer, still
+// panic. Snapshots inherit the option at the time they are taken.
+func (db *DB) SetSafeReflect(enabled bool) {
+	var v int32
+
+	if enabled {
+		v = 1
+	}
+
+	atomic.StoreInt32(&db.safeReflect, v)
+}
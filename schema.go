@@ -4,13 +4,23 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"io/fs"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 )
 
 const (
 	SchemaFilename = "schema.json"
+	// SchemaBackupFilename is the schema file saved before the current one,
+	// it is loaded if the schema file is missing or cannot be decoded
+	SchemaBackupFilename = SchemaFilename + ".bak"
+	// schemaNewFilename is the schema file being saved before it is promoted
+	schemaNewFilename = SchemaFilename + ".new"
+	// DirNamesFilename is the file, at the root of the DB, storing the
+	// directory names of object types having a custom one
+	DirNamesFilename = "dirnames.json"
 )
 
 var (
@@ -19,7 +29,14 @@ var (
 	ErrMissingObjIndex   = errors.New("schema is missing object index")
 	ErrStructureChanged  = errors.New("object structure changed")
 	ErrExtensionMismatch = errors.New("extension mismatch")
+	ErrCompressMismatch  = errors.New("compression mismatch")
 	ErrUnindexedField    = errors.New("field is not indexed")
+	ErrTargetsMismatch   = errors.New("one target per field is expected")
+	ErrSchemaNotCreated  = errors.New("schema not created")
+	ErrBadDirName        = errors.New("bad directory name")
+	ErrDirNameCollision  = errors.New("directory name already used")
+	ErrBadUpdatedAt      = errors.New("bad updated at field")
+	ErrUpdatesNotTracked = errors.New("updates are not tracked")
 
 	DefaultExtension   = ".json"
 	DefaultCompression = false
@@ -37,6 +54,10 @@ func IsIndexCorrupted(err error) bool {
 	return errors.Is(err, ErrIndexCorrupted)
 }
 
+func IsSchemaNotCreated(err error) bool {
+	return errors.Is(err, ErrSchemaNotCreated)
+}
+
 type jsonAsync struct {
 	Enable    bool   `json:"enable"`
 	Threshold int    `json:"threshold"`
@@ -44,10 +65,9 @@ type jsonAsync struct {
 }
 
 type Async struct {
-	routineStarted bool
-	Enable         bool
-	Threshold      int
-	Timeout        time.Duration
+	Enable    bool
+	Threshold int
+	Timeout   time.Duration
 }
 
 func (a *Async) MarshalJSON() ([]byte, error) {
@@ -77,13 +97,145 @@ type Schema struct {
 	db           *DB
 	object       Object
 	transformers []FieldDescriptor
+	repairs      *readRepairs
+	queries      *queryCache
+	// predicates of partial indexes by field
+	partials map[string]func(o Object) bool
+	// functions computing the values of derived indexes by field
+	derived map[string]func(o Object) interface{}
+	// function validating the JSON encoding of Objects
+	jsonValidator func(data []byte) error
+	// top level fields of the schema file unknown to this version
+	unknown map[string]json.RawMessage
+	// Object files deleted since the schema was last saved
+	deleted bool
 
 	Fields      FieldDescMap `json:"fields"`
 	Extension   string       `json:"extension"`
 	Compress    bool         `json:"compress"`
 	Cache       bool         `json:"cache"`
 	AsyncWrites *Async       `json:"async-writes,omitempty"`
-	ObjectIndex *objIndex    `json:"index"`
+	// WriteBehind keeps all the Objects in cache and writes them to disk
+	// only on DB.Sync or DB.Close. Contrary to AsyncWrites, Objects are
+	// never written in the background. Objects are however deleted from
+	// disk at once, in which case all the Objects not written yet are
+	// written on commit, so that the index saved matches the disk.
+	WriteBehind bool `json:"write-behind,omitempty"`
+	// PreserveUnknownFields keeps, when an Object is written, the top level
+	// fields found in the Object file but unknown to the Object structure
+	// (i.e. fields written by a newer version of the structure)
+	PreserveUnknownFields bool       `json:"preserve-unknown-fields,omitempty"`
+	CompositeIndexes      [][]string `json:"composite-indexes,omitempty"`
+	LenIndexes            []string   `json:"len-indexes,omitempty"`
+	// KeyIndexes are the map fields whose keys are indexed, see KeyIndex
+	KeyIndexes []string `json:"key-indexes,omitempty"`
+	DirName    string   `json:"dir-name,omitempty"`
+	// KeepHistory is the number of previous versions kept for every
+	// Object, previous versions are not kept if zero (see DB.History).
+	// History of deleted Objects is kept, the deleted version included.
+	KeepHistory int `json:"keep-history,omitempty"`
+	// CompressSchema gzips the schema file, the index included
+	CompressSchema bool `json:"compress-schema,omitempty"`
+	// ReadRepair fixes the index when Objects read are found missing
+	// from disk or not indexed. Repairs are applied at the next commit.
+	ReadRepair bool `json:"read-repair,omitempty"`
+	// UpdatedAt is the path of an indexed time.Time field set to the
+	// current time every time an Object is inserted or updated
+	UpdatedAt string `json:"updated-at,omitempty"`
+	// Sequence is the path of an indexed uint64 field set, when an Object
+	// is first inserted, to a number incremented at every insertion. As
+	// it is stored in Object files, it survives a repair of the index.
+	Sequence     string `json:"sequence,omitempty"`
+	LastSequence uint64 `json:"last-sequence,omitempty"`
+	// QueryCache is the maximum number of searches whose results are
+	// cached, searches are not cached if zero. Cached results are
+	// invalidated on any write to the Objects of the type, so a search
+	// never returns results older than the last write.
+	QueryCache int `json:"query-cache,omitempty"`
+	// Partition stores Objects in sub-directories by time period
+	Partition *Partition `json:"partition,omitempty"`
+	// TimeFormat is the format of the time.Time fields in Object files,
+	// either a time layout (i.e. time.RFC3339) or one of TimeUnixMilli
+	// and TimeUnixNano. Times are stored as RFC3339 with nanoseconds if
+	// empty. Values are truncated to the precision of the format when
+	// Objects are written, indexes always use nanoseconds.
+	TimeFormat string `json:"time-format,omitempty"`
+	// ContentAddressed derives the UUID of Objects from their content, the
+	// SHA-256 of their JSON encoding, every time they are inserted or
+	// updated. Inserting an Object identical to an existing one updates
+	// the existing one, so insertions are idempotent. Modifying a field of
+	// an Object changes its UUID, the modified Object is a new Object and
+	// the previous one is kept, which suits immutable Objects (i.e. a
+	// content store). It cannot be used with UpdatedAt or Sequence.
+	ContentAddressed bool      `json:"content-addressed,omitempty"`
+	ObjectIndex      *objIndex `json:"index"`
+}
+
+// rawSchema has the fields of Schema but not its JSON methods
+type rawSchema Schema
+
+// schemaFields returns the names of the top level fields of a schema file
+func schemaFields() map[string]bool {
+	t := reflect.TypeOf(Schema{})
+	names := make(map[string]bool, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+
+	return names
+}
+
+// MarshalJSON encodes the schema with the fields unknown to this version
+// found when it was decoded, so that they are not lost for the versions
+// knowing them when the schema is saved
+func (s *Schema) MarshalJSON() (data []byte, err error) {
+	var m map[string]json.RawMessage
+
+	if data, err = json.Marshal((*rawSchema)(s)); err != nil || len(s.unknown) == 0 {
+		return
+	}
+
+	if err = json.Unmarshal(data, &m); err != nil {
+		return
+	}
+
+	for name, raw := range s.unknown {
+		if _, ok := m[name]; !ok {
+			m[name] = raw
+		}
+	}
+
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON decodes the schema and keeps the fields unknown
+// to this version, written by a newer version of sod
+func (s *Schema) UnmarshalJSON(data []byte) (err error) {
+	var m map[string]json.RawMessage
+
+	if err = json.Unmarshal(data, (*rawSchema)(s)); err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(data, &m); err != nil {
+		return
+	}
+
+	s.unknown = nil
+	known := schemaFields()
+	for name, raw := range m {
+		if !known[name] {
+			if s.unknown == nil {
+				s.unknown = make(map[string]json.RawMessage)
+			}
+			s.unknown[name] = raw
+		}
+	}
+
+	return
 }
 
 func NewCustomSchema(fields FieldDescMap, ext string) (s Schema) {
@@ -104,17 +256,75 @@ func (s *Schema) Asynchrone(threshold int, timeout time.Duration) {
 		Timeout:   timeout}
 }
 
+// CompositeIndex declares an index on a tuple of fields. Searches ANDing
+// equality conditions on all the fields but the last one and any comparison
+// on the last field are answered with a single range lookup in the composite
+// index. Fields order matters, so CompositeIndex("Country", "Age") speeds up
+// searches like Country="us" AND Age>40.
+func (s *Schema) CompositeIndex(fields ...string) {
+	for _, ci := range s.CompositeIndexes {
+		if compositeName(ci) == compositeName(fields) {
+			return
+		}
+	}
+	s.CompositeIndexes = append(s.CompositeIndexes, fields)
+}
+
+// IndexLen declares an index on the length of slice, array, map or string
+// fields. The length of a field is searchable as the virtual int field
+// LenPath(field), i.e. Search(o, "Tags.len", ">", 3).
+func (s *Schema) IndexLen(fields ...string) {
+next:
+	for _, f := range fields {
+		for _, li := range s.LenIndexes {
+			if li == f {
+				continue next
+			}
+		}
+		s.LenIndexes = append(s.LenIndexes, f)
+	}
+}
+
 // Indexed returns the FieldDescriptors of indexed fields
 func (s *Schema) Indexed() (desc []FieldDescriptor) {
 	desc = make([]FieldDescriptor, 0)
 
-	for fpath := range s.ObjectIndex.Fields {
+	for fpath, fi := range s.ObjectIndex.Fields {
+		if isLenPath(fi.nameSplit) {
+			desc = append(desc, lenDescriptor(fpath))
+			continue
+		}
+		if fi.Derived {
+			desc = append(desc, FieldDescriptor{Path: fpath, Type: fi.Cast, Constraints: fi.Constraints})
+			continue
+		}
 		desc = append(desc, s.Fields[fpath])
 	}
 
 	return
 }
 
+// QueryIndex runs operator against the index of field and returns the
+// matching IndexedFields, ordered as in the index. If constrain is not nil,
+// only the IndexedFields whose ObjectIds are in constrain are searched.
+// This is a low level API meant to build custom query layers, unlike
+// DB.Search it does not lock the DB, so the caller must hold the DB read
+// lock (see DB.RLock) while querying and using the results. Searching a
+// field not indexed returns ErrFieldNotIndexed.
+func (s *Schema) QueryIndex(field, operator string, value interface{}, constrain []*IndexedField) ([]*IndexedField, error) {
+	// transform search value before searching
+	s.prepare(field, &value)
+
+	return s.ObjectIndex.search(s.object, field, operator, value, constrain)
+}
+
+// ObjectUUID returns the UUID of the Object identified by an ObjectId
+// found in an IndexedField. The caller must hold the DB read lock.
+func (s *Schema) ObjectUUID(objid uint64) (uuid string, ok bool) {
+	uuid, ok = s.ObjectIndex.ObjectIds[objid]
+	return
+}
+
 func (s *Schema) initialize(db *DB, o Object) (err error) {
 	// initialize db using this schema
 	s.db = db
@@ -125,16 +335,29 @@ func (s *Schema) initialize(db *DB, o Object) (err error) {
 	// initialize fields
 	if s.Fields == nil {
 		s.Fields = FieldDescriptors(o)
+	} else {
+		// harmless type changes are recorded
+		s.Fields.updateTypes(FieldDescriptors(o))
 	}
 
 	// initializes the list of tranformers
 	s.transformers = s.Fields.Transformers()
 
+	if s.repairs == nil {
+		s.repairs = newReadRepairs()
+	}
+
+	if s.queries == nil {
+		s.queries = newQueryCache()
+	}
+
 	// initializes ObjectsIndex if needed
 	if s.ObjectIndex == nil {
 		s.ObjectIndex = newIndex(s.Fields)
 	}
 
+	s.ObjectIndex.partitionBy(s.Partition)
+
 	return
 }
 
@@ -148,34 +371,93 @@ func (s *Schema) prepare(fpath string, value interface{}) {
 	}
 }
 
-// transform applies transform constraints defined in Schema
+// transform applies transform constraints defined in Schema, sets
+// the time Objects are updated at and their sequence number
 func (s *Schema) transform(o Object) {
 	// transform Object
 	for _, t := range s.transformers {
 		t.Transform(o)
 	}
+
+	if s.UpdatedAt != "" {
+		if v, ok := valueFieldByName(reflect.ValueOf(o), fieldPath(s.UpdatedAt)); ok && v.CanSet() && v.Type() == timeType {
+			v.Set(reflect.ValueOf(time.Now().UTC()))
+		}
+	}
+
+	if s.Sequence != "" {
+		s.sequence(o)
+	}
+
+	s.truncateTimes(o)
+
+	// UUID must be derived from the content written
+	if s.ContentAddressed {
+		s.contentAddress(o)
+	}
+}
+
+// controlUpdatedAt checks the field tracking updates
+// is an indexed time.Time field
+func (s *Schema) controlUpdatedAt() error {
+	if s.UpdatedAt == "" {
+		return nil
+	}
+
+	if fd, ok := s.Fields.GetDescriptor(s.UpdatedAt); !ok {
+		return fmt.Errorf("%w: unknown field %s", ErrBadUpdatedAt, s.UpdatedAt)
+	} else if fd.Type != "time.Time" || !fd.Constraints.Index {
+		return fmt.Errorf("%w: %s must be an indexed time.Time field", ErrBadUpdatedAt, s.UpdatedAt)
+	}
+
+	return nil
 }
 
 func (s *Schema) makeTmpIndex() *objIndex {
-	return newIndex(s.Fields)
+	in := newIndex(s.Fields)
+	in.copyDerived(s.ObjectIndex)
+	in.copyPartials(s.ObjectIndex)
+	return in
 }
 
 // index indexes an Object
 func (s *Schema) index(o Object) error {
+	s.queries.invalidate()
 	return s.ObjectIndex.insertOrUpdate(o)
 }
 
+// bulkLoad indexes Objects not indexed yet in a single pass
+func (s *Schema) bulkLoad(objects []Object) error {
+	s.queries.invalidate()
+	return s.ObjectIndex.bulkInsert(objects)
+}
+
+// allNew returns true if none of the Objects is indexed
+// and if they all have a different UUID
+func (s *Schema) allNew(objects []Object) bool {
+	seen := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		if seen[o.UUID()] || s.isUUIDIndexed(o.UUID()) {
+			return false
+		}
+		seen[o.UUID()] = true
+	}
+	return true
+}
+
 func (s *Schema) isUUIDIndexed(uuid string) bool {
 	_, ok := s.ObjectIndex.uuids[uuid]
 	return ok
 }
 
 func (s *Schema) unindexByUUID(uuid string) {
+	s.queries.invalidate()
 	s.ObjectIndex.deleteByUUID(uuid)
 }
 
 // Index un-indexes an Object
 func (s *Schema) unindex(o Object) {
+	s.queries.invalidate()
 	s.ObjectIndex.deleteByUUID(o.UUID())
 }
 
@@ -196,6 +478,16 @@ func (s *Schema) isCompatibleWith(other *Schema) (err error) {
 		return ErrExtensionMismatch
 	}
 
+	// existing files are not compressed or decompressed
+	if s.Compress != other.Compress {
+		return fmt.Errorf("%w: objects are stored with compress=%t", ErrCompressMismatch, s.Compress)
+	}
+
+	// existing files are not converted to another time format
+	if s.TimeFormat != other.TimeFormat {
+		return fmt.Errorf("%w: objects are stored with time format %q", ErrTimeFormatMismatch, s.TimeFormat)
+	}
+
 	// check if FieldDescriptors are compatible
 	if err = s.Fields.CompatibleWith(other.Fields); err != nil {
 		return
@@ -210,14 +502,35 @@ func (s *Schema) update(from *Schema) (err error) {
 		return
 	}
 
+	// objects are not moved to another directory
+	if from.DirName != "" && from.DirName != s.DirName {
+		return fmt.Errorf("%w: cannot change %q to %q", ErrBadDirName, s.DirName, from.DirName)
+	}
+
+	// objects are not moved to other partitions
+	if from.Partition != nil && !from.Partition.equal(s.Partition) {
+		return fmt.Errorf("%w: partitioning cannot be changed", ErrBadPartition)
+	}
+
 	s.Cache = from.Cache
 	s.AsyncWrites = from.AsyncWrites
+	s.WriteBehind = from.WriteBehind
+	s.PreserveUnknownFields = from.PreserveUnknownFields
+	s.UpdatedAt = from.UpdatedAt
+	s.Sequence = from.Sequence
+	s.ReadRepair = from.ReadRepair
+	s.CompressSchema = from.CompressSchema
+	s.KeepHistory = from.KeepHistory
+	s.QueryCache = from.QueryCache
+	s.ContentAddressed = from.ContentAddressed
+	s.jsonValidator = from.jsonValidator
+	s.queries.invalidate()
 
 	return
 }
 
 func (s *Schema) mustCache() bool {
-	return s.Cache || s.asyncWritesEnabled()
+	return s.Cache || s.asyncWritesEnabled() || s.WriteBehind
 }
 
 func (s *Schema) asyncWritesEnabled() bool {
@@ -227,15 +540,61 @@ func (s *Schema) asyncWritesEnabled() bool {
 	return false
 }
 
+// deferWrites returns true if Objects are not written to disk on insertion
+func (s *Schema) deferWrites() bool {
+	return s.asyncWritesEnabled() || s.WriteBehind
+}
+
 func (s *Schema) assignIndex(of Object, field string, target interface{}) (err error) {
 	var fi *fieldIndex
 	var ok bool
 
-	if fi, ok = s.ObjectIndex.Fields[field]; !ok {
+	if fi, ok = s.ObjectIndex.field(field); !ok {
 		return fmt.Errorf("%s %w", field, ErrUnindexedField)
 	}
 
-	index := fi.Index
+	assignIndexedFields(fi.Index, target)
+	return
+}
+
+// assignIndexes assigns the values of several indexed fields to targets.
+// Values are ordered by ObjectId so that targets are aligned.
+func (s *Schema) assignIndexes(of Object, fields []string, targets ...interface{}) (err error) {
+	if len(fields) != len(targets) {
+		return fmt.Errorf("%w: %d fields for %d targets", ErrTargetsMismatch, len(fields), len(targets))
+	}
+
+	indexes := make([]*fieldIndex, 0, len(fields))
+	for _, field := range fields {
+		if fi, ok := s.ObjectIndex.field(field); !ok {
+			return fmt.Errorf("%s %w", field, ErrUnindexedField)
+		} else if fi.Partial {
+			return fmt.Errorf("%w: %s values are not indexed for all Objects", ErrBadPartialIndex, field)
+		} else {
+			indexes = append(indexes, fi)
+		}
+	}
+
+	ids := make([]uint64, 0, len(s.ObjectIndex.ObjectIds))
+	for id := range s.ObjectIndex.ObjectIds {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for k, fi := range indexes {
+		column := make([]*IndexedField, 0, len(ids))
+		for _, id := range ids {
+			column = append(column, fi.objectIds[id])
+		}
+		assignIndexedFields(column, targets[k])
+	}
+
+	return
+}
+
+// assignIndexedFields assigns the values of indexed fields to
+// target, it panics if target is not a slice pointer
+func assignIndexedFields(index []*IndexedField, target interface{}) {
 	vTarget := reflect.ValueOf(target)
 	if vTarget.Kind() == reflect.Ptr && !vTarget.IsZero() {
 		vTarget = vTarget.Elem()
@@ -255,7 +614,7 @@ func (s *Schema) assignIndex(of Object, field string, target interface{}) (err e
 				continue
 			case ov.CanInt():
 				if t.Elem().Elem().AssignableTo(timeType) {
-					// time is currently encoded as int64 from UnixNano
+					// time is currently encoded as int64 from UnixNano
 					vTarget.Index(i).Set(reflect.ValueOf(time.Unix(0, ov.Int())))
 				} else {
 					vTarget.Index(i).SetInt(ov.Int())
@@ -275,10 +634,29 @@ panic:
 	panic("target must be a slice pointer")
 }
 
-func (s *Schema) control() (err error) {
-	var uuids map[string]bool
+// checkObject checks that o is described by the schema, o might be of
+// another type having the same name as the type the schema was created for
+func (s *Schema) checkObject(o Object) (err error) {
+	if typeof(o) == typeof(s.object) {
+		return
+	}
+
+	fields := FieldDescriptors(o)
+	if len(fields) != len(s.Fields) {
+		return fmt.Errorf("%T %w: fields do not match schema", o, ErrStructureChanged)
+	}
+
+	for fpath, fd := range s.Fields {
+		if ofd, ok := fields[fpath]; !ok || !fd.FieldEqual(&ofd) {
+			return fmt.Errorf("%T %w: field %s does not match schema", o, ErrStructureChanged, fpath)
+		}
+	}
+
+	return
+}
 
-	dir := s.db.oDir(s.object)
+func (s *Schema) control() (err error) {
+	var onlyInIndex, onlyOnDisk []string
 
 	// control that object structure did not change
 	if err := s.Fields.FieldsCompatibleWith(FieldDescriptors(s.object)); err != nil {
@@ -292,25 +670,107 @@ func (s *Schema) control() (err error) {
 
 	// verifying index integrity (longer process so done at last)
 	// we control any index corruption
-	if uuids, err = uuidsFromDir(dir); err != nil && !os.IsNotExist(err) {
+	if onlyInIndex, onlyOnDisk, err = s.drift(); err != nil {
+		return
+	}
+
+	// if file is on disk but not indexed
+	if len(onlyOnDisk) > 0 {
+		return fmt.Errorf("%s %w: schema index is missing entry", typeof(s.object), ErrIndexCorrupted)
+	}
+
+	// if file is indexed but not on disk
+	if len(onlyInIndex) > 0 {
+		return fmt.Errorf("%s %w: object deleted but still indexed", typeof(s.object), ErrIndexCorrupted)
+	}
+
+	return
+}
+
+// controlIndex controls that an index (i.e. imported) has the indexed fields,
+// with the same constraints, and the composite indexes of the schema and that
+// it is consistent with the Objects on disk
+func (s *Schema) controlIndex(in *objIndex) (err error) {
+	var onlyInIndex, onlyOnDisk []string
+
+	for fn, fi := range newIndex(s.Fields).Fields {
+		if ifi, ok := in.Fields[fn]; !ok || ifi.Cast != fi.Cast {
+			return fmt.Errorf("%s %w: field %s index missing or of wrong type", typeof(s.object), ErrIndexCorrupted, fn)
+		} else if !reflect.DeepEqual(ifi.Constraints, fi.Constraints) {
+			return fmt.Errorf("%s %w: field %s index constraints modified", typeof(s.object), ErrIndexCorrupted, fn)
+		} else if cfi, ok := s.ObjectIndex.Fields[fn]; ok && cfi.Partial != ifi.Partial {
+			return fmt.Errorf("%s %w: field %s index partial or not as expected", typeof(s.object), ErrIndexCorrupted, fn)
+		}
+	}
+
+	for fn, fi := range s.ObjectIndex.Fields {
+		if ifi, ok := in.Fields[fn]; fi.Derived && (!ok || !ifi.Derived || ifi.Cast != fi.Cast || !reflect.DeepEqual(ifi.Constraints, fi.Constraints)) {
+			return fmt.Errorf("%s %w: derived index %s missing or of wrong type", typeof(s.object), ErrIndexCorrupted, fn)
+		}
+	}
+
+	if len(in.Fields) != len(s.ObjectIndex.Fields) {
+		return fmt.Errorf("%s %w: unexpected field index", typeof(s.object), ErrIndexCorrupted)
+	}
+
+	for cn := range s.ObjectIndex.Composites {
+		if _, ok := in.Composites[cn]; !ok {
+			return fmt.Errorf("%s %w: composite index %s missing", typeof(s.object), ErrIndexCorrupted, cn)
+		}
+	}
+
+	if len(in.Composites) != len(s.ObjectIndex.Composites) {
+		return fmt.Errorf("%s %w: unexpected composite index", typeof(s.object), ErrIndexCorrupted)
+	}
+
+	if err = in.control(); err != nil {
+		return fmt.Errorf("%s %w: %s", typeof(s.object), ErrIndexCorrupted, err)
+	}
+
+	// index must reference exactly the objects on disk
+	tmp := *s
+	tmp.ObjectIndex = in
+	if onlyInIndex, onlyOnDisk, err = tmp.drift(); err != nil {
 		return
 	}
 
+	if len(onlyInIndex) > 0 || len(onlyOnDisk) > 0 {
+		return fmt.Errorf("%s %w: index does not match objects on disk, %d only in index, %d only on disk",
+			typeof(s.object), ErrIndexCorrupted, len(onlyInIndex), len(onlyOnDisk))
+	}
+
+	return
+}
+
+// drift compares the objects indexed with the ones found on disk. It returns
+// the sorted uuids of objects only found in index and only found on disk.
+func (s *Schema) drift() (onlyInIndex, onlyOnDisk []string, err error) {
+	var files map[string]string
+
+	if files, err = s.db.objectFiles(s, s.object); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+
+	onlyInIndex = make([]string, 0)
+	onlyOnDisk = make([]string, 0)
+
 	// we iterate over all the uuids found on disk
-	for uuid := range uuids {
-		// if file is on disk but not indexed
+	for uuid := range files {
 		if !s.isUUIDIndexed(uuid) {
-			return fmt.Errorf("%s %w: schema index is missing entry", typeof(s.object), ErrIndexCorrupted)
+			onlyOnDisk = append(onlyOnDisk, uuid)
 		}
 	}
 
-	// we de-index missing objects
+	// we iterate over all the uuids indexed
 	for uuid := range s.ObjectIndex.uuids {
-		if !uuids[uuid] {
-			return fmt.Errorf("%s %w: object deleted but still indexed", typeof(s.object), ErrIndexCorrupted)
+		if _, ok := files[uuid]; !ok {
+			onlyInIndex = append(onlyInIndex, uuid)
 		}
 	}
 
+	sort.Strings(onlyInIndex)
+	sort.Strings(onlyOnDisk)
+
 	// force nil otherwise takes NoExist error skipped above
-	return nil
+	return onlyInIndex, onlyOnDisk, nil
 }
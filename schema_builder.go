@@ -0,0 +1,255 @@
+package sod
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrUnindexableField = errors.New("field type cannot be indexed")
+)
+
+// SchemaBuilder builds a custom Schema for an Object. Constraints are
+// added to the ones already defined by the sod struct tags of the Object.
+// Field names are checked when constraints are added and the first error
+// encountered is returned by Build.
+//
+//	s, err := sod.NewSchemaBuilder(&Person{}).
+//		Index("Age").
+//		Unique("Email").
+//		Upper("Country").
+//		Compress().
+//		Build()
+type SchemaBuilder struct {
+	object Object
+	schema Schema
+	err    error
+}
+
+// NewSchemaBuilder creates a SchemaBuilder for Object o
+// starting from a DefaultSchema
+func NewSchemaBuilder(o Object) *SchemaBuilder {
+	b := &SchemaBuilder{object: o, schema: DefaultSchema}
+	b.schema.Fields = FieldDescriptors(o)
+	return b
+}
+
+func (b *SchemaBuilder) constrain(fpath string, f func(c *Constraints)) *SchemaBuilder {
+	var fd FieldDescriptor
+	var ok bool
+
+	if b.err != nil {
+		return b
+	}
+
+	if fd, ok = b.schema.Fields.GetDescriptor(fpath); !ok {
+		b.err = fmt.Errorf("%w %s for object %T", ErrUnkownField, fpath, b.object)
+		return b
+	}
+
+	c := fd.Constraints
+	f(&c)
+
+	if c.Index {
+		if _, ok = fd.castType(); !ok {
+			b.err = fmt.Errorf("%s %w: %s", fpath, ErrUnindexableField, fd.Type)
+			return b
+		}
+	}
+
+	b.err = b.schema.Fields.Constraint(fpath, c)
+	return b
+}
+
+// Index indexes fields
+func (b *SchemaBuilder) Index(fields ...string) *SchemaBuilder {
+	for _, fpath := range fields {
+		b.constrain(fpath, func(c *Constraints) { c.Index = true })
+	}
+	return b
+}
+
+// Unique indexes fields and makes their values unique
+func (b *SchemaBuilder) Unique(fields ...string) *SchemaBuilder {
+	for _, fpath := range fields {
+		b.constrain(fpath, func(c *Constraints) { c.Index, c.Unique = true, true })
+	}
+	return b
+}
+
+// SuffixIndex indexes fields and their reversed values to
+// search them efficiently with the "$=" (ends with) operator
+func (b *SchemaBuilder) SuffixIndex(fields ...string) *SchemaBuilder {
+	for _, fpath := range fields {
+		b.constrain(fpath, func(c *Constraints) { c.Index, c.SuffixIndex = true, true })
+	}
+	return b
+}
+
+// PartialIndex indexes field only for the Objects
+// satisfying predicate, see Schema.PartialIndex
+func (b *SchemaBuilder) PartialIndex(field string, predicate func(o Object) bool) *SchemaBuilder {
+	b.schema.PartialIndex(field, predicate)
+	return b.Index(field)
+}
+
+// DerivedIndex indexes the virtual field computed
+// by compute, see Schema.DerivedIndex
+func (b *SchemaBuilder) DerivedIndex(field string, compute func(o Object) interface{}) *SchemaBuilder {
+	b.schema.DerivedIndex(field, compute)
+	return b
+}
+
+// Upper upper cases values of fields before insertion
+func (b *SchemaBuilder) Upper(fields ...string) *SchemaBuilder {
+	for _, fpath := range fields {
+		b.constrain(fpath, func(c *Constraints) { c.Upper = true })
+	}
+	return b
+}
+
+// Lower lower cases values of fields before insertion
+func (b *SchemaBuilder) Lower(fields ...string) *SchemaBuilder {
+	for _, fpath := range fields {
+		b.constrain(fpath, func(c *Constraints) { c.Lower = true })
+	}
+	return b
+}
+
+// CompositeIndex declares a composite index, see Schema.CompositeIndex
+func (b *SchemaBuilder) CompositeIndex(fields ...string) *SchemaBuilder {
+	b.schema.CompositeIndex(fields...)
+	return b
+}
+
+// IndexLen indexes the length of fields, see Schema.IndexLen
+func (b *SchemaBuilder) IndexLen(fields ...string) *SchemaBuilder {
+	b.schema.IndexLen(fields...)
+	return b
+}
+
+// KeyIndex indexes the keys of map fields, see Schema.KeyIndex
+func (b *SchemaBuilder) KeyIndex(fields ...string) *SchemaBuilder {
+	b.schema.KeyIndex(fields...)
+	return b
+}
+
+// Extension sets the extension of Object files
+func (b *SchemaBuilder) Extension(ext string) *SchemaBuilder {
+	b.schema.Extension = ext
+	return b
+}
+
+// Compress compresses Object files
+func (b *SchemaBuilder) Compress() *SchemaBuilder {
+	b.schema.Compress = true
+	return b
+}
+
+// CompressSchema compresses the schema file
+func (b *SchemaBuilder) CompressSchema() *SchemaBuilder {
+	b.schema.CompressSchema = true
+	return b
+}
+
+// KeepHistory keeps the n previous versions of every Object
+func (b *SchemaBuilder) KeepHistory(n int) *SchemaBuilder {
+	b.schema.KeepHistory = n
+	return b
+}
+
+// QueryCache caches the results of at most n searches
+func (b *SchemaBuilder) QueryCache(n int) *SchemaBuilder {
+	b.schema.QueryCache = n
+	return b
+}
+
+// Cache caches Objects in memory
+func (b *SchemaBuilder) Cache() *SchemaBuilder {
+	b.schema.Cache = true
+	return b
+}
+
+// Asynchrone enables async writes, see Schema.Asynchrone
+func (b *SchemaBuilder) Asynchrone(threshold int, timeout time.Duration) *SchemaBuilder {
+	b.schema.Asynchrone(threshold, timeout)
+	return b
+}
+
+// WriteBehind enables write behind mode, see Schema.WriteBehind
+func (b *SchemaBuilder) WriteBehind() *SchemaBuilder {
+	b.schema.WriteBehind = true
+	return b
+}
+
+// DirName sets a custom directory name, see Schema.DirName
+func (b *SchemaBuilder) DirName(name string) *SchemaBuilder {
+	b.schema.DirName = name
+	return b
+}
+
+// UpdatedAt indexes field and tracks the time Objects are
+// updated at in it, see Schema.UpdatedAt
+func (b *SchemaBuilder) UpdatedAt(field string) *SchemaBuilder {
+	b.schema.UpdatedAt = field
+	return b.Index(field)
+}
+
+// Sequence indexes field and sets it to the sequence number
+// of Objects on insertion, see Schema.Sequence
+func (b *SchemaBuilder) Sequence(field string) *SchemaBuilder {
+	b.schema.Sequence = field
+	return b.Index(field)
+}
+
+// Partition stores Objects in sub-directories by period, see Partition
+func (b *SchemaBuilder) Partition(field, period string) *SchemaBuilder {
+	b.schema.Partition = &Partition{Field: field, Period: period}
+	return b
+}
+
+// TimeFormat sets the format of time.Time fields in Object files,
+// see Schema.TimeFormat
+func (b *SchemaBuilder) TimeFormat(format string) *SchemaBuilder {
+	b.schema.TimeFormat = format
+	return b
+}
+
+// ContentAddressed derives the UUID of Objects from their
+// content, see Schema.ContentAddressed
+func (b *SchemaBuilder) ContentAddressed() *SchemaBuilder {
+	b.schema.ContentAddressed = true
+	return b
+}
+
+// JSONValidator sets the function validating the JSON encoding of
+// Objects, see Schema.SetJSONValidator
+func (b *SchemaBuilder) JSONValidator(validate func(data []byte) error) *SchemaBuilder {
+	b.schema.SetJSONValidator(validate)
+	return b
+}
+
+// Build returns the Schema built or the first error encountered
+func (b *SchemaBuilder) Build() (s Schema, err error) {
+	if b.err != nil {
+		return s, b.err
+	}
+
+	s = b.schema
+	// built schema must not be modified by further calls to the builder
+	s.Fields = make(FieldDescMap, len(b.schema.Fields))
+	for fpath, fd := range b.schema.Fields {
+		s.Fields[fpath] = fd
+	}
+	s.CompositeIndexes = append([][]string{}, b.schema.CompositeIndexes...)
+	s.LenIndexes = append([]string{}, b.schema.LenIndexes...)
+	s.KeyIndexes = append([]string{}, b.schema.KeyIndexes...)
+	if b.schema.Partition != nil {
+		p := *b.schema.Partition
+		s.Partition = &p
+	}
+	s.ObjectIndex = newIndex(s.Fields)
+
+	return
+}
@@ -0,0 +1,58 @@
+package sod
+
+import (
+	"testing"
+
+	"github.com/0xrawsec/toast"
+)
+
+type person struct {
+	Item
+	Name    string
+	Email   string
+	Country string
+	Age     int
+	Tags    []string
+}
+
+func TestSchemaBuilder(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	b := NewSchemaBuilder(&person{}).
+		Index("Age").
+		Unique("Email").
+		Upper("Country").
+		Index("Country").
+		CompositeIndex("Country", "Age").
+		Compress()
+
+	s, err := b.Build()
+	tt.CheckErr(err)
+	tt.Assert(s.Compress)
+	tt.Assert(s.Extension == DefaultExtension)
+	tt.Assert(s.Fields["Age"].Constraints == Constraints{Index: true})
+	tt.Assert(s.Fields["Email"].Constraints == Constraints{Index: true, Unique: true})
+	tt.Assert(s.Fields["Country"].Constraints == Constraints{Index: true, Upper: true})
+	tt.Assert(s.Fields["Name"].Constraints == Constraints{})
+
+	// built schema is not modified by the builder
+	b.Index("Name")
+	tt.Assert(!s.Fields["Name"].Constraints.Index)
+
+	tt.CheckErr(db.Create(&person{}, s))
+	tt.CheckErr(db.InsertOrUpdate(&person{Email: "john@doe.com", Country: "us", Age: 42}))
+	tt.ExpectErr(db.InsertOrUpdate(&person{Email: "john@doe.com"}), ErrConstraintUnique)
+	p, err := db.Search(&person{}, "Country", "=", "us").And("Age", "=", 42).One()
+	tt.CheckErr(err)
+	tt.Assert(p.(*person).Country == "US")
+
+	// typos and unindexable fields are reported
+	_, err = NewSchemaBuilder(&person{}).Index("Age").Unique("Mail").Index("Age").Build()
+	tt.ExpectErr(err, ErrUnkownField)
+	_, err = NewSchemaBuilder(&person{}).Index("Tags").Build()
+	tt.ExpectErr(err, ErrUnindexableField)
+}
@@ -4,44 +4,124 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"regexp"
 	"strings"
+	"sync"
 )
 
 var (
 	ErrUnknownOperator           = errors.New("unknown logical operator")
 	ErrNoObjectFound             = errors.New("no object found")
 	ErrUnexpectedNumberOfResults = errors.New("unexpected number of results")
+	ErrNoCondition               = errors.New("no search condition")
+
+	// operators accepted by searches
+	searchOperators = map[string]bool{
+		"=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true,
+		"~=": true, "~in": true, "contains": true, "$=": true, "in": true,
+		HasKeyOperator: true,
+	}
 )
 
 func IsNoObjectFound(err error) bool {
 	return errors.Is(err, ErrNoObjectFound)
 }
 
+// searchClause holds a single search not evaluated yet
+type searchClause struct {
+	field    string
+	operator string
+	value    interface{}
+}
+
+// Condition is a search condition, see DB.SearchConditions
+type Condition struct {
+	Field    string
+	Operator string
+	Value    interface{}
+}
+
+// validateConditions checks that conditions can be combined with logic
+func validateConditions(conds []Condition, logic string) error {
+	if len(conds) == 0 {
+		return ErrNoCondition
+	}
+
+	switch strings.ToLower(logic) {
+	case "and", "&&", "or", "||":
+	default:
+		return fmt.Errorf("%w %s", ErrUnknownOperator, logic)
+	}
+
+	for _, c := range conds {
+		if !searchOperators[c.Operator] {
+			return fmt.Errorf("%w %s", ErrUnkownSearchOperator, c.Operator)
+		}
+	}
+
+	return nil
+}
+
+// ObjectValue pairs an Object returned by a search with the
+// value of the last field searched
+type ObjectValue struct {
+	Object Object
+	Value  interface{}
+}
+
 // Search helper structure to easily build search queries on objects
 // and retrieve the results
 type Search struct {
-	db      *DB
-	object  Object
-	fields  []*indexedField
-	limit   uint64
-	reverse bool
-	err     error
+	db     *DB
+	object Object
+	// clauses of a lazy search, never modified once the search is created
+	pending []*searchClause
+	// evaluation of pending clauses, done only once
+	resolved sync.Once
+	fields   []*IndexedField
+	// field values must be read from objects as fields
+	// come from a composite index
+	compositeField string
+	limit          uint64
+	reverse        bool
+	err            error
 }
 
-func newSearch(db *DB, o Object, f []*indexedField, err error) *Search {
+func newSearch(db *DB, o Object, f []*IndexedField, err error) *Search {
 	return &Search{db: db, object: o, fields: f, limit: math.MaxUint, err: err}
 }
 
+// newLazySearch creates a Search whose evaluation is deferred until
+// results are needed. It allows One to use a faster path on single
+// clause searches and AND clauses to be answered by a composite index.
+// The search is evaluated once, so that all the methods called on it
+// see the same results. A Search must not be used by several goroutines.
+func newLazySearch(db *DB, o Object, field, operator string, value interface{}) *Search {
+	return &Search{db: db, object: o, pending: []*searchClause{{field, operator, value}}, limit: math.MaxUint}
+}
+
+// newResolvedSearch creates a Search whose results f are already known.
+// Clauses are the ones f matches, kept to evaluate the search again on a
+// subset of the results (see DeleteInBatches).
+func newResolvedSearch(db *DB, o Object, clauses []*searchClause, f []*IndexedField) *Search {
+	s := &Search{db: db, object: o, pending: clauses, fields: f, limit: math.MaxUint}
+	// clauses must not be evaluated to replace f
+	s.resolved.Do(func() {})
+	return s
+}
+
 // ExpectsZeroOrN checks that the number of results is the one expected or zero.
 // If not, next call to s.Err must return an error and any subsbequent
 // attempt to collect results must fail
 func (s *Search) ExpectsZeroOrN(n int) *Search {
-	found := len(s.fields)
+	s.lockResolve()
 
 	if s.err != nil {
 		return s
 	}
 
+	found := len(s.fields)
+
 	if found != 0 && found != n {
 		s.err = fmt.Errorf("%w expected %d, found %d", ErrUnexpectedNumberOfResults, n, found)
 	}
@@ -53,12 +133,14 @@ func (s *Search) ExpectsZeroOrN(n int) *Search {
 // if not, next call to s.Err must return an error and any subsbequent
 // attempt to collect results must fail
 func (s *Search) Expects(n int) *Search {
-	found := len(s.fields)
+	s.lockResolve()
 
 	if s.err != nil {
 		return s
 	}
 
+	found := len(s.fields)
+
 	if found != n {
 		s.err = fmt.Errorf("%w expected %d, found %d", ErrUnexpectedNumberOfResults, n, found)
 	}
@@ -93,11 +175,22 @@ func (s *Search) And(field, operator string, value interface{}) *Search {
 		return s
 	}
 
+	// ANDed clauses are evaluated all together so that
+	// a composite index can be used
+	if len(s.pending) > 0 {
+		new := &Search{db: s.db, object: s.object, limit: s.limit, reverse: s.reverse}
+		new.pending = make([]*searchClause, 0, len(s.pending)+1)
+		new.pending = append(new.pending, s.pending...)
+		new.pending = append(new.pending, &searchClause{field, operator, value})
+		return new
+	}
+
 	return s.db.search(s.object, field, operator, value, s.fields)
 }
 
 // Or performs a new Search while "ORing" search results
 func (s *Search) Or(field, operator string, value interface{}) *Search {
+	s.lockResolve()
 
 	if s.err != nil {
 		return s
@@ -118,38 +211,84 @@ func (s *Search) Or(field, operator string, value interface{}) *Search {
 	return new
 }
 
-// Len returns the number of data returned by the search
-func (s *Search) Len() int {
-	return len(s.fields)
+// AndNot performs a new Search keeping the results not matching the
+// clause, it is the set difference of the results and the clause's ones
+func (s *Search) AndNot(field, operator string, value interface{}) *Search {
+	s.db.RLock()
+	defer s.db.RUnlock()
+
+	s.resolve()
+
+	if s.err != nil {
+		return s
+	}
+
+	// clause only needs to be evaluated on current results
+	excluded := s.db.search(s.object, field, operator, value, s.fields)
+	if excluded.err != nil {
+		return excluded
+	}
+
+	new := newSearch(s.db, s.object, difference(s.fields, excluded.fields), nil)
+	new.compositeField = s.compositeField
+	return new
 }
 
-// Iterator returns an Iterator convenient to iterate over
-// the objects resulting from the search
-func (s *Search) Iterator() (it *iterator, err error) {
+// OrNot performs a new Search while "ORing" search results with all the
+// Objects not matching the clause. Values of the Objects added are their
+// UUIDs, see CollectWithValues.
+func (s *Search) OrNot(field, operator string, value interface{}) *Search {
+	s.db.RLock()
+	defer s.db.RUnlock()
+
 	var sch *Schema
+	var err error
+
+	s.resolve()
 
 	if s.err != nil {
-		return nil, s.err
+		return s
 	}
 
 	if sch, err = s.db.schema(s.object); err != nil {
-		return
+		return newSearch(s.db, s.object, nil, err)
 	}
 
-	// create a new iterator
-	it = newIterator(s.db, s.object, make([]string, 0, len(s.fields)))
-
-	for _, f := range s.fields {
-		it.uuids = append(it.uuids, sch.ObjectIndex.ObjectIds[f.ObjectId])
+	matched := s.db.search(s.object, field, operator, value, nil)
+	if matched.err != nil {
+		return matched
 	}
 
-	return
+	// Objects not matching are the ones of the UUID index not matched
+	new := newSearch(s.db, s.object, difference(sch.ObjectIndex.uuidIndex.Index, matched.fields), nil)
+	// we concat the searches while deduplicating
+	new.fields = append(new.fields, difference(s.fields, new.fields)...)
+	return new
+}
+
+// Len returns the number of data returned by the search
+func (s *Search) Len() int {
+	s.lockResolve()
+	return len(s.fields)
+}
+
+// Iterator returns an Iterator convenient to iterate over
+// the objects resulting from the search
+func (s *Search) Iterator() (it *iterator, err error) {
+	s.lockResolve()
+	return s.iterator()
 }
 
-// Delete deletes the objects found by the search
+// Delete deletes the objects found by the search. All the objects are
+// deleted while holding the DB lock, see DeleteInBatches to delete a
+// large number of objects.
 func (s *Search) Delete() (err error) {
 	var it *iterator
 
+	if err = s.db.readOnly(); err != nil {
+		return
+	}
+
 	if it, err = s.Iterator(); err != nil {
 		return
 	}
@@ -157,6 +296,51 @@ func (s *Search) Delete() (err error) {
 	return s.db.DeleteObjects(it)
 }
 
+// DeleteInBatches deletes the objects found by the search by batches of
+// size objects. Every batch is deleted and committed while holding the DB
+// lock, which is released between batches so that a large deletion neither
+// blocks the DB for long nor loads all the objects to delete. Contrary to
+// Delete, atomicity is only guaranteed per batch: if an error occurs, objects
+// of the previous batches are deleted. The clauses of the search are evaluated
+// again on every batch while holding the lock, so objects modified by someone
+// else and not matching anymore are skipped. Searches combined with Or, OrNot
+// or AndNot cannot be evaluated again, only their deleted objects are skipped.
+// Objects found are tracked by uuid so batches are not affected by a Vacuum
+// run between them. It returns the number of objects deleted.
+func (s *Search) DeleteInBatches(size int) (n int, err error) {
+	var uuids []string
+
+	if err = s.db.readOnly(); err != nil {
+		return
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	if uuids, err = s.resultUUIDs(); err != nil {
+		return
+	}
+
+	for i := 0; i < len(uuids); i += size {
+		var deleted int
+
+		j := i + size
+		if j > len(uuids) {
+			j = len(uuids)
+		}
+
+		deleted, err = s.deleteBatch(uuids[i:j])
+		n += deleted
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
 // Reverse the order the results are collected by Collect function
 func (s *Search) Reverse() *Search {
 	s.reverse = true
@@ -188,9 +372,13 @@ func (s *Search) AssignUnique(target interface{}) (err error) {
 
 // AssignOne returns the first result found calling Collect function
 // and assign the Object found to target. Target must be a *sod.Object
-// otherwise the function panics. If no Object is found, ErrNoObjectFound
+// otherwise the function panics, or returns ErrReflection if safe
+// reflection is enabled (see DB.SetSafeReflect) and the Object found
+// cannot be assigned to target. If no Object is found, ErrNoObjectFound
 // is returned
 func (s *Search) AssignOne(target interface{}) (err error) {
+	defer s.db.recoverReflect(&err)
+
 	s.db.RLock()
 	defer s.db.RUnlock()
 
@@ -206,10 +394,12 @@ func (s *Search) AssignOne(target interface{}) (err error) {
 }
 
 // Assign returns results found calling Collect function
-// and assign them to target. Target must be a *[]sod.Object
-// otherwise the function panics. If no Object is found, ErrNoObjectFound
-// is returned
+// and assign them to target. Target must be a *[]sod.Object, or a *[]T
+// with *T implementing Object, otherwise the function panics, see
+// AssignOne. If no Object is found, ErrNoObjectFound is returned
 func (s *Search) Assign(target interface{}) (err error) {
+	defer s.db.recoverReflect(&err)
+
 	s.db.RLock()
 	defer s.db.RUnlock()
 
@@ -235,29 +425,365 @@ func (s *Search) Collect() (out []Object, err error) {
 	return s.collect()
 }
 
+// CollectWithValues collects all the objects resulting from the search
+// like Collect does but pairs each Object with the value of the last
+// field searched. Values are the ones stored in the index so they are
+// normalized the same way (i.e. integers are int64 or uint64, floats are
+// float64 and time.Time are nanoseconds since Unix epoch).
+func (s *Search) CollectWithValues() (out []ObjectValue, err error) {
+	defer s.db.recoverReflect(&err)
+
+	s.db.RLock()
+	defer s.db.RUnlock()
+
+	return s.collectWithValues()
+}
+
+// GroupBy collects all the objects resulting from the search like Collect
+// does and groups them by the value of field. Group keys are normalized
+// the same way as indexed values (see CollectWithValues) and they are read
+// from the index if field is indexed. Within a group, Objects are in the
+// order they are collected. ErrUnkownField is returned if field is not a
+// field of the Objects searched.
+func (s *Search) GroupBy(field string) (groups map[interface{}][]Object, err error) {
+	defer s.db.recoverReflect(&err)
+
+	s.db.RLock()
+	defer s.db.RUnlock()
+
+	return s.groupBy(field)
+}
+
+// UUIDs returns the UUIDs of the Objects resulting from the search
+// in the order they would be collected by Collect function. Objects
+// are not read from disk.
+func (s *Search) UUIDs() (uuids []string, err error) {
+	s.db.RLock()
+	defer s.db.RUnlock()
+
+	var it *iterator
+
+	if it, err = s.iterator(); err != nil {
+		return
+	}
+
+	if s.reverse {
+		it.reversed()
+	}
+
+	// limit applies to every call
+	limit := s.limit
+	uuids = make([]string, 0, it.len())
+	for i := it.i; i >= 0 && i < it.len() && limit > 0; limit-- {
+		uuids = append(uuids, it.uuids[i])
+		if s.reverse {
+			i--
+		} else {
+			i++
+		}
+	}
+
+	return
+}
+
 // Err return any error encountered while searching
 func (s *Search) Err() error {
+	s.lockResolve()
 	return s.err
 }
 
 /************** Private Methods ******************/
 
+// searchOperator translates the operators not evaluated as they are
+func searchOperator(operator string, value interface{}) (string, interface{}, error) {
+	// matching any of several regexes is done in a single regex search
+	if operator == "~in" {
+		rex, err := regexAny(value)
+		return "~=", rex, err
+	}
+	return operator, value, nil
+}
+
+// regexAny returns a regex matching any of the regexes passed as
+// a []string. Every regex is checked to compile on its own so that
+// an invalid one cannot alter the meaning of the others.
+func regexAny(value interface{}) (rex string, err error) {
+	var patterns []string
+	var ok bool
+
+	if patterns, ok = value.([]string); !ok {
+		return "", fmt.Errorf("%w, cannot cast %T(%v) to []string", ErrCasting, value, value)
+	}
+
+	// never matches anything
+	if len(patterns) == 0 {
+		return `[^\x00-\x{10FFFF}]`, nil
+	}
+
+	groups := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		if _, err = regexp.Compile(p); err != nil {
+			return
+		}
+		groups = append(groups, fmt.Sprintf("(?:%s)", p))
+	}
+
+	return strings.Join(groups, "|"), nil
+}
+
+// difference returns the fields of from whose ObjectIds are not in exclude
+func difference(from, exclude []*IndexedField) (f []*IndexedField) {
+	marked := make(map[uint64]bool, len(exclude))
+	for _, e := range exclude {
+		marked[e.ObjectId] = true
+	}
+
+	f = make([]*IndexedField, 0, len(from))
+	for _, field := range from {
+		if !marked[field.ObjectId] {
+			f = append(f, field)
+		}
+	}
+	return
+}
+
+// resolve evaluates a pending search, db must be locked by caller
+func (s *Search) resolve() {
+	s.resolved.Do(s.evaluate)
+}
+
+// evaluate evaluates the pending clauses of a lazy search, it must only be
+// called through resolve
+func (s *Search) evaluate() {
+	var r *Search
+
+	if len(s.pending) == 0 {
+		return
+	}
+
+	pending := s.pending
+
+	// results are cached before limit and order are applied
+	if sch, err := s.db.schema(s.object); err == nil && sch.QueryCache > 0 {
+		key := queryKey(pending)
+		if q, ok := sch.queries.get(key); ok {
+			s.fields, s.compositeField = q.fields, q.compositeField
+			return
+		}
+		defer func() {
+			if s.err == nil {
+				sch.queries.put(key, &cachedQuery{s.fields, s.compositeField}, sch.QueryCache)
+			}
+		}()
+	}
+
+	// registered after the cache so that failed searches are not cached
+	defer s.db.recoverReflect(&s.err)
+
+	if len(pending) > 1 {
+		if f, ok := s.db.searchComposite(s.object, pending); ok {
+			s.fields = f
+			s.compositeField = pending[len(pending)-1].field
+			return
+		}
+	}
+
+	// clauses are evaluated one after the other, two consecutive clauses
+	// on the same field are evaluated as a single range search
+	for i := 0; i < len(pending); i++ {
+		var constrain []*IndexedField
+
+		c := pending[i]
+		if i > 0 {
+			constrain = r.fields
+		}
+
+		if i+1 < len(pending) {
+			if f, ok := s.db.searchRange(s.object, c, pending[i+1], constrain); ok {
+				r = newSearch(s.db, s.object, f, nil)
+				i++
+				continue
+			}
+		}
+
+		r = s.db.search(s.object, c.field, c.operator, c.value, constrain)
+
+		if r.err != nil {
+			break
+		}
+	}
+
+	s.fields, s.err = r.fields, r.err
+}
+
+// lockResolve evaluates a pending search while holding db read lock
+func (s *Search) lockResolve() {
+	if len(s.pending) > 0 {
+		s.db.RLock()
+		defer s.db.RUnlock()
+		s.resolve()
+	}
+}
+
+func (s *Search) iterator() (it *iterator, err error) {
+	var sch *Schema
+
+	s.resolve()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	if sch, err = s.db.schema(s.object); err != nil {
+		return
+	}
+
+	// create a new iterator
+	it = newIterator(s.db, s.object, make([]string, 0, len(s.fields)))
+
+	for _, f := range s.fields {
+		it.uuids = append(it.uuids, sch.ObjectIndex.ObjectIds[f.ObjectId])
+	}
+
+	return
+}
+
+// resultUUIDs returns the uuids of the Objects found by the search. Batches
+// are made of uuids because ObjectIds of the search results might be
+// reassigned, i.e. by Vacuum, once the lock is released.
+func (s *Search) resultUUIDs() (uuids []string, err error) {
+	var sch *Schema
+
+	s.db.RLock()
+	defer s.db.RUnlock()
+
+	s.resolve()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	if sch, err = s.db.schema(s.object); err != nil {
+		return
+	}
+
+	uuids = make([]string, 0, len(s.fields))
+	for _, f := range s.fields {
+		uuids = append(uuids, sch.ObjectIndex.ObjectIds[f.ObjectId])
+	}
+
+	return
+}
+
+// matching returns the uuids of batch, still indexed, of the Objects which
+// match the clauses of the search as the index is now, db must be locked by
+// caller. Searches whose results are not made of clauses only, i.e. combined
+// with Or, cannot be evaluated again so their results are only checked to be
+// still indexed.
+func (s *Search) matching(sch *Schema, batch []string) (uuids []string, err error) {
+	constrain := make([]*IndexedField, 0, len(batch))
+	for _, uuid := range batch {
+		// object deleted since the search was evaluated
+		if id, ok := sch.ObjectIndex.uuids[uuid]; ok {
+			if f, ok := sch.ObjectIndex.uuidIndex.objectIds[id]; ok {
+				constrain = append(constrain, f)
+			}
+		}
+	}
+
+	for _, c := range s.pending {
+		if len(constrain) == 0 {
+			break
+		}
+
+		r := s.db.search(s.object, c.field, c.operator, c.value, constrain)
+		if r.err != nil {
+			return nil, r.err
+		}
+		constrain = r.fields
+	}
+
+	matched := make(map[uint64]bool, len(constrain))
+	for _, f := range constrain {
+		matched[f.ObjectId] = true
+	}
+
+	// batch order is kept
+	uuids = make([]string, 0, len(constrain))
+	for _, uuid := range batch {
+		if id, ok := sch.ObjectIndex.uuids[uuid]; ok && matched[id] {
+			uuids = append(uuids, uuid)
+		}
+	}
+
+	return
+}
+
+// deleteBatch deletes and commits the objects of a batch while holding DB
+// lock, only the objects still matching the search are deleted
+func (s *Search) deleteBatch(batch []string) (n int, err error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+
+	var sch *Schema
+
+	if sch, err = s.db.schema(s.object); err != nil {
+		return
+	}
+
+	if batch, err = s.matching(sch, batch); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := s.db.commit(s.object); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	for _, uuid := range batch {
+		o := newObject(s.object)
+		o.Initialize(uuid)
+		if err = s.db.delete(o); err != nil {
+			return
+		}
+		n++
+	}
+
+	return
+}
+
 func (s *Search) one() (o Object, err error) {
 	var sr []Object
 
+	defer s.db.recoverReflect(&err)
+
+	// error set by Expects on an already evaluated search
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	// single clause searches might not need to be fully evaluated
+	if len(s.pending) == 1 {
+		if o, err = s.db.searchFirst(s.object, s.pending[0], s.reverse); !errors.Is(err, errNoFastPath) {
+			return
+		}
+	}
+
+	s.resolve()
+
 	if s.err != nil {
 		err = s.err
 		return
 	}
 
-	if s.Len() == 0 {
+	if len(s.fields) == 0 {
 		err = ErrNoObjectFound
 		return
 	}
 
 	// prevent collecting all results and using only one
-	s.limit = 1
-	if sr, err = s.collect(); err != nil {
+	if sr, err = s.collectN(1); err != nil {
 		return
 	}
 	o = sr[0]
@@ -265,14 +791,22 @@ func (s *Search) one() (o Object, err error) {
 }
 
 func (s *Search) collect() (out []Object, err error) {
+	return s.collectN(s.limit)
+}
+
+// collectN collects at most limit results, limit of the search is not
+// modified so that it applies to every call
+func (s *Search) collectN(limit uint64) (out []Object, err error) {
 	var it *iterator
 	var o Object
 
+	s.resolve()
+
 	if s.err != nil {
 		return nil, s.err
 	}
 
-	if it, err = s.Iterator(); err != nil {
+	if it, err = s.iterator(); err != nil {
 		return
 	}
 
@@ -281,9 +815,105 @@ func (s *Search) collect() (out []Object, err error) {
 	}
 
 	out = make([]Object, 0, it.len())
-	for o, err = it.next(); err == nil && err != ErrEOI && s.limit > 0; o, err = it.next() {
+	for o, err = it.next(); err == nil && err != ErrEOI && limit > 0; o, err = it.next() {
 		out = append(out, o)
-		s.limit--
+		limit--
+	}
+
+	// normal end of iterator
+	if err == ErrEOI {
+		err = nil
+	}
+
+	return
+}
+
+func (s *Search) groupBy(field string) (groups map[interface{}][]Object, err error) {
+	var sch *Schema
+	var objects []Object
+
+	s.resolve()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	fpath := fieldPath(field)
+	if _, ok := fieldByName(s.object, fpath); !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnkownField, field)
+	}
+
+	if sch, err = s.db.schema(s.object); err != nil {
+		return
+	}
+
+	if objects, err = s.collect(); err != nil {
+		return
+	}
+
+	_, indexed := sch.ObjectIndex.Fields[field]
+	groups = make(map[interface{}][]Object)
+	for _, o := range objects {
+		var f *IndexedField
+		var ok bool
+
+		// group value is read from the object if not in the index
+		if indexed {
+			f, ok = sch.ObjectIndex.indexed(field, sch.ObjectIndex.uuids[o.UUID()])
+		}
+
+		if !ok {
+			value, _ := fieldByName(o, fpath)
+			if f, err = searchField(value); err != nil {
+				return nil, err
+			}
+		}
+
+		groups[f.Value] = append(groups[f.Value], o)
+	}
+
+	return
+}
+
+func (s *Search) collectWithValues() (out []ObjectValue, err error) {
+	var it *iterator
+	var o Object
+	var f *IndexedField
+
+	s.resolve()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	if it, err = s.iterator(); err != nil {
+		return
+	}
+
+	if s.reverse {
+		it.reversed()
+	}
+
+	// limit applies to every call
+	limit := s.limit
+	out = make([]ObjectValue, 0, it.len())
+	for limit > 0 {
+		if o, err = it.next(); err != nil {
+			break
+		}
+
+		if s.compositeField != "" {
+			value, _ := fieldByName(o, fieldPath(s.compositeField))
+			if f, err = searchField(value); err != nil {
+				return
+			}
+		} else {
+			// objects missing from disk may have been skipped
+			f = s.fields[it.pos]
+		}
+
+		out = append(out, ObjectValue{o, f.Value})
+		limit--
 	}
 
 	// normal end of iterator
@@ -0,0 +1,124 @@
+package sod
+
+import (
+	"fmt"
+)
+
+// boxRange returns the field index of field and the bounds of the range
+// [lo, hi] searched on it. It returns false if field is not indexed.
+func (in *objIndex) boxRange(field string, lo, hi interface{}) (fi *fieldIndex, flo, fhi *IndexedField, ok bool, err error) {
+	if fi, ok = in.Fields[field]; !ok {
+		return
+	}
+
+	for i, v := range []interface{}{lo, hi} {
+		var f *IndexedField
+
+		if f, err = searchField(v); err != nil {
+			return
+		}
+
+		if fi.Cast != f.valueTypeString() {
+			err = fmt.Errorf("%w, cannot cast %T(%v) to %s", ErrCasting, v, v, fi.Cast)
+			return
+		}
+
+		if i == 0 {
+			flo = f
+		} else {
+			fhi = f
+		}
+	}
+
+	return
+}
+
+// searchBox searches the Objects whose x and y fields are in the ranges
+// [x0, x1] and [y0, y1]. The range matching the less entries is scanned and
+// the other field of the Objects found is checked against its range. It
+// returns false if any of the fields is not indexed or if Objects are
+// partitioned.
+func (in *objIndex) searchBox(fieldX string, x0, x1 interface{}, fieldY string, y0, y1 interface{}) (f []*IndexedField, ok bool, err error) {
+	var fx, fy *fieldIndex
+	var lx, hx, ly, hy *IndexedField
+
+	// partitioned Objects are searched in the partitions by the regular
+	// search path
+	if in.Partitions != nil {
+		return
+	}
+
+	if fx, lx, hx, ok, err = in.boxRange(fieldX, x0, x1); !ok || err != nil {
+		return
+	}
+
+	if fy, ly, hy, ok, err = in.boxRange(fieldY, y0, y1); !ok || err != nil {
+		return
+	}
+
+	// ranges are slices of the indexes so they are not copied
+	rx := fx.SearchRange(lx, hx, true, true)
+	ry := fy.SearchRange(ly, hy, true, true)
+
+	scan, other, lo, hi := rx, fy, ly, hy
+	if len(ry) < len(rx) {
+		scan, other, lo, hi = ry, fx, lx, hx
+	}
+
+	f = make([]*IndexedField, 0)
+	for _, sf := range scan {
+		if v, indexed := other.objectIds[sf.ObjectId]; indexed && !v.less(lo) && !v.greater(hi) {
+			f = append(f, sf)
+		}
+	}
+
+	return
+}
+
+/***** Public Methods ******/
+
+// SearchBox searches the Objects whose fieldX is in [x0, x1] and fieldY is in
+// [y0, y1], bounds included, i.e. a bounding box over two numeric fields.
+// Only the index of the most selective field is scanned, the other field
+// of the Objects found is checked against its range, which is faster than
+// searching the two ranges when a range matches much fewer Objects than
+// the other. Results are ordered as in the index of the most selective
+// field. If any of the fields is not indexed, or if Objects are partitioned
+// (see Partition), the search is evaluated as a regular Search of the ranges.
+func (db *DB) SearchBox(of Object, fieldX string, x0, x1 interface{}, fieldY string, y0, y1 interface{}) *Search {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+	var f []*IndexedField
+	var ok bool
+	var err error
+
+	if s, err = db.schema(of); err == nil {
+		err = s.checkObject(of)
+	}
+
+	if err != nil {
+		return &Search{db: db, object: of, err: err}
+	}
+
+	// fallback search prepares values itself so raw values are kept
+	px0, px1, py0, py1 := x0, x1, y0, y1
+
+	// transform search values before searching
+	s.prepare(fieldX, &px0)
+	s.prepare(fieldX, &px1)
+	s.prepare(fieldY, &py0)
+	s.prepare(fieldY, &py1)
+
+	if f, ok, err = s.ObjectIndex.searchBox(fieldX, px0, px1, fieldY, py0, py1); !ok && err == nil {
+		search := newLazySearch(db, of, fieldX, ">=", x0)
+		search.pending = append(search.pending,
+			&searchClause{fieldX, "<=", x1},
+			&searchClause{fieldY, ">=", y0},
+			&searchClause{fieldY, "<=", y1})
+		return search
+	}
+
+	return newSearch(db, of, f, err)
+}
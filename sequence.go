@@ -0,0 +1,126 @@
+package sod
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+)
+
+var (
+	ErrBadSequence  = errors.New("bad sequence field")
+	ErrNotSequenced = errors.New("objects are not sequenced")
+	uint64Type      = reflect.TypeOf(uint64(0))
+)
+
+// controlSequence checks the field holding
+// sequence numbers is an indexed uint64 field
+func (s *Schema) controlSequence() error {
+	if s.Sequence == "" {
+		return nil
+	}
+
+	if fd, ok := s.Fields.GetDescriptor(s.Sequence); !ok {
+		return fmt.Errorf("%w: unknown field %s", ErrBadSequence, s.Sequence)
+	} else if fd.Type != "uint64" || !fd.Constraints.Index {
+		return fmt.Errorf("%w: %s must be an indexed uint64 field", ErrBadSequence, s.Sequence)
+	}
+
+	return nil
+}
+
+// indexedSequence returns the sequence number an indexed Object has been assigned
+func (s *Schema) indexedSequence(uuid string) (seq uint64, ok bool) {
+	var objid uint64
+	var f *IndexedField
+
+	if objid, ok = s.ObjectIndex.uuids[uuid]; !ok {
+		return
+	}
+
+	if f, ok = s.ObjectIndex.indexed(s.Sequence, objid); !ok {
+		return
+	}
+
+	seq, ok = f.Value.(uint64)
+	return
+}
+
+// sequence sets the sequence number of o. New Objects are assigned the next
+// sequence number and indexed ones keep the one they have been assigned.
+func (s *Schema) sequence(o Object) {
+	v, ok := valueFieldByName(reflect.ValueOf(o), fieldPath(s.Sequence))
+	if !ok || !v.CanSet() || v.Type() != uint64Type {
+		return
+	}
+
+	if seq, ok := s.indexedSequence(o.UUID()); ok && seq > 0 {
+		v.SetUint(seq)
+		return
+	}
+
+	s.LastSequence++
+	v.SetUint(s.LastSequence)
+}
+
+// syncSequence makes sure the last sequence number is not
+// lower than any sequence number found in the index
+func (s *Schema) syncSequence() {
+	if s.Sequence == "" {
+		return
+	}
+
+	// by convention the greatest value is first
+	if fi, ok := s.ObjectIndex.field(s.Sequence); ok && fi.Len() > 0 {
+		if seq, ok := fi.Index[0].Value.(uint64); ok && seq > s.LastSequence {
+			s.LastSequence = seq
+		}
+	}
+}
+
+/***** Public Methods ******/
+
+// Sequence returns the sequence number assigned to o when it was first
+// inserted, see Schema.Sequence. ErrNotSequenced is returned if the
+// schema does not sequence Objects.
+func (db *DB) Sequence(o Object) (seq uint64, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+	var ok bool
+
+	if s, err = db.schema(o); err != nil {
+		return
+	}
+
+	if s.Sequence == "" {
+		return 0, fmt.Errorf("%s %w", stype(o), ErrNotSequenced)
+	}
+
+	if seq, ok = s.indexedSequence(o.UUID()); !ok {
+		return 0, noObjectFoundErr(o, fs.ErrNotExist)
+	}
+
+	return
+}
+
+// SearchBySequence searches the Objects of the same type as of whose
+// sequence number is between from and to, bounds included. Results are
+// ordered by sequence number so that Objects can be replayed in the
+// order they were inserted. ErrNotSequenced is returned if the schema
+// does not sequence Objects.
+func (db *DB) SearchBySequence(of Object, from, to uint64) (s *Search, err error) {
+	var sch *Schema
+
+	if sch, err = db.Schema(of); err != nil {
+		return
+	}
+
+	if sch.Sequence == "" {
+		return nil, fmt.Errorf("%s %w", stype(of), ErrNotSequenced)
+	}
+
+	// index is in descending order
+	return db.Search(of, sch.Sequence, ">=", from).And(sch.Sequence, "<=", to).Reverse(), nil
+}
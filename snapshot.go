@@ -0,0 +1,186 @@
+package sod
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync/atomic"
+)
+
+var (
+	ErrSnapshotClosed   = errors.New("snapshot closed")
+	ErrSnapshotReadOnly = errors.New("snapshot is read only")
+)
+
+// Snapshot is a read only view of the Objects of a given type as they were
+// when the snapshot was taken. All the reads made through a Snapshot see the
+// same data even if Objects are inserted, modified or deleted in the meantime.
+// Before an Object of the Snapshot gets modified or deleted, its current
+// version is kept in memory until the Snapshot is closed, so a Snapshot must
+// be closed as soon as it is not needed anymore. Modifying a cached Object
+// in place (i.e. without calling InsertOrUpdate) cannot be detected and
+// is visible from the Snapshot.
+type Snapshot struct {
+	// snapshot view of the DB
+	db     *DB
+	object Object
+	schema *Schema
+	// versions of Objects modified or deleted after the snapshot was taken,
+	// a nil version means the Object could not be read
+	versions map[string][]byte
+	closed   bool
+}
+
+/***** Private Methods ******/
+
+// preserve keeps current version of o if needed
+func (sn *Snapshot) preserve(db *DB, o Object) {
+	var data []byte
+	var err error
+
+	uuid := o.UUID()
+
+	if _, ok := sn.versions[uuid]; ok || !sn.schema.isUUIDIndexed(uuid) {
+		return
+	}
+
+	cur := newObject(o)
+	cur.Initialize(uuid)
+	if cur, err = db.get(cur); err == nil {
+		if data, err = json.Marshal(cur); err != nil {
+			data = nil
+		}
+	}
+
+	sn.versions[uuid] = data
+}
+
+// preserved returns the version of Object kept by the snapshot if any
+func (sn *Snapshot) preserved(in Object) (out Object, ok bool, err error) {
+	var data []byte
+
+	if sn.closed {
+		return nil, true, ErrSnapshotClosed
+	}
+
+	if data, ok = sn.versions[in.UUID()]; !ok {
+		return
+	}
+
+	if data == nil {
+		return nil, true, noObjectFoundErr(in, fs.ErrNotExist)
+	}
+
+	if err = json.Unmarshal(data, in); err != nil {
+		return
+	}
+
+	return in, true, nil
+}
+
+func (sn *Snapshot) checkType(of Object) error {
+	if stype(of) != stype(sn.object) {
+		return fmt.Errorf("%w expecting %s, got %s", ErrWrongObjectType, stype(sn.object), stype(of))
+	}
+	return nil
+}
+
+// preserve keeps the current version of an Object for the opened
+// snapshots, it must be called before the Object gets modified
+// or deleted
+func (db *DB) preserve(o Object) {
+	for sn := range db.snapshots[stype(o)] {
+		sn.preserve(db, o)
+	}
+}
+
+/***** Public Methods ******/
+
+// Snapshot takes a Snapshot of the Objects of the same type as of.
+// Snapshot must be closed after use.
+func (db *DB) Snapshot(of Object) (sn *Snapshot, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	sn = &Snapshot{
+		object:   of,
+		versions: make(map[string][]byte),
+	}
+
+	sn.db = &DB{
+		l:           db.l,
+		ctx:         db.ctx,
+		cancel:      db.cancel,
+		wg:          db.wg,
+		root:        db.root,
+		cache:       db.cache,
+		asyncw:      db.asyncw,
+		schemas:     make(map[string]*Schema),
+		dirs:        db.dirs,
+		snapshots:   db.snapshots,
+		snapshot:    sn,
+		logger:      db.logger,
+		storage:     db.storage,
+		routines:    db.routines,
+		safeReflect: atomic.LoadInt32(&db.safeReflect),
+	}
+
+	// schema with an index frozen at snapshot time
+	frozen := *s
+	frozen.db = sn.db
+	frozen.ObjectIndex = s.ObjectIndex.clone()
+	frozen.queries = newQueryCache()
+	sn.schema = &frozen
+	sn.db.schemas[stype(of)] = &frozen
+
+	key := stype(of)
+	if _, ok := db.snapshots[key]; !ok {
+		db.snapshots[key] = make(map[*Snapshot]bool)
+	}
+	db.snapshots[key][sn] = true
+
+	return
+}
+
+// Search Objects of the Snapshot, see DB.Search. Objects
+// found cannot be deleted through the Search.
+func (sn *Snapshot) Search(field, operator string, value interface{}) *Search {
+	return sn.db.Search(sn.object, field, operator, value)
+}
+
+// Get gets a single Object of the Snapshot, see DB.Get
+func (sn *Snapshot) Get(in Object) (out Object, err error) {
+	if err = sn.checkType(in); err != nil {
+		return
+	}
+	return sn.db.Get(in)
+}
+
+// All returns all the Objects of the Snapshot
+func (sn *Snapshot) All() (out []Object, err error) {
+	return sn.db.All(sn.object)
+}
+
+// Count returns the number of Objects in the Snapshot
+func (sn *Snapshot) Count() (n int, err error) {
+	return sn.db.Count(sn.object)
+}
+
+// Close closes the Snapshot and releases the Objects versions it keeps.
+// Any subsequent attempt to read Objects from the Snapshot fails with
+// ErrSnapshotClosed.
+func (sn *Snapshot) Close() {
+	sn.db.Lock()
+	defer sn.db.Unlock()
+
+	delete(sn.db.snapshots[stype(sn.object)], sn)
+	sn.versions = nil
+	sn.closed = true
+}
@@ -6,23 +6,51 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
-	"io/ioutil"
-	"os"
+	"math/rand"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	DefaultPermissions = fs.FileMode(0700)
 	LowercaseNames     = false
+	// BulkWriteConcurrency is the maximum number of Objects
+	// written concurrently to disk by bulk insertions
+	BulkWriteConcurrency = 8
+	// DeleteBatchSize is the number of Objects deleted
+	// and committed at once by DB.DeleteOlderThan
+	DeleteBatchSize = 1000
+	// UpdateBatchSize is the number of Objects updated
+	// and committed at once by DB.UpdateWhere
+	UpdateBatchSize = 1000
+	// UUIDRetries is the maximum number of UUIDs generated
+	// for a new Object until one is not used yet
+	UUIDRetries        = 8
 	ErrWrongObjectType = errors.New("wrong objet type")
+	ErrAlreadyExists   = errors.New("object already exists")
+	ErrAsyncWritesOff  = errors.New("async writes not enabled")
+	ErrBadAsyncParams  = errors.New("bad async writes parameters")
+	ErrNotTimeField    = errors.New("not a time.Time field")
+	ErrDuplicateKey    = errors.New("duplicate key")
+	ErrUUIDCollision   = errors.New("no free uuid found")
+
+	errNoFastPath = errors.New("no fast path for search")
 
 	uuidRegexp = regexp.MustCompile(`(?i:^[A-F0-9]{8}-[A-F0-9]{4}-[A-F0-9]{4}-[A-F0-9]{4}-[A-F0-9]{12}$)`)
 )
 
+func IsAlreadyExists(err error) bool {
+	return errors.Is(err, ErrAlreadyExists)
+}
+
 type objectMap struct {
 	sync.RWMutex
 	m map[string]Object
@@ -57,6 +85,20 @@ func (m *objectMap) lockDelete(uuid string) {
 	m.delete(uuid)
 }
 
+// uuids returns the sorted UUIDs of the Objects in the map
+func (m *objectMap) uuids() (uuids []string) {
+	m.RLock()
+	defer m.RUnlock()
+
+	uuids = make([]string, 0, len(m.m))
+	for uuid := range m.m {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	return
+}
+
 func (m *objectMap) len() int {
 	m.RLock()
 	defer m.RUnlock()
@@ -122,6 +164,14 @@ func (s *objectStore) delete(o Object) {
 	}
 }
 
+// drop deletes all the Objects of the type of of
+func (s *objectStore) drop(of Object) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.m, stype(of))
+}
+
 func (s *objectStore) count(of Object) (n int) {
 	s.RLock()
 	defer s.RUnlock()
@@ -133,6 +183,17 @@ func (s *objectStore) count(of Object) (n int) {
 	return
 }
 
+// uuids returns the sorted UUIDs of the Objects of the type of of
+func (s *objectStore) uuids(of Object) []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	if m, ok := s.m[stype(of)]; ok {
+		return m.uuids()
+	}
+	return []string{}
+}
+
 func (s *objectStore) flush(db *DB) (err error) {
 	s.Lock()
 	defer s.Unlock()
@@ -147,38 +208,173 @@ func (s *objectStore) flush(db *DB) (err error) {
 }
 
 type DB struct {
-	l       sync.RWMutex
+	// lock is shared with DB views
+	l *sync.RWMutex
+	// nolock is set on lock free views of the DB
+	nolock  bool
 	ctx     context.Context
 	cancel  context.CancelFunc
+	wg      *sync.WaitGroup
 	root    string
 	cache   *objectStore
 	asyncw  *objectStore
 	schemas map[string]*Schema
+	dirs    *dirNames
+	// opened snapshots by object type
+	snapshots map[string]map[*Snapshot]bool
+	// set on snapshot views of the DB
+	snapshot *Snapshot
+	logger   Logger
+	storage  Storage
+	// types of the Objects flushed by an async writes routine, routines
+	// are tracked by type as schemas can be reloaded
+	routines *sync.Map
+	// reflection panics are returned as errors if set to 1,
+	// accessed atomically (see SetSafeReflect)
+	safeReflect int32
 }
 
 /***** Private Methods ******/
 
+// schemaFile returns the path of the schema file named name found
+// in dir, the compressed one if it exists otherwise the plain one
+func (db *DB) schemaFile(dir, name string) string {
+	compressed := filepath.Join(dir, name+compressedExtension)
+	if isFileAndExist(db.storage, compressed) {
+		return compressed
+	}
+	return filepath.Join(dir, name)
+}
+
+// schemaPath returns the path of the schema file found in dir
+func (db *DB) schemaPath(dir string) string {
+	return db.schemaFile(dir, SchemaFilename)
+}
+
+// schemaBackupPath returns the path of the backup schema file found in dir
+func (db *DB) schemaBackupPath(dir string) string {
+	return db.schemaFile(dir, SchemaBackupFilename)
+}
+
+// schemaNewPath returns the path of the schema file being saved found in dir
+func (db *DB) schemaNewPath(dir string) string {
+	return db.schemaFile(dir, schemaNewFilename)
+}
+
+// hasSchema returns true if a schema file, the one being saved or the
+// backup is found in dir
+func (db *DB) hasSchema(dir string) bool {
+	return isFileAndExist(db.storage, db.schemaPath(dir)) ||
+		isFileAndExist(db.storage, db.schemaNewPath(dir)) ||
+		isFileAndExist(db.storage, db.schemaBackupPath(dir))
+}
+
+// readSchema decodes the newest valid schema file found in dir. A schema file
+// being saved is complete if it can be decoded, as it is only promoted once
+// written, so it is newer than the schema file. The backup schema file is
+// decoded if the other ones are missing or cannot be decoded.
+func (db *DB) readSchema(dir string) (s *Schema, backup bool, err error) {
+	var first error
+
+	new, backupPath := db.schemaNewPath(dir), db.schemaBackupPath(dir)
+	for _, path := range []string{new, db.schemaPath(dir), backupPath} {
+		var stat fs.FileInfo
+
+		s, backup = nil, path == backupPath
+		if stat, err = db.storage.Stat(path); err == nil {
+			if !stat.Mode().IsRegular() {
+				err = ErrBadSchema
+			} else if err = unmarshalJsonFile(db.storage, path, &s); err == nil {
+				switch {
+				case backup:
+					db.logger.Warnf("schema file in %s cannot be loaded, backup loaded instead: %s", dir, first)
+				case path == new:
+					db.logger.Warnf("schema file in %s was not completely saved, the one being saved loaded instead", dir)
+				}
+				return
+			}
+		}
+
+		// error of a missing file is not relevant if the other one is found
+		if first == nil || errors.Is(first, fs.ErrNotExist) {
+			first = err
+		}
+	}
+
+	return nil, false, first
+}
+
 func (db *DB) deleteSchema(o Object) (err error) {
 	var ok bool
 
 	dir := db.oDir(o)
-	path := filepath.Join(dir, SchemaFilename)
+	path := db.schemaPath(dir)
 	skey := stype(o)
 
 	if _, ok = db.schemas[skey]; ok {
 		delete(db.schemas, skey)
 	}
 
-	return os.Remove(path)
+	// backup must not be loaded instead of the schema deleted
+	for _, name := range []string{SchemaBackupFilename, SchemaBackupFilename + compressedExtension} {
+		if bak := filepath.Join(dir, name); isFileAndExist(db.storage, bak) {
+			if err = db.storage.Remove(bak); err != nil {
+				return
+			}
+		}
+	}
+
+	return db.storage.Remove(path)
+}
+
+// backupSchema moves the schema file at path to the backup schema file,
+// it is copied if storage cannot rename files
+func (db *DB) backupSchema(path string) (err error) {
+	var data []byte
+
+	dir := filepath.Dir(path)
+	bak := filepath.Join(dir, SchemaBackupFilename)
+	other := bak + compressedExtension
+	if strings.HasSuffix(path, compressedExtension) {
+		bak, other = other, bak
+	}
+
+	// backup schema file with another compression would be loaded first
+	if isFileAndExist(db.storage, other) {
+		if err = db.storage.Remove(other); err != nil {
+			return
+		}
+	}
+
+	if r, ok := renamer(db.storage); ok {
+		return r.Rename(path, bak)
+	}
+
+	if data, err = db.storage.ReadFile(path); err != nil {
+		return
+	}
+
+	return db.storage.WriteFile(bak, data, DefaultPermissions)
 }
 
+// saveSchema writes the schema file of o while the previous one is kept as
+// backup, so that an interrupted save leaves a schema file to load. If the
+// storage implements Renamer, the new schema file is written aside and
+// promoted once complete, otherwise it is written in place.
 func (db *DB) saveSchema(o Object, s *Schema, override bool) (err error) {
 	var data []byte
 
 	dir := db.oDir(o)
 	path := filepath.Join(dir, SchemaFilename)
+	new := filepath.Join(dir, schemaNewFilename)
+	// schema file used before this one is saved
+	prev := db.schemaPath(dir)
+
+	if err = db.storage.MkdirAll(dir, DefaultPermissions); err != nil {
+		return
+	}
 
-	if err = os.MkdirAll(dir, DefaultPermissions); err != nil {
+	if !override && db.hasSchema(dir) {
 		return
 	}
 
@@ -186,81 +382,323 @@ func (db *DB) saveSchema(o Object, s *Schema, override bool) (err error) {
 		return
 	}
 
-	if override || !isFileAndExist(path) {
-		if err = ioutil.WriteFile(path, data, DefaultPermissions); err != nil {
+	if s.CompressSchema {
+		path += compressedExtension
+		new += compressedExtension
+	}
+
+	if r, ok := renamer(db.storage); ok {
+		if err = writeReader(db.storage, new, bytes.NewReader(data), DefaultPermissions, s.CompressSchema); err != nil {
+			return
+		}
+
+		if isFileAndExist(db.storage, prev) {
+			if err = db.backupSchema(prev); err != nil {
+				return
+			}
+		}
+
+		return r.Rename(new, path)
+	}
+
+	if isFileAndExist(db.storage, prev) {
+		if err = db.backupSchema(prev); err != nil {
+			return
+		}
+	}
+
+	if err = writeReader(db.storage, path, bytes.NewReader(data), DefaultPermissions, s.CompressSchema); err != nil {
+		return
+	}
+
+	// a schema file left by a storage able to rename files must not be
+	// loaded instead of this one
+	if stale := db.schemaNewPath(dir); isFileAndExist(db.storage, stale) {
+		if err = db.storage.Remove(stale); err != nil {
 			return
 		}
 	}
 
+	// schema file changed from plain to compressed or the opposite
+	if prev != path && isFileAndExist(db.storage, prev) {
+		return db.storage.Remove(prev)
+	}
+
 	return
 }
 
 func (db *DB) loadSchema(of Object) (s *Schema, err error) {
+	var backup bool
+
+	// custom directory names are needed to find schema
+	if err = db.dirs.load(db.storage, db.root); err != nil {
+		return
+	}
+
+	// default directory is used by a type with a custom directory name
+	if _, ok := db.dirs.get(stype(of)); !ok {
+		if owner, ok := db.dirs.owner(db.itemname(of)); ok {
+			err = fmt.Errorf("%s %w: directory used by %s", stype(of), ErrSchemaNotCreated, owner)
+			return
+		}
+	}
 
-	var stat os.FileInfo
+	dir := db.oDir(of)
+	if s, backup, err = db.readSchema(dir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = &sentinelErr{ErrSchemaNotCreated, fmt.Sprintf("%s %s", stype(of), ErrSchemaNotCreated), err}
+		}
+		return
+	}
 
-	path := filepath.Join(db.oDir(of), SchemaFilename)
+	// broken schema file must not replace the backup when schema is saved
+	if path := db.schemaPath(dir); backup && db.snapshot == nil && isFileAndExist(db.storage, path) {
+		if err = db.storage.Remove(path); err != nil {
+			return
+		}
+	}
 
-	if stat, err = os.Stat(path); err != nil {
+	// we initialize schema from object
+	if err = s.initialize(db, of); err != nil {
 		return
 	}
 
-	if stat.Mode().IsRegular() {
-		if err = unmarshalJsonFile(path, &s); err != nil {
+	// we control schema and if object struct did not change
+	// we allow to cache schema if index is corrupted
+	if err = s.control(); err != nil {
+		if !errors.Is(err, ErrIndexCorrupted) {
 			return
 		}
+		db.logger.Warnf("%s", err)
+	}
 
-		// we initialize schema from object
-		if err = s.initialize(db, of); err != nil {
+	db.schemas[stype(of)] = s
+
+	// backup index is one commit late, objects written or deleted since
+	// must be indexed as they are on disk
+	if backup && db.snapshot == nil {
+		if err = db.reindex(s, of); err != nil {
+			delete(db.schemas, stype(of))
 			return
 		}
+	}
+
+	return
+}
+
+// syncCompositeIndexes builds the composite indexes declared but not existing
+// yet in schema and drops the ones not declared anymore. Indexes are built
+// and schema is modified by b (see DB.backfill).
+func (db *DB) syncCompositeIndexes(s *Schema, declaration [][]string, b *backfill) (err error) {
+	declared := make(map[string]bool)
+	built := make(map[string]*compositeIndex)
+	for _, fields := range declaration {
+		var ci *compositeIndex
+
+		name := compositeName(fields)
+		declared[name] = true
+
+		if _, ok := s.ObjectIndex.Composites[name]; ok {
+			continue
+		}
 
-		// we control schema and if object struct did not change
-		// we allow to cache schema if index is corrupted
-		if err = s.control(); err != nil && !errors.Is(err, ErrIndexCorrupted) {
+		if ci, err = newCompositeIndex(fields, s.Fields); err != nil {
 			return
 		}
 
-		db.schemas[stype(of)] = s
-		return
+		b.add(ci.insert, nil)
+		built[name] = ci
+	}
+
+	b.install(func() {
+		for name := range s.ObjectIndex.Composites {
+			if !declared[name] {
+				delete(s.ObjectIndex.Composites, name)
+			}
+		}
+
+		for name, ci := range built {
+			s.ObjectIndex.Composites[name] = ci
+		}
+
+		s.CompositeIndexes = declaration
+	})
+
+	return
+}
+
+// syncLenIndexes builds the length indexes declared but not existing yet
+// in schema and drops the ones not declared anymore. Indexes are built
+// and schema is modified by b (see DB.backfill).
+func (db *DB) syncLenIndexes(s *Schema, declaration []string, b *backfill) (err error) {
+	declared := make(map[string]bool)
+	built := make(map[string]*fieldIndex)
+	for _, field := range declaration {
+		lp := LenPath(field)
+		declared[lp] = true
+
+		if _, ok := s.ObjectIndex.Fields[lp]; ok {
+			continue
+		}
+
+		if _, ok := lenByName(newObject(s.object), fieldPath(field)); !ok {
+			return fmt.Errorf("%w %s: cannot index length of field", ErrUnindexableField, field)
+		}
+
+		fi := newFieldIndex(lenDescriptor(lp))
+		fp := fieldPath(field)
+
+		b.addField(fi, func(o Object, objid uint64) error {
+			// index might be made partial by syncPartialIndexes
+			if !fi.indexes(o) {
+				return nil
+			}
+			l, _ := lenByName(o, fp)
+			return fi.Insert(l, objid)
+		}, nil)
+		built[lp] = fi
+	}
+
+	b.install(func() {
+		for fpath, fi := range s.ObjectIndex.Fields {
+			if isLenPath(fi.nameSplit) && !declared[fpath] {
+				delete(s.ObjectIndex.Fields, fpath)
+			}
+		}
+
+		for lp, fi := range built {
+			s.ObjectIndex.Fields[lp] = fi
+		}
+
+		s.LenIndexes = declaration
+	})
+
+	return
+}
+
+// view returns a lock free view of the DB sharing all the DB structures.
+// It must only be used while DB lock is held by the caller.
+func (db *DB) view() *DB {
+	return &DB{
+		l:           db.l,
+		nolock:      true,
+		ctx:         db.ctx,
+		cancel:      db.cancel,
+		wg:          db.wg,
+		root:        db.root,
+		cache:       db.cache,
+		asyncw:      db.asyncw,
+		schemas:     db.schemas,
+		dirs:        db.dirs,
+		snapshots:   db.snapshots,
+		snapshot:    db.snapshot,
+		logger:      db.logger,
+		storage:     db.storage,
+		routines:    db.routines,
+		safeReflect: atomic.LoadInt32(&db.safeReflect)}
+}
+
+// validate validates an Object using its Validate method and
+// ValidateWithDB if Object implements DBValidator
+func (db *DB) validate(o Object) (err error) {
+	if err = o.Validate(); err != nil {
+		return validationErr(o, err)
+	}
+
+	if s, ok := db.schemas[stype(o)]; ok {
+		if err = s.validateJSON(o); err != nil {
+			return validationErr(o, err)
+		}
+	}
+
+	if v, ok := o.(DBValidator); ok {
+		if err = v.ValidateWithDB(&DBView{db.view()}); err != nil {
+			return validationErr(o, err)
+		}
 	}
 
-	err = ErrBadSchema
 	return
 }
 
 func (db *DB) startAsyncWritesRoutine(s *Schema) {
 	step := time.Millisecond * 100
-	if s.asyncWritesEnabled() && !s.AsyncWrites.routineStarted {
-		s.AsyncWrites.routineStarted = true
+	// routine must not be started from a DB view and
+	// objects must never be written in background in write behind mode
+	if s.asyncWritesEnabled() && !s.WriteBehind && !db.nolock && db.snapshot == nil {
+		// no routine must be started once db context is cancelled
+		if db.ctx.Err() != nil {
+			return
+		}
+
+		// schema might have been reloaded since routine started
+		if _, started := db.routines.LoadOrStore(stype(s.object), true); started {
+			return
+		}
+
+		db.wg.Add(1)
 		go func() {
+			defer db.wg.Done()
 			for db.ctx.Err() == nil {
 				for slept := time.Duration(0); ; slept += step {
-					n := db.safeCountPendingAsyncW(s.object)
-					if n >= s.AsyncWrites.Threshold || slept >= s.AsyncWrites.Timeout {
+					// parameters can be modified at runtime
+					n, threshold, timeout := db.safeAsyncWritesState(s)
+					if n >= threshold || slept >= timeout {
 						// enter critical section
 						db.Lock()
 						// checking db.ctx not to race with db.Close function
 						if db.ctx.Err() == nil {
 							if err := db.flushAllAndCommit(s.object); err != nil {
-								panic(err)
+								db.logger.Errorf("%s failed to flush async writes: %s", stype(s.object), err)
 							}
 						}
 						db.Unlock()
 						// leave critical section
 						break
 					}
-					time.Sleep(step)
+
+					select {
+					case <-db.ctx.Done():
+					case <-time.After(step):
+					}
 				}
 			}
 		}()
 	}
 }
 
-func (db *DB) safeCountPendingAsyncW(of Object) (n int) {
+// safeAsyncWritesState returns the number of pending async writes
+// and the async writes parameters of a schema. Parameters are taken
+// from the schema in use as s might have been reloaded since.
+func (db *DB) safeAsyncWritesState(s *Schema) (n, threshold int, timeout time.Duration) {
 	db.RLock()
 	defer db.RUnlock()
-	return db.asyncw.count(of)
+	if cur, ok := db.schemas[stype(s.object)]; ok && cur.asyncWritesEnabled() {
+		s = cur
+	}
+	return db.asyncw.count(s.object), s.AsyncWrites.Threshold, s.AsyncWrites.Timeout
+}
+
+// reloadSchema loads again from disk the schema of of and drops the
+// Objects cached
+func (db *DB) reloadSchema(of Object) (s *Schema, err error) {
+	old, loaded := db.schemas[stype(of)]
+
+	delete(db.schemas, stype(of))
+	db.cache.drop(of)
+
+	if s, err = db.schema(of); err != nil || !loaded {
+		return
+	}
+
+	// functions of derived and partial indexes are not stored
+	for fn, fi := range s.ObjectIndex.Fields {
+		if ofi, ok := old.ObjectIndex.Fields[fn]; ok {
+			fi.compute, fi.predicate = ofi.compute, ofi.predicate
+		}
+	}
+	s.ObjectIndex.partitionBy(s.Partition)
+
+	return
 }
 
 func (db *DB) schema(of Object) (s *Schema, err error) {
@@ -282,13 +720,66 @@ func (db *DB) itemname(o Object) string {
 }
 
 func (db *DB) oDir(of Object) string {
+	if dir, ok := db.dirs.get(stype(of)); ok {
+		return filepath.Join(db.root, dir)
+	}
 	return filepath.Join(db.root, db.itemname(of))
 }
 
+// registerDirName checks the directory used to store Objects described
+// by a new schema is not used by another type and registers custom
+// directory names
+func (db *DB) registerDirName(o Object, s *Schema) (err error) {
+	dir := s.DirName
+
+	if dir == "" {
+		dir = db.itemname(o)
+	} else if filepath.Base(dir) != dir || dir == "." || dir == ".." {
+		return fmt.Errorf("%w %q", ErrBadDirName, dir)
+	}
+
+	if owner, ok := db.dirs.owner(dir); ok && owner != stype(o) {
+		return fmt.Errorf("%w: %q is used by %s", ErrDirNameCollision, dir, owner)
+	}
+
+	if s.DirName == "" {
+		return
+	}
+
+	// directory already holds the schema of another type
+	if db.hasSchema(filepath.Join(db.root, dir)) {
+		return fmt.Errorf("%w: %q is used by another type", ErrDirNameCollision, dir)
+	}
+
+	return db.dirs.set(db.storage, db.root, stype(o), dir)
+}
+
+// oPath returns the path of the file storing an Object, partitioned Objects
+// are looked up in their partition according to the index
 func (db *DB) oPath(s *Schema, of Object) (path string) {
+	if name, ok := s.partitionFromIndex(of.UUID()); ok {
+		return filepath.Join(db.oDir(of), name, s.filename(of))
+	}
 	return filepath.Join(db.oDir(of), s.filename(of))
 }
 
+// writePath returns the path an Object must be written to
+func (db *DB) writePath(s *Schema, o Object) (path string) {
+	if name, ok := s.partitionOf(o); ok {
+		return filepath.Join(db.oDir(o), name, s.filename(o))
+	}
+	return filepath.Join(db.oDir(o), s.filename(o))
+}
+
+// removeStale removes the file an Object was stored in before
+// it moved to another partition
+func (db *DB) removeStale(s *Schema, o Object, old string) (err error) {
+	if old != db.oPath(s, o) && isFileAndExist(db.storage, old) {
+		return db.storage.Remove(old)
+	}
+	return
+}
+
 func (db *DB) exist(o Object) (ok bool, err error) {
 	var path string
 	var s *Schema
@@ -298,13 +789,33 @@ func (db *DB) exist(o Object) (ok bool, err error) {
 	}
 
 	path = db.oPath(s, o)
-	stat, err := os.Stat(path)
-	if os.IsNotExist(err) {
+	stat, err := db.storage.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
 		return false, nil
 	}
 	return stat.Mode().IsRegular() && err == nil, nil
 }
 
+// encodeObject returns the content of the file of o stored at path
+func (db *DB) encodeObject(s *Schema, path string, o Object) (data []byte, err error) {
+	// encoding is deterministic as encoding/json sorts map keys
+	if data, err = json.Marshal(o); err != nil {
+		return
+	}
+
+	if data, err = s.encodeTimes(data); err != nil {
+		return
+	}
+
+	if s.PreserveUnknownFields {
+		if data, err = preserveUnknownFields(db.storage, path, o, data); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
 func (db *DB) writeObject(o Object) (err error) {
 	var data []byte
 	var s *Schema
@@ -313,16 +824,22 @@ func (db *DB) writeObject(o Object) (err error) {
 		return
 	}
 
-	path := db.oPath(s, o)
-	if err = os.MkdirAll(filepath.Dir(path), DefaultPermissions); err != nil {
+	path := db.writePath(s, o)
+	if err = db.storage.MkdirAll(filepath.Dir(path), DefaultPermissions); err != nil {
 		return
 	}
 
-	if data, err = json.Marshal(o); err != nil {
+	if data, err = db.encodeObject(s, path, o); err != nil {
 		return
 	}
 
-	if err = writeReader(path, bytes.NewBuffer(data), DefaultPermissions, s.Compress); err != nil {
+	if s.KeepHistory > 0 {
+		if err = db.archive(s, o, path); err != nil {
+			return
+		}
+	}
+
+	if err = writeReader(db.storage, path, bytes.NewBuffer(data), DefaultPermissions, s.Compress); err != nil {
 		return
 	}
 
@@ -344,6 +861,13 @@ func (db *DB) get(in Object) (out Object, err error) {
 		return
 	}
 
+	// objects modified since the snapshot was taken
+	if db.snapshot != nil {
+		if out, ok, err = db.snapshot.preserved(in); ok {
+			return
+		}
+	}
+
 	// we return object if cached
 	if s.mustCache() {
 		if out, ok = db.cache.get(in); ok {
@@ -351,9 +875,20 @@ func (db *DB) get(in Object) (out Object, err error) {
 		}
 	}
 
-	path = filepath.Join(db.oDir(in), s.filename(in))
-	err = unmarshalJsonFile(path, in)
+	path = db.oPath(s, in)
+	if err = db.readObject(s, path, in, nil); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			db.readRepair(s, in, false)
+			err = noObjectFoundErr(in, err)
+		}
+		return
+	}
 	out = in
+	db.readRepair(s, out, true)
+
+	if pl, ok := out.(PostLoader); ok {
+		pl.PostLoad()
+	}
 
 	// we cache the object
 	if s.mustCache() {
@@ -362,45 +897,340 @@ func (db *DB) get(in Object) (out Object, err error) {
 	return
 }
 
-func (db *DB) initialize(o Object) (err error) {
-	// this is a new object, we have to handle here
-	// potential uuid duplicates (even though it is very unlikely)
-	if o.UUID() == "" {
-		for ok := true; ok; {
-			o.Initialize(uuidOrPanic())
-			ok, err = db.exist(o)
-			if err != nil {
-				return
-			}
-		}
-	}
-	return
-}
-
-func (db *DB) insertOrUpdate(s *Schema, o Object, commit bool) (err error) {
+// getFields gets a single Object from the DB only decoding the fields passed
+// as parameter. Cached objects are returned with all their fields.
+func (db *DB) getFields(in Object, fields []string) (out Object, err error) {
+	var ok bool
+	var s *Schema
+	var keys []string
 
-	// initialize object first
-	if err = db.initialize(o); err != nil {
+	if s, err = db.schema(in); err != nil {
 		return
 	}
 
+	if !s.isUUIDIndexed(in.UUID()) {
+		return nil, noObjectFoundErr(in, fs.ErrNotExist)
+	}
+
 	if s.mustCache() {
-		db.cache.put(o)
+		if out, ok = db.cache.get(in); ok {
+			return
+		}
 	}
 
-	if err = s.index(o); err != nil {
+	if keys, err = jsonKeys(in, fields); err != nil {
 		return
 	}
 
-	if s.asyncWritesEnabled() {
-		// we don't write object to disk but store
-		// it in a structure for later saving
-		db.asyncw.put(o)
-	} else {
-		// writing the object to disk
-		if err = db.writeObject(o); err != nil {
-			return
-		}
+	// fields not requested are zero whatever in holds
+	uuid := in.UUID()
+	v := reflect.ValueOf(in).Elem()
+	v.Set(reflect.Zero(v.Type()))
+	in.Initialize(uuid)
+
+	// partial objects must never be cached
+	if err = db.readObject(s, db.oPath(s, in), in, keys); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = noObjectFoundErr(in, err)
+		}
+		return
+	}
+
+	return in, nil
+}
+
+// getIndexed gets a single Object from the DB only if it is indexed
+func (db *DB) getIndexed(in Object) (out Object, err error) {
+	var s *Schema
+
+	if s, err = db.schema(in); err != nil {
+		return
+	}
+
+	// we don't attempt to read from disk an object not indexed
+	if !s.isUUIDIndexed(in.UUID()) {
+		// unless it is to repair the index
+		if s.ReadRepair {
+			cur := newObject(in)
+			cur.Initialize(in.UUID())
+			db.get(cur)
+		}
+		return nil, noObjectFoundErr(in, fs.ErrNotExist)
+	}
+
+	return db.get(in)
+}
+
+func (db *DB) initialize(o Object) (err error) {
+	// this is a new object, we have to handle here
+	// potential uuid duplicates (even though it is very unlikely)
+	if o.UUID() == "" {
+		return db.newUUID(o, db.existOrIndexed)
+	}
+	return
+}
+
+// newUUID initializes o with a new UUID for which exist returns false. It
+// gives up after UUIDRetries attempts, returning an error wrapping
+// ErrUUIDCollision, and aborts at the first error returned by exist. The
+// UUID of o is reset if no free UUID is found.
+func (db *DB) newUUID(o Object, exist func(Object) (bool, error)) (err error) {
+	var ok bool
+
+	retries := UUIDRetries
+	if retries < 1 {
+		retries = 1
+	}
+
+	for i := 0; i < retries; i++ {
+		o.Initialize(uuidOrPanic())
+		if ok, err = exist(o); err != nil {
+			break
+		} else if !ok {
+			return
+		}
+	}
+
+	// Object must stay new
+	o.Initialize("")
+
+	if err != nil {
+		return
+	}
+
+	return fmt.Errorf("%s %w after %d attempts", stype(o), ErrUUIDCollision, retries)
+}
+
+// existOrIndexed returns true if the object exists on disk or is
+// indexed (i.e. it is pending to be written asynchronously)
+func (db *DB) existOrIndexed(o Object) (ok bool, err error) {
+	var s *Schema
+
+	if s, err = db.schema(o); err != nil {
+		return
+	}
+
+	if s.isUUIDIndexed(o.UUID()) {
+		return true, nil
+	}
+
+	return db.exist(o)
+}
+
+// writeObjects writes Objects to disk using at most BulkWriteConcurrency
+// concurrent writers. It returns the error of the first Object, in the
+// order they were passed, whose write failed.
+func (db *DB) writeObjects(objects []Object, progress ProgressFunc) (err error) {
+	var mut sync.Mutex
+	var n int
+
+	wg := sync.WaitGroup{}
+	jobs := make(chan int)
+	errs := make([]error, len(objects))
+
+	workers := BulkWriteConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				o := objects[i]
+				if errs[i] = db.writeObject(o); errs[i] != nil {
+					errs[i] = fmt.Errorf("%w > %s", errs[i], jsonOrPanic(o))
+					continue
+				}
+
+				mut.Lock()
+				n++
+				if progress != nil {
+					progress(n, len(objects))
+				}
+				mut.Unlock()
+			}
+		}()
+	}
+
+	for i := range objects {
+		jobs <- i
+	}
+	close(jobs)
+
+	wg.Wait()
+
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+
+	return
+}
+
+// previousVersion is the state of an Object before it is updated
+// by a bulk insertion, used to revert the insertion if it fails
+type previousVersion struct {
+	// Object as it was, only set when writes are deferred
+	// as it might not be written to disk yet
+	object Object
+	// file the Object is stored in and its content
+	path string
+	data []byte
+	// latest version of the Object kept in history
+	version int
+}
+
+// previousVersions returns the state of the Objects already in the DB
+// before they are updated by an insertion, mapped by UUID
+func (db *DB) previousVersions(s *Schema, objects []Object) (previous map[string]*previousVersion, err error) {
+	previous = make(map[string]*previousVersion)
+
+	for _, o := range objects {
+		var versions []int
+
+		if _, ok := previous[o.UUID()]; ok || !s.isUUIDIndexed(o.UUID()) {
+			continue
+		}
+
+		p := &previousVersion{path: db.oPath(s, o)}
+
+		// objects missing from disk cannot be restored
+		if s.deferWrites() {
+			if p.object, err = db.getByUUID(newObject(o), o.UUID()); err != nil {
+				if !errors.Is(err, ErrNoObjectFound) {
+					return
+				}
+				p.object, err = nil, nil
+			}
+		} else if p.data, err = db.storage.ReadFile(p.path); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return
+			}
+			p.data, err = nil, nil
+		}
+
+		if s.KeepHistory > 0 && !s.deferWrites() {
+			if versions, _, err = db.versions(o); err != nil {
+				return
+			}
+			if len(versions) > 0 {
+				p.version = versions[len(versions)-1]
+			}
+		}
+
+		previous[o.UUID()] = p
+	}
+
+	return
+}
+
+// rollback reverts the insertion of objects, already indexed and maybe
+// written to disk, so that the DB is as described by previous. Objects
+// are unindexed, files of new Objects are removed and Objects already
+// in the DB are restored, on disk if written is set, and indexed again.
+func (db *DB) rollback(s *Schema, objects []Object, written bool, previous map[string]*previousVersion) (err error) {
+	for _, o := range objects {
+		if s.mustCache() {
+			db.cache.delete(o)
+		}
+		s.unindex(o)
+
+		p, ok := previous[o.UUID()]
+
+		// file of a new Object or of an Object moved to another partition
+		if path := db.writePath(s, o); written && (!ok || path != p.path) && isFileAndExist(db.storage, path) {
+			if e := db.storage.Remove(path); e != nil {
+				err = e
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		old := p.object
+		if old == nil {
+			if p.data == nil {
+				continue
+			}
+
+			if written {
+				if e := db.storage.WriteFile(p.path, p.data, DefaultPermissions); e != nil {
+					err = e
+					continue
+				}
+
+				if s.KeepHistory > 0 {
+					if e := db.unarchive(o, p.version); e != nil {
+						err = e
+					}
+				}
+			}
+
+			old = newObject(o)
+			old.Initialize(o.UUID())
+			if e := db.readObject(s, p.path, old, nil); e != nil {
+				err = e
+				continue
+			}
+		} else if s.mustCache() {
+			db.cache.put(old)
+		}
+
+		if e := s.index(old); e != nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+// index initializes and indexes an Object, it does not write it to disk
+func (db *DB) index(s *Schema, o Object) (err error) {
+
+	// initialize object first
+	if err = db.initialize(o); err != nil {
+		return
+	}
+
+	// must be done before object is modified in cache
+	db.preserve(o)
+
+	if s.mustCache() {
+		db.cache.put(o)
+	}
+
+	old := db.oPath(s, o)
+	if err = s.index(o); err != nil {
+		return
+	}
+
+	// object moved to another partition
+	if s.Partition != nil {
+		return db.removeStale(s, o, old)
+	}
+
+	return
+}
+
+func (db *DB) insertOrUpdate(s *Schema, o Object, commit bool) (err error) {
+
+	if err = db.index(s, o); err != nil {
+		return
+	}
+
+	if s.deferWrites() {
+		// we don't write object to disk but store
+		// it in a structure for later saving
+		db.asyncw.put(o)
+	} else {
+		// writing the object to disk
+		if err = db.writeObject(o); err != nil {
+			return
+		}
 
 		// commiting schema and index to disk
 		if commit {
@@ -419,33 +1249,73 @@ func (db *DB) delete(o Object) (err error) {
 		return
 	}
 
+	db.preserve(o)
+
 	// deleting from cache
 	if s.mustCache() {
 		db.cache.delete(o)
 		db.asyncw.delete(o)
 	}
 
-	// unindexing object
+	// path must be known before unindexing object
+	path = db.oPath(s, o)
 	s.unindex(o)
-	path = filepath.Join(db.oDir(o), s.filename(o))
-	if isFileAndExist(path) {
-		return os.Remove(path)
+
+	// deleted version is kept as the latest previous version
+	if s.KeepHistory > 0 {
+		if err = db.archive(s, o, path); err != nil {
+			return
+		}
+	}
+
+	if isFileAndExist(db.storage, path) {
+		s.deleted = true
+		return db.storage.Remove(path)
 	}
 	return
 }
 
-func (db *DB) search(o Object, field, operator string, value interface{}, constrain []*indexedField) *Search {
+func (db *DB) findDuplicates(of Object, fields []string) (groups [][]string, err error) {
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	if len(fields) == 0 {
+		for _, fd := range s.Indexed() {
+			fields = append(fields, fd.Path)
+		}
+		sort.Strings(fields)
+	}
+
+	return s.ObjectIndex.duplicates(fields)
+}
+
+func (db *DB) search(o Object, field, operator string, value interface{}, constrain []*IndexedField) *Search {
 	var s *Schema
-	var f []*indexedField
+	var f []*IndexedField
 	var err error
 
 	if s, err = db.schema(o); err != nil {
 		return &Search{db: db, err: err}
 	}
 
+	if err = s.checkObject(o); err != nil {
+		return &Search{db: db, err: err}
+	}
+
+	if operator == HasKeyOperator {
+		return db.searchKey(s, o, field, value, constrain)
+	}
+
 	// transform search value before searching
 	s.prepare(field, &value)
 
+	if operator, value, err = searchOperator(operator, value); err != nil {
+		return &Search{db: db, err: err}
+	}
+
 	if f, err = s.ObjectIndex.search(o, field, operator, value, constrain); err != nil {
 		// if the field is not indexed we have to go through all the collection
 		if errors.Is(err, ErrFieldNotIndexed) {
@@ -457,6 +1327,91 @@ func (db *DB) search(o Object, field, operator string, value interface{}, constr
 	}
 }
 
+// searchComposite searches AND clauses using a composite index. It returns
+// false if no composite index can be used.
+func (db *DB) searchComposite(o Object, clauses []*searchClause) (f []*IndexedField, ok bool) {
+	var s *Schema
+	var err error
+
+	if s, err = db.schema(o); err != nil {
+		return
+	}
+
+	// transform search values before searching
+	prepared := make([]*searchClause, 0, len(clauses))
+	for _, c := range clauses {
+		p := *c
+		s.prepare(p.field, &p.value)
+		prepared = append(prepared, &p)
+	}
+
+	return s.ObjectIndex.searchComposite(prepared)
+}
+
+// searchRange searches two AND clauses on the same indexed field with a
+// single range search. It returns false if clauses cannot be collapsed.
+func (db *DB) searchRange(o Object, a, b *searchClause, constrain []*IndexedField) (f []*IndexedField, ok bool) {
+	var s *Schema
+	var err error
+
+	if s, err = db.schema(o); err != nil {
+		return
+	}
+
+	// errors are left to the regular search path
+	if err = s.checkObject(o); err != nil {
+		return
+	}
+
+	// transform search values before searching
+	pa, pb := *a, *b
+	s.prepare(pa.field, &pa.value)
+	s.prepare(pb.field, &pb.value)
+
+	return s.ObjectIndex.searchRange(&pa, &pb, constrain)
+}
+
+// searchFirst returns the first Object matching a single clause search
+// without evaluating the full search. It returns errNoFastPath if
+// the search cannot be optimized.
+func (db *DB) searchFirst(o Object, c *searchClause, reverse bool) (out Object, err error) {
+	var s *Schema
+	var fi *fieldIndex
+	var iField *IndexedField
+	var ok bool
+
+	// only equality searches are optimized
+	if c.operator != "=" {
+		return nil, errNoFastPath
+	}
+
+	if s, err = db.schema(o); err != nil {
+		return
+	}
+
+	// results of partitions are merged by the regular search path
+	if fi, ok = s.ObjectIndex.Fields[c.field]; !ok || s.ObjectIndex.Partitions != nil {
+		return nil, errNoFastPath
+	}
+
+	// transform search value before searching
+	value := c.value
+	s.prepare(c.field, &value)
+
+	// error handling is left to the regular search path
+	if iField, err = searchField(value); err != nil || fi.Cast != iField.valueTypeString() {
+		return nil, errNoFastPath
+	}
+
+	if iField, ok = fi.SearchFirstEqual(iField, reverse); !ok {
+		return nil, ErrNoObjectFound
+	}
+
+	out = newObject(o)
+	out.Initialize(s.ObjectIndex.ObjectIds[iField.ObjectId])
+	return db.get(out)
+}
+
 func (db *DB) flush(o Object) (err error) {
 
 	if e := db.writeObject(o); e != nil {
@@ -489,32 +1444,102 @@ func (db *DB) flushDB() (err error) {
 func Open(root string) *DB {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &DB{
-		ctx:     ctx,
-		cancel:  cancel,
-		root:    root,
-		cache:   newObjectStore(),
-		asyncw:  newObjectStore(),
-		schemas: map[string]*Schema{}}
+		l:         new(sync.RWMutex),
+		ctx:       ctx,
+		cancel:    cancel,
+		wg:        new(sync.WaitGroup),
+		root:      root,
+		cache:     newObjectStore(),
+		asyncw:    newObjectStore(),
+		schemas:   map[string]*Schema{},
+		dirs:      newDirNames(),
+		snapshots: map[string]map[*Snapshot]bool{},
+		logger:    nopLogger{},
+		storage:   OSStorage{},
+		routines:  new(sync.Map)}
+}
+
+// OpenWithLogger opens a Simple Object Database reporting its
+// internal events to logger
+func OpenWithLogger(root string, logger Logger) *DB {
+	db := Open(root)
+	if logger != nil {
+		db.logger = logger
+	}
+	return db
+}
+
+// OpenWithStorage opens a Simple Object Database stored on storage
+func OpenWithStorage(root string, storage Storage) *DB {
+	db := Open(root)
+	if storage != nil {
+		db.storage = storage
+	}
+	return db
+}
+
+// OpenWithMaxOpenFiles opens a Simple Object Database opening at most
+// n Object files concurrently, see LimitStorage
+func OpenWithMaxOpenFiles(root string, n int) *DB {
+	return OpenWithStorage(root, LimitStorage(OSStorage{}, n))
+}
+
+// OpenVerified opens a Simple Object Database and verifies the schemas of
+// the types of Objects passed as parameters, typically after an unclean
+// shutdown. Schemas are controlled and the ones having a corrupted index
+// are repaired and committed. Types without schema are skipped. An error
+// is returned only if a schema cannot be loaded (i.e. structure changed)
+// or repaired. Schemas found on disk but not belonging to any of the
+// types cannot be verified, a warning is logged for each of them.
+func OpenVerified(root string, types ...Object) (db *DB, err error) {
+	db = Open(root)
+
+	verified := make(map[string]bool)
+	for _, of := range types {
+		if err = db.verify(of); err != nil {
+			return nil, err
+		}
+		verified[db.oDir(of)] = true
+	}
+
+	if entries, e := db.storage.ReadDir(root); e == nil {
+		for _, entry := range entries {
+			dir := filepath.Join(root, entry.Name())
+			if entry.IsDir() && !verified[dir] && db.hasSchema(dir) {
+				db.logger.Warnf("schema found in %s not verified: object type unknown", dir)
+			}
+		}
+	}
+
+	return
 }
 
 func (db *DB) Lock() {
-	//dbgLock("Lock")
-	db.l.Lock()
+	db.traceLock("Lock")
+	if !db.nolock {
+		db.l.Lock()
+	}
 }
 
 func (db *DB) RLock() {
-	//dbgLock("RLock")
-	db.l.RLock()
+	db.traceLock("RLock")
+	if !db.nolock {
+		db.l.RLock()
+	}
 }
 
 func (db *DB) Unlock() {
-	//dbgLock("Unlock")
-	db.l.Unlock()
+	db.traceLock("Unlock")
+	if !db.nolock {
+		db.l.Unlock()
+	}
 }
 
 func (db *DB) RUnlock() {
-	//dbgLock("RUnlock")
-	db.l.RUnlock()
+	db.traceLock("RUnlock")
+	if !db.nolock {
+		db.l.RUnlock()
+	}
 }
 
 // Create a schema for an Object
@@ -527,27 +1552,135 @@ func (db *DB) Create(o Object, s Schema) (err error) {
 
 	switch {
 	case err == nil:
-		s.initialize(db, o)
-
-		// the schema is existing and we don't need to build a new one
-		// update existing schema with changes
-		if err = es.update(&s); err != nil {
+		if err = s.initialize(db, o); err != nil {
 			return
 		}
 
-		return db.saveSchema(o, es, true)
+		if err = s.controlUpdatedAt(); err != nil {
+			return
+		}
 
-	case errors.Is(err, fs.ErrNotExist):
-		// we need to create a new schema
-		if err = s.initialize(db, o); err != nil {
+		if err = s.controlSequence(); err != nil {
 			return
 		}
 
-		if err = db.saveSchema(o, &s, false); err != nil {
+		if err = s.controlContentAddressed(); err != nil {
 			return
 		}
 
-		if err = s.control(); err != nil {
+		// the schema is existing and we don't need to build a new one
+		// update existing schema with changes
+		if err = es.update(&s); err != nil {
+			return
+		}
+		es.syncSequence()
+
+		// indexes declared are built in a single pass
+		b := newBackfill()
+
+		if err = db.syncCompositeIndexes(es, s.CompositeIndexes, b); err != nil {
+			return
+		}
+
+		if err = db.syncLenIndexes(es, s.LenIndexes, b); err != nil {
+			return
+		}
+
+		if err = db.syncKeyIndexes(es, s.KeyIndexes, b); err != nil {
+			return
+		}
+
+		if err = db.syncDerivedIndexes(es, s.derived, b); err != nil {
+			return
+		}
+
+		if err = db.syncPartialIndexes(es, s.partials, b); err != nil {
+			return
+		}
+
+		if err = db.backfill(es, b); err != nil {
+			return
+		}
+
+		return db.saveSchema(o, es, true)
+
+	case errors.Is(err, ErrSchemaNotCreated):
+		// we need to create a new schema
+		if err = s.initialize(db, o); err != nil {
+			return
+		}
+
+		if s.Partition != nil {
+			if err = s.Partition.validate(s.Fields); err != nil {
+				return
+			}
+		}
+
+		if err = s.Fields.validateSuffixIndexes(); err != nil {
+			return
+		}
+
+		if err = s.controlTimeFormat(); err != nil {
+			return
+		}
+
+		if err = s.controlUpdatedAt(); err != nil {
+			return
+		}
+
+		if err = s.controlSequence(); err != nil {
+			return
+		}
+
+		if err = s.controlContentAddressed(); err != nil {
+			return
+		}
+
+		// indexes declared are built in a single pass
+		b := newBackfill()
+
+		if err = db.syncCompositeIndexes(&s, s.CompositeIndexes, b); err != nil {
+			return
+		}
+
+		if err = db.syncLenIndexes(&s, s.LenIndexes, b); err != nil {
+			return
+		}
+
+		if err = db.syncKeyIndexes(&s, s.KeyIndexes, b); err != nil {
+			return
+		}
+
+		if err = db.syncDerivedIndexes(&s, s.derived, b); err != nil {
+			return
+		}
+
+		if err = db.syncPartialIndexes(&s, s.partials, b); err != nil {
+			return
+		}
+
+		if err = db.backfill(&s, b); err != nil {
+			return
+		}
+
+		if err = db.registerDirName(o, &s); err != nil {
+			return
+		}
+
+		// directory name of a schema not created must not stay registered
+		defer func() {
+			if err != nil && s.DirName != "" {
+				if e := db.dirs.remove(db.storage, db.root, stype(o)); e != nil {
+					db.logger.Errorf("failed to unregister directory name of %s: %s", stype(o), e)
+				}
+			}
+		}()
+
+		if err = db.saveSchema(o, &s, false); err != nil {
+			return
+		}
+
+		if err = s.control(); err != nil {
 			return
 		}
 
@@ -568,19 +1701,128 @@ func (db *DB) Schema(of Object) (s *Schema, err error) {
 	return db.schema(of)
 }
 
-// Get gets a single Object from the DB
+// Get gets a single Object from the DB. If the Object is not found
+// ErrNoObjectFound is returned.
 func (db *DB) Get(in Object) (out Object, err error) {
 	db.RLock()
 	defer db.RUnlock()
 
-	return db.get(in)
+	return db.getIndexed(in)
 }
 
-// GetByUUID gets a single Object from the DB its UUID
+// GetByUUID gets a single Object from the DB its UUID. If the Object
+// is not found ErrNoObjectFound is returned.
 func (db *DB) GetByUUID(in Object, uuid string) (out Object, err error) {
 	db.RLock()
 	defer db.RUnlock()
-	return db.getByUUID(in, uuid)
+
+	in.Initialize(uuid)
+	return db.getIndexed(in)
+}
+
+// GetManyByUUID gets several Objects from the DB by their UUIDs. Objects
+// are returned in the same order as uuids and a nil placeholder is set
+// for any Object not found in the DB.
+func (db *DB) GetManyByUUID(of Object, uuids []string) (out []Object, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var o Object
+
+	out = make([]Object, len(uuids))
+	for i, uuid := range uuids {
+		o = newObject(of)
+		o.Initialize(uuid)
+		if o, err = db.getIndexed(o); err != nil {
+			if IsNoObjectFound(err) {
+				err = nil
+				continue
+			}
+			return
+		}
+		out[i] = o
+	}
+
+	return
+}
+
+// GetFields gets a single Object from the DB but only decodes from disk
+// the fields passed as parameter, other fields of in are reset to their zero
+// value. It is meant to speed up reads of wide objects when only few fields
+// are needed (see BenchmarkGetFields). Only the top level part of a field path is considered so nested
+// structures are decoded entirely. If the Object is cached it is returned
+// with all its fields set.
+func (db *DB) GetFields(in Object, fields ...string) (out Object, err error) {
+	defer db.recoverReflect(&err)
+
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.getFields(in, fields)
+}
+
+// RawJSON returns the raw JSON data, decompressed if needed, of the Object
+// of the same type as of and identified by uuid, as stored on disk. It does
+// not unmarshal data so it can be used to diagnose serialization issues, it
+// even works if the schema cannot be loaded because the Object structure
+// changed. Objects not written to disk yet are not found, neither are
+// uuids which are not well formed as they cannot identify an Object.
+func (db *DB) RawJSON(of Object, uuid string) (data []byte, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+	var entries []fs.DirEntry
+
+	o := newObject(of)
+	o.Initialize(uuid)
+
+	// uuid is used to build a path so it must not be arbitrary
+	if !uuidRegexp.MatchString(uuid) {
+		return nil, noObjectFoundErr(o, fs.ErrNotExist)
+	}
+
+	if s, err = db.schema(o); err == nil {
+		if data, err = readJsonFile(db.storage, db.oPath(s, o)); errors.Is(err, fs.ErrNotExist) {
+			err = noObjectFoundErr(o, err)
+		}
+		return
+	} else if errors.Is(err, ErrSchemaNotCreated) {
+		return
+	}
+
+	// schema cannot be loaded so we search the file
+	if entries, err = db.storage.ReadDir(db.oDir(o)); err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), uuid+".") && entry.Type().IsRegular() {
+			return readJsonFile(db.storage, filepath.Join(db.oDir(o), entry.Name()))
+		}
+	}
+
+	// object might be stored in a partition
+	for _, entry := range entries {
+		var sub []fs.DirEntry
+
+		if !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(db.oDir(o), entry.Name())
+		if sub, err = db.storage.ReadDir(dir); err != nil {
+			return
+		}
+
+		for _, e := range sub {
+			if strings.HasPrefix(e.Name(), uuid+".") && e.Type().IsRegular() {
+				return readJsonFile(db.storage, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	return nil, noObjectFoundErr(o, fs.ErrNotExist)
 }
 
 func (db *DB) all(of Object) (out []Object, err error) {
@@ -613,23 +1855,59 @@ func (db *DB) All(of Object) (out []Object, err error) {
 
 // AssignAll assigns all Objects in the DB to target
 func (db *DB) AssignAll(of Object, target interface{}) (err error) {
+	defer db.recoverReflect(&err)
+
+	db.RLock()
+	defer db.RUnlock()
+
+	var it *iterator
+
+	if it, err = db.Iterator(of); err != nil {
+		return
+	}
+
+	// objects are directly assigned to target
+	return assignIterator(it, target)
+}
+
+// AllAsMap assigns all the Objects of the same type as of to target, a
+// *map[K]*T, keyed by the values of keyField or by UUID if keyField is
+// UUIDField. A new map is assigned to target only if no error occurred.
+// ErrDuplicateKey is returned if several Objects have the same key, so
+// keyField should be unique. Like Assign, the function panics if target is
+// not a map pointer or if keys or Objects cannot be assigned to the map.
+func (db *DB) AllAsMap(of Object, keyField string, target interface{}) (err error) {
+	defer db.recoverReflect(&err)
+
 	db.RLock()
 	defer db.RUnlock()
 
-	var objs []Object
+	var s *Schema
+	var it *iterator
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	if _, ok := s.Fields.GetDescriptor(keyField); !ok && keyField != UUIDField {
+		return fmt.Errorf("%w %s for object %T", ErrUnkownField, keyField, of)
+	}
 
-	if objs, err = db.all(of); err != nil {
+	if it, err = db.Iterator(of); err != nil {
 		return
 	}
 
-	return Assign(objs, target)
+	return assignMap(it, keyField, target)
 }
 
 // AssignIndex assign indexed fields to target. It prevents from fetching objects from disk
 // if the only thing we actually want to query is some indexed fields. As indexes are
 // all in memory this call is fast. The function panics if target is not a slice pointer
-// or if indexed values cannot be assigned to target elements.
+// or if indexed values cannot be assigned to target elements, the latter is returned
+// as ErrReflection if safe reflection is enabled (see DB.SetSafeReflect).
 func (db *DB) AssignIndex(of Object, field string, target interface{}) (err error) {
+	defer db.recoverReflect(&err)
+
 	db.RLock()
 	defer db.RUnlock()
 
@@ -642,13 +1920,73 @@ func (db *DB) AssignIndex(of Object, field string, target interface{}) (err erro
 	return s.assignIndex(of, field, target)
 }
 
-func (db *DB) searchAll(o Object, field, operator string, value interface{}, constrain []*indexedField) *Search {
+// AssignIndexes assigns the indexed values of several fields to targets,
+// one target per field, under a single read lock. Values are assigned in
+// the same Object order for all the fields so that targets[i][k] are the
+// values of the same Object. ErrTargetsMismatch is returned if the numbers
+// of fields and targets differ. Like AssignIndex, it panics if a target is
+// not a slice pointer or if indexed values cannot be assigned to it (see
+// DB.SetSafeReflect).
+func (db *DB) AssignIndexes(of Object, fields []string, targets ...interface{}) (err error) {
+	defer db.recoverReflect(&err)
+
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	return s.assignIndexes(of, fields, targets...)
+}
+
+// IsIndexed returns true if field is indexed in the schema of of, length
+// virtual fields (see Schema.IndexLen) included. Searching an indexed field
+// does not scan Objects. Virtual UUIDField is not considered as a field.
+func (db *DB) IsIndexed(of Object, field string) (ok bool, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	_, ok = s.ObjectIndex.Fields[field]
+	return
+}
+
+// IndexedFields returns the sorted paths of the fields
+// indexed in the schema of of, see IsIndexed
+func (db *DB) IndexedFields(of Object) (fields []string, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	fields = make([]string, 0, len(s.ObjectIndex.Fields))
+	for _, fd := range s.Indexed() {
+		fields = append(fields, fd.Path)
+	}
+	sort.Strings(fields)
+
+	return
+}
+
+func (db *DB) searchAll(o Object, field, operator string, value interface{}, constrain []*IndexedField) *Search {
 	var iter *iterator
 	var err error
 	var s *Schema
-	var search *indexedField
+	var search *IndexedField
 
-	f := make([]*indexedField, 0)
+	f := make([]*IndexedField, 0)
 
 	if search, err = searchField(value); err != nil {
 		return &Search{db: db, err: err}
@@ -673,13 +2011,19 @@ func (db *DB) searchAll(o Object, field, operator string, value interface{}, con
 	fp := fieldPath(field)
 	searchType := search.valueTypeString()
 
+	// substring searches only apply to strings
+	if (operator == "contains" || operator == "$=") && searchType != "string" {
+		return &Search{db: db, err: fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, search.Value, search.Value)}
+	}
+
 	for obj, err := iter.next(); err == nil && err != ErrEOI; obj, err = iter.next() {
-		var test *indexedField
+		var test *IndexedField
 		var value interface{}
 		var ok bool
 		var index uint64
 
 		if index, ok = s.ObjectIndex.uuids[obj.UUID()]; !ok {
+			db.logger.Warnf("%s %s: object uuid=%s is not indexed", stype(o), ErrIndexCorrupted, obj.UUID())
 			return &Search{db: db, err: ErrIndexCorrupted}
 		}
 
@@ -710,12 +2054,113 @@ func (db *DB) searchAll(o Object, field, operator string, value interface{}, con
 
 }
 
-// Search Object where field matches value according to an operator
+// Search Object where field matches value according to an operator.
+// The search is evaluated only when its results are first needed, so
+// results and errors reflect the index at that time, and then once for
+// all (a Search can be shared between goroutines).
+// Objects can be searched by UUID using the virtual field UUIDField
+// which also supports the "in" operator taking a []string value.
+// The "contains" operator matches string fields containing value
+// as a substring, the "$=" operator matches string fields ending with
+// value (see Constraints.SuffixIndex) and the "~in" operator, taking a
+// []string of regexes, matches string fields matching any of the regexes.
+// The "haskey" operator (HasKeyOperator) matches map fields having value
+// as a key, see Schema.KeyIndex.
+// Results ordered by UUID allow keyset pagination, i.e.
+// Search(o, UUIDField, ">", lastUUID).Reverse().Limit(n).
+// An Object whose fields do not match the ones of the schema
+// created for its type name makes the search fail with
+// ErrStructureChanged.
 func (db *DB) Search(o Object, field, operator string, value interface{}) *Search {
 	db.RLock()
 	defer db.RUnlock()
 
-	return db.search(o, field, operator, value, nil)
+	var sch *Schema
+	var err error
+
+	// a wrong Object is reported before the search is evaluated
+	if sch, err = db.schema(o); err == nil {
+		err = sch.checkObject(o)
+	}
+
+	if err != nil {
+		return &Search{db: db, object: o, err: err}
+	}
+
+	return newLazySearch(db, o, field, operator, value)
+}
+
+// SearchConditions searches Objects matching conditions built at runtime
+// (i.e. from the parameters of a request). Conditions are applied in
+// sequence and combined with the logical operator logic which must be in
+// ["and", "&&", "or", "||"], as done with Search.Operation. Operators of
+// the conditions are validated before anything is searched and, as any
+// other error, invalid ones are reported by the Err method of the Search
+// returned.
+func (db *DB) SearchConditions(of Object, conds []Condition, logic string) *Search {
+	if err := validateConditions(conds, logic); err != nil {
+		return &Search{db: db, object: of, err: err}
+	}
+
+	s := db.Search(of, conds[0].Field, conds[0].Operator, conds[0].Value)
+	for _, c := range conds[1:] {
+		s = s.Operation(logic, c.Field, c.Operator, c.Value)
+	}
+
+	return s
+}
+
+// SearchGlobal searches, among all the types whose schema is known by the DB
+// (i.e. created or loaded since the DB has been opened, see OpenVerified),
+// the Objects whose indexed field satisfies operator and value. Types not
+// indexing field, or whose field cannot be compared to value, are skipped.
+// Objects found are returned by type name.
+func (db *DB) SearchGlobal(field, operator string, value interface{}) (out map[string][]Object, err error) {
+	types := make([]Object, 0)
+
+	db.RLock()
+	for _, s := range db.schemas {
+		if _, ok := s.ObjectIndex.Fields[field]; ok {
+			types = append(types, s.object)
+		}
+	}
+	db.RUnlock()
+
+	out = make(map[string][]Object)
+	for _, of := range types {
+		var found []Object
+
+		if found, err = db.Search(of, field, operator, value).Collect(); err != nil {
+			if errors.Is(err, ErrCasting) {
+				err = nil
+				continue
+			}
+			return
+		}
+
+		if len(found) > 0 {
+			out[stype(of)] = found
+		}
+	}
+
+	return
+}
+
+// Changed searches the Objects of the same type as of inserted or
+// updated after since. Updates must be tracked by the schema, see
+// Schema.UpdatedAt, otherwise ErrUpdatesNotTracked is returned.
+func (db *DB) Changed(of Object, since time.Time) (s *Search, err error) {
+	var sch *Schema
+
+	if sch, err = db.Schema(of); err != nil {
+		return
+	}
+
+	if sch.UpdatedAt == "" {
+		return nil, fmt.Errorf("%s %w", stype(of), ErrUpdatesNotTracked)
+	}
+
+	return db.Search(of, sch.UpdatedAt, ">", since), nil
 }
 
 // Iterator returns an Object Iterator
@@ -756,34 +2201,219 @@ func (db *DB) Count(of Object) (n int, err error) {
 	return
 }
 
-// Drop drops all the database
-func (db *DB) Drop() (err error) {
-	db.Lock()
-	defer db.Unlock()
-
-	return os.RemoveAll(db.root)
-}
+// countAll counts the Objects matching a search on a field not indexed.
+// Objects not cached are only partially decoded to get the field value.
+func (db *DB) countAll(s *Schema, of Object, field, operator string, value interface{}) (n int, err error) {
+	var search *IndexedField
+	var keys []string
 
-// DeleteAll deletes all Objects of the same type and commit changes
-func (db *DB) DeleteAll(of Object) (err error) {
-	var it *iterator
-	if it, err = db.Iterator(of); err != nil {
+	if search, err = searchField(value); err != nil {
 		return
 	}
-	return db.DeleteObjects(it)
-}
 
-// DeleteObjects deletes Objects from an Iterator and commit changes.
-// This primitive can be used for bulk deletions.
-func (db *DB) DeleteObjects(from *iterator) (err error) {
-	db.Lock()
-	defer db.Unlock()
+	searchType := search.valueTypeString()
 
-	var o Object
+	// substring searches only apply to strings
+	if (operator == "contains" || operator == "$=") && searchType != "string" {
+		return 0, fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, search.Value, search.Value)
+	}
 
-	defer db.commit(from.object())
+	if keys, err = jsonKeys(of, []string{field}); err != nil {
+		return
+	}
 
-	for o, err = from.next(); err == nil || err != ErrEOI; o, err = from.next() {
+	// field might be computed by PostLoad so Objects must be fully read
+	_, postLoad := of.(PostLoader)
+
+	fp := fieldPath(field)
+	for uuid, objid := range s.ObjectIndex.uuids {
+		var o Object
+		var test *IndexedField
+		var v interface{}
+		var ok bool
+
+		o = newObject(of)
+		o.Initialize(uuid)
+
+		if postLoad {
+			if o, err = db.get(o); err != nil {
+				// objects missing from disk are skipped as when searching
+				if errors.Is(err, ErrNoObjectFound) && s.ReadRepair {
+					err = nil
+					continue
+				}
+				return
+			}
+		} else if cached, ok := db.cache.get(o); ok && s.mustCache() {
+			o = cached
+		} else if err = db.readObject(s, db.oPath(s, o), o, keys); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				db.readRepair(s, o, false)
+				if s.ReadRepair {
+					err = nil
+					continue
+				}
+				err = noObjectFoundErr(o, err)
+			}
+			return
+		}
+
+		if v, ok = fieldByName(o, fp); !ok {
+			return 0, fmt.Errorf("%w %s", ErrUnkownField, field)
+		}
+
+		if test, err = newIndexedField(v, objid); err != nil {
+			return
+		}
+
+		if fieldType := test.valueTypeString(); fieldType != searchType {
+			return 0, fmt.Errorf("%w, cannot cast %T(%v) to %s", ErrCasting, search.Value, search.Value, fieldType)
+		}
+
+		if test.evaluate(operator, search) {
+			n++
+		}
+	}
+
+	return
+}
+
+// CountWhere counts the Objects of the same type as of matching a search,
+// see DB.Search. When the field is not indexed Objects are not fully
+// decoded, only the field searched is, unless they implement PostLoader
+// in which case they are read as with Get. Objects missing from disk are
+// skipped if the schema does read repair.
+func (db *DB) CountWhere(of Object, field, operator string, value interface{}) (n int, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+	var f []*IndexedField
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	if err = s.checkObject(of); err != nil {
+		return
+	}
+
+	// transform search value before searching
+	s.prepare(field, &value)
+
+	if operator, value, err = searchOperator(operator, value); err != nil {
+		return
+	}
+
+	if f, err = s.ObjectIndex.search(of, field, operator, value, nil); err == nil {
+		return len(f), nil
+	} else if errors.Is(err, ErrFieldNotIndexed) {
+		return db.countAll(s, of, field, operator, value)
+	}
+
+	return
+}
+
+// EstimateMatches returns the number of Objects of the same type as of whose
+// indexed field matches operator and value, without building a Search nor
+// resolving Objects. Comparison operators are answered from the boundaries
+// of the sorted field index. It is a cheap primitive to plan or warn about
+// searches matching large parts of a collection. ErrUnindexedField is
+// returned if field is not indexed.
+func (db *DB) EstimateMatches(of Object, field, operator string, value interface{}) (n int, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	if err = s.checkObject(of); err != nil {
+		return
+	}
+
+	// transform search value before searching
+	s.prepare(field, &value)
+
+	if operator, value, err = searchOperator(operator, value); err != nil {
+		return
+	}
+
+	return s.ObjectIndex.estimate(of, field, operator, value)
+}
+
+// UUIDs returns the UUIDs of all the Objects of the same type as of. UUIDs
+// are read from the index so no Object is read from disk. UUIDs are not
+// returned in any particular order.
+func (db *DB) UUIDs(of Object) (uuids []string, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	uuids = make([]string, 0, len(s.ObjectIndex.uuids))
+	for uuid := range s.ObjectIndex.uuids {
+		uuids = append(uuids, uuid)
+	}
+
+	return
+}
+
+// PendingWrites returns the sorted UUIDs of the Objects of the same type as
+// of inserted or updated but not written to disk yet, because Objects are
+// written asynchronously (see Schema.AsyncWrites) or in write behind mode.
+// Those Objects would be lost if the process stopped without DB.Close.
+func (db *DB) PendingWrites(of Object) []string {
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.asyncw.uuids(of)
+}
+
+// Drop drops all the database. Background routines are stopped
+// before files are removed so nothing is written after Drop returns.
+func (db *DB) Drop() (err error) {
+	// context is cancelled under lock so that no routine is started after
+	db.Lock()
+	db.cancel()
+	db.Unlock()
+
+	// routines need the lock to stop
+	db.wg.Wait()
+
+	db.Lock()
+	defer db.Unlock()
+
+	return db.storage.RemoveAll(db.root)
+}
+
+// DeleteAll deletes all Objects of the same type and commit changes
+func (db *DB) DeleteAll(of Object) (err error) {
+	var it *iterator
+	if it, err = db.Iterator(of); err != nil {
+		return
+	}
+	return db.DeleteObjects(it)
+}
+
+// DeleteObjects deletes Objects from an Iterator and commit changes.
+// This primitive can be used for bulk deletions.
+func (db *DB) DeleteObjects(from *iterator) (err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var o Object
+
+	defer db.commit(from.object())
+
+	// any error returned by the iterator aborts deletion
+	for o, err = from.next(); err == nil; o, err = from.next() {
 		if err = db.delete(o); err != nil {
 			return
 		}
@@ -813,6 +2443,92 @@ func (db *DB) Delete(o Object) (lastErr error) {
 	return
 }
 
+// DeleteExisting deletes a single Object from the database and commit changes
+// as Delete does but it returns whether the Object was found in the index
+// and actually deleted. Nothing is modified if the Object is not indexed.
+func (db *DB) DeleteExisting(o Object) (deleted bool, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+
+	if s, err = db.schema(o); err != nil {
+		return
+	}
+
+	if !s.isUUIDIndexed(o.UUID()) {
+		return
+	}
+
+	deleted = true
+
+	if e := db.delete(o); e != nil {
+		err = e
+	}
+
+	if e := db.commit(o); e != nil {
+		err = e
+	}
+
+	return
+}
+
+// DeleteOlderThan deletes the Objects of the same type as of whose indexed
+// time.Time field is before cutoff. Objects are sliced out of the sorted
+// field index, so recent Objects are never scanned, and deleted from the
+// oldest by batches of DeleteBatchSize Objects committed one after the
+// other, see Search.DeleteInBatches. Objects updated after cutoff while
+// deleting are not deleted. It returns the number of Objects deleted.
+func (db *DB) DeleteOlderThan(of Object, field string, cutoff time.Time) (n int, err error) {
+	var older *Search
+
+	if older, err = db.olderThan(of, field, cutoff); err != nil {
+		return
+	}
+
+	return older.DeleteInBatches(DeleteBatchSize)
+}
+
+// olderThan returns a search of the index entries of field before cutoff,
+// the oldest first. Every batch deleted from it is checked again to be
+// before cutoff, in case Objects are updated in the meantime.
+func (db *DB) olderThan(of Object, field string, cutoff time.Time) (older *Search, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+	var fi *fieldIndex
+	var value *IndexedField
+	var ok bool
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	if fd, ok := s.Fields[field]; !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnkownField, field)
+	} else if fd.Type != timeType.String() {
+		return nil, fmt.Errorf("%s %w", field, ErrNotTimeField)
+	}
+
+	if fi, ok = s.ObjectIndex.field(field); !ok {
+		return nil, fmt.Errorf("%s %w", field, ErrUnindexedField)
+	}
+
+	if value, err = newIndexedField(cutoff, 0); err != nil {
+		return
+	}
+
+	// index is sorted from the newest to the oldest
+	entries := fi.SearchLess(value)
+	f := make([]*IndexedField, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		f = append(f, entries[i])
+	}
+
+	return newResolvedSearch(db, of, []*searchClause{{field, "<", cutoff}}, f), nil
+}
+
 // Exist returns true if the object exist.
 func (db *DB) Exist(o Object) (ok bool, err error) {
 	db.RLock()
@@ -820,11 +2536,42 @@ func (db *DB) Exist(o Object) (ok bool, err error) {
 	return db.exist(o)
 }
 
-// InsertOrUpdateBulk inserts objects in bulk in the DB. A chunk size needs to be
-// provided to commit the DB at every chunk. The DB is locked at every chunk
-// processed, so changing the chunk size impact other concurrent DB operations.
-// n returns the number of Objects successfully inserted.
-func (db *DB) InsertOrUpdateBulk(in chan Object, csize int) (n int, err error) {
+// ExistMany returns, keyed by UUID, whether the objects exist. Contrary to
+// Exist, it is answered from the index only, without accessing the disk,
+// so it is suited to skip the Objects already known before a bulk insertion.
+// All objects must be of the same type. Objects with an empty UUID, which
+// cannot exist, are not in the map returned.
+func (db *DB) ExistMany(objects ...Object) (exist map[string]bool, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+
+	exist = make(map[string]bool, len(objects))
+	if len(objects) == 0 {
+		return
+	}
+
+	if s, err = db.schema(objects[0]); err != nil {
+		return nil, err
+	}
+
+	expType := stype(objects[0])
+	for _, o := range objects {
+		if otype := stype(o); otype != expType {
+			return nil, fmt.Errorf("%w expecting %s, got %s", ErrWrongObjectType, expType, otype)
+		}
+
+		if o.UUID() != "" {
+			exist[o.UUID()] = s.isUUIDIndexed(o.UUID())
+		}
+	}
+
+	return
+}
+
+// insertBulk inserts objects from in by chunks of csize using many
+func (db *DB) insertBulk(in chan Object, csize int, many func(...Object) (int, error)) (n int, err error) {
 	var o Object
 	var insn int
 
@@ -832,7 +2579,7 @@ func (db *DB) InsertOrUpdateBulk(in chan Object, csize int) (n int, err error) {
 	for o = range in {
 		chunk = append(chunk, o)
 		if len(chunk) == csize {
-			insn, err = db.InsertOrUpdateMany(chunk...)
+			insn, err = many(chunk...)
 			n += insn
 			if err != nil {
 				return
@@ -842,21 +2589,110 @@ func (db *DB) InsertOrUpdateBulk(in chan Object, csize int) (n int, err error) {
 	}
 
 	// we process last chunk
-	insn, err = db.InsertOrUpdateMany(chunk...)
-	n += insn
+	if len(chunk) > 0 {
+		insn, err = many(chunk...)
+		n += insn
+	}
+
+	return
+}
+
+// merge merges incoming Object with a copy of the existing Object having
+// the same UUID. Merged Object keeps the UUID of the existing one.
+func (db *DB) merge(incoming Object, merge MergeFunc) (out Object, err error) {
+	var existing Object
+
+	existing = newObject(incoming)
+	existing.Initialize(incoming.UUID())
+	if existing, err = db.get(existing); err != nil {
+		return
+	}
+
+	// existing object might be cached so we must not modify it
+	if out = merge(CloneObject(existing), incoming); out == nil || stype(out) != stype(incoming) {
+		return nil, fmt.Errorf("%w: merge must return a %s", ErrWrongObjectType, stype(incoming))
+	}
 
+	out.Initialize(incoming.UUID())
 	return
 }
 
+// InsertOrUpdateBulk inserts objects in bulk in the DB. A chunk size needs to be
+// provided to commit the DB at every chunk. The DB is locked at every chunk
+// processed, so changing the chunk size impact other concurrent DB operations.
+// Chunks are inserted as with InsertOrUpdateMany, so a chunk failing is not
+// inserted at all but the chunks before remain inserted.
+// n returns the number of Objects successfully inserted. As the type of the
+// Objects is unknown until one is received, an empty channel is a no-op
+// and no error is returned even if the schema does not exist.
+func (db *DB) InsertOrUpdateBulk(in chan Object, csize int) (n int, err error) {
+	return db.insertBulk(in, csize, db.InsertOrUpdateMany)
+}
+
+// InsertOrMergeBulk works as InsertOrUpdateBulk but Objects already
+// existing in the DB are merged as done by InsertOrMergeMany.
+func (db *DB) InsertOrMergeBulk(in chan Object, csize int, merge MergeFunc) (n int, err error) {
+	return db.insertBulk(in, csize, func(objects ...Object) (int, error) {
+		return db.InsertOrMergeMany(merge, objects...)
+	})
+}
+
 // InsertOrUpdateMany inserts several objects into the DB and
 // commit schema after all insertions. It is faster than calling
 // InsertOrUpdate for every objects separately. All objects must
 // be of the same type. This method is atomic, so all objects
 // must satisfy constraints and be valid according to their Validate
-// method. If this method fails no object is inserted.
+// method. If this method fails no object is inserted. Objects are
+// indexed serially and then written to disk by at most
+// BulkWriteConcurrency concurrent writers. If any write fails, the
+// insertion is reverted: files of new objects are removed and the files
+// of updated objects are restored, along with their index entries.
+// Previous versions evicted from history (see Schema.KeepHistory) by
+// the writes reverted are not restored. Calling this method
+// without any object is a no-op.
 func (db *DB) InsertOrUpdateMany(objects ...Object) (n int, err error) {
 	db.Lock()
 	defer db.Unlock()
+
+	return db.insertOrUpdateMany(objects, nil, nil)
+}
+
+// ProgressFunc is called with the number of items
+// processed so far out of the total number of items
+type ProgressFunc func(done, total int)
+
+// InsertOrUpdateManyProgress works as InsertOrUpdateMany but progress is
+// called every time an Object is written to disk, with the number of
+// Objects written so far and the number of Objects to insert. Progress is
+// reported once all the Objects are validated and indexed, so it is not
+// called at all if any Object is rejected. When writes are deferred (i.e.
+// async writes) progress is called once all the Objects are queued.
+// Progress is called serially but from the goroutines writing Objects and
+// while the DB is locked, so it must not call DB methods.
+func (db *DB) InsertOrUpdateManyProgress(progress ProgressFunc, objects ...Object) (n int, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.insertOrUpdateMany(objects, nil, progress)
+}
+
+// InsertOrMergeMany works as InsertOrUpdateMany but when an Object with
+// the same UUID already exists, merge is called and the Object returned
+// by merge is stored instead. Existing Objects passed to merge are copies
+// so they can be modified and returned.
+func (db *DB) InsertOrMergeMany(merge MergeFunc, objects ...Object) (n int, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	// objects are replaced by merged ones so we work on a copy
+	return db.insertOrUpdateMany(append(make([]Object, 0, len(objects)), objects...), merge, nil)
+}
+
+// insertOrUpdateMany inserts or updates objects, existing objects are
+// merged with incoming ones if merge is not nil. Objects slice is
+// modified in place with merged objects. Progress of writes is reported
+// to progress if not nil.
+func (db *DB) insertOrUpdateMany(objects []Object, merge MergeFunc, progress ProgressFunc) (n int, err error) {
 	var schema *Schema
 
 	if len(objects) == 0 {
@@ -874,7 +2710,7 @@ func (db *DB) InsertOrUpdateMany(objects ...Object) (n int, err error) {
 	tmpIndex := schema.makeTmpIndex()
 
 	// we validate all the objects prior to insertion
-	for _, o := range objects {
+	for i, o := range objects {
 
 		otype := stype(o)
 
@@ -889,6 +2725,13 @@ func (db *DB) InsertOrUpdateMany(objects ...Object) (n int, err error) {
 			return
 		}
 
+		if merge != nil && schema.isUUIDIndexed(o.UUID()) {
+			if o, err = db.merge(o, merge); err != nil {
+				return
+			}
+			objects[i] = o
+		}
+
 		// making transformations prior to validation
 		// Object transform
 		o.Transform()
@@ -896,8 +2739,7 @@ func (db *DB) InsertOrUpdateMany(objects ...Object) (n int, err error) {
 		schema.transform(o)
 
 		// validate object before insertion
-		if err = o.Validate(); err != nil {
-			err = validationErr(o, err)
+		if err = db.validate(o); err != nil {
 			return
 		}
 
@@ -908,70 +2750,408 @@ func (db *DB) InsertOrUpdateMany(objects ...Object) (n int, err error) {
 			return
 		}
 
-		// check that current objects' index validate object's constraints
-		if err = schema.ObjectIndex.satisfyAll(o); err != nil {
-			err = fmt.Errorf("%w > %s", err, jsonOrPanic(o))
+		// check that current objects' index validate object's constraints
+		if err = schema.ObjectIndex.satisfyAll(o); err != nil {
+			err = fmt.Errorf("%w > %s", err, jsonOrPanic(o))
+			return
+		}
+	}
+
+	// state of the objects already in the DB, to restore it on failure
+	previous, err := db.previousVersions(schema, objects)
+	if err != nil {
+		return
+	}
+
+	// indexing objects must be done serially
+	if schema.allNew(objects) {
+		// new objects are indexed at once
+		if err = schema.bulkLoad(objects); err != nil {
+			// index is modified only if all objects can be indexed
+			return
+		}
+		for _, o := range objects {
+			if schema.mustCache() {
+				db.cache.put(o)
+			}
+		}
+	} else {
+		for i, o := range objects {
+			if e := db.index(schema, o); e != nil {
+				err = fmt.Errorf("%w > %s", e, jsonOrPanic(o))
+				// the object failing might be partially indexed
+				if e := db.rollback(schema, objects[:i+1], false, previous); e != nil {
+					db.logger.Warnf("failed to revert indexing of objects: %s", e)
+				}
+				return
+			}
+		}
+	}
+
+	if schema.deferWrites() {
+		// objects are saved later on
+		for _, o := range objects {
+			db.asyncw.put(o)
+		}
+		n = len(objects)
+		if progress != nil {
+			progress(n, len(objects))
+		}
+	} else {
+		// disk writes are independent so they are parallelized
+		if err = db.writeObjects(objects, progress); err != nil {
+			// none of the objects must be inserted
+			if e := db.rollback(schema, objects, true, previous); e != nil {
+				db.logger.Warnf("failed to revert insertion of objects: %s", e)
+			}
+			return
+		}
+		n = len(objects)
+	}
+
+	if e := db.commit(objects[0]); e != nil && err == nil {
+		err = e
+	}
+
+	return
+}
+
+// InsertOrUpdate inserts or updates a single Object and commits
+// changes. This method is not suited for bulk insertions as each
+// insert will trigger a write overhead. For
+// bulk insertion use InsertOrUpdateBulk function
+func (db *DB) InsertOrUpdate(o Object) (err error) {
+	db.Lock()
+	defer db.Unlock()
+	var schema *Schema
+
+	if schema, err = db.schema(o); err != nil {
+		return
+	}
+
+	// making transformations prior to validation
+	// Object transform
+	o.Transform()
+	// schema transformation superseeds Object transformation
+	schema.transform(o)
+	if err := db.validate(o); err != nil {
+		return err
+	}
+
+	return db.insertOrUpdate(schema, o, true)
+}
+
+// AppendToSlice appends values to the slice field of the stored version
+// of o and saves it, atomically. Only o.UUID() is used to find the Object
+// to modify and o is not modified. Values must be assignable to the
+// elements of the slice otherwise an error wrapping ErrCasting is returned.
+func (db *DB) AppendToSlice(o Object, field string, values ...interface{}) (err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var schema *Schema
+	var cur Object
+
+	if schema, err = db.schema(o); err != nil {
+		return
+	}
+
+	if !schema.isUUIDIndexed(o.UUID()) {
+		return noObjectFoundErr(o, fs.ErrNotExist)
+	}
+
+	if cur, err = db.getByUUID(newObject(o), o.UUID()); err != nil {
+		return
+	}
+
+	// stored object might be cached so we must not modify it
+	cur = CloneObject(cur)
+
+	v, ok := valueFieldByName(reflect.ValueOf(cur), fieldPath(field))
+	if !ok || !v.CanSet() {
+		return fmt.Errorf("%w %s for object %T", ErrUnkownField, field, o)
+	}
+
+	if v.Kind() != reflect.Slice {
+		return fmt.Errorf("%w, field %s of type %s is not a slice", ErrCasting, field, v.Type())
+	}
+
+	elems := make([]reflect.Value, 0, len(values))
+	for _, value := range values {
+		e := reflect.ValueOf(value)
+		switch {
+		case !e.IsValid() && isNillable(v.Type().Elem()):
+			e = reflect.Zero(v.Type().Elem())
+		case !e.IsValid() || !e.Type().AssignableTo(v.Type().Elem()):
+			return fmt.Errorf("%w, cannot append %T to %s of type %s", ErrCasting, value, field, v.Type())
+		}
+		elems = append(elems, e)
+	}
+
+	v.Set(reflect.Append(v, elems...))
+
+	cur.Transform()
+	schema.transform(cur)
+	if err = db.validate(cur); err != nil {
+		return
+	}
+
+	return db.insertOrUpdate(schema, cur, true)
+}
+
+// Insert inserts a single Object only if it does not exist yet and commits
+// changes. If an Object with the same UUID already exists ErrAlreadyExists
+// is returned and nothing is modified. Objects with an empty UUID are
+// always inserted under a newly generated UUID, except Objects whose
+// schema is content addressed (see Schema.ContentAddressed) which are
+// not inserted if an identical Object exists.
+func (db *DB) Insert(o Object) (err error) {
+	db.Lock()
+	defer db.Unlock()
+	var schema *Schema
+	var exists bool
+
+	if schema, err = db.schema(o); err != nil {
+		return
+	}
+
+	if o.UUID() != "" {
+		if exists, err = db.existOrIndexed(o); err != nil {
+			return
+		} else if exists {
+			return fmt.Errorf("%s %w uuid=%s", stype(o), ErrAlreadyExists, o.UUID())
+		}
+	}
+
+	// making transformations prior to validation
+	// Object transform
+	o.Transform()
+	// schema transformation superseeds Object transformation
+	schema.transform(o)
+	if err := db.validate(o); err != nil {
+		return err
+	}
+
+	// UUID of content addressed Objects is only known once transformed
+	if schema.ContentAddressed {
+		if exists, err = db.existOrIndexed(o); err != nil {
+			return
+		} else if exists {
+			return fmt.Errorf("%s %w uuid=%s", stype(o), ErrAlreadyExists, o.UUID())
+		}
+	}
+
+	return db.insertOrUpdate(schema, o, true)
+}
+
+// Swap atomically exchanges the data of two existing Objects of the same
+// type while keeping their UUIDs, only a.UUID() and b.UUID() are used to
+// identify the Objects to swap. Swapped Objects are validated and checked
+// against the constraints of the schema as a pair, so that swapping values
+// of unique fields is possible. ErrNoObjectFound is returned if any of the
+// Objects does not exist and nothing is modified if an error is returned
+// prior to writing Objects.
+func (db *DB) Swap(a, b Object) (err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+	var sa, sb Object
+
+	if stype(a) != stype(b) {
+		return fmt.Errorf("%w expecting %s, got %s", ErrWrongObjectType, stype(a), stype(b))
+	}
+
+	if s, err = db.schema(a); err != nil {
+		return
+	}
+
+	for _, o := range []Object{a, b} {
+		if !s.isUUIDIndexed(o.UUID()) {
+			return noObjectFoundErr(o, fs.ErrNotExist)
+		}
+	}
+
+	if a.UUID() == b.UUID() {
+		return
+	}
+
+	if sa, err = db.getByUUID(newObject(a), a.UUID()); err != nil {
+		return
+	}
+
+	if sb, err = db.getByUUID(newObject(b), b.UUID()); err != nil {
+		return
+	}
+
+	// stored objects might be cached so we must not modify them
+	na, nb := CloneObject(sb), CloneObject(sa)
+	na.Initialize(sa.UUID())
+	nb.Initialize(sb.UUID())
+
+	// swapped objects are written as any updated Object is
+	for _, o := range []Object{na, nb} {
+		o.Transform()
+		s.transform(o)
+		if err = db.validate(o); err != nil {
+			return
+		}
+	}
+
+	// swapped objects might move to other partitions
+	pa, pb := db.oPath(s, sa), db.oPath(s, sb)
+
+	// swapped objects are checked against the index without the originals
+	s.unindex(sa)
+	s.unindex(sb)
+
+	tmpIndex := s.makeTmpIndex()
+	for _, o := range []Object{na, nb} {
+		if err = tmpIndex.insertOrUpdate(o); err == nil {
+			err = s.ObjectIndex.satisfyAll(o)
+		}
+
+		if err != nil {
+			// restoring index
+			s.index(sa)
+			s.index(sb)
+			return
+		}
+	}
+
+	for _, o := range []Object{na, nb} {
+		if err = db.insertOrUpdate(s, o, false); err != nil {
+			return
+		}
+	}
+
+	if s.Partition != nil {
+		for o, old := range map[Object]string{na: pa, nb: pb} {
+			if err = db.removeStale(s, o, old); err != nil {
+				return
+			}
+		}
+	}
+
+	return db.commit(a)
+}
+
+func (db *DB) commit(o Object) (err error) {
+	var schema *Schema
+
+	if schema, err = db.schema(o); err != nil {
+		return
+	}
+
+	db.applyReadRepairs(schema, o)
+
+	// in write behind mode schema must not reference
+	// objects not written to disk yet
+	if schema.WriteBehind && db.asyncw.count(o) > 0 {
+		// schema saved must not reference deleted objects either
+		if !schema.deleted {
+			return
+		}
+
+		if err = db.flushAll(o); err != nil {
+			return
+		}
+	}
+
+	if err = db.saveSchema(o, schema, true); err != nil {
+		return
+	}
+
+	schema.deleted = false
+	return
+}
+
+// Control controls checks for inconsistencies in DB
+func (db *DB) Control() (err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	for _, s := range db.schemas {
+		if err = s.control(); err != nil {
 			return
 		}
 	}
+	return
+}
 
-	// inserting objects
-	for _, o := range objects {
-		if e := db.insertOrUpdate(schema, o, false); e != nil {
-			err = fmt.Errorf("%w > %s", e, jsonOrPanic(o))
-			break
+// controlObject checks that the Object identified by uuid can be read and
+// that the values of its indexed fields are the ones found in the index.
+// Objects not written to disk yet are only checked against the index.
+func (db *DB) controlObject(s *Schema, of Object, uuid string) (err error) {
+	o := newObject(of)
+	o.Initialize(uuid)
+
+	if pending, ok := db.asyncw.get(o); ok {
+		o = pending
+	} else if err = db.readObject(s, db.oPath(s, o), o, nil); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%s %w: object uuid=%s is missing", stype(of), ErrIndexCorrupted, uuid)
 		}
-		n++
+		return fmt.Errorf("%s %w: object uuid=%s cannot be decoded: %s", stype(of), ErrIndexCorrupted, uuid, err)
 	}
 
-	if e := db.commit(objects[0]); e != nil {
-		err = e
+	if err = s.ObjectIndex.check(o); err != nil {
+		return fmt.Errorf("%s %w: object uuid=%s %s", stype(of), ErrIndexCorrupted, uuid, err)
 	}
 
 	return
 }
 
-// InsertOrUpdate inserts or updates a single Object and commits
-// changes. This method is not suited for bulk insertions as each
-// insert will trigger a write overhead. For
-// bulk insertion use InsertOrUpdateBulk function
-func (db *DB) InsertOrUpdate(o Object) (err error) {
-	db.Lock()
-	defer db.Unlock()
-	var schema *Schema
+// Sample verifies a random sample of n Objects of the same type as of. It
+// checks that the files of the Objects exist, can be decoded and that the
+// values of their indexed fields are the ones found in the index. Objects
+// not written to disk yet are only checked against the index. All the
+// Objects are verified if n is greater than the number of Objects. An
+// error wrapping ErrIndexCorrupted is returned at the first inconsistency.
+func (db *DB) Sample(of Object, n int) (err error) {
+	db.RLock()
+	defer db.RUnlock()
 
-	if schema, err = db.schema(o); err != nil {
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
 		return
 	}
 
-	// making transformations prior to validation
-	// Object transform
-	o.Transform()
-	// schema transformation superseeds Object transformation
-	schema.transform(o)
-	if err := o.Validate(); err != nil {
-		return validationErr(o, err)
+	if n < 0 {
+		n = 0
 	}
 
-	return db.insertOrUpdate(schema, o, true)
-}
-
-func (db *DB) commit(o Object) (err error) {
-	var schema *Schema
+	if n > len(s.ObjectIndex.uuids) {
+		n = len(s.ObjectIndex.uuids)
+	}
 
-	if schema, err = db.schema(o); err != nil {
-		return
+	// reservoir sampling, only the sample is held in memory
+	uuids := make([]string, 0, n)
+	i := 0
+	for uuid := range s.ObjectIndex.uuids {
+		if len(uuids) < n {
+			uuids = append(uuids, uuid)
+		} else if j := rand.Intn(i + 1); j < n {
+			uuids[j] = uuid
+		}
+		i++
 	}
 
-	if err = db.saveSchema(o, schema, true); err != nil {
-		return
+	for _, uuid := range uuids {
+		if err = db.controlObject(s, of, uuid); err != nil {
+			return
+		}
 	}
 
 	return
 }
 
-// Control controls checks for inconsistencies in DB
-func (db *DB) Control() (err error) {
+// DeepControl controls the DB as Control does and also checks, for every
+// Object, that its file can be decoded and that the values of its indexed
+// fields are the ones found in the index. As all the Objects are read it
+// is much slower than Control, see Sample to verify a subset of Objects.
+func (db *DB) DeepControl() (err error) {
 	db.Lock()
 	defer db.Unlock()
 
@@ -979,7 +3159,14 @@ func (db *DB) Control() (err error) {
 		if err = s.control(); err != nil {
 			return
 		}
+
+		for uuid := range s.ObjectIndex.uuids {
+			if err = db.controlObject(s, s.object, uuid); err != nil {
+				return
+			}
+		}
 	}
+
 	return
 }
 
@@ -1051,57 +3238,400 @@ func (db *DB) Repair(of Object) (err error) {
 	db.Lock()
 	defer db.Unlock()
 
-	var uuids map[string]bool
+	_, _, err = db.repair(of)
+	return
+}
+
+// WalkFiles calls fn, in UUID order, for every Object file found on disk
+// for the type of of, in partitions too, whether the Object is indexed or
+// not, so that orphan or corrupted files can be inspected contrary to
+// Iterator. Files are not read, they can be opened from path with the
+// Storage of the DB. Objects not flushed yet (see PendingWrites) are not
+// walked. Walking stops at the first error returned by fn, which is
+// returned. Files are listed first so that fn can modify the DB.
+func (db *DB) WalkFiles(of Object, fn func(uuid, path string, size int64) error) (err error) {
+	var files map[string]string
+
+	if files, err = db.lockObjectFiles(of); err != nil {
+		return
+	}
+
+	uuids := make([]string, 0, len(files))
+	for uuid := range files {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	for _, uuid := range uuids {
+		var stat fs.FileInfo
+
+		path := files[uuid]
+		if stat, err = db.storage.Stat(path); err != nil {
+			// file removed since listed
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return
+		}
+
+		if err = fn(uuid, path, stat.Size()); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// lockObjectFiles returns the Object files found on disk, see objectFiles
+func (db *DB) lockObjectFiles(of Object) (files map[string]string, err error) {
 	var s *Schema
-	var o Object
 
-	dir := db.oDir(of)
+	db.RLock()
+	defer db.RUnlock()
+
+	// files must be walked even if the index is corrupted
+	if s, err = db.schema(of); err != nil && !errors.Is(err, ErrIndexCorrupted) {
+		return
+	}
+
+	return db.objectFiles(s, of)
+}
+
+// repair re-indexes the Objects found on disk but not indexed and de-indexes
+// the ones missing from disk. It returns the number of Objects re-indexed
+// and de-indexed.
+func (db *DB) repair(of Object) (reindexed, unindexed int, err error) {
+	var files map[string]string
+	var s *Schema
+	var o Object
 
 	// we get schema
 	if s, err = db.schema(of); err != nil && !errors.Is(err, ErrIndexCorrupted) {
 		return
 	}
 
+	// schema must be loaded to know object directory
+	dir := db.oDir(of)
+
 	// we re-index missing objects in index
-	if uuids, err = uuidsFromDir(dir); err != nil {
+	if files, err = db.objectFiles(s, of); err != nil {
 		return
 	}
 
+	db.logger.Infof("%s repairing index of %d objects found in %s", stype(of), len(files), dir)
+
 	// we re-index missing uuids
-	for uuid := range uuids {
+	for uuid, path := range files {
 		// we don't re-index already indexed objects
 		if s.isUUIDIndexed(uuid) {
 			continue
 		}
 
-		if o, err = db.getByUUID(of, uuid); err != nil {
+		// objects not indexed cannot be found from their partition
+		o = newObject(of)
+		o.Initialize(uuid)
+		if err = db.readObject(s, path, o, nil); err != nil {
+			db.logger.Errorf("%s failed to repair object uuid=%s: %s", stype(of), uuid, err)
 			return
 		}
 
 		if err = s.index(o); err != nil {
+			db.logger.Errorf("%s failed to re-index object uuid=%s: %s", stype(of), uuid, err)
 			return
 		}
+		reindexed++
 	}
 
 	// we de-index missing objects
 	for uuid := range s.ObjectIndex.uuids {
-		if !uuids[uuid] {
+		if _, ok := files[uuid]; !ok {
 			// if object is not on disk and is in index
 			s.unindexByUUID(uuid)
+			unindexed++
 		}
 	}
 
-	return nil
+	// sequence numbers are never reused
+	s.syncSequence()
+
+	db.logger.Infof("%s index repaired: %d objects re-indexed, %d objects de-indexed", stype(of), reindexed, unindexed)
+
+	return
 }
 
-// Close closes gently the DB by flushing any pending async writes
-// and by committing all the schemas to disk
-func (db *DB) Close() (last error) {
+// reindex indexes again all the Objects of the same type as of as they are
+// on disk, so that a stale index is made consistent with the Objects.
+func (db *DB) reindex(s *Schema, of Object) (err error) {
+	var files map[string]string
+
+	if files, err = db.objectFiles(s, of); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	err = nil
+
+	objects := make([]Object, 0, len(files))
+	for uuid, path := range files {
+		o := newObject(of)
+		o.Initialize(uuid)
+		if e := db.readObject(s, path, o, nil); e != nil {
+			db.logger.Errorf("%s failed to re-index object uuid=%s: %s", stype(of), uuid, e)
+			continue
+		}
+		objects = append(objects, o)
+	}
+
+	uuids := make([]string, 0, len(s.ObjectIndex.uuids))
+	for uuid := range s.ObjectIndex.uuids {
+		uuids = append(uuids, uuid)
+	}
+
+	// index is replaced at once
+	new := s.ObjectIndex.clone()
+	old := s.ObjectIndex
+	s.ObjectIndex = new
+	for _, uuid := range uuids {
+		s.unindexByUUID(uuid)
+	}
+
+	if err = s.bulkLoad(objects); err != nil {
+		s.ObjectIndex = old
+		return
+	}
+
+	// sequence numbers are never reused
+	s.syncSequence()
+
+	db.logger.Infof("%s index rebuilt from %d objects found on disk", stype(of), len(objects))
+
+	return
+}
+
+// verify controls the schema of of and repairs its index if corrupted
+func (db *DB) verify(of Object) (err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err == nil || errors.Is(err, ErrSchemaNotCreated) {
+		return nil
+	}
+
+	if !errors.Is(err, ErrIndexCorrupted) {
+		return
+	}
+
+	if _, _, err = db.repair(of); err != nil {
+		return
+	}
+
+	if err = s.control(); err != nil {
+		return
+	}
+
+	return db.commit(of)
+}
+
+// VerifyConstraints verifies that the Objects already in the DB satisfy
+// the unique constraints of their schema. Constraints are only checked
+// at insertion time, so this method can be used to find stale duplicates
+// after a unique constraint has been added. It returns an error wrapping
+// ErrConstraintUnique for every value shared by several Objects.
+func (db *DB) VerifyConstraints(of Object) (errs []error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+	var err error
+
+	if s, err = db.schema(of); err != nil {
+		return []error{err}
+	}
+
+	return s.ObjectIndex.verifyConstraints()
+}
+
+// FindDuplicates returns the groups of UUIDs of the Objects sharing the
+// same values for all the fields passed as parameter. Fields must be
+// indexed, if no field is given all the indexed fields are used. UUIDs
+// are sorted within a group.
+func (db *DB) FindDuplicates(of Object, fields ...string) (groups [][]string, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.findDuplicates(of, fields)
+}
+
+// Deduplicate deletes the duplicates found by FindDuplicates while keeping
+// the Object having the first UUID of every group. Search and deletion are
+// made while holding the DB lock so that no Object can be modified in the
+// meantime. It returns the number of Objects deleted.
+func (db *DB) Deduplicate(of Object, fields ...string) (n int, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var groups [][]string
+
+	if groups, err = db.findDuplicates(of, fields); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := db.commit(of); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	for _, group := range groups {
+		for _, uuid := range group[1:] {
+			o := newObject(of)
+			o.Initialize(uuid)
+			if err = db.delete(o); err != nil {
+				return
+			}
+			n++
+		}
+	}
+
+	return
+}
+
+// IndexDrift compares the objects indexed with the ones found on disk without
+// repairing anything. It returns the UUIDs of objects only found in index
+// and the UUIDs of objects only found on disk. Both slices are empty if
+// index and disk are consistent.
+func (db *DB) IndexDrift(of Object) (onlyInIndex, onlyOnDisk []string, err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil && !errors.Is(err, ErrIndexCorrupted) {
+		return
+	}
+
+	return s.drift()
+}
+
+// ExportIndex writes the index of the Objects of the same type as of to w,
+// without the Objects data. Objects not written to disk yet are part of
+// the exported index.
+func (db *DB) ExportIndex(of Object, w io.Writer) (err error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	return json.NewEncoder(w).Encode(s.ObjectIndex)
+}
+
+// ImportIndex reads an index exported with ExportIndex from r and replaces
+// the index of the Objects of the same type as of. Imported index is
+// validated against the schema and the Objects on disk and ErrIndexCorrupted
+// is returned if it does not match. Any pending write is flushed prior to
+// validation so that pending Objects are found on disk. ImportIndex can be
+// used to restore the index of a DB reporting ErrIndexCorrupted.
+func (db *DB) ImportIndex(of Object, r io.Reader) (err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+	in := &objIndex{}
+
+	if s, err = db.schema(of); err != nil && !errors.Is(err, ErrIndexCorrupted) {
+		return
+	}
+
+	if err = json.NewDecoder(r).Decode(in); err != nil {
+		return
+	}
+
+	if err = db.flushAll(of); err != nil {
+		return
+	}
+
+	if err = s.controlIndex(in); err != nil {
+		return
+	}
+
+	in.copyDerived(s.ObjectIndex)
+	in.copyPartials(s.ObjectIndex)
+	in.partitionBy(s.Partition)
+	s.ObjectIndex = in
+	s.queries.invalidate()
+
+	return db.commit(of)
+}
+
+// SetAsyncParams modifies at runtime the async writes parameters of the
+// schema of an Object. New parameters are taken into account from the next
+// check made by the routine flushing Objects and are persisted at the next
+// commit of the schema. ErrAsyncWritesOff is returned if async writes are
+// not enabled in schema and ErrBadAsyncParams if threshold is lower than one
+// or timeout is not positive.
+func (db *DB) SetAsyncParams(of Object, threshold int, timeout time.Duration) (err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+
+	// routine flushing objects would never wait
+	if threshold < 1 || timeout <= 0 {
+		return fmt.Errorf("%w: threshold=%d timeout=%s", ErrBadAsyncParams, threshold, timeout)
+	}
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	if !s.asyncWritesEnabled() {
+		return fmt.Errorf("%s %w", stype(of), ErrAsyncWritesOff)
+	}
+
+	s.AsyncWrites.Threshold = threshold
+	s.AsyncWrites.Timeout = timeout
+
+	return
+}
+
+// Sync flushes any pending write of all the Objects to disk and commits
+// all the schemas. It is the way to persist data in WriteBehind mode
+// without closing the DB.
+func (db *DB) Sync() (last error) {
 	db.Lock()
 	defer db.Unlock()
 
-	// cancelling db context
+	if err := db.flushDB(); err != nil {
+		last = err
+	}
+
+	for _, s := range db.schemas {
+		if err := db.commit(s.object); err != nil {
+			last = err
+		}
+	}
+
+	return
+}
+
+// Close closes gently the DB by flushing any pending async writes
+// and by committing all the schemas to disk. Background routines are
+// stopped before so nothing touches the files after Close returns.
+func (db *DB) Close() (last error) {
+	// cancelling db context under lock so that no routine is started after
+	db.Lock()
 	db.cancel()
+	db.Unlock()
+
+	// routines need the lock to stop
+	db.wg.Wait()
+
+	db.Lock()
+	defer db.Unlock()
 
 	// flushing all the objects of all kinds on disk
 	if err := db.flushDB(); err != nil {
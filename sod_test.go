@@ -1,15 +1,22 @@
 package sod
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -174,6 +181,12 @@ func TestSimpleDb(t *testing.T) {
 
 	_, err := db.Get(&ts)
 	tt.ExpectErr(err, os.ErrNotExist)
+	tt.ExpectErr(err, ErrNoObjectFound)
+	tt.Assert(IsNoObjectFound(err))
+
+	// object not indexed
+	_, err = db.GetByUUID(&testStruct{}, uuidOrPanic())
+	tt.ExpectErr(err, ErrNoObjectFound)
 
 	_, err = db.Get(&t1)
 	tt.CheckErr(err)
@@ -582,18 +595,26 @@ func TestUnknownObject(t *testing.T) {
 		Item
 	}
 
-	if _, err := db.Schema(&Unknown{}); err == nil {
+	if _, err := db.Schema(&Unknown{}); !IsSchemaNotCreated(err) || !errors.Is(err, os.ErrNotExist) {
 		t.Error("Should raise schema error")
 	}
 
-	if err := db.InsertOrUpdate(&Unknown{}); err == nil {
+	if err := db.InsertOrUpdate(&Unknown{}); !IsSchemaNotCreated(err) {
 		t.Error("Should raise insert error")
 	}
 
-	if err := db.Delete(&Unknown{}); err == nil {
+	if err := db.Delete(&Unknown{}); !IsSchemaNotCreated(err) {
 		t.Error("Should raise delete error")
 	}
 
+	if err := db.Search(&Unknown{}, "A", "=", 42).Err(); !IsSchemaNotCreated(err) {
+		t.Error("Should raise search error")
+	}
+
+	if _, err := db.Get(&Unknown{}); !IsSchemaNotCreated(err) || IsNoObjectFound(err) {
+		t.Error("Should raise get error")
+	}
+
 	if err := db.Commit(&Unknown{}); err == nil {
 		t.Error("Should raise commit error")
 	}
@@ -861,10 +882,7 @@ func TestAsyncWrites(t *testing.T) {
 	controlDBSize(t, db, &testStruct{}, size-search.Len())
 	t.Logf("dropping db: %s", db.root)
 	tt.CheckErr(db.Drop())
-
-	// we wait two timeouts before checking
-	time.Sleep(2 * timeout)
-	tt.Assert(!isDirAndExist(db.root))
+	tt.Assert(!isDirAndExist(OSStorage{}, db.root))
 }
 
 func TestAsyncWritesFastDelete(t *testing.T) {
@@ -895,9 +913,82 @@ func TestAsyncWritesFastDelete(t *testing.T) {
 	db = closeAndReOpen(db)
 	controlDBSize(t, db, &testStruct{}, size-search.Len())
 	tt.CheckErr(db.Drop())
-	// we wait two timeouts before checking
-	time.Sleep(2 * timeout)
-	tt.Assert(!isDirAndExist(db.root))
+	tt.Assert(!isDirAndExist(OSStorage{}, db.root))
+}
+
+func TestCloseStopsRoutines(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	s := DefaultSchema
+	// routine would not flush by itself during the test
+	s.Asynchrone(size*10, time.Hour)
+
+	db := createFreshTestDb(size, s)
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		tt.CheckErr(db.Close())
+		tt.Assert(time.Since(start) < time.Minute)
+
+		// all routines stopped when Close returns
+		done := make(chan bool)
+		go func() {
+			db.wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("routines still running after Close")
+		}
+
+		db = Open(db.root)
+		controlDBSize(t, db, &testStruct{}, size+i)
+		tt.CheckErr(db.InsertOrUpdate(<-genTestStructs(1)))
+	}
+
+	tt.CheckErr(db.Drop())
+	tt.Assert(!isDirAndExist(OSStorage{}, db.root))
+}
+
+func TestPendingWrites(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	s := DefaultSchema
+	// routine would not flush by itself during the test
+	s.Asynchrone(size*10, time.Hour)
+
+	db := createFreshTestDb(0, s)
+	defer db.Drop()
+
+	tt.Assert(len(db.PendingWrites(&testStruct{})) == 0)
+
+	uuids := make([]string, 0, size)
+	for o := range genTestStructs(size) {
+		tt.CheckErr(db.InsertOrUpdate(o))
+		uuids = append(uuids, o.UUID())
+	}
+	sort.Strings(uuids)
+
+	pending := db.PendingWrites(&testStruct{})
+	tt.Assert(reflect.DeepEqual(pending, uuids))
+	for _, uuid := range pending {
+		tt.Assert(!isFileAndExist(OSStorage{}, filepath.Join(db.oDir(&testStruct{}), uuid+DefaultExtension)))
+	}
+
+	// other types are not concerned
+	tt.CheckErr(db.Create(&testStructUnique{}, DefaultSchema))
+	tt.CheckErr(db.InsertOrUpdate(&testStructUnique{}))
+	tt.Assert(len(db.PendingWrites(&testStructUnique{})) == 0)
+
+	tt.CheckErr(db.FlushAll(&testStruct{}))
+	tt.Assert(len(db.PendingWrites(&testStruct{})) == 0)
+	controlDBSize(t, db, &testStruct{}, size)
 }
 
 type invalidStruct struct {
@@ -968,6 +1059,25 @@ func TestAssign(t *testing.T) {
 	tt.ShouldPanic(func() { db.Search(&testStruct{}, "A", "<", 21).Assign(s) })
 	// should panic because ts is not a slice
 	tt.ShouldPanic(func() { db.Search(&testStruct{}, "A", "=", 0).Assign(&ts) })
+
+	// slices of values are assigned copies of the Objects
+	var values []testStruct
+	tt.CheckErr(db.Search(&testStruct{}, "A", "<", 21).And("B", ">", 21).Assign(&values))
+	tt.Assert(len(values) == len(s))
+	for i := range values {
+		tt.Assert(values[i].UUID() == s[i].UUID())
+		tt.Assert(values[i].A == s[i].A && values[i].B == s[i].B)
+	}
+	tt.CheckErr(db.AssignAll(&testStruct{}, &values))
+	tt.Assert(len(values) == count)
+
+	// panic messages name the types involved
+	defer func() {
+		r := recover()
+		tt.Assert(strings.Contains(fmt.Sprint(r), "sod.testStructUnique"), r)
+	}()
+	var wrong []testStructUnique
+	db.Search(&testStruct{}, "A", "<", 21).Assign(&wrong)
 }
 
 func TestNestedStruct(t *testing.T) {
@@ -1035,6 +1145,91 @@ func TestRepairFull(t *testing.T) {
 	tt.TimeIt("controlling repaired", func() { tt.CheckErr(s.control()) })
 }
 
+func TestWalkFiles(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	odir := db.oDir(&testStruct{})
+	orphan := filepath.Join(odir, "00000000-0000-4000-8000-000000000000"+DefaultExtension)
+	tt.CheckErr(ioutil.WriteFile(orphan, []byte("corrupted"), 0600))
+	// not an Object file
+	tt.CheckErr(ioutil.WriteFile(filepath.Join(odir, "notes.txt"), []byte("notes"), 0600))
+
+	// orphan files are not iterated but walked
+	it, err := db.Iterator(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(it.len() == size)
+
+	prev := ""
+	walked := make(map[string]int64)
+	tt.CheckErr(db.WalkFiles(&testStruct{}, func(uuid, path string, size int64) error {
+		tt.Assert(uuid > prev)
+		prev = uuid
+		stat, err := os.Stat(path)
+		tt.CheckErr(err)
+		tt.Assert(stat.Size() == size)
+		walked[uuid] = size
+		return nil
+	}))
+	tt.Assert(len(walked) == size+1)
+	tt.Assert(walked["00000000-0000-4000-8000-000000000000"] == int64(len("corrupted")))
+
+	// walking stops at the first error
+	n := 0
+	tt.ExpectErr(db.WalkFiles(&testStruct{}, func(uuid, path string, size int64) error {
+		n++
+		return ErrNoObjectFound
+	}), ErrNoObjectFound)
+	tt.Assert(n == 1)
+
+	// walk function can modify the DB
+	tt.CheckErr(db.WalkFiles(&testStruct{}, func(uuid, path string, size int64) error {
+		if size == int64(len("corrupted")) {
+			return os.Remove(path)
+		}
+		o, err := db.GetByUUID(&testStruct{}, uuid)
+		if err != nil {
+			return err
+		}
+		return db.Delete(o)
+	}))
+	controlDBSize(t, db, &testStruct{}, 0)
+}
+
+func TestNewUUID(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(0, DefaultSchema)
+	defer db.Drop()
+
+	// generation terminates even if all UUIDs collide
+	n := 0
+	o := &testStruct{}
+	tt.ExpectErr(db.newUUID(o, func(Object) (bool, error) { n++; return true, nil }), ErrUUIDCollision)
+	tt.Assert(n == UUIDRetries)
+	tt.Assert(o.UUID() == "")
+
+	// errors abort generation
+	n = 0
+	tt.ExpectErr(db.newUUID(o, func(Object) (bool, error) { n++; return false, os.ErrPermission }), os.ErrPermission)
+	tt.Assert(n == 1)
+	tt.Assert(o.UUID() == "")
+
+	// first free UUID is used
+	n = 0
+	tt.CheckErr(db.newUUID(o, func(Object) (bool, error) { n++; return n < 3, nil }))
+	tt.Assert(n == 3)
+	tt.Assert(uuidRegexp.MatchString(o.UUID()))
+
+	tt.CheckErr(db.InsertOrUpdate(&testStruct{}))
+	controlDBSize(t, db, &testStruct{}, 1)
+}
+
 func TestRepairPartial(t *testing.T) {
 	var db *DB
 
@@ -1050,7 +1245,7 @@ func TestRepairPartial(t *testing.T) {
 	// we corrupt schema
 	s, err := db.Schema(&testStruct{})
 	tt.CheckErr(err)
-	uuids, err := uuidsFromDir(odir)
+	uuids, err := uuidsFromDir(OSStorage{}, odir)
 	tt.CheckErr(err)
 
 	t.Logf("Corrupting %d entries (%.2f%%)", del, corruptPerc*100)
@@ -1167,6 +1362,38 @@ func TestAssignIndex(t *testing.T) {
 	tt.ShouldPanic(func() { db.AssignIndex(&testStruct{}, "A", intIndex) })
 }
 
+func TestAssignIndexes(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	count := 100
+	db := createFreshTestDb(count, DefaultSchema)
+	defer controlDB(t, db)
+
+	var strIndex []string
+	var intIndex []int
+	var timeIndex []time.Time
+
+	tt.CheckErr(db.AssignIndexes(&testStruct{}, []string{"C", "A", "M"}, &strIndex, &intIndex, &timeIndex))
+	tt.Assert(len(strIndex) == count && len(intIndex) == count && len(timeIndex) == count)
+
+	// values of the same object are at the same position
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+	columns := make(map[string]bool)
+	for i := range strIndex {
+		columns[fmt.Sprintf("%s-%d-%d", strIndex[i], intIndex[i], timeIndex[i].UnixNano())] = true
+	}
+	for _, o := range all {
+		ts := o.(*testStruct)
+		tt.Assert(columns[fmt.Sprintf("%s-%d-%d", ts.C, ts.A, ts.M.UnixNano())])
+	}
+
+	tt.ExpectErr(db.AssignIndexes(&testStruct{}, []string{"A", "N"}, &intIndex, &intIndex), ErrUnindexedField)
+	tt.ExpectErr(db.AssignIndexes(&testStruct{}, []string{"A", "C"}, &intIndex), ErrTargetsMismatch)
+	tt.ShouldPanic(func() { db.AssignIndexes(&testStruct{}, []string{"A"}, intIndex) })
+}
+
 func TestBugCasting(t *testing.T) {
 	// there is a bug when a value is searched before anything got inserted in the index
 	t.Parallel()
@@ -1198,8 +1425,9 @@ func TestIndexCorruption(t *testing.T) {
 	// we close database
 	tt.CheckErr(db.Close())
 
-	// we delete schema manually
+	// we delete schema manually, backup would be loaded otherwise
 	tt.CheckErr(os.Remove(schemaPath))
+	tt.CheckErr(os.Remove(filepath.Join(odir, SchemaBackupFilename)))
 
 	db = Open(db.root)
 
@@ -1316,3 +1544,3915 @@ func TestErrors(t *testing.T) {
 	tt.ExpectErr(db.Search(&testStruct{}, "A", "=", 42).AssignOne(&fake), ErrStructureChanged)
 	tt.ExpectErr(db.InsertOrUpdate(&testStruct{}), ErrStructureChanged)
 }
+
+func TestGetManyByUUID(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	count := 100
+	db := createFreshTestDb(count, DefaultSchema)
+	defer controlDB(t, db)
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+
+	inserted := make(map[string]Object)
+	for _, o := range all {
+		inserted[o.UUID()] = o
+	}
+
+	// we request objects in reverse order with a missing one in the middle
+	missing := uuidOrPanic()
+	uuids := make([]string, 0, count+1)
+	for i := len(all) - 1; i >= 0; i-- {
+		uuids = append(uuids, all[i].UUID())
+		if i == count/2 {
+			uuids = append(uuids, missing)
+		}
+	}
+
+	out, err := db.GetManyByUUID(&testStruct{}, uuids)
+	tt.CheckErr(err)
+	tt.Assert(len(out) == len(uuids))
+
+	for i, o := range out {
+		if uuids[i] == missing {
+			tt.Assert(o == nil)
+			continue
+		}
+		tt.Assert(o != nil, "missing object uuid=", uuids[i])
+		tt.Assert(o.UUID() == uuids[i])
+		tt.Assert(reflect.DeepEqual(o, inserted[uuids[i]]))
+	}
+}
+
+func TestGetFields(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(0, DefaultSchema)
+	defer controlDB(t, db)
+
+	k := 42
+	ts := &testStruct{A: 1, B: 2, C: "foo", Nested: &nestedStruct{}, Ptr: &k}
+	tt.CheckErr(db.InsertOrUpdate(ts))
+
+	o, err := db.GetFields(&testStruct{Item: ts.Item}, "A", "Ptr", "Nested.C")
+	tt.CheckErr(err)
+	partial := o.(*testStruct)
+	tt.Assert(partial.UUID() == ts.UUID())
+	tt.Assert(partial.A == 1)
+	tt.Assert(*partial.Ptr == 42)
+	tt.Assert(partial.Nested != nil)
+	// fields not requested must be zero
+	tt.Assert(partial.B == 0)
+	tt.Assert(partial.C == "")
+
+	// partial object must not alter a full read
+	o, err = db.Get(&testStruct{Item: ts.Item})
+	tt.CheckErr(err)
+	tt.Assert(o.(*testStruct).C == "foo")
+
+	_, err = db.GetFields(&testStruct{Item: ts.Item}, "Unknown")
+	tt.ExpectErr(err, ErrUnkownField)
+
+	_, err = db.GetFields(&testStruct{}, "A")
+	tt.ExpectErr(err, ErrNoObjectFound)
+
+	// decoding errors report the file
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	path := db.oPath(sch, ts)
+	data, err := os.ReadFile(path)
+	tt.CheckErr(err)
+	tt.CheckErr(os.WriteFile(path, []byte("[]"), DefaultPermissions))
+	_, err = db.GetFields(&testStruct{Item: ts.Item}, "A")
+	tt.Assert(err != nil && strings.Contains(err.Error(), path), err)
+	tt.CheckErr(os.WriteFile(path, data, DefaultPermissions))
+
+	// fields of the Object passed are reset
+	o, err = db.GetFields(&testStruct{Item: ts.Item, B: 42, O: "bar"}, "A")
+	tt.CheckErr(err)
+	tt.Assert(o.UUID() == ts.UUID())
+	tt.Assert(o.(*testStruct).A == 1)
+	tt.Assert(o.(*testStruct).B == 0)
+	tt.Assert(o.(*testStruct).O == "")
+}
+
+func BenchmarkGetFields(b *testing.B) {
+	type wide struct {
+		Item
+		Name string
+		Blob []string
+	}
+
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	if err := db.Create(&wide{}, DefaultSchema); err != nil {
+		b.Fatal(err)
+	}
+
+	o := &wide{Name: "wide", Blob: make([]string, 0, 10000)}
+	for i := 0; i < cap(o.Blob); i++ {
+		o.Blob = append(o.Blob, fmt.Sprintf("value-%d", i))
+	}
+
+	if err := db.InsertOrUpdate(o); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("Get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get(&wide{Item: o.Item}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("GetFields", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetFields(&wide{Item: o.Item}, "Name"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDeleteExisting(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+
+	deleted, err := db.DeleteExisting(all[0])
+	tt.CheckErr(err)
+	tt.Assert(deleted)
+	controlDBSize(t, db, &testStruct{}, size-1)
+
+	// deleting twice
+	deleted, err = db.DeleteExisting(all[0])
+	tt.CheckErr(err)
+	tt.Assert(!deleted)
+	tt.CheckErr(db.Delete(all[0]))
+
+	// never inserted
+	deleted, err = db.DeleteExisting(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(!deleted)
+	tt.CheckErr(db.Delete(&testStruct{}))
+
+	db = closeAndReOpen(db)
+	controlDBSize(t, db, &testStruct{}, size-1)
+	deleted, err = db.DeleteExisting(all[1])
+	tt.CheckErr(err)
+	tt.Assert(deleted)
+	controlDBSize(t, db, &testStruct{}, size-2)
+}
+
+func TestExistMany(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+
+	candidates := append([]Object{}, all[:size/2]...)
+	for o := range genTestStructs(size / 2) {
+		o.Initialize(uuidOrPanic())
+		candidates = append(candidates, o)
+	}
+
+	exist, err := db.ExistMany(candidates...)
+	tt.CheckErr(err)
+	tt.Assert(len(exist) == len(candidates))
+	for i, o := range candidates {
+		tt.Assert(exist[o.UUID()] == (i < size/2))
+		ok, err := db.Exist(o)
+		tt.CheckErr(err)
+		tt.Assert(ok == exist[o.UUID()])
+	}
+
+	// Objects of several types
+	u := &testStructUnique{}
+	tt.CheckErr(db.Create(u, DefaultSchema))
+	tt.CheckErr(db.InsertOrUpdate(u))
+	_, err = db.ExistMany(all[0], u)
+	tt.ExpectErr(err, ErrWrongObjectType)
+
+	// Objects without UUID cannot exist
+	exist, err = db.ExistMany(all[0], &testStruct{}, &testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(exist) == 1)
+	tt.Assert(exist[all[0].UUID()])
+
+	type unknown struct{ Item }
+	_, err = db.ExistMany(&unknown{}, &unknown{})
+	tt.ExpectErr(err, ErrSchemaNotCreated)
+
+	exist, err = db.ExistMany()
+	tt.CheckErr(err)
+	tt.Assert(len(exist) == 0)
+}
+
+func TestVacuum(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	s := DefaultSchema
+	s.CompositeIndex("A", "B")
+	db := createFreshTestDb(size, s)
+	defer db.Drop()
+
+	// churn
+	tt.CheckErr(db.Search(&testStruct{}, "A", "<", 30).Delete())
+	objects := make([]Object, 0, size)
+	for o := range genTestStructs(size) {
+		objects = append(objects, o)
+	}
+	_, err := db.InsertOrUpdateMany(objects...)
+	tt.CheckErr(err)
+	tt.CheckErr(db.Search(&testStruct{}, "A", ">=", 10).Delete())
+
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	n := sch.ObjectIndex.len()
+	tt.Assert(sch.ObjectIndex.i > uint64(n))
+
+	before, err := db.Search(&testStruct{}, "A", "<", 5).And("B", ">", 20).UUIDs()
+	tt.CheckErr(err)
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+
+	tt.CheckErr(db.Vacuum(&testStruct{}))
+	sch, err = db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(sch.ObjectIndex.i == uint64(n))
+	for id := range sch.ObjectIndex.ObjectIds {
+		tt.Assert(id < uint64(n))
+	}
+	tt.CheckErr(sch.ObjectIndex.control())
+	tt.CheckErr(sch.control())
+
+	after, err := db.Search(&testStruct{}, "A", "<", 5).And("B", ">", 20).UUIDs()
+	tt.CheckErr(err)
+	sort.Strings(before)
+	sort.Strings(after)
+	tt.Assert(reflect.DeepEqual(before, after))
+
+	// Objects are found through every index
+	for _, o := range all {
+		ts := o.(*testStruct)
+		tt.Assert(db.Search(&testStruct{}, UUIDField, "=", ts.UUID()).Len() == 1)
+		tt.Assert(db.Search(&testStruct{}, "A", "=", ts.A).And("B", "=", ts.B).And(UUIDField, "=", ts.UUID()).Len() == 1)
+	}
+
+	// new Objects follow the renumbered ones
+	for o := range genTestStructs(10) {
+		tt.CheckErr(db.InsertOrUpdate(o))
+	}
+	tt.Assert(sch.ObjectIndex.i == uint64(n+10))
+
+	db = closeAndReOpen(db)
+	tt.CheckErr(db.Control())
+	controlDBSize(t, db, &testStruct{}, n+10)
+}
+
+func TestDeleteObjectsCorrupted(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	count := 10
+	corrupted := 5
+	db := createFreshTestDb(count, DefaultSchema)
+	defer controlDB(t, db)
+
+	s, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+
+	it, err := db.Iterator(&testStruct{})
+	tt.CheckErr(err)
+
+	// corrupting one object in the middle of the deletion set
+	corruptFile(filepath.Join(db.oDir(&testStruct{}), s.filenameFromUUID(it.uuids[corrupted])))
+
+	err = db.DeleteObjects(it)
+	tt.Assert(err != nil)
+	tt.Assert(err != ErrEOI)
+	t.Logf("Expected error: %s", err)
+
+	// objects before the corrupted one must have been deleted
+	controlDBSize(t, db, &testStruct{}, count-corrupted)
+	for _, uuid := range it.uuids[:corrupted] {
+		ok, err := db.Exist(newObjectFromUUID(&testStruct{}, uuid))
+		tt.CheckErr(err)
+		tt.Assert(!ok)
+	}
+
+	// objects from the corrupted one must still be there
+	for _, uuid := range it.uuids[corrupted:] {
+		ok, err := db.Exist(newObjectFromUUID(&testStruct{}, uuid))
+		tt.CheckErr(err)
+		tt.Assert(ok)
+	}
+}
+
+func newObjectFromUUID(of Object, uuid string) Object {
+	o := newObject(of)
+	o.Initialize(uuid)
+	return o
+}
+
+func TestIndexDrift(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	count := 100
+	ndrift := 5
+	db := createFreshTestDb(count, DefaultSchema)
+	odir := db.oDir(&testStruct{})
+
+	onlyInIndex, onlyOnDisk, err := db.IndexDrift(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(onlyInIndex) == 0 && len(onlyOnDisk) == 0)
+
+	s, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	uuids, err := uuidsFromDir(OSStorage{}, odir)
+	tt.CheckErr(err)
+
+	removed := make(map[string]bool)
+	unindexed := make(map[string]bool)
+	for uuid := range uuids {
+		switch {
+		case len(removed) < ndrift:
+			tt.CheckErr(os.Remove(filepath.Join(odir, s.filenameFromUUID(uuid))))
+			removed[uuid] = true
+		case len(unindexed) < ndrift:
+			s.ObjectIndex.deleteByUUID(uuid)
+			unindexed[uuid] = true
+		}
+	}
+
+	onlyInIndex, onlyOnDisk, err = db.IndexDrift(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(onlyInIndex) == ndrift)
+	tt.Assert(len(onlyOnDisk) == ndrift)
+	for _, uuid := range onlyInIndex {
+		tt.Assert(removed[uuid])
+	}
+	for _, uuid := range onlyOnDisk {
+		tt.Assert(unindexed[uuid])
+	}
+
+	tt.ExpectErr(db.Control(), ErrIndexCorrupted)
+	tt.CheckErr(db.Repair(&testStruct{}))
+	tt.CheckErr(db.Control())
+}
+
+type parentStruct struct {
+	Item
+	Name  string `sod:"unique"`
+	Total int
+}
+
+type childStruct struct {
+	Item
+	Parent string `sod:"index"`
+	Amount int
+}
+
+// ValidateWithDB checks that the sum of all children amounts
+// does not exceed parent total
+func (c *childStruct) ValidateWithDB(db *DBView) (err error) {
+	var p *parentStruct
+	var children []*childStruct
+
+	if err = db.Search(&parentStruct{}, "Name", "=", c.Parent).AssignUnique(&p); err != nil {
+		return
+	}
+
+	if err = db.Search(&childStruct{}, "Parent", "=", c.Parent).Assign(&children); err != nil {
+		return
+	}
+
+	sum := c.Amount
+	for _, child := range children {
+		if child.UUID() != c.UUID() {
+			sum += child.Amount
+		}
+	}
+
+	if sum > p.Total {
+		return fmt.Errorf("children amount %d exceeds parent total %d", sum, p.Total)
+	}
+
+	return
+}
+
+func TestValidateWithDB(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(0, DefaultSchema)
+	defer controlDB(t, db)
+
+	tt.CheckErr(db.Create(&parentStruct{}, DefaultSchema))
+	tt.CheckErr(db.Create(&childStruct{}, DefaultSchema))
+
+	tt.CheckErr(db.InsertOrUpdate(&parentStruct{Name: "parent", Total: 42}))
+
+	tt.CheckErr(db.InsertOrUpdate(&childStruct{Parent: "parent", Amount: 20}))
+	tt.CheckErr(db.InsertOrUpdate(&childStruct{Parent: "parent", Amount: 20}))
+	tt.ExpectErr(db.InsertOrUpdate(&childStruct{Parent: "parent", Amount: 20}), ErrInvalidObject)
+	// parent does not exist
+	tt.ExpectErr(db.InsertOrUpdate(&childStruct{Parent: "unknown", Amount: 1}), ErrInvalidObject)
+
+	_, err := db.InsertOrUpdateMany(&childStruct{Parent: "parent", Amount: 1}, &childStruct{Parent: "parent", Amount: 3})
+	tt.ExpectErr(err, ErrInvalidObject)
+
+	n, err := db.InsertOrUpdateMany(&childStruct{Parent: "parent", Amount: 1}, &childStruct{Parent: "parent", Amount: 1})
+	tt.CheckErr(err)
+	tt.Assert(n == 2)
+
+	controlDBSize(t, db, &childStruct{}, 4)
+
+	// Objects cannot be deleted from a view
+	v := &DBView{db.view()}
+	tt.ExpectErr(v.Search(&childStruct{}, "Parent", "=", "parent").Delete(), ErrViewReadOnly)
+	_, err = v.Search(&childStruct{}, "Parent", "=", "parent").DeleteInBatches(1)
+	tt.ExpectErr(err, ErrViewReadOnly)
+	n, err = v.Count(&childStruct{})
+	tt.CheckErr(err)
+	tt.Assert(n == 4)
+	controlDBSize(t, db, &childStruct{}, 4)
+}
+
+func TestSearchTimeZone(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(0, DefaultSchema)
+	defer controlDB(t, db)
+
+	east := time.FixedZone("UTC+5", 5*3600)
+	west := time.FixedZone("UTC-8", -8*3600)
+	// instant close to a DST change in Europe
+	ref := time.Date(2022, time.March, 27, 1, 30, 0, 42, time.UTC)
+
+	tt.CheckErr(db.InsertOrUpdate(&testStruct{M: ref.In(east)}))
+	tt.CheckErr(db.InsertOrUpdate(&testStruct{M: ref.Add(time.Hour).In(west)}))
+
+	check := func() {
+		for _, loc := range []*time.Location{time.UTC, time.Local, east, west} {
+			var ts *testStruct
+
+			literal := ref.In(loc)
+			tt.CheckErr(db.Search(&testStruct{}, "M", "=", literal).AssignUnique(&ts))
+			tt.Assert(ts.M.Equal(ref))
+
+			tt.Assert(db.Search(&testStruct{}, "M", ">=", literal).Len() == 2)
+			tt.Assert(db.Search(&testStruct{}, "M", ">", literal).Len() == 1)
+			tt.Assert(db.Search(&testStruct{}, "M", "<", literal.Add(time.Hour)).Len() == 1)
+			tt.Assert(db.Search(&testStruct{}, "M", "<=", literal.Add(time.Hour)).Len() == 2)
+			tt.Assert(db.Search(&testStruct{}, "M", "!=", literal).Len() == 1)
+		}
+	}
+
+	check()
+
+	// values read from disk must compare the same way
+	db = closeAndReOpen(db)
+	check()
+}
+
+type testStatus int
+
+const (
+	statusInactive testStatus = iota
+	statusActive
+)
+
+type testLabel string
+
+type namedTypesStruct struct {
+	Item
+	Status testStatus    `sod:"index"`
+	Label  testLabel     `sod:"upper,index"`
+	Delay  time.Duration `sod:"index"`
+}
+
+func TestNamedTypes(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(0, DefaultSchema)
+	defer controlDB(t, db)
+
+	fds := FieldDescriptors(&namedTypesStruct{})
+	tt.Assert(fds["Status"].Kind == "int")
+	tt.Assert(fds["Label"].Kind == "string")
+	tt.Assert(fds["Delay"].Kind == "int64")
+
+	tt.CheckErr(db.Create(&namedTypesStruct{}, DefaultSchema))
+
+	for i := 0; i < 100; i++ {
+		tt.CheckErr(db.InsertOrUpdate(&namedTypesStruct{
+			Status: testStatus(i % 2),
+			Label:  testLabel(fmt.Sprintf("label%d", i%10)),
+			Delay:  time.Duration(i) * time.Second,
+		}))
+	}
+
+	check := func() {
+		var out []*namedTypesStruct
+
+		tt.CheckErr(db.Search(&namedTypesStruct{}, "Status", "=", statusActive).Assign(&out))
+		tt.Assert(len(out) == 50)
+		for _, o := range out {
+			tt.Assert(o.Status == statusActive)
+		}
+
+		// searching with the underlying type must work as well
+		tt.Assert(db.Search(&namedTypesStruct{}, "Status", "=", 0).Len() == 50)
+		tt.Assert(db.Search(&namedTypesStruct{}, "Label", "=", testLabel("label1")).Len() == 10)
+		tt.Assert(db.Search(&namedTypesStruct{}, "Label", "=", "LABEL1").Len() == 10)
+		tt.Assert(db.Search(&namedTypesStruct{}, "Delay", "<", 10*time.Second).Len() == 10)
+
+		var statuses []testStatus
+		tt.CheckErr(db.AssignIndex(&namedTypesStruct{}, "Status", &statuses))
+		tt.Assert(len(statuses) == 100)
+	}
+
+	check()
+
+	db = closeAndReOpen(db)
+	tt.CheckErr(db.Create(&namedTypesStruct{}, DefaultSchema))
+	check()
+}
+
+func BenchmarkInsertOrUpdateMany(b *testing.B) {
+	size := 100000
+
+	objects := make([]Object, 0, size)
+	for o := range genTestStructs(size) {
+		objects = append(objects, o)
+	}
+
+	defer func(c int) { BulkWriteConcurrency = c }(BulkWriteConcurrency)
+
+	for _, c := range []int{1, 4, 8, 16} {
+		b.Run(fmt.Sprintf("Concurrency%d", c), func(b *testing.B) {
+			BulkWriteConcurrency = c
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				db := createFreshTestDb(0, DefaultSchema)
+				// objects must be inserted as new ones
+				for _, o := range objects {
+					o.Initialize("")
+				}
+				if _, err := db.InsertOrUpdateMany(objects...); err != nil {
+					b.Error(err)
+				}
+				b.StopTimer()
+				db.Drop()
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(size*b.N)/time.Since(start).Seconds(), "obj/s")
+		})
+	}
+}
+
+func TestVerifyConstraints(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(0, DefaultSchema)
+	defer controlDB(t, db)
+
+	tt.CheckErr(db.Create(&testStructUnique{}, DefaultSchema))
+	for i := 0; i < 100; i++ {
+		tt.CheckErr(db.InsertOrUpdate(&testStructUnique{A: i, B: int32(i), C: fmt.Sprintf("%d", i)}))
+	}
+	tt.Assert(len(db.VerifyConstraints(&testStructUnique{})) == 0)
+
+	// objects with duplicated values inserted before constraint is added
+	for i := 0; i < 100; i++ {
+		tt.CheckErr(db.InsertOrUpdate(&testStruct{A: i % 10, B: i}))
+	}
+	tt.Assert(len(db.VerifyConstraints(&testStruct{})) == 0)
+
+	s, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	s.ObjectIndex.Fields["A"].Constraints.Unique = true
+	s.ObjectIndex.Fields["B"].Constraints.Unique = true
+
+	errs := db.VerifyConstraints(&testStruct{})
+	tt.Assert(len(errs) == 10)
+	for _, err := range errs {
+		tt.ExpectErr(err, ErrConstraintUnique)
+	}
+
+	tt.Assert(len(db.VerifyConstraints(&struct{ Item }{})) == 1)
+}
+
+func TestInsert(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(0, DefaultSchema)
+	defer controlDB(t, db)
+
+	ts := &testStruct{A: 42}
+	tt.CheckErr(db.Insert(ts))
+	tt.Assert(ts.UUID() != "")
+
+	// inserting again must fail and leave object untouched
+	dup := &testStruct{A: 41}
+	dup.Initialize(ts.UUID())
+	tt.ExpectErr(db.Insert(dup), ErrAlreadyExists)
+
+	o, err := db.Get(&testStruct{Item: ts.Item})
+	tt.CheckErr(err)
+	tt.Assert(o.(*testStruct).A == 42)
+
+	// a new object with a chosen uuid can be inserted
+	chosen := &testStruct{A: 43}
+	chosen.Initialize(uuidOrPanic())
+	tt.CheckErr(db.Insert(chosen))
+	tt.ExpectErr(db.Insert(chosen), ErrAlreadyExists)
+
+	// update is still possible with InsertOrUpdate
+	chosen.A = 44
+	tt.CheckErr(db.InsertOrUpdate(chosen))
+
+	controlDBSize(t, db, &testStruct{}, 2)
+}
+
+func TestSchemaDirName(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s := DefaultSchema
+	s.DirName = "test_structs"
+	tt.CheckErr(db.Create(&testStruct{}, s))
+	_, err := db.InsertOrUpdateBulk(genTestStructs(size), size)
+	tt.CheckErr(err)
+	tt.Assert(isFileAndExist(OSStorage{}, filepath.Join(db.root, "test_structs", SchemaFilename)))
+	tt.Assert(!isDirAndExist(OSStorage{}, filepath.Join(db.root, stype(&testStruct{}))))
+
+	// directory name is persisted
+	db = closeAndReOpen(db)
+	controlDBSize(t, db, &testStruct{}, size)
+	controlDB(t, db)
+	tt.CheckErr(db.Create(&testStruct{}, DefaultSchema))
+	tt.CheckErr(db.Create(&testStruct{}, s))
+	controlDBSize(t, db, &testStruct{}, size)
+
+	// directory name cannot be changed
+	s.DirName = "other"
+	tt.ExpectErr(db.Create(&testStruct{}, s), ErrBadDirName)
+
+	// directory names must not collide
+	u := DefaultSchema
+	u.DirName = "test_structs"
+	tt.ExpectErr(db.Create(&testStructUnique{}, u), ErrDirNameCollision)
+	u.DirName = stype(&testStruct{})
+	tt.CheckErr(db.Create(&testStructUnique{}, u))
+
+	// directory names must be valid
+	type other struct{ Item }
+	for _, name := range []string{"a/b", ".", ".."} {
+		u.DirName = name
+		tt.ExpectErr(db.Create(&other{}, u), ErrBadDirName)
+	}
+
+	// default directory name collides with a custom one
+	type another struct{ Item }
+	u.DirName = stype(&another{})
+	tt.CheckErr(db.Create(&other{}, u))
+	db = closeAndReOpen(db)
+	tt.ExpectErr(db.Create(&another{}, DefaultSchema), ErrDirNameCollision)
+	controlDBSize(t, db, &testStruct{}, size)
+}
+
+func TestSchemaDirNameCreateFailure(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	root := randDBPath()
+	st := &failingStorage{memStorage: newMemStorage(), marker: []byte(`"dir-name":"failing"`)}
+	db := OpenWithStorage(root, st)
+	defer db.Drop()
+
+	// directory name is not registered if schema cannot be saved
+	s := DefaultSchema
+	s.DirName = "failing"
+	tt.ExpectErr(db.Create(&testStruct{}, s), errFailingWrite)
+	_, ok := db.dirs.get(stype(&testStruct{}))
+	tt.Assert(!ok)
+
+	db = OpenWithStorage(root, st)
+	tt.CheckErr(db.dirs.load(st, root))
+	_, ok = db.dirs.get(stype(&testStruct{}))
+	tt.Assert(!ok)
+
+	// directory name can be used by another type
+	s.DirName = "succeeding"
+	tt.CheckErr(db.Create(&testStruct{}, s))
+	u := DefaultSchema
+	u.DirName = "failing"
+	st.marker = []byte("never written")
+	tt.CheckErr(db.Create(&testStructUnique{}, u))
+}
+
+func TestInsertOrMergeMany(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	s := DefaultSchema
+	s.Cache = true
+	db := createFreshTestDb(size, s)
+	defer controlDB(t, db)
+
+	// only non zero fields overwrite existing ones
+	merge := func(existing, incoming Object) Object {
+		e, i := existing.(*testStruct), incoming.(*testStruct)
+		if i.B != 0 {
+			e.B = i.B
+		}
+		return e
+	}
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+
+	incoming := make([]Object, 0, len(all)+10)
+	for _, o := range all {
+		ts := &testStruct{B: 4242}
+		ts.Initialize(o.UUID())
+		incoming = append(incoming, ts)
+	}
+	// new objects
+	for i := 0; i < 10; i++ {
+		incoming = append(incoming, &testStruct{A: 42, B: 4242})
+	}
+
+	n, err := db.InsertOrMergeMany(merge, incoming...)
+	tt.CheckErr(err)
+	tt.Assert(n == len(incoming))
+	controlDBSize(t, db, &testStruct{}, size+10)
+
+	for _, o := range all {
+		ts, err := db.Get(newObjectFromUUID(&testStruct{}, o.UUID()))
+		tt.CheckErr(err)
+		tt.Assert(ts.(*testStruct).A == o.(*testStruct).A)
+		tt.Assert(ts.(*testStruct).B == 4242)
+	}
+	tt.Assert(db.Search(&testStruct{}, "A", "=", 42).Len() == 10)
+
+	// a merge returning a bad object must fail without modifying existing objects
+	bad := &testStruct{B: 1}
+	bad.Initialize(all[0].UUID())
+	_, err = db.InsertOrMergeMany(func(existing, incoming Object) Object {
+		existing.(*testStruct).B = 1
+		return nil
+	}, bad)
+	tt.ExpectErr(err, ErrWrongObjectType)
+	o, err := db.Get(newObjectFromUUID(&testStruct{}, all[0].UUID()))
+	tt.CheckErr(err)
+	tt.Assert(o.(*testStruct).B == 4242)
+
+	// bulk insertion
+	_, err = db.InsertOrMergeBulk(ToObjectChan(incoming[:size]), 10, merge)
+	tt.CheckErr(err)
+	controlDBSize(t, db, &testStruct{}, size+10)
+}
+
+func TestCompatibleTypeChange(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 10
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	{
+		type versioned struct {
+			Item
+			A int `sod:"index"`
+		}
+
+		tt.CheckErr(db.Create(&versioned{}, DefaultSchema))
+		for i := 0; i < size; i++ {
+			tt.CheckErr(db.InsertOrUpdate(&versioned{A: i}))
+		}
+	}
+
+	// integer width changes are not breaking
+	db = closeAndReOpen(db)
+	{
+		type versioned struct {
+			Item
+			A int64 `sod:"index"`
+		}
+
+		tt.CheckErr(db.Create(&versioned{}, DefaultSchema))
+		controlDB(t, db)
+		tt.Assert(db.Search(&versioned{}, "A", "=", int64(5)).Len() == 1)
+		s, err := db.Schema(&versioned{})
+		tt.CheckErr(err)
+		tt.Assert(s.Fields["A"].Type == "int64")
+	}
+
+	// narrowing integers is breaking as stored values may overflow
+	db = closeAndReOpen(db)
+	{
+		type versioned struct {
+			Item
+			A int8 `sod:"index"`
+		}
+
+		tt.ExpectErr(db.Create(&versioned{}, DefaultSchema), ErrStructureChanged)
+	}
+
+	// named integer types are not breaking
+	db = closeAndReOpen(db)
+	{
+		type versioned struct {
+			Item
+			A testStatus `sod:"index"`
+		}
+
+		tt.CheckErr(db.Create(&versioned{}, DefaultSchema))
+		controlDB(t, db)
+		tt.Assert(db.Search(&versioned{}, "A", "=", testStatus(5)).Len() == 1)
+	}
+
+	// signedness and kind changes are breaking
+	db = closeAndReOpen(db)
+	{
+		type versioned struct {
+			Item
+			A uint `sod:"index"`
+		}
+
+		tt.ExpectErr(db.Create(&versioned{}, DefaultSchema), ErrStructureChanged)
+	}
+
+	db = closeAndReOpen(db)
+	{
+		type versioned struct {
+			Item
+			A string `sod:"index"`
+		}
+
+		tt.ExpectErr(db.Create(&versioned{}, DefaultSchema), ErrStructureChanged)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+
+	for _, s := range []Schema{DefaultSchema, {Extension: DefaultExtension, Cache: true}} {
+		db := createFreshTestDb(size, s)
+
+		all, err := db.All(&testStruct{})
+		tt.CheckErr(err)
+		modified, deleted := all[0].(*testStruct), all[1].(*testStruct)
+		oldA := modified.A
+
+		sn, err := db.Snapshot(&testStruct{})
+		tt.CheckErr(err)
+
+		// modifications made after the snapshot
+		update := &testStruct{A: 4242}
+		update.Initialize(modified.UUID())
+		tt.CheckErr(db.InsertOrUpdate(update))
+		tt.CheckErr(db.Delete(deleted))
+		inserted := &testStruct{A: 4242}
+		tt.CheckErr(db.InsertOrUpdate(inserted))
+
+		// snapshot must not see modifications
+		n, err := sn.Count()
+		tt.CheckErr(err)
+		tt.Assert(n == size)
+		o, err := sn.Get(newObjectFromUUID(&testStruct{}, modified.UUID()))
+		tt.CheckErr(err)
+		tt.Assert(o.(*testStruct).A == oldA)
+		_, err = sn.Get(newObjectFromUUID(&testStruct{}, deleted.UUID()))
+		tt.CheckErr(err)
+		_, err = sn.Get(newObjectFromUUID(&testStruct{}, inserted.UUID()))
+		tt.ExpectErr(err, ErrNoObjectFound)
+		_, err = sn.Get(&testStructUnique{})
+		tt.ExpectErr(err, ErrWrongObjectType)
+		tt.Assert(sn.Search("A", "=", 4242).Len() == 0)
+		objs, err := sn.Search("A", "=", oldA).Collect()
+		tt.CheckErr(err)
+		found := false
+		for _, o := range objs {
+			tt.Assert(o.(*testStruct).A == oldA)
+			found = found || o.UUID() == modified.UUID()
+		}
+		tt.Assert(found)
+		snAll, err := sn.All()
+		tt.CheckErr(err)
+		tt.Assert(len(snAll) == size)
+
+		// snapshot is read only
+		tt.ExpectErr(sn.Search("A", "=", oldA).Delete(), ErrSnapshotReadOnly)
+
+		// DB sees modifications
+		controlDBSize(t, db, &testStruct{}, size)
+		tt.Assert(db.Search(&testStruct{}, "A", "=", 4242).Len() == 2)
+
+		sn.Close()
+		_, err = sn.Get(newObjectFromUUID(&testStruct{}, modified.UUID()))
+		tt.ExpectErr(err, ErrSnapshotClosed)
+
+		controlDB(t, db)
+		tt.CheckErr(db.Close())
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s := DefaultSchema
+	s.WriteBehind = true
+	tt.CheckErr(db.Create(&testStruct{}, s))
+
+	onDisk := func() int {
+		uuids, err := uuidsFromDir(OSStorage{}, db.oDir(&testStruct{}))
+		tt.CheckErr(err)
+		return len(uuids)
+	}
+
+	_, err := db.InsertOrUpdateBulk(genTestStructs(size), size/4)
+	tt.CheckErr(err)
+	single := &testStruct{A: 4242}
+	tt.CheckErr(db.InsertOrUpdate(single))
+
+	// nothing is written on insertion
+	tt.Assert(onDisk() == 0)
+	var saved Schema
+	tt.CheckErr(unmarshalJsonFile(OSStorage{}, filepath.Join(db.oDir(&testStruct{}), SchemaFilename), &saved))
+	tt.Assert(saved.ObjectIndex.len() == 0)
+
+	// objects are served from cache
+	controlDBSize(t, db, &testStruct{}, size+1)
+	o, err := db.Search(&testStruct{}, "A", "=", 4242).One()
+	tt.CheckErr(err)
+	tt.Assert(o.UUID() == single.UUID())
+
+	tt.CheckErr(db.Sync())
+	tt.Assert(onDisk() == size+1)
+	controlDB(t, db)
+
+	// updates are written on close
+	single.A = 4343
+	tt.CheckErr(db.InsertOrUpdate(single))
+	disk := newObjectFromUUID(&testStruct{}, single.UUID())
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	tt.CheckErr(unmarshalJsonFile(OSStorage{}, db.oPath(sch, single), disk))
+	tt.Assert(disk.(*testStruct).A == 4242)
+
+	// deleting writes pending objects to save the index
+	deleted, err := db.Search(&testStruct{}, "A", "!=", 4343).One()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Delete(deleted))
+	tt.CheckErr(unmarshalJsonFile(OSStorage{}, filepath.Join(db.oDir(&testStruct{}), SchemaFilename), &saved))
+	tt.Assert(saved.ObjectIndex.len() == size)
+	tt.Assert(onDisk() == size)
+	tt.CheckErr(unmarshalJsonFile(OSStorage{}, db.oPath(sch, single), disk))
+	tt.Assert(disk.(*testStruct).A == 4343)
+
+	db = closeAndReOpen(db)
+	controlDB(t, db)
+	controlDBSize(t, db, &testStruct{}, size)
+	o, err = db.Get(newObjectFromUUID(&testStruct{}, single.UUID()))
+	tt.CheckErr(err)
+	tt.Assert(o.(*testStruct).A == 4343)
+}
+
+func TestRawJSON(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 10
+
+	for _, s := range []Schema{DefaultSchema, DefaultSchemaCompress} {
+		db := createFreshTestDb(size, s)
+		defer db.Drop()
+
+		all, err := db.All(&testStruct{})
+		tt.CheckErr(err)
+
+		for _, o := range all {
+			data, err := db.RawJSON(&testStruct{}, o.UUID())
+			tt.CheckErr(err)
+			tt.Assert(string(data) == jsonOrPanic(o))
+		}
+
+		_, err = db.RawJSON(&testStruct{}, uuidOrPanic())
+		tt.ExpectErr(err, ErrNoObjectFound)
+		_, err = db.RawJSON(&testStructUnique{}, uuidOrPanic())
+		tt.ExpectErr(err, ErrSchemaNotCreated)
+		for _, uuid := range []string{"", "../schema", "../../" + all[0].UUID()} {
+			_, err = db.RawJSON(&testStruct{}, uuid)
+			tt.ExpectErr(err, ErrNoObjectFound)
+		}
+
+		// raw data must be readable even if structure changed
+		db = closeAndReOpen(db)
+		type testStruct struct {
+			Item
+			A string
+		}
+		_, err = db.Schema(&testStruct{})
+		tt.ExpectErr(err, ErrStructureChanged)
+		data, err := db.RawJSON(&testStruct{}, all[0].UUID())
+		tt.CheckErr(err)
+		tt.Assert(string(data) == jsonOrPanic(all[0]))
+		_, err = db.RawJSON(&testStruct{}, uuidOrPanic())
+		tt.ExpectErr(err, ErrNoObjectFound)
+		_, err = db.RawJSON(&testStruct{}, "../schema")
+		tt.ExpectErr(err, ErrNoObjectFound)
+	}
+}
+
+func TestMissingObjectDir(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(10, DefaultSchema)
+	defer db.Drop()
+
+	// schema is cached in memory
+	controlDBSize(t, db, &testStruct{}, 10)
+	tt.CheckErr(os.RemoveAll(db.oDir(&testStruct{})))
+
+	_, err := db.All(&testStruct{})
+	tt.ExpectErr(err, ErrIndexCorrupted)
+	it, err := db.Iterator(&testStruct{})
+	tt.CheckErr(err)
+	_, err = it.next()
+	tt.ExpectErr(err, ErrIndexCorrupted)
+
+	// read repair must not hide a missing directory
+	db.schemas[stype(&testStruct{})].ReadRepair = true
+	_, err = db.All(&testStruct{})
+	tt.ExpectErr(err, ErrIndexCorrupted)
+}
+
+func TestSetAsyncParams(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 10
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s := DefaultSchema
+	s.Asynchrone(1000, time.Hour)
+	tt.CheckErr(db.Create(&testStruct{}, s))
+	tt.ExpectErr(db.SetAsyncParams(&testStructUnique{}, 1, time.Second), ErrSchemaNotCreated)
+	tt.CheckErr(db.Create(&testStructUnique{}, DefaultSchema))
+	tt.ExpectErr(db.SetAsyncParams(&testStructUnique{}, 1, time.Second), ErrAsyncWritesOff)
+
+	_, err := db.InsertOrUpdateBulk(genTestStructs(size), size)
+	tt.CheckErr(err)
+
+	pending := func() int {
+		db.RLock()
+		defer db.RUnlock()
+		return db.asyncw.count(&testStruct{})
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	tt.Assert(pending() == size)
+
+	// bad parameters are rejected and previous ones are kept
+	tt.ExpectErr(db.SetAsyncParams(&testStruct{}, 0, time.Hour), ErrBadAsyncParams)
+	tt.ExpectErr(db.SetAsyncParams(&testStruct{}, -1, time.Hour), ErrBadAsyncParams)
+	tt.ExpectErr(db.SetAsyncParams(&testStruct{}, size, 0), ErrBadAsyncParams)
+	tt.ExpectErr(db.SetAsyncParams(&testStruct{}, size, -time.Second), ErrBadAsyncParams)
+	time.Sleep(300 * time.Millisecond)
+	tt.Assert(pending() == size)
+
+	// objects must be flushed with the new threshold
+	tt.CheckErr(db.SetAsyncParams(&testStruct{}, size, time.Hour))
+	for start := time.Now(); pending() > 0 && time.Since(start) < 2*time.Second; {
+		time.Sleep(50 * time.Millisecond)
+	}
+	tt.Assert(pending() == 0)
+	controlDB(t, db)
+
+	// parameters are persisted
+	db = closeAndReOpen(db)
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(sch.AsyncWrites.Threshold == size)
+	tt.CheckErr(db.Close())
+}
+
+func TestAssignAll(t *testing.T) {
+	t.Parallel()
+
+	var tsSlice []*testStruct
+	var objs []Object
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	tt.CheckErr(db.AssignAll(&testStruct{}, &tsSlice))
+	tt.Assert(len(tsSlice) == size)
+	tt.CheckErr(db.AssignAll(&testStruct{}, &objs))
+	tt.Assert(len(objs) == size)
+	uuids := make(map[string]bool)
+	for _, o := range objs {
+		uuids[o.UUID()] = true
+	}
+	for _, ts := range tsSlice {
+		tt.Assert(uuids[ts.UUID()])
+	}
+
+	// errors are returned
+	corruptFile(filepath.Join(db.oDir(&testStruct{}), DefaultSchema.filename(tsSlice[size/2])))
+	tt.Assert(db.AssignAll(&testStruct{}, &tsSlice) != nil)
+
+	// wrong target types make the function panic
+	for _, target := range []interface{}{tsSlice, &testStruct{}, nil} {
+		func() {
+			defer func() { tt.Assert(recover() != nil) }()
+			db.AssignAll(&testStruct{}, target)
+		}()
+	}
+}
+
+func TestSafeReflect(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	root := createFreshTestDb(size, DefaultSchema).root
+
+	var wrongObjects []*testStructUnique
+	var wrongObject *testStructUnique
+	var wrongValues []string
+
+	calls := map[string]func(db *DB) error{
+		"AssignAll": func(db *DB) error { return db.AssignAll(&testStruct{}, &wrongObjects) },
+		"AssignIndex": func(db *DB) error {
+			return db.AssignIndex(&testStruct{}, "A", &wrongValues)
+		},
+		"AssignIndexes": func(db *DB) error {
+			var c []string
+			return db.AssignIndexes(&testStruct{}, []string{"C", "A"}, &c, &wrongValues)
+		},
+		"Assign": func(db *DB) error {
+			return db.Search(&testStruct{}, "A", ">=", 0).Assign(&wrongObjects)
+		},
+		"AssignOne": func(db *DB) error {
+			return db.Search(&testStruct{}, "A", ">=", 0).AssignOne(&wrongObject)
+		},
+	}
+
+	// reflection panics by default
+	db := Open(root)
+	for name, call := range calls {
+		func() {
+			defer func() { tt.Assert(recover() != nil, name) }()
+			call(db)
+		}()
+	}
+	tt.CheckErr(db.Close())
+
+	db = Open(root)
+	db.SetSafeReflect(true)
+	defer db.Drop()
+	for name, call := range calls {
+		err := call(db)
+		tt.Assert(errors.Is(err, ErrReflection), name, err)
+	}
+
+	// locks have been released
+	tt.CheckErr(db.InsertOrUpdate(<-genTestStructs(1)))
+	controlDBSize(t, db, &testStruct{}, size+1)
+
+	// documented programmer errors still panic
+	for _, target := range []interface{}{wrongObjects, nil} {
+		func() {
+			defer func() { tt.Assert(recover() != nil) }()
+			db.AssignAll(&testStruct{}, target)
+		}()
+	}
+
+	// snapshots inherit the option
+	sn, err := db.Snapshot(&testStruct{})
+	tt.CheckErr(err)
+	defer sn.Close()
+	tt.ExpectErr(sn.Search("A", ">=", 0).Assign(&wrongObjects), ErrReflection)
+
+	// searches reading Objects from disk
+	tt.CheckErr(db.Create(&reflectPanicking{}, DefaultSchema))
+	panicking := &reflectPanicking{Panic: "reflect"}
+	tt.CheckErr(db.InsertOrUpdate(panicking))
+	_, err = db.Search(&reflectPanicking{}, "Panic", "=", "reflect").Collect()
+	tt.ExpectErr(err, ErrReflection)
+	search := db.Search(&reflectPanicking{}, "Panic", "=", "reflect")
+	tt.Assert(search.Len() == 0)
+	tt.ExpectErr(search.Err(), ErrReflection)
+	_, err = db.Search(&reflectPanicking{}, "Panic", "=", "reflect").One()
+	tt.ExpectErr(err, ErrReflection)
+
+	// option can be disabled
+	db.SetSafeReflect(false)
+	func() {
+		defer func() { tt.Assert(recover() != nil) }()
+		db.Search(&reflectPanicking{}, "Panic", "=", "reflect").Collect()
+	}()
+	db.SetSafeReflect(true)
+
+	// other panics are not recovered
+	tt.CheckErr(db.Delete(panicking))
+	tt.CheckErr(db.InsertOrUpdate(&reflectPanicking{Panic: "runtime"}))
+	func() {
+		defer func() { tt.Assert(recover() != nil) }()
+		db.Search(&reflectPanicking{}, "Panic", "=", "runtime").Collect()
+	}()
+	tt.CheckErr(db.InsertOrUpdate(<-genTestStructs(1)))
+}
+
+// reflectPanicking panics when loaded, according to Panic
+type reflectPanicking struct {
+	Item
+	Panic string
+}
+
+func (r *reflectPanicking) PostLoad() {
+	switch r.Panic {
+	case "reflect":
+		reflect.ValueOf(r.Panic).SetString("")
+	case "runtime":
+		var m map[string]int
+		m[r.Panic] = 0
+	}
+}
+
+func TestUpdateWhere(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	matched := db.Search(&testStruct{}, "A", "<", 21).Len()
+	n, err := db.UpdateWhere(&testStruct{}, db.Search(&testStruct{}, "A", "<", 21), "Upper", "archived")
+	tt.CheckErr(err)
+	tt.Assert(n == matched, n, matched)
+
+	// transformers ran and field is re-indexed
+	tt.Assert(db.Search(&testStruct{}, "Upper", "=", "ARCHIVED").Len() == n)
+	tt.Assert(db.Search(&testStruct{}, "Upper", "=", "UPPER").Len() == size-n)
+
+	db = closeAndReOpen(db)
+	tt.CheckErr(db.Control())
+	objects, err := db.Search(&testStruct{}, "Upper", "=", "ARCHIVED").Collect()
+	tt.CheckErr(err)
+	tt.Assert(len(objects) == n)
+	for _, o := range objects {
+		tt.Assert(o.(*testStruct).A < 21)
+	}
+
+	// fields not indexed can be updated
+	n, err = db.UpdateWhere(&testStruct{}, db.Search(&testStruct{}, "A", "<", 21), "N", uint(4242))
+	tt.CheckErr(err)
+	tt.Assert(db.Search(&testStruct{}, "N", "=", uint(4242)).Len() == n)
+
+	// nothing matches
+	n, err = db.UpdateWhere(&testStruct{}, db.Search(&testStruct{}, "A", "<", 0), "Upper", "none")
+	tt.CheckErr(err)
+	tt.Assert(n == 0)
+
+	_, err = db.UpdateWhere(&testStruct{}, db.Search(&testStruct{}, "A", "<", 21), "Upper", 42)
+	tt.ExpectErr(err, ErrCasting)
+	_, err = db.UpdateWhere(&testStruct{}, db.Search(&testStruct{}, "A", "<", 21), "Unknown", 42)
+	tt.ExpectErr(err, ErrUnkownField)
+	_, err = db.UpdateWhere(&testStruct{}, db.Search(&testStruct{}, "Unknown", "=", 42), "A", 42)
+	tt.ExpectErr(err, ErrUnkownField)
+
+	// unique constraints are enforced on the new value
+	tt.CheckErr(db.Create(&testStructUnique{}, DefaultSchema))
+	for i := 0; i < 10; i++ {
+		tt.CheckErr(db.InsertOrUpdate(&testStructUnique{A: i, B: int32(i), C: fmt.Sprintf("%d", i)}))
+	}
+	_, err = db.UpdateWhere(&testStruct{}, db.Search(&testStructUnique{}, "A", "<", 5), "A", 42)
+	tt.ExpectErr(err, ErrWrongObjectType)
+	// none of the objects of the failing batch is updated
+	n, err = db.UpdateWhere(&testStructUnique{}, db.Search(&testStructUnique{}, "A", "<", 5), "A", 42)
+	tt.ExpectErr(err, ErrConstraintUnique)
+	tt.Assert(n == 0, n)
+	tt.Assert(db.Search(&testStructUnique{}, "A", "=", 42).Len() == 0)
+	tt.CheckErr(db.Control())
+
+	// objects not matching anymore when their batch is updated are skipped
+	match := db.Search(&testStruct{}, "A", "=", 7)
+	matched = match.Len()
+	tt.Assert(matched > 1)
+	o, err := match.One()
+	tt.CheckErr(err)
+	o.(*testStruct).A = 4242
+	tt.CheckErr(db.InsertOrUpdate(o))
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	before := append([]*IndexedField{}, sch.ObjectIndex.Fields["A"].Index...)
+	n, err = db.UpdateWhere(&testStruct{}, match, "N", uint(4343))
+	tt.CheckErr(err)
+	// values not changed are not indexed again
+	for i, f := range sch.ObjectIndex.Fields["A"].Index {
+		tt.Assert(f == before[i])
+	}
+	tt.Assert(n == matched-1, n)
+	tt.Assert(db.Search(&testStruct{}, "N", "=", uint(4343)).Len() == n)
+
+	db = closeAndReOpen(db)
+	tt.CheckErr(db.Control())
+	tt.Assert(db.Search(&testStructUnique{}, "A", "=", 42).Len() == 0)
+	controlDBSize(t, db, &testStructUnique{}, 10)
+}
+
+func TestContentAddressed(t *testing.T) {
+	t.Parallel()
+
+	type blob struct {
+		Item
+		Name string `sod:"index"`
+		Data []byte
+		At   time.Time
+	}
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	at := time.Now()
+	s, err := NewSchemaBuilder(&blob{}).ContentAddressed().Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&blob{}, s))
+
+	a := &blob{Name: "a", Data: []byte("content"), At: at}
+	b := &blob{Name: "a", Data: []byte("content"), At: at}
+	tt.CheckErr(db.InsertOrUpdate(a))
+	tt.CheckErr(db.InsertOrUpdate(b))
+	tt.Assert(a.UUID() != "" && a.UUID() == b.UUID())
+	tt.Assert(uuidRegexp.MatchString(a.UUID()))
+	controlDBSize(t, db, &blob{}, 1)
+
+	// identical Objects collide to one file
+	uuids, err := uuidsFromDir(OSStorage{}, db.oDir(&blob{}))
+	tt.CheckErr(err)
+	tt.Assert(len(uuids) == 1 && uuids[a.UUID()])
+
+	tt.ExpectErr(db.Insert(&blob{Name: "a", Data: []byte("content"), At: at}), ErrAlreadyExists)
+	_, err = db.InsertOrUpdateMany(&blob{Name: "a", Data: []byte("content"), At: at}, &blob{Name: "a", Data: []byte("content"), At: at})
+	tt.CheckErr(err)
+	controlDBSize(t, db, &blob{}, 1)
+
+	// a modified Object is a new Object
+	uuid := a.UUID()
+	a.Data = []byte("modified")
+	tt.CheckErr(db.InsertOrUpdate(a))
+	tt.Assert(a.UUID() != uuid)
+	controlDBSize(t, db, &blob{}, 2)
+	tt.CheckErr(db.Insert(&blob{Name: "b"}))
+	controlDBSize(t, db, &blob{}, 3)
+
+	db = closeAndReOpen(db)
+	tt.CheckErr(db.Control())
+	tt.CheckErr(db.InsertOrUpdate(&blob{Name: "a", Data: []byte("modified"), At: at}))
+	controlDBSize(t, db, &blob{}, 3)
+	tt.Assert(db.Search(&blob{}, "Name", "=", "a").Len() == 2)
+
+	// Objects modified on every insertion cannot be content addressed
+	type dated struct {
+		Item
+		Updated time.Time
+	}
+
+	s, err = NewSchemaBuilder(&dated{}).ContentAddressed().UpdatedAt("Updated").Build()
+	tt.CheckErr(err)
+	tt.ExpectErr(db.Create(&dated{}, s), ErrBadContentAddressed)
+}
+
+func TestAllAsMap(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(0, DefaultSchema)
+	defer db.Drop()
+
+	tt.CheckErr(db.Create(&testStructUnique{}, DefaultSchema))
+	for i := 0; i < size; i++ {
+		tt.CheckErr(db.InsertOrUpdate(&testStructUnique{A: i, B: int32(i), C: fmt.Sprintf("%d", i)}))
+	}
+
+	var byA map[int]*testStructUnique
+	tt.CheckErr(db.AllAsMap(&testStructUnique{}, "A", &byA))
+	tt.Assert(len(byA) == size)
+	for k, o := range byA {
+		tt.Assert(o.A == k)
+	}
+
+	var byUUID map[string]Object
+	tt.CheckErr(db.AllAsMap(&testStructUnique{}, UUIDField, &byUUID))
+	tt.Assert(len(byUUID) == size)
+	for uuid, o := range byUUID {
+		tt.Assert(o.UUID() == uuid)
+	}
+
+	// key field is not unique
+	var byC map[string]*testStruct
+	for o := range genTestStructs(size) {
+		tt.CheckErr(db.InsertOrUpdate(o))
+	}
+	tt.ExpectErr(db.AllAsMap(&testStruct{}, "C", &byC), ErrDuplicateKey)
+	tt.Assert(byC == nil)
+	tt.ExpectErr(db.AllAsMap(&testStruct{}, "Unknown", &byC), ErrUnkownField)
+
+	// wrong target types make the function panic
+	for _, target := range []interface{}{byA, &[]*testStructUnique{}, nil} {
+		func() {
+			defer func() { tt.Assert(recover() != nil) }()
+			db.AllAsMap(&testStructUnique{}, "A", target)
+		}()
+	}
+}
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(0, DefaultSchema)
+	defer db.Drop()
+	tt.CheckErr(db.Create(&testStructUnique{}, DefaultSchema))
+
+	// number of Objects in the index saved on disk
+	committed := func(of Object) int {
+		s, err := db.diskSchema(of)
+		tt.CheckErr(err)
+		return len(s.ObjectIndex.ObjectIds)
+	}
+
+	b := db.Batch()
+	for o := range genTestStructs(size) {
+		tt.CheckErr(b.InsertOrUpdate(o))
+	}
+	tt.CheckErr(b.InsertOrUpdate(&testStructUnique{A: 1, B: 1, C: "1"}))
+	tt.ExpectErr(b.InsertOrUpdate(&testStructUnique{A: 1, B: 2, C: "2"}), ErrConstraintUnique)
+
+	// Objects are written but index is not committed
+	controlDBSize(t, db, &testStruct{}, size)
+	uuids, err := uuidsFromDir(OSStorage{}, db.oDir(&testStruct{}))
+	tt.CheckErr(err)
+	tt.Assert(len(uuids) == size)
+	tt.Assert(committed(&testStruct{}) == 0)
+	tt.Assert(committed(&testStructUnique{}) == 0)
+
+	tt.CheckErr(b.Commit())
+	tt.Assert(committed(&testStruct{}) == size)
+	tt.Assert(committed(&testStructUnique{}) == 1)
+
+	// batch is still usable after a commit
+	for o := range genTestStructs(size) {
+		tt.CheckErr(b.InsertOrUpdate(o))
+	}
+	tt.Assert(committed(&testStruct{}) == size)
+	tt.CheckErr(b.Close())
+	tt.Assert(committed(&testStruct{}) == size*2)
+
+	tt.ExpectErr(b.InsertOrUpdate(<-genTestStructs(1)), ErrBatchClosed)
+	tt.ExpectErr(b.Commit(), ErrBatchClosed)
+	tt.ExpectErr(b.Close(), ErrBatchClosed)
+	controlDB(t, db)
+}
+
+func TestFieldOrder(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	root := randDBPath()
+
+	{
+		type reordered struct {
+			Item
+			A      int    `sod:"index"`
+			B      string `sod:"unique"`
+			Nested struct {
+				X float64 `sod:"index"`
+				Y []string
+			}
+			P *struct {
+				U uint `sod:"index"`
+				V string
+			}
+		}
+
+		db := Open(root)
+		s, err := NewSchemaBuilder(&reordered{}).CompositeIndex("A", "Nested.X").Build()
+		tt.CheckErr(err)
+		tt.CheckErr(db.Create(&reordered{}, s))
+
+		for i := 0; i < size; i++ {
+			o := &reordered{A: i, B: fmt.Sprintf("%d", i)}
+			o.Nested.X = float64(i) / 2
+			o.Nested.Y = []string{o.B}
+			o.P = &struct {
+				U uint `sod:"index"`
+				V string
+			}{uint(i), o.B}
+			tt.CheckErr(db.InsertOrUpdate(o))
+		}
+		tt.CheckErr(db.Close())
+	}
+
+	{
+		// same fields in a different order
+		type reordered struct {
+			P *struct {
+				V string
+				U uint `sod:"index"`
+			}
+			Nested struct {
+				Y []string
+				X float64 `sod:"index"`
+			}
+			B string `sod:"unique"`
+			Item
+			A int `sod:"index"`
+		}
+
+		db := Open(root)
+		// db is re-opened below, the last handle must be dropped
+		defer func() { tt.CheckErr(db.Drop()) }()
+
+		// structure did not change
+		s, err := NewSchemaBuilder(&reordered{}).CompositeIndex("A", "Nested.X").Cache().Build()
+		tt.CheckErr(err)
+		tt.CheckErr(db.Create(&reordered{}, s))
+		tt.CheckErr(db.Control())
+		controlDBSize(t, db, &reordered{}, size)
+
+		var found []*reordered
+		tt.CheckErr(db.Search(&reordered{}, "A", "<", 10).And("Nested.X", "<", 5.0).Assign(&found))
+		tt.Assert(len(found) == 10)
+		for _, o := range found {
+			b := fmt.Sprintf("%d", o.A)
+			tt.Assert(o.B == b && o.Nested.X == float64(o.A)/2)
+			tt.Assert(len(o.Nested.Y) == 1 && o.Nested.Y[0] == b)
+			tt.Assert(o.P != nil && o.P.U == uint(o.A) && o.P.V == b)
+
+			// clones are deep copies field by field
+			clone := CloneObject(o).(*reordered)
+			tt.Assert(reflect.DeepEqual(clone, o))
+			tt.Assert(clone.P != o.P)
+		}
+
+		tt.Assert(db.Search(&reordered{}, "P.U", ">=", uint(size/2)).Len() == size/2)
+		tt.ExpectErr(db.InsertOrUpdate(&reordered{A: size, B: "0"}), ErrConstraintUnique)
+		tt.CheckErr(db.InsertOrUpdate(&reordered{A: size, B: "new"}))
+
+		db = closeAndReOpen(db)
+		tt.CheckErr(db.Create(&reordered{}, s))
+		tt.CheckErr(db.Control())
+		controlDBSize(t, db, &reordered{}, size+1)
+	}
+}
+
+type testLogger struct {
+	sync.Mutex
+	msgs map[string][]string
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{msgs: make(map[string][]string)}
+}
+
+func (l *testLogger) log(level, format string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.msgs[level] = append(l.msgs[level], fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) count(level string) int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.msgs[level])
+}
+
+func (l *testLogger) Debugf(format string, v ...interface{}) { l.log("debug", format, v...) }
+func (l *testLogger) Infof(format string, v ...interface{})  { l.log("info", format, v...) }
+func (l *testLogger) Warnf(format string, v ...interface{})  { l.log("warn", format, v...) }
+func (l *testLogger) Errorf(format string, v ...interface{}) { l.log("error", format, v...) }
+
+func TestLogger(t *testing.T) {
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	tt.CheckErr(db.Close())
+
+	// object deleted but still indexed
+	tt.CheckErr(os.Remove(db.oPath(sch, all[0])))
+
+	logger := newTestLogger()
+	db = OpenWithLogger(db.root, logger)
+	_, err = db.Schema(&testStruct{})
+	tt.ExpectErr(err, ErrIndexCorrupted)
+	tt.Assert(logger.count("warn") == 1)
+
+	tt.CheckErr(db.Repair(&testStruct{}))
+	tt.Assert(logger.count("info") == 2)
+	tt.Assert(strings.Contains(logger.msgs["info"][1], "1 objects de-indexed"))
+	controlDBSize(t, db, &testStruct{}, size-1)
+
+	// locks are traced only when enabled
+	tt.Assert(logger.count("debug") == 0)
+	TraceLocks = true
+	_, err = db.Count(&testStruct{})
+	TraceLocks = false
+	tt.CheckErr(err)
+	tt.Assert(logger.count("debug") == 2)
+	tt.Assert(strings.Contains(logger.msgs["debug"][0], "RLock"))
+	tt.Assert(logger.count("error") == 0)
+
+	// nil logger keeps the default one
+	tt.CheckErr(db.Close())
+	db = OpenWithLogger(db.root, nil)
+	controlDBSize(t, db, &testStruct{}, size-1)
+}
+
+func TestExportImportIndex(t *testing.T) {
+	t.Parallel()
+
+	var index bytes.Buffer
+
+	tt := toast.FromT(t)
+	size := 1000
+	s := DefaultSchema
+	s.CompositeIndex("A", "B")
+	db := createFreshTestDb(size, s)
+	defer db.Drop()
+
+	tt.CheckErr(db.ExportIndex(&testStruct{}, &index))
+	exported := index.Bytes()
+
+	// index is lost
+	tt.CheckErr(db.deleteSchema(&testStruct{}))
+	tt.CheckErr(db.Close())
+	db = Open(db.root)
+	_, err := db.Schema(&testStruct{})
+	tt.ExpectErr(err, ErrSchemaNotCreated)
+	tt.ExpectErr(db.Create(&testStruct{}, s), ErrIndexCorrupted)
+
+	tt.ExpectErr(db.ImportIndex(&testStruct{}, strings.NewReader("{")), io.ErrUnexpectedEOF)
+	tt.CheckErr(db.ImportIndex(&testStruct{}, bytes.NewReader(exported)))
+	controlDB(t, db)
+	controlDBSize(t, db, &testStruct{}, size)
+	objs, err := db.Search(&testStruct{}, "A", "=", 21).And("B", ">", 21).Collect()
+	tt.CheckErr(err)
+	tt.Assert(len(objs) > 0)
+	for _, o := range objs {
+		tt.Assert(o.(*testStruct).A == 21 && o.(*testStruct).B > 21)
+	}
+
+	// imported index is persisted
+	db = closeAndReOpen(db)
+	controlDB(t, db)
+	controlDBSize(t, db, &testStruct{}, size)
+
+	// index with constraints not matching the schema
+	modified := bytes.Replace(exported, []byte(`"constraints":{"index":true}`), []byte(`"constraints":{"index":true,"upper":true}`), 1)
+	tt.Assert(!bytes.Equal(modified, exported))
+	tt.ExpectErr(db.ImportIndex(&testStruct{}, bytes.NewReader(modified)), ErrIndexCorrupted)
+	controlDB(t, db)
+	controlDBSize(t, db, &testStruct{}, size)
+
+	// index not matching objects on disk
+	o, err := db.Search(&testStruct{}, "A", "<", 42).One()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Delete(o))
+	tt.ExpectErr(db.ImportIndex(&testStruct{}, bytes.NewReader(exported)), ErrIndexCorrupted)
+	controlDB(t, db)
+	controlDBSize(t, db, &testStruct{}, size-1)
+
+	// index of another type
+	tt.CheckErr(db.Create(&testStructUnique{}, DefaultSchema))
+	tt.ExpectErr(db.ImportIndex(&testStructUnique{}, bytes.NewReader(exported)), ErrIndexCorrupted)
+}
+
+func TestUUIDs(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	uuids, err := db.UUIDs(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(uuids) == size)
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+	m := make(map[string]bool)
+	for _, o := range all {
+		m[o.UUID()] = true
+	}
+	for _, uuid := range uuids {
+		tt.Assert(m[uuid])
+	}
+
+	_, err = db.UUIDs(&testStructUnique{})
+	tt.ExpectErr(err, ErrSchemaNotCreated)
+
+	// uuids of search results are in the same order as collected objects
+	for _, reverse := range []bool{false, true} {
+		s := db.Search(&testStruct{}, "A", "<", 21)
+		c := db.Search(&testStruct{}, "A", "<", 21)
+		if reverse {
+			s, c = s.Reverse(), c.Reverse()
+		}
+		uuids, err = s.Limit(10).UUIDs()
+		tt.CheckErr(err)
+		objs, err := c.Limit(10).Collect()
+		tt.CheckErr(err)
+		tt.Assert(len(uuids) == 10)
+		tt.Assert(len(uuids) == len(objs))
+		for i := range objs {
+			tt.Assert(objs[i].UUID() == uuids[i])
+		}
+	}
+
+	uuids, err = db.Search(&testStruct{}, "A", ">", 42).UUIDs()
+	tt.CheckErr(err)
+	tt.Assert(len(uuids) == 0)
+	_, err = db.Search(&testStruct{}, "A", "=", "42").UUIDs()
+	tt.ExpectErr(err, ErrCasting)
+}
+
+func TestPreserveUnknownFields(t *testing.T) {
+	t.Parallel()
+
+	type preserved struct {
+		Item
+		A int
+		B string `json:"b,omitempty"`
+	}
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	addUnknown := func(path string) {
+		m := make(map[string]interface{})
+		data, err := readJsonFile(OSStorage{}, path)
+		tt.CheckErr(err)
+		tt.CheckErr(json.Unmarshal(data, &m))
+		m["Unknown"] = "value"
+		m["b"] = "known"
+		tt.CheckErr(ioutil.WriteFile(path, []byte(jsonOrPanic(m)), DefaultPermissions))
+	}
+
+	fields := func(path string) map[string]interface{} {
+		m := make(map[string]interface{})
+		data, err := readJsonFile(OSStorage{}, path)
+		tt.CheckErr(err)
+		tt.CheckErr(json.Unmarshal(data, &m))
+		return m
+	}
+
+	for _, preserve := range []bool{false, true} {
+		tt.CheckErr(db.Drop())
+		db = Open(db.root)
+
+		s := DefaultSchema
+		s.PreserveUnknownFields = preserve
+		tt.CheckErr(db.Create(&preserved{}, s))
+		sch, err := db.Schema(&preserved{})
+		tt.CheckErr(err)
+
+		o := &preserved{A: 42}
+		tt.CheckErr(db.InsertOrUpdate(o))
+		addUnknown(db.oPath(sch, o))
+
+		// object is read and written back by a structure not knowing Unknown
+		out, err := db.Get(newObjectFromUUID(&preserved{}, o.UUID()))
+		tt.CheckErr(err)
+		p := out.(*preserved)
+		tt.Assert(p.B == "known")
+		p.A, p.B = 43, ""
+		tt.CheckErr(db.InsertOrUpdate(p))
+
+		m := fields(db.oPath(sch, o))
+		_, ok := m["Unknown"]
+		tt.Assert(ok == preserve)
+		// known fields are never preserved
+		_, ok = m["b"]
+		tt.Assert(!ok)
+		tt.Assert(m["A"] == float64(43))
+
+		// setting persists
+		db = closeAndReOpen(db)
+		sch, err = db.Schema(&preserved{})
+		tt.CheckErr(err)
+		tt.Assert(sch.PreserveUnknownFields == preserve)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	tt.CheckErr(db.Create(&testStruct{}, DefaultSchema))
+
+	objs := make([]Object, 0)
+	for _, v := range []struct {
+		A int
+		C string
+	}{{1, "foo"}, {1, "foo"}, {1, "foo"}, {1, "bar"}, {2, "foo"}, {2, "bar"}, {2, "bar"}, {3, "baz"}} {
+		objs = append(objs, &testStruct{A: v.A, C: v.C, M: time.Now()})
+	}
+	_, err := db.InsertOrUpdateMany(objs...)
+	tt.CheckErr(err)
+
+	groups, err := db.FindDuplicates(&testStruct{}, "A", "C")
+	tt.CheckErr(err)
+	tt.Assert(len(groups) == 2)
+	sizes := make(map[int]bool)
+	for _, g := range groups {
+		tt.Assert(sort.StringsAreSorted(g))
+		sizes[len(g)] = true
+	}
+	tt.Assert(sizes[3] && sizes[2])
+
+	groups, err = db.FindDuplicates(&testStruct{}, "C")
+	tt.CheckErr(err)
+	tt.Assert(len(groups) == 2)
+
+	// M is different for all the objects
+	groups, err = db.FindDuplicates(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(groups) == 0)
+
+	_, err = db.FindDuplicates(&testStruct{}, "O")
+	tt.ExpectErr(err, ErrFieldNotIndexed)
+	_, err = db.Deduplicate(&testStruct{}, "O")
+	tt.ExpectErr(err, ErrFieldNotIndexed)
+
+	n, err := db.Deduplicate(&testStruct{}, "A", "C")
+	tt.CheckErr(err)
+	tt.Assert(n == 3)
+	controlDBSize(t, db, &testStruct{}, len(objs)-3)
+	groups, err = db.FindDuplicates(&testStruct{}, "A", "C")
+	tt.CheckErr(err)
+	tt.Assert(len(groups) == 0)
+
+	db = closeAndReOpen(db)
+	controlDB(t, db)
+	controlDBSize(t, db, &testStruct{}, len(objs)-3)
+}
+
+func TestSwap(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+
+	for _, schema := range []Schema{DefaultSchema, {Extension: DefaultExtension, Cache: true}} {
+		db := Open(randDBPath())
+
+		tt.CheckErr(db.Create(&testStructUnique{}, schema))
+		a := &testStructUnique{A: 1, B: 1, C: "a"}
+		b := &testStructUnique{A: 2, B: 2, C: "b"}
+		tt.CheckErr(db.InsertOrUpdate(a))
+		tt.CheckErr(db.InsertOrUpdate(b))
+
+		sn, err := db.Snapshot(&testStructUnique{})
+		tt.CheckErr(err)
+
+		// only UUIDs matter
+		tt.CheckErr(db.Swap(&testStructUnique{Item: a.Item}, &testStructUnique{Item: b.Item}))
+
+		o, err := db.Search(&testStructUnique{}, "C", "=", "b").One()
+		tt.CheckErr(err)
+		tt.Assert(o.UUID() == a.UUID() && o.(*testStructUnique).A == 2)
+		o, err = db.Search(&testStructUnique{}, "A", "=", 1).One()
+		tt.CheckErr(err)
+		tt.Assert(o.UUID() == b.UUID() && o.(*testStructUnique).C == "a")
+
+		// snapshot is not modified
+		o, err = sn.Get(&testStructUnique{Item: a.Item})
+		tt.CheckErr(err)
+		tt.Assert(o.(*testStructUnique).C == "a")
+		sn.Close()
+
+		// swapping an object with itself does nothing
+		tt.CheckErr(db.Swap(a, a))
+
+		unknown := &testStructUnique{}
+		unknown.Initialize(uuidOrPanic())
+		tt.ExpectErr(db.Swap(a, unknown), ErrNoObjectFound)
+		tt.ExpectErr(db.Swap(a, &testStruct{Item: b.Item}), ErrWrongObjectType)
+
+		controlDB(t, db)
+		db = closeAndReOpen(db)
+		controlDB(t, db)
+		controlDBSize(t, db, &testStructUnique{}, 2)
+		o, err = db.Get(&testStructUnique{Item: a.Item})
+		tt.CheckErr(err)
+		tt.Assert(o.(*testStructUnique).C == "b")
+		tt.CheckErr(db.Drop())
+	}
+
+	// update time and sequence number are the ones of the Objects swapped to
+	type tracked struct {
+		Item
+		Name    string
+		Seq     uint64    `sod:"index"`
+		Updated time.Time `sod:"index"`
+	}
+
+	db := Open(randDBPath())
+	defer db.Drop()
+	s, err := NewSchemaBuilder(&tracked{}).Sequence("Seq").UpdatedAt("Updated").Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&tracked{}, s))
+	a, b := &tracked{Name: "a"}, &tracked{Name: "b"}
+	tt.CheckErr(db.InsertOrUpdate(a))
+	tt.CheckErr(db.InsertOrUpdate(b))
+	time.Sleep(10 * time.Millisecond)
+	tt.CheckErr(db.Swap(a, b))
+
+	for _, orig := range []*tracked{a, b} {
+		o, err := db.Get(&tracked{Item: orig.Item})
+		tt.CheckErr(err)
+		swapped := o.(*tracked)
+		tt.Assert(swapped.Name != orig.Name)
+		tt.Assert(swapped.Seq == orig.Seq)
+		tt.Assert(swapped.Updated.After(a.Updated) && swapped.Updated.After(b.Updated))
+		tt.Assert(db.Search(&tracked{}, "Seq", "=", orig.Seq).Len() == 1)
+	}
+	controlDB(t, db)
+}
+
+func TestEmptyBulk(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	empty := func() chan Object {
+		c := make(chan Object)
+		close(c)
+		return c
+	}
+
+	// empty input is a no-op even if schema does not exist
+	n, err := db.InsertOrUpdateBulk(empty(), 10)
+	tt.CheckErr(err)
+	tt.Assert(n == 0)
+	n, err = db.InsertOrUpdateMany()
+	tt.CheckErr(err)
+	tt.Assert(n == 0)
+	n, err = db.InsertOrMergeBulk(empty(), 10, func(existing, incoming Object) Object { return incoming })
+	tt.CheckErr(err)
+	tt.Assert(n == 0)
+	tt.Assert(!isDirAndExist(OSStorage{}, db.root))
+
+	// schema is checked as soon as an object is received
+	n, err = db.InsertOrUpdateBulk(genTestStructs(1), 10)
+	tt.ExpectErr(err, ErrSchemaNotCreated)
+	tt.Assert(n == 0)
+
+	// chunks are not processed when empty
+	tt.CheckErr(db.Create(&testStruct{}, DefaultSchema))
+	n, err = db.InsertOrUpdateBulk(genTestStructs(20), 10)
+	tt.CheckErr(err)
+	tt.Assert(n == 20)
+	controlDBSize(t, db, &testStruct{}, 20)
+}
+
+func TestPartition(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s := DefaultSchema
+	s.Partition = &Partition{Field: "M", Period: PartitionMonth}
+	tt.CheckErr(db.Create(&testStruct{}, s))
+
+	// partitioning cannot be changed
+	s.Partition = &Partition{Field: "M", Period: PartitionDay}
+	tt.ExpectErr(db.Create(&testStruct{}, s), ErrBadPartition)
+
+	// partition field must be an indexed time.Time
+	for _, p := range []Partition{{"M", "week"}, {"A", PartitionMonth}, {"Unknown", PartitionDay}} {
+		p := p
+		s.Partition = &p
+		tt.ExpectErr(Open(randDBPath()).Create(&testStruct{}, s), ErrBadPartition)
+	}
+
+	months := []time.Time{
+		time.Date(2022, time.January, 15, 0, 0, 0, 0, time.UTC),
+		time.Date(2022, time.February, 15, 0, 0, 0, 0, time.UTC),
+		time.Date(2022, time.March, 15, 0, 0, 0, 0, time.UTC),
+	}
+
+	objs := make([]Object, 0)
+	for i := 0; i < 30; i++ {
+		objs = append(objs, &testStruct{A: i, M: months[i%len(months)]})
+	}
+	_, err := db.InsertOrUpdateMany(objs...)
+	tt.CheckErr(err)
+	controlDB(t, db)
+
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	for _, name := range []string{"2022-01", "2022-02", "2022-03"} {
+		uuids, err := uuidsFromDir(OSStorage{}, filepath.Join(db.oDir(&testStruct{}), name))
+		tt.CheckErr(err)
+		tt.Assert(len(uuids) == 10)
+	}
+
+	// objects move to their new partition
+	o := objs[0].(*testStruct)
+	o.M = months[2]
+	tt.CheckErr(db.InsertOrUpdate(o))
+	tt.Assert(isFileAndExist(OSStorage{}, filepath.Join(db.oDir(o), "2022-03", sch.filename(o))))
+	tt.Assert(!isFileAndExist(OSStorage{}, filepath.Join(db.oDir(o), "2022-01", sch.filename(o))))
+
+	// every partition has its own field indexes
+	tt.Assert(len(sch.ObjectIndex.Partitions) == 3)
+	tt.Assert(sch.ObjectIndex.Fields["A"].Len() == 0)
+	tt.Assert(sch.ObjectIndex.Partitions["2022-01"].Fields["A"].Len() == 9)
+	tt.Assert(sch.ObjectIndex.Partitions["2022-03"].Fields["A"].Len() == 11)
+
+	// searches fan out across partitions
+	tt.Assert(db.Search(&testStruct{}, "M", ">=", months[1]).Len() == 21)
+	tt.Assert(db.Search(&testStruct{}, "M", ">=", months[1]).And("A", "<", 10).Len() == 7)
+	found, err := db.Search(&testStruct{}, "A", ">=", 0).Collect()
+	tt.CheckErr(err)
+	tt.Assert(len(found) == 30)
+	for i, o := range found {
+		// results are ordered as in a single index
+		tt.Assert(o.(*testStruct).A == 29-i)
+	}
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(all) == 30)
+
+	// only the partitions of the time range searched are visited
+	relevant := func(operator string, t time.Time) int {
+		return len(sch.ObjectIndex.relevant([]*searchClause{{"M", operator, t}}, nil))
+	}
+	tt.Assert(relevant(">=", months[1]) == 2)
+	tt.Assert(relevant(">", months[2]) == 1)
+	tt.Assert(relevant("<", months[0]) == 1)
+	tt.Assert(relevant("=", months[1]) == 1)
+	tt.Assert(relevant("!=", months[1]) == 3)
+	tt.Assert(relevant("=", time.Date(2022, time.April, 1, 0, 0, 0, 0, time.UTC)) == 0)
+	tt.Assert(db.Search(&testStruct{}, "M", "=", months[1]).Len() == 10)
+	tt.Assert(db.Search(&testStruct{}, "M", ">", months[2]).Len() == 0)
+	tt.Assert(db.Search(&testStruct{}, "M", ">=", months[0]).And("M", "<", months[2]).Len() == 19)
+
+	// index is repaired from all partitions
+	tt.CheckErr(db.Close())
+	db = Open(db.root)
+	controlDBSize(t, db, &testStruct{}, 30)
+	sch, err = db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	sch.unindex(o)
+	tt.CheckErr(db.Repair(&testStruct{}))
+	controlDBSize(t, db, &testStruct{}, 30)
+	inIndex, onDisk, err := db.IndexDrift(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(inIndex) == 0 && len(onDisk) == 0)
+
+	n, err := db.DropPartition(&testStruct{}, months[1])
+	tt.CheckErr(err)
+	tt.Assert(n == 9)
+	tt.Assert(!isDirAndExist(OSStorage{}, filepath.Join(db.oDir(o), "2022-01")))
+	controlDBSize(t, db, &testStruct{}, 21)
+	sch, err = db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	_, ok := sch.ObjectIndex.Partitions["2022-01"]
+	tt.Assert(!ok)
+
+	// a partition is dropped only if its period ended
+	n, err = db.DropPartition(&testStruct{}, months[2])
+	tt.CheckErr(err)
+	tt.Assert(n == 10)
+	controlDBSize(t, db, &testStruct{}, 11)
+	_, err = db.Get(o)
+	tt.CheckErr(err)
+
+	other := createFreshTestDb(1, DefaultSchema)
+	defer other.Drop()
+	_, err = other.DropPartition(&testStruct{}, months[2])
+	tt.ExpectErr(err, ErrNotPartitioned)
+}
+
+func TestPartitionIndexes(t *testing.T) {
+	t.Parallel()
+
+	type partitioned struct {
+		Item
+		Name string    `sod:"unique"`
+		Time time.Time `sod:"index"`
+	}
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s := DefaultSchema
+	s.Partition = &Partition{Field: "Time", Period: PartitionDay}
+	tt.CheckErr(db.Create(&partitioned{}, s))
+
+	days := []time.Time{
+		time.Date(2022, time.May, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(2022, time.May, 2, 10, 0, 0, 0, time.UTC),
+	}
+
+	tt.CheckErr(db.InsertOrUpdate(&partitioned{Name: "foo", Time: days[0]}))
+
+	// unique constraints hold across partitions
+	tt.ExpectErr(db.InsertOrUpdate(&partitioned{Name: "foo", Time: days[1]}), ErrConstraintUnique)
+	_, err := db.InsertOrUpdateMany(&partitioned{Name: "bar", Time: days[1]}, &partitioned{Name: "foo", Time: days[1]})
+	tt.ExpectErr(err, ErrConstraintUnique)
+	tt.CheckErr(db.InsertOrUpdate(&partitioned{Name: "bar", Time: days[1]}))
+	controlDBSize(t, db, &partitioned{}, 2)
+
+	sch, err := db.Schema(&partitioned{})
+	tt.CheckErr(err)
+	tt.Assert(len(sch.ObjectIndex.Partitions) == 2)
+
+	// partitions are kept in the schema file
+	db = closeAndReOpen(db)
+	sch, err = db.Schema(&partitioned{})
+	tt.CheckErr(err)
+	tt.Assert(len(sch.ObjectIndex.Partitions) == 2)
+	tt.Assert(db.Search(&partitioned{}, "Name", "=", "bar").Len() == 1)
+
+	// vacuum renumbers the Objects of the partitions
+	tt.CheckErr(db.Vacuum(&partitioned{}))
+	controlDBSize(t, db, &partitioned{}, 2)
+	var o *partitioned
+	tt.CheckErr(db.Search(&partitioned{}, "Name", "=", "foo").AssignOne(&o))
+	tt.Assert(o.Time.Equal(days[0]))
+
+	// an index whose field indexes are not partitioned is partitioned
+	sch, err = db.Schema(&partitioned{})
+	tt.CheckErr(err)
+	legacy := newIndex(sch.Fields)
+	tt.CheckErr(legacy.bulkInsert([]Object{&partitioned{Item{uuid: "a"}, "a", days[0]}, &partitioned{Item{uuid: "b"}, "b", days[1]}}))
+	tt.Assert(legacy.Partitions == nil)
+	legacy.partitionBy(sch.Partition)
+	tt.CheckErr(legacy.control())
+	tt.Assert(len(legacy.Partitions) == 2)
+	tt.Assert(legacy.Partitions["2022-05-01"].Fields["Name"].Len() == 1)
+	f, err := legacy.search(&partitioned{}, "Name", ">=", "a", nil)
+	tt.CheckErr(err)
+	tt.Assert(len(f) == 2)
+}
+
+func TestSearchWrongObject(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := createFreshTestDb(10, DefaultSchema)
+	defer db.Drop()
+
+	tt.CheckErr(db.Search(&testStruct{}, "A", ">=", 0).err)
+
+	{
+		// same type name as the one of the schema
+		type testStruct struct {
+			Item
+			A string `sod:"index"`
+		}
+
+		// error is known before the search is evaluated
+		s := db.Search(&testStruct{}, "A", "=", "42")
+		tt.ExpectErr(s.err, ErrStructureChanged)
+		_, err := s.Collect()
+		tt.ExpectErr(err, ErrStructureChanged)
+		tt.ExpectErr(db.Search(&testStruct{}, "A", "=", "42").And("A", "=", "43").Err(), ErrStructureChanged)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	_, err := db.Changed(&testStruct{}, time.Time{})
+	tt.ExpectErr(err, ErrUpdatesNotTracked)
+
+	s := DefaultSchema
+	s.UpdatedAt = "N"
+	tt.ExpectErr(db.Create(&testStruct{}, s), ErrBadUpdatedAt)
+	s.UpdatedAt = "M"
+	tt.CheckErr(db.Create(&testStruct{}, s))
+
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+	for _, o := range all[:10] {
+		// updated at is set whatever the value
+		o.(*testStruct).M = time.Time{}
+	}
+	_, err = db.InsertOrUpdateMany(all[:10]...)
+	tt.CheckErr(err)
+	tt.CheckErr(db.InsertOrUpdate(&testStruct{}))
+
+	search, err := db.Changed(&testStruct{}, since)
+	tt.CheckErr(err)
+	changed, err := search.Collect()
+	tt.CheckErr(err)
+	tt.Assert(len(changed) == 11)
+	for _, o := range changed {
+		tt.Assert(o.(*testStruct).M.After(since))
+	}
+
+	// updates are still tracked after re-opening
+	db = closeAndReOpen(db)
+	search, err = db.Changed(&testStruct{}, since)
+	tt.CheckErr(err)
+	tt.Assert(search.Len() == 11)
+}
+
+func TestAppendToSlice(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s, err := NewSchemaBuilder(&person{}).IndexLen("Tags").Cache().Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&person{}, s))
+
+	p := &person{Name: "john"}
+	tt.CheckErr(db.InsertOrUpdate(p))
+
+	// concurrent appends do not lose updates
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				tt.CheckErr(db.AppendToSlice(p, "Tags", fmt.Sprintf("%d-%d", i, j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	tt.Assert(len(p.Tags) == 0)
+	o, err := db.Search(&person{}, "Tags.len", "=", 100).One()
+	tt.CheckErr(err)
+	tt.Assert(o.(*person).Name == "john")
+
+	tt.CheckErr(db.AppendToSlice(p, "Tags", "a", "b"))
+	tt.CheckErr(db.AppendToSlice(p, "Tags"))
+	o, err = db.Get(&person{Item: p.Item})
+	tt.CheckErr(err)
+	tags := o.(*person).Tags
+	tt.Assert(len(tags) == 102 && tags[100] == "a" && tags[101] == "b")
+
+	tt.ExpectErr(db.AppendToSlice(p, "Tags", 42), ErrCasting)
+	tt.ExpectErr(db.AppendToSlice(p, "Tags", nil), ErrCasting)
+	tt.ExpectErr(db.AppendToSlice(p, "Name", "doe"), ErrCasting)
+	tt.ExpectErr(db.AppendToSlice(p, "Unknown", "doe"), ErrUnkownField)
+	tt.ExpectErr(db.AppendToSlice(&person{}, "Tags", "a"), ErrNoObjectFound)
+
+	db = closeAndReOpen(db)
+	o, err = db.Get(&person{Item: p.Item})
+	tt.CheckErr(err)
+	tt.Assert(len(o.(*person).Tags) == 102)
+}
+
+func TestDeterministicEncoding(t *testing.T) {
+	t.Parallel()
+
+	type withMap struct {
+		Item
+		M map[string]int
+		I interface{}
+	}
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	tt.CheckErr(db.Create(&withMap{}, DefaultSchema))
+
+	m := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		m[fmt.Sprintf("key-%d", i)] = i
+	}
+	o := &withMap{M: m, I: map[string]interface{}{"b": 1, "a": map[string]int{"d": 1, "c": 2}}}
+
+	tt.CheckErr(db.InsertOrUpdate(o))
+	first, err := db.RawJSON(&withMap{}, o.UUID())
+	tt.CheckErr(err)
+
+	// same object written again must produce identical bytes
+	for i := 0; i < 10; i++ {
+		tt.CheckErr(db.InsertOrUpdate(o))
+		data, err := db.RawJSON(&withMap{}, o.UUID())
+		tt.CheckErr(err)
+		tt.Assert(bytes.Equal(first, data))
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	logger := newTestLogger()
+	db := OpenWithLogger(randDBPath(), logger)
+	defer db.Drop()
+
+	s := DefaultSchema
+	s.ReadRepair = true
+	tt.CheckErr(db.Create(&testStruct{}, s))
+	_, err := db.InsertOrUpdateBulk(genTestStructs(size), size)
+	tt.CheckErr(err)
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+
+	// object deleted from disk
+	tt.CheckErr(os.Remove(db.oPath(sch, all[0])))
+	// object missing from index
+	sch.unindex(all[1])
+
+	// reads keep working
+	objs, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(objs) == size-2)
+	// not indexed object is reported as not found until index is repaired
+	_, err = db.Get(all[1])
+	tt.ExpectErr(err, ErrNoObjectFound)
+	_, err = db.Get(all[0])
+	tt.ExpectErr(err, ErrNoObjectFound)
+	tt.Assert(logger.count("warn") == 0)
+
+	// repairs are applied at next commit
+	tt.CheckErr(db.Commit(&testStruct{}))
+	tt.Assert(logger.count("warn") == 2)
+	tt.CheckErr(db.Control())
+	controlDBSize(t, db, &testStruct{}, size-1)
+	tt.Assert(sch.isUUIDIndexed(all[1].UUID()))
+	tt.Assert(!sch.isUUIDIndexed(all[0].UUID()))
+	_, err = db.Get(all[1])
+	tt.CheckErr(err)
+
+	// repairs are persisted
+	db = closeAndReOpen(db)
+	tt.CheckErr(db.Control())
+	controlDBSize(t, db, &testStruct{}, size-1)
+}
+
+func TestSample(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	tt.CheckErr(db.Sample(&testStruct{}, 10))
+	tt.CheckErr(db.Sample(&testStruct{}, 0))
+	tt.CheckErr(db.Sample(&testStruct{}, size*2))
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+
+	// data diverging from index is not detected by Control
+	o := CloneObject(all[0]).(*testStruct)
+	o.A = 4242
+	tt.CheckErr(db.writeObject(o))
+	tt.CheckErr(db.Control())
+	tt.ExpectErr(db.Sample(&testStruct{}, size), ErrIndexCorrupted)
+	tt.CheckErr(db.writeObject(all[0]))
+	tt.CheckErr(db.Sample(&testStruct{}, size))
+
+	corruptFile(db.oPath(sch, all[1]))
+	tt.ExpectErr(db.Sample(&testStruct{}, size), ErrIndexCorrupted)
+	tt.CheckErr(db.writeObject(all[1]))
+
+	tt.CheckErr(os.Remove(db.oPath(sch, all[2])))
+	tt.ExpectErr(db.Sample(&testStruct{}, size), ErrIndexCorrupted)
+}
+
+func TestDeepControl(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	s := DefaultSchema
+	s.CompositeIndex("C", "A")
+	db := createFreshTestDb(size, s)
+	defer db.Drop()
+
+	tt.CheckErr(db.DeepControl())
+
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+
+	// object file updated without its index
+	o := CloneObject(all[0]).(*testStruct)
+	o.C = "foobar"
+	tt.CheckErr(db.writeObject(o))
+	tt.CheckErr(db.Control())
+	err = db.DeepControl()
+	tt.ExpectErr(err, ErrIndexCorrupted)
+	tt.Assert(strings.Contains(err.Error(), o.UUID()))
+
+	// index is fixed by updating the object
+	tt.CheckErr(db.InsertOrUpdate(o))
+	tt.CheckErr(db.DeepControl())
+}
+
+func TestCompressSchema(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	s := DefaultSchema
+	s.CompressSchema = true
+	db := createFreshTestDb(size, s)
+	defer db.Drop()
+
+	dir := db.oDir(&testStruct{})
+	plain := filepath.Join(dir, SchemaFilename)
+	compressed := plain + compressedExtension
+
+	tt.Assert(isFileAndExist(OSStorage{}, compressed))
+	tt.Assert(!isFileAndExist(OSStorage{}, plain))
+
+	db = closeAndReOpen(db)
+	tt.CheckErr(db.Control())
+	controlDBSize(t, db, &testStruct{}, size)
+
+	// going back to a plain schema file
+	tt.CheckErr(db.Create(&testStruct{}, DefaultSchema))
+	tt.Assert(!isFileAndExist(OSStorage{}, compressed))
+	tt.Assert(isFileAndExist(OSStorage{}, plain))
+
+	db = closeAndReOpen(db)
+	tt.CheckErr(db.Control())
+	controlDBSize(t, db, &testStruct{}, size)
+}
+
+func TestCompressMismatch(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchemaCompress)
+	defer db.Drop()
+
+	// compression of existing objects cannot be changed
+	tt.ExpectErr(db.Create(&testStruct{}, DefaultSchema), ErrCompressMismatch)
+	db = closeAndReOpen(db)
+	tt.ExpectErr(db.Create(&testStruct{}, DefaultSchema), ErrCompressMismatch)
+	tt.CheckErr(db.Create(&testStruct{}, DefaultSchemaCompress))
+
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(sch.Compress)
+
+	// new objects are still compressed
+	tt.CheckErr(db.InsertOrUpdate(<-genTestStructs(1)))
+	tt.CheckErr(db.Commit(&testStruct{}))
+	entries, err := os.ReadDir(db.oDir(&testStruct{}))
+	tt.CheckErr(err)
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), SchemaFilename) {
+			tt.Assert(strings.HasSuffix(e.Name(), compressedExtension), e.Name())
+		}
+	}
+
+	db = closeAndReOpen(db)
+	tt.CheckErr(db.Control())
+	controlDBSize(t, db, &testStruct{}, size+1)
+}
+
+func TestSchemaBackup(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+
+	for _, st := range []Storage{OSStorage{}, newMemStorage()} {
+		for _, compress := range []bool{false, true} {
+			root := randDBPath()
+			s := DefaultSchema
+			s.CompressSchema = compress
+
+			db := OpenWithStorage(root, st)
+			tt.CheckErr(db.Create(&testStruct{}, s))
+			for o := range genTestStructs(size) {
+				tt.CheckErr(db.InsertOrUpdate(o))
+			}
+			tt.CheckErr(db.Close())
+
+			db = OpenWithStorage(root, st)
+			for o := range genTestStructs(size) {
+				tt.CheckErr(db.InsertOrUpdate(o))
+			}
+			// the update is not in the backup
+			o, err := db.Search(&testStruct{}, "A", ">=", 0).One()
+			tt.CheckErr(err)
+			o.(*testStruct).A = 4242
+			tt.CheckErr(db.InsertOrUpdate(o))
+			tt.CheckErr(db.Close())
+
+			dir := db.oDir(&testStruct{})
+			path, bak := db.schemaPath(dir), db.schemaBackupPath(dir)
+			tt.Assert(isFileAndExist(st, path))
+			tt.Assert(isFileAndExist(st, bak))
+			tt.Assert(strings.HasSuffix(bak, compressedExtension) == compress, bak)
+			tt.Assert(!isFileAndExist(st, filepath.Join(dir, schemaNewFilename)))
+
+			// save interrupted while writing the schema file
+			data, err := st.ReadFile(path)
+			tt.CheckErr(err)
+			tt.CheckErr(st.WriteFile(path, data[:len(data)/2], DefaultPermissions))
+
+			// Objects modified after the backup are indexed as on disk
+			db = OpenWithStorage(root, st)
+			tt.CheckErr(db.Control())
+			controlDBSize(t, db, &testStruct{}, size*2)
+			tt.Assert(db.Search(&testStruct{}, "A", "=", 4242).Len() == 1)
+			tt.CheckErr(db.Close())
+
+			// save interrupted before the new schema file is promoted
+			tt.CheckErr(st.Remove(db.schemaPath(dir)))
+			db = OpenWithStorage(root, st)
+			tt.CheckErr(db.Control())
+			controlDBSize(t, db, &testStruct{}, size*2)
+			tt.Assert(db.Search(&testStruct{}, "A", "=", 4242).Len() == 1)
+			tt.CheckErr(db.Close())
+
+			// save interrupted between backup and promotion of the new
+			// schema file, the newest one is loaded
+			new := filepath.Join(dir, schemaNewFilename)
+			if compress {
+				new += compressedExtension
+			}
+			data, err = st.ReadFile(db.schemaPath(dir))
+			tt.CheckErr(err)
+			tt.CheckErr(st.WriteFile(new, data, DefaultPermissions))
+			tt.CheckErr(st.Remove(db.schemaPath(dir)))
+			tt.CheckErr(st.WriteFile(db.schemaBackupPath(dir), []byte("{}"), DefaultPermissions))
+			db = OpenWithStorage(root, st)
+			tt.CheckErr(db.Control())
+			controlDBSize(t, db, &testStruct{}, size*2)
+			tt.Assert(db.Search(&testStruct{}, "A", "=", 4242).Len() == 1)
+			tt.CheckErr(db.Close())
+			tt.Assert(!isFileAndExist(st, new))
+
+			// schema is lost only if both files are
+			tt.CheckErr(st.Remove(db.schemaPath(dir)))
+			tt.CheckErr(st.Remove(db.schemaBackupPath(dir)))
+			db = OpenWithStorage(root, st)
+			_, err = db.Schema(&testStruct{})
+			tt.ExpectErr(err, ErrSchemaNotCreated)
+			tt.CheckErr(db.Drop())
+		}
+	}
+}
+
+type postLoaded struct {
+	Item
+	First  string `sod:"index"`
+	Last   string
+	Full   string `json:"-"`
+	loaded int
+}
+
+func (p *postLoaded) PostLoad() {
+	p.Full = p.First + " " + p.Last
+	p.loaded++
+}
+
+func TestPostLoad(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+
+	for _, s := range []Schema{DefaultSchema, {Extension: DefaultExtension, Cache: true}} {
+		db := Open(randDBPath())
+		tt.CheckErr(db.Create(&postLoaded{}, s))
+
+		p := &postLoaded{First: "John", Last: "Doe"}
+		tt.CheckErr(db.InsertOrUpdate(p))
+		tt.Assert(p.Full == "")
+
+		// objects are read from disk
+		db = closeAndReOpen(db)
+
+		for i := 0; i < 2; i++ {
+			o, err := db.Get(&postLoaded{Item: p.Item})
+			tt.CheckErr(err)
+			tt.Assert(o.(*postLoaded).Full == "John Doe")
+			// cached objects are post loaded once
+			tt.Assert(o.(*postLoaded).loaded == 1)
+		}
+
+		all, err := db.All(&postLoaded{})
+		tt.CheckErr(err)
+		tt.Assert(len(all) == 1)
+		tt.Assert(all[0].(*postLoaded).Full == "John Doe")
+
+		// partially decoded objects are not post loaded
+		if !s.Cache {
+			o, err := db.GetFields(&postLoaded{Item: p.Item}, "First")
+			tt.CheckErr(err)
+			tt.Assert(o.(*postLoaded).Full == "")
+		}
+
+		// fields set by PostLoad are counted as searched
+		n, err := db.CountWhere(&postLoaded{}, "Full", "=", "John Doe")
+		tt.CheckErr(err)
+		tt.Assert(n == 1)
+		tt.Assert(n == db.Search(&postLoaded{}, "Full", "=", "John Doe").Len())
+
+		tt.CheckErr(db.Drop())
+	}
+}
+
+func TestCountWhere(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 500
+
+	type query struct {
+		field    string
+		operator string
+		value    interface{}
+	}
+
+	queries := []query{
+		// not indexed fields
+		{"N", "<", uint(21)}, {"N", ">=", uint(21)}, {"O", "=", "foo"}, {"O", "~in", []string{"^f", "^b"}},
+		{"Lower", "contains", "ow"}, {"Nested.A", "=", 0},
+		// indexed fields
+		{"A", "<", 21}, {"C", "=", "bar"}, {"Upper", "=", "upper"},
+	}
+
+	for _, s := range []Schema{DefaultSchema, {Extension: DefaultExtension, Cache: true}} {
+		db := createFreshTestDb(size, s)
+
+		for _, q := range queries {
+			n, err := db.CountWhere(&testStruct{}, q.field, q.operator, q.value)
+			tt.CheckErr(err)
+			search := db.Search(&testStruct{}, q.field, q.operator, q.value)
+			tt.CheckErr(search.Err())
+			tt.Assert(n == search.Len(), q, n, search.Len())
+		}
+
+		_, err := db.CountWhere(&testStruct{}, "N", "<", "21")
+		tt.ExpectErr(err, ErrCasting)
+		_, err = db.CountWhere(&testStruct{}, "O", "contains", 21)
+		tt.ExpectErr(err, ErrCasting)
+		_, err = db.CountWhere(&testStruct{}, "Unknown", "=", 21)
+		tt.ExpectErr(err, ErrUnkownField)
+
+		// objects missing from disk are skipped with read repair
+		sch, err := db.Schema(&testStruct{})
+		tt.CheckErr(err)
+		o, err := db.Search(&testStruct{}, "N", "<", uint(21)).One()
+		tt.CheckErr(err)
+		tt.CheckErr(os.Remove(db.oPath(sch, o)))
+		db.cache.delete(o)
+		_, err = db.CountWhere(&testStruct{}, "N", "<", uint(21))
+		tt.ExpectErr(err, ErrNoObjectFound)
+		sch.ReadRepair = true
+		n, err := db.CountWhere(&testStruct{}, "N", "<", uint(21))
+		tt.CheckErr(err)
+		tt.Assert(n == db.Search(&testStruct{}, "N", "<", uint(21)).Len(), n)
+
+		tt.CheckErr(db.Drop())
+	}
+}
+
+func TestHistory(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s, err := NewSchemaBuilder(&person{}).Compress().KeepHistory(3).Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&person{}, s))
+
+	p := &person{Name: "v0"}
+	tt.CheckErr(db.InsertOrUpdate(p))
+
+	h, err := db.History(p)
+	tt.CheckErr(err)
+	tt.Assert(len(h) == 0)
+
+	for i := 1; i <= 5; i++ {
+		p.Name = fmt.Sprintf("v%d", i)
+		tt.CheckErr(db.InsertOrUpdate(p))
+	}
+
+	// only the last versions are kept
+	db = closeAndReOpen(db)
+	h, err = db.History(p)
+	tt.CheckErr(err)
+	tt.Assert(len(h) == 3)
+	for i, o := range h {
+		tt.Assert(o.UUID() == p.UUID())
+		tt.Assert(o.(*person).Name == fmt.Sprintf("v%d", i+2))
+	}
+
+	tt.CheckErr(db.RollbackTo(p, 0))
+	o, err := db.Get(&person{Item: p.Item})
+	tt.CheckErr(err)
+	tt.Assert(o.(*person).Name == "v2")
+	tt.Assert(db.Search(&person{}, "Name", "=", "v2").Len() == 1)
+
+	// rollback can be undone
+	h, err = db.History(p)
+	tt.CheckErr(err)
+	tt.Assert(len(h) == 3)
+	tt.Assert(h[2].(*person).Name == "v5")
+
+	tt.ExpectErr(db.RollbackTo(p, 3), ErrNoSuchVersion)
+	tt.ExpectErr(db.RollbackTo(p, -1), ErrNoSuchVersion)
+	tt.ExpectErr(db.RollbackTo(newObjectFromUUID(&person{}, uuidOrPanic()), 0), ErrNoObjectFound)
+
+	// history is kept with the deleted version
+	tt.CheckErr(db.Delete(p))
+	h, err = db.History(p)
+	tt.CheckErr(err)
+	tt.Assert(len(h) == 3)
+	tt.Assert(h[2].(*person).Name == "v2")
+	tt.CheckErr(db.Control())
+
+	// deleted object can be restored
+	tt.CheckErr(db.InsertOrUpdate(h[2]))
+	tt.Assert(db.Search(&person{}, "Name", "=", "v2").Len() == 1)
+
+	// previous versions are transformed as any update
+	type versioned struct {
+		Item
+		Name    string
+		Updated time.Time `sod:"index"`
+	}
+
+	s, err = NewSchemaBuilder(&versioned{}).UpdatedAt("Updated").KeepHistory(1).Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&versioned{}, s))
+
+	v := &versioned{Name: "v0"}
+	tt.CheckErr(db.InsertOrUpdate(v))
+	v.Name = "v1"
+	tt.CheckErr(db.InsertOrUpdate(v))
+	h, err = db.History(v)
+	tt.CheckErr(err)
+	time.Sleep(10 * time.Millisecond)
+	tt.CheckErr(db.RollbackTo(v, 0))
+	o, err = db.Get(&versioned{Item: v.Item})
+	tt.CheckErr(err)
+	tt.Assert(o.(*versioned).Name == "v0")
+	tt.Assert(o.(*versioned).Updated.After(h[0].(*versioned).Updated))
+}
+
+func TestSuffixIndex(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s, err := NewSchemaBuilder(&person{}).Index("Country").SuffixIndex("Email").Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&person{}, s))
+
+	domains := []string{"example.com", "example.org", "mail.example.com", "exämple.com", "com"}
+	people := make([]Object, 0)
+	for i := 0; i < 500; i++ {
+		people = append(people, &person{
+			Email:   fmt.Sprintf("user%d@%s", i, domains[rand.Intn(len(domains))]),
+			Country: []string{"fr", "de", "us"}[i%3],
+		})
+	}
+	_, err = db.InsertOrUpdateMany(people...)
+	tt.CheckErr(err)
+
+	// updates and deletions must be reflected in suffix index
+	for _, o := range people[:50] {
+		o.(*person).Email = strings.ToUpper(o.(*person).Email)
+		tt.CheckErr(db.InsertOrUpdate(o))
+	}
+	tt.CheckErr(db.Delete(people[50]))
+	tt.CheckErr(db.InsertOrUpdate(&person{Email: "new@example.com", Country: "fr"}))
+
+	uuids := func(objects []Object) []string {
+		out := make([]string, 0, len(objects))
+		for _, o := range objects {
+			out = append(out, o.UUID())
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	check := func(db *DB) {
+		tt.CheckErr(db.Control())
+
+		sch, err := db.Schema(&person{})
+		tt.CheckErr(err)
+		tt.Assert(sch.ObjectIndex.suffixes["Email"].Len() == 500)
+
+		for _, suffix := range []string{"", "m", ".com", "@example.com", "example.com", "ämple.com", ".COM", "@nowhere.net"} {
+			rex := regexp.QuoteMeta(suffix) + "$"
+
+			expected, err := db.Search(&person{}, "Email", "~=", rex).Collect()
+			tt.CheckErr(err)
+			found, err := db.Search(&person{}, "Email", "$=", suffix).Collect()
+			tt.CheckErr(err)
+			tt.Assert(strings.Join(uuids(found), ",") == strings.Join(uuids(expected), ","), suffix)
+
+			// suffix search constrained by a previous search
+			expected, err = db.Search(&person{}, "Country", "=", "fr").And("Email", "~=", rex).Collect()
+			tt.CheckErr(err)
+			found, err = db.Search(&person{}, "Country", "=", "fr").And("Email", "$=", suffix).Collect()
+			tt.CheckErr(err)
+			tt.Assert(strings.Join(uuids(found), ",") == strings.Join(uuids(expected), ","), suffix)
+
+			// same results on a field without suffix index
+			expected, err = db.Search(&person{}, "Name", "~=", rex).Collect()
+			tt.CheckErr(err)
+			found, err = db.Search(&person{}, "Name", "$=", suffix).Collect()
+			tt.CheckErr(err)
+			tt.Assert(len(found) == len(expected))
+		}
+
+		tt.Assert(db.Search(&person{}, "Email", "$=", "@example.com").Len() > 0)
+		tt.ExpectErr(db.Search(&person{}, "Email", "$=", 42).Err(), ErrCasting)
+	}
+
+	check(db)
+	// suffix index is rebuilt when the index is loaded
+	db = closeAndReOpen(db)
+	check(db)
+
+	// suffix index only applies to strings
+	type badSuffix struct {
+		Item
+		A int `sod:"suffix"`
+	}
+	tt.ExpectErr(db.Create(&badSuffix{}, DefaultSchema), ErrBadSuffixIndex)
+}
+
+func TestQueryCache(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s, err := NewSchemaBuilder(&person{}).Index("Age", "Country").QueryCache(2).Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&person{}, s))
+
+	for i := 0; i < 100; i++ {
+		tt.CheckErr(db.InsertOrUpdate(&person{Age: i, Country: []string{"fr", "de"}[i%2]}))
+	}
+
+	sch, err := db.Schema(&person{})
+	tt.CheckErr(err)
+	tt.Assert(sch.queries.len() == 0)
+
+	tt.Assert(db.Search(&person{}, "Age", ">=", 50).And("Country", "=", "fr").Len() == 25)
+	tt.Assert(sch.queries.len() == 1)
+	// cached results
+	tt.Assert(db.Search(&person{}, "Age", ">=", 50).And("Country", "=", "fr").Len() == 25)
+	tt.Assert(sch.queries.len() == 1)
+
+	// limit and order are applied on cached results
+	o, err := db.Search(&person{}, "Age", ">=", 50).And("Country", "=", "fr").Reverse().Limit(1).One()
+	tt.CheckErr(err)
+	tt.Assert(o.(*person).Age == 50)
+	o, err = db.Search(&person{}, "Age", ">=", 50).And("Country", "=", "fr").Limit(1).One()
+	tt.CheckErr(err)
+	tt.Assert(o.(*person).Age == 98)
+
+	// values of different types are different queries
+	tt.ExpectErr(db.Search(&person{}, "Age", ">=", "50").Err(), ErrCasting)
+	tt.Assert(sch.queries.len() == 1)
+
+	// cache size is bounded
+	for i := 0; i < 10; i++ {
+		tt.Assert(db.Search(&person{}, "Age", "=", i).Len() == 1)
+		tt.Assert(sch.queries.len() <= 2)
+	}
+
+	// snapshot searches do not use the cache of the DB
+	sn, err := db.Snapshot(&person{})
+	tt.CheckErr(err)
+	defer sn.Close()
+
+	// any write invalidates the cache
+	tt.CheckErr(db.InsertOrUpdate(&person{Age: 100, Country: "fr"}))
+	tt.Assert(sch.queries.len() == 0)
+	tt.Assert(db.Search(&person{}, "Age", ">=", 50).And("Country", "=", "fr").Len() == 26)
+
+	tt.Assert(sn.Search("Age", ">=", 50).And("Country", "=", "fr").Len() == 25)
+	tt.Assert(db.Search(&person{}, "Age", ">=", 50).And("Country", "=", "fr").Len() == 26)
+
+	tt.CheckErr(db.Search(&person{}, "Age", "=", 100).Delete())
+	tt.Assert(sch.queries.len() == 0)
+	tt.Assert(db.Search(&person{}, "Age", ">=", 50).And("Country", "=", "fr").Len() == 25)
+}
+
+type sequenced struct {
+	Item
+	Seq  uint64
+	Name string
+}
+
+func TestSequence(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s, err := NewSchemaBuilder(&sequenced{}).Sequence("Seq").Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&sequenced{}, s))
+
+	events := make([]*sequenced, 0)
+	for i := 0; i < 10; i++ {
+		e := &sequenced{Name: fmt.Sprintf("event-%d", i)}
+		tt.CheckErr(db.InsertOrUpdate(e))
+		events = append(events, e)
+	}
+	bulk := make([]Object, 0)
+	for i := 10; i < 20; i++ {
+		e := &sequenced{Name: fmt.Sprintf("event-%d", i)}
+		bulk = append(bulk, e)
+		events = append(events, e)
+	}
+	_, err = db.InsertOrUpdateMany(bulk...)
+	tt.CheckErr(err)
+
+	for i, e := range events {
+		tt.Assert(e.Seq == uint64(i+1))
+		seq, err := db.Sequence(e)
+		tt.CheckErr(err)
+		tt.Assert(seq == e.Seq)
+	}
+
+	// updates keep the sequence number
+	update := &sequenced{Name: "updated"}
+	update.Initialize(events[3].UUID())
+	tt.CheckErr(db.InsertOrUpdate(update))
+	tt.Assert(update.Seq == 4)
+
+	// sequence numbers are not reused
+	tt.CheckErr(db.Delete(events[19]))
+	e := &sequenced{Name: "event-20"}
+	tt.CheckErr(db.InsertOrUpdate(e))
+	tt.Assert(e.Seq == 21)
+
+	replay := func(from, to uint64, expected ...uint64) {
+		search, err := db.SearchBySequence(&sequenced{}, from, to)
+		tt.CheckErr(err)
+		var out []*sequenced
+		tt.CheckErr(search.Assign(&out))
+		tt.Assert(len(out) == len(expected), len(out), expected)
+		for i := range out {
+			tt.Assert(out[i].Seq == expected[i])
+		}
+	}
+
+	replay(3, 6, 3, 4, 5, 6)
+	replay(18, 100, 18, 19, 21)
+
+	// sequence numbers survive reopen and repair
+	db = closeAndReOpen(db)
+	sch, err := db.Schema(&sequenced{})
+	tt.CheckErr(err)
+	// last sequence number is recovered from Objects
+	sch.LastSequence = 0
+	sch.ObjectIndex = newIndex(sch.Fields)
+	tt.CheckErr(db.Repair(&sequenced{}))
+	tt.CheckErr(db.Control())
+	replay(3, 6, 3, 4, 5, 6)
+	seq, err := db.Sequence(update)
+	tt.CheckErr(err)
+	tt.Assert(seq == 4)
+
+	e = &sequenced{Name: "event-21"}
+	tt.CheckErr(db.InsertOrUpdate(e))
+	tt.Assert(e.Seq == 22)
+
+	_, err = db.Sequence(&sequenced{Item: Item{uuid: uuidOrPanic()}})
+	tt.ExpectErr(err, ErrNoObjectFound)
+
+	// objects not sequenced
+	_, err = db.Sequence(&person{})
+	tt.ExpectErr(err, ErrSchemaNotCreated)
+	tt.CheckErr(db.Create(&person{}, DefaultSchema))
+	_, err = db.SearchBySequence(&person{}, 0, 10)
+	tt.ExpectErr(err, ErrNotSequenced)
+
+	// sequence field must be an indexed uint64
+	s, err = NewSchemaBuilder(&sequenced{}).Sequence("Name").Build()
+	tt.CheckErr(err)
+	tt.ExpectErr(db.Create(&sequenced{}, s), ErrBadSequence)
+}
+
+func TestRenameField(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 10
+
+	for _, st := range []Storage{OSStorage{}, newMemStorage()} {
+		root := randDBPath()
+		db := OpenWithStorage(root, st)
+
+		{
+			type renamed struct {
+				Item
+				Age   int `sod:"index"`
+				Score int `json:"score"`
+				Info  struct {
+					Country string `sod:"index" json:"country"`
+				} `json:"info"`
+			}
+
+			s, err := NewSchemaBuilder(&renamed{}).
+				CompositeIndex("Info.Country", "Age").
+				Compress().
+				KeepHistory(1).
+				Build()
+			tt.CheckErr(err)
+			tt.CheckErr(db.Create(&renamed{}, s))
+
+			for i := 0; i < size; i++ {
+				o := &renamed{Age: i}
+				o.Initialize(fmt.Sprintf("%08d-0000-0000-0000-000000000000", i))
+				o.Info.Country = []string{"fr", "us"}[i%2]
+				o.Score = i * 10
+				tt.CheckErr(db.InsertOrUpdate(o))
+				// keeps a previous version
+				tt.CheckErr(db.InsertOrUpdate(o))
+			}
+		}
+
+		tt.CheckErr(db.Close())
+		db = OpenWithStorage(root, st)
+
+		{
+			type renamed struct {
+				Item
+				YearsOld int `sod:"index"`
+				Points   int `json:"points"`
+				Location struct {
+					Country string `sod:"index" json:"country"`
+				} `json:"location"`
+			}
+
+			_, err := db.Schema(&renamed{})
+			tt.ExpectErr(err, ErrStructureChanged)
+
+			tt.ExpectErr(db.RenameField(&renamed{}, "Unknown", "YearsOld"), ErrUnkownField)
+			tt.ExpectErr(db.RenameField(&renamed{}, "Age", "Unknown"), ErrUnkownField)
+			tt.ExpectErr(db.RenameField(&renamed{}, "Age", "Info"), ErrBadRename)
+			tt.ExpectErr(db.RenameField(&renamed{}, "Info", "Info.Country"), ErrBadRename)
+
+			tt.CheckErr(db.RenameField(&renamed{}, "Age", "YearsOld"))
+			tt.CheckErr(db.RenameField(&renamed{}, "Info", "Location"))
+			tt.CheckErr(db.RenameField(&renamed{}, "Score", "Points"))
+			_, err = st.Stat(db.oDir(&renamed{}) + renameSuffix)
+			tt.ExpectErr(err, fs.ErrNotExist)
+
+			sch, err := db.Schema(&renamed{})
+			tt.CheckErr(err)
+			_, ok := sch.ObjectIndex.Composites["Location.Country,YearsOld"]
+			tt.Assert(ok)
+			tt.Assert(sch.CompositeIndexes[0][0] == "Location.Country")
+			controlDB(t, db)
+
+			var out []*renamed
+			tt.CheckErr(db.Search(&renamed{}, "YearsOld", ">=", 5).Reverse().Assign(&out))
+			tt.Assert(len(out) == 5)
+			for i, o := range out {
+				tt.Assert(o.YearsOld == i+5)
+				tt.Assert(o.Location.Country == []string{"fr", "us"}[o.YearsOld%2])
+				// values of fields with JSON tags are kept
+				tt.Assert(o.Points == o.YearsOld*10)
+			}
+
+			// composite index is used
+			tt.Assert(db.Search(&renamed{}, "Location.Country", "=", "fr").And("YearsOld", ">", 4).Len() == 2)
+
+			// previous versions are renamed as well
+			history, err := db.History(out[0])
+			tt.CheckErr(err)
+			tt.Assert(len(history) == 1)
+			tt.Assert(history[0].(*renamed).YearsOld == 5)
+
+			tt.CheckErr(db.Close())
+			db = OpenWithStorage(root, st)
+			controlDB(t, db)
+			tt.Assert(db.Search(&renamed{}, "Location.Country", "=", "us").Len() == size/2)
+		}
+
+		tt.CheckErr(db.Drop())
+	}
+}
+
+type backfilled struct {
+	Item
+	Name  string `sod:"index"`
+	Score int    `sod:"index"`
+	Tags  []string
+	Attrs map[string]int
+}
+
+func (b *backfilled) PostLoad() {
+	atomic.AddInt32(&backfilledLoads, 1)
+}
+
+var backfilledLoads int32
+
+func TestBackfill(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 50
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	tt.CheckErr(db.Create(&backfilled{}, DefaultSchema))
+	for i := 0; i < size; i++ {
+		o := &backfilled{Name: fmt.Sprintf("name%d", i), Score: i, Tags: make([]string, i%5), Attrs: map[string]int{fmt.Sprint(i % 3): i}}
+		tt.CheckErr(db.InsertOrUpdate(o))
+	}
+
+	active := func(o Object) bool { return o.(*backfilled).Score%2 == 0 }
+	s := DefaultSchema
+	s.CompositeIndex("Name", "Score")
+	s.IndexLen("Tags")
+	s.KeyIndex("Attrs")
+	s.DerivedIndex("Double", func(o Object) interface{} { return o.(*backfilled).Score * 2 })
+	s.PartialIndex("Double", active)
+	s.PartialIndex("Score", active)
+
+	// indexes failing to be built are not installed
+	wrong := s
+	wrong.DerivedIndex("Fails", func(o Object) interface{} {
+		if o.UUID() != "" {
+			return struct{}{}
+		}
+		return 0
+	})
+	tt.ExpectErr(db.Create(&backfilled{}, wrong), ErrUnknownKeyType)
+	sch, err := db.Schema(&backfilled{})
+	tt.CheckErr(err)
+	tt.Assert(len(sch.ObjectIndex.Composites) == 0)
+	tt.Assert(len(sch.ObjectIndex.Keys) == 0)
+	tt.Assert(len(sch.ObjectIndex.Fields) == 2)
+	tt.Assert(!sch.ObjectIndex.Fields["Score"].Partial)
+
+	// objects are read once whatever the number of indexes built
+	atomic.StoreInt32(&backfilledLoads, 0)
+	tt.CheckErr(db.Create(&backfilled{}, s))
+	tt.Assert(atomic.LoadInt32(&backfilledLoads) == int32(size))
+	controlDB(t, db)
+
+	tt.Assert(db.Search(&backfilled{}, "Name", "=", "name42").And("Score", "=", 42).Len() == 1)
+	tt.Assert(db.Search(&backfilled{}, LenPath("Tags"), "=", 4).Len() == size/5)
+	tt.Assert(db.Search(&backfilled{}, "Attrs", HasKeyOperator, "0").Len() == (size+2)/3)
+	tt.Assert(db.Search(&backfilled{}, "Double", ">=", 0).Len() == size/2)
+	tt.Assert(db.Search(&backfilled{}, "Score", ">=", 0).Len() == size/2)
+}
+
+func TestPartialIndex(t *testing.T) {
+	t.Parallel()
+
+	type account struct {
+		Item
+		Active bool
+		Score  int    `sod:"index"`
+		Email  string `sod:"unique"`
+	}
+
+	tt := toast.FromT(t)
+	size := 20
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	active := func(o Object) bool { return o.(*account).Active }
+
+	s, err := NewSchemaBuilder(&account{}).
+		PartialIndex("Score", active).
+		PartialIndex("Email", active).
+		Build()
+	tt.CheckErr(err)
+
+	wrong := s
+	wrong.PartialIndex("Active", active)
+	tt.ExpectErr(db.Create(&account{}, wrong), ErrBadPartialIndex)
+
+	tt.CheckErr(db.Create(&account{}, s))
+
+	accounts := make([]Object, 0, size)
+	for i := 0; i < size; i++ {
+		// inactive accounts share the same email
+		a := &account{Active: i%2 == 0, Score: i, Email: "inactive@example.com"}
+		if a.Active {
+			a.Email = fmt.Sprintf("%d@example.com", i)
+		}
+		accounts = append(accounts, a)
+	}
+	_, err = db.InsertOrUpdateMany(accounts...)
+	tt.CheckErr(err)
+	controlDBSize(t, db, &account{}, size)
+
+	sch, err := db.Schema(&account{})
+	tt.CheckErr(err)
+	tt.Assert(sch.ObjectIndex.Fields["Score"].Len() == size/2)
+
+	var out []*account
+	tt.CheckErr(db.Search(&account{}, "Score", ">=", 0).Assign(&out))
+	tt.Assert(len(out) == size/2)
+	for _, a := range out {
+		tt.Assert(a.Active)
+	}
+	tt.Assert(db.Search(&account{}, "Score", "!=", 0).Len() == size/2-1)
+
+	// uniqueness only applies to active accounts
+	tt.CheckErr(db.InsertOrUpdate(&account{Score: 42, Email: "inactive@example.com"}))
+	tt.ExpectErr(db.InsertOrUpdate(&account{Active: true, Email: "0@example.com"}), ErrConstraintUnique)
+
+	// Objects are indexed when they start satisfying the predicate and the opposite
+	first := accounts[0].(*account)
+	first.Active = false
+	first.Email = "inactive@example.com"
+	tt.CheckErr(db.InsertOrUpdate(first))
+	second := accounts[1].(*account)
+	second.Active = true
+	second.Email = "1@example.com"
+	tt.CheckErr(db.InsertOrUpdate(second))
+	tt.Assert(db.Search(&account{}, "Score", "=", 0).Len() == 0)
+	tt.Assert(db.Search(&account{}, "Score", "=", 1).Len() == 1)
+	tt.Assert(sch.ObjectIndex.Fields["Score"].Len() == size/2)
+
+	tt.CheckErr(db.Delete(second))
+	tt.Assert(sch.ObjectIndex.Fields["Score"].Len() == size/2-1)
+	controlDB(t, db)
+	tt.CheckErr(db.DeepControl())
+
+	// predicates must be declared again to write Objects
+	db = closeAndReOpen(db)
+	tt.Assert(db.Search(&account{}, "Score", ">=", 0).Len() == size/2-1)
+	tt.ExpectErr(db.InsertOrUpdate(&account{Active: true}), ErrMissingPredicate)
+	tt.CheckErr(db.Create(&account{}, s))
+	tt.CheckErr(db.InsertOrUpdate(&account{Active: true, Score: 100, Email: "100@example.com"}))
+	tt.Assert(db.Search(&account{}, "Score", ">=", 0).Len() == size/2)
+	controlDB(t, db)
+
+	// index not partial anymore is rebuilt
+	full, err := NewSchemaBuilder(&account{}).PartialIndex("Email", active).Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&account{}, full))
+	tt.Assert(db.Search(&account{}, "Score", ">=", 0).Len() == size+1)
+
+	// inactive accounts share the same email
+	full, err = NewSchemaBuilder(&account{}).Build()
+	tt.CheckErr(err)
+	tt.ExpectErr(db.Create(&account{}, full), ErrConstraintUnique)
+
+	db = closeAndReOpen(db)
+	controlDB(t, db)
+	tt.CheckErr(db.DeepControl())
+}
+
+func TestInsertOrUpdateManyProgress(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(0, DefaultSchema)
+	defer db.Drop()
+
+	objects := make([]Object, 0, size)
+	for o := range genTestStructs(size) {
+		objects = append(objects, o)
+	}
+
+	calls, last := 0, 0
+	progress := func(done, total int) {
+		tt.Assert(done == last+1)
+		tt.Assert(total == size)
+		calls++
+		last = done
+	}
+
+	n, err := db.InsertOrUpdateManyProgress(progress, objects...)
+	tt.CheckErr(err)
+	tt.Assert(n == size)
+	tt.Assert(calls == size)
+	controlDBSize(t, db, &testStruct{}, size)
+
+	// progress is not reported if Objects are rejected
+	calls = 0
+	tt.CheckErr(db.Create(&testStructUnique{}, DefaultSchema))
+	_, err = db.InsertOrUpdateManyProgress(progress, &testStructUnique{A: 1}, &testStructUnique{A: 1})
+	tt.ExpectErr(err, ErrConstraintUnique)
+	tt.Assert(calls == 0)
+
+	// deferred writes are reported at once
+	s := DefaultSchema
+	s.Asynchrone(size*10, time.Hour)
+	tt.CheckErr(db.Create(&testStruct{}, s))
+	objects = objects[:0]
+	for o := range genTestStructs(size) {
+		objects = append(objects, o)
+	}
+	_, err = db.InsertOrUpdateManyProgress(func(done, total int) {
+		tt.Assert(done == size && total == size)
+		calls++
+	}, objects...)
+	tt.CheckErr(err)
+	tt.Assert(calls == 1)
+}
+
+func TestOpenVerified(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	odir := db.oDir(&testStruct{})
+	s, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	uuids, err := db.UUIDs(&testStruct{})
+	tt.CheckErr(err)
+
+	// Objects missing from index and from disk
+	for _, uuid := range uuids[:10] {
+		s.ObjectIndex.deleteByUUID(uuid)
+	}
+	tt.CheckErr(db.Close())
+	for _, uuid := range uuids[10:15] {
+		tt.CheckErr(os.Remove(filepath.Join(odir, s.filenameFromUUID(uuid))))
+	}
+
+	_, err = Open(db.root).Schema(&testStruct{})
+	tt.ExpectErr(err, ErrIndexCorrupted)
+
+	// types without schema are skipped
+	db, err = OpenVerified(db.root, &testStruct{}, &testStructUnique{})
+	tt.CheckErr(err)
+	controlDB(t, db)
+	controlDBSize(t, db, &testStruct{}, size-5)
+
+	// repaired index is committed
+	db = closeAndReOpen(db)
+	_, err = db.Schema(&testStruct{})
+	tt.CheckErr(err)
+
+	{
+		type testStruct struct {
+			Item
+			A string
+		}
+
+		_, err = OpenVerified(db.root, &testStruct{})
+		tt.ExpectErr(err, ErrStructureChanged)
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+
+	for _, format := range []string{TimeUnixMilli, TimeUnixNano, time.RFC3339, "2006-01-02 15:04"} {
+		s, err := NewSchemaBuilder(&testStruct{}).TimeFormat(format).Build()
+		tt.CheckErr(err)
+		db := createFreshTestDb(size, s)
+
+		all, err := db.All(&testStruct{})
+		tt.CheckErr(err)
+		ts := all[0].(*testStruct)
+
+		// times are stored in the chosen format
+		data, err := db.RawJSON(&testStruct{}, ts.UUID())
+		tt.CheckErr(err)
+		m := make(map[string]interface{})
+		tt.CheckErr(json.Unmarshal(data, &m))
+		switch format {
+		case TimeUnixMilli:
+			tt.Assert(m["M"] == float64(ts.M.UnixMilli()), m["M"])
+		case TimeUnixNano:
+			tt.Assert(m["M"] == float64(ts.M.UnixNano()), m["M"])
+		default:
+			tt.Assert(m["M"] == ts.M.UTC().Format(format), m["M"])
+		}
+
+		// Objects are read back with the same times
+		db = closeAndReOpen(db)
+		tt.CheckErr(db.DeepControl())
+		controlDBSize(t, db, &testStruct{}, size)
+		o, err := db.Search(&testStruct{}, "M", "=", ts.M).One()
+		tt.CheckErr(err)
+		tt.Assert(o.(*testStruct).M.Equal(ts.M))
+
+		// format of existing Objects cannot be changed
+		tt.ExpectErr(db.Create(&testStruct{}, DefaultSchema), ErrTimeFormatMismatch)
+		tt.CheckErr(db.Drop())
+	}
+}
+
+func TestDeleteOlderThan(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	cutoff := 30
+	db := createFreshTestDb(0, DefaultSchema)
+	defer db.Drop()
+
+	base := time.Now().Add(-time.Hour * time.Duration(size))
+	objects := make([]Object, 0, size)
+	i := 0
+	for o := range genTestStructs(size) {
+		o.(*testStruct).M = base.Add(time.Hour * time.Duration(i))
+		objects = append(objects, o)
+		i++
+	}
+	_, err := db.InsertOrUpdateMany(objects...)
+	tt.CheckErr(err)
+
+	n, err := db.DeleteOlderThan(&testStruct{}, "M", base.Add(time.Hour*time.Duration(cutoff)))
+	tt.CheckErr(err)
+	tt.Assert(n == cutoff, n)
+	controlDBSize(t, db, &testStruct{}, size-cutoff)
+	tt.Assert(db.Search(&testStruct{}, "M", "<", base.Add(time.Hour*time.Duration(cutoff))).Len() == 0)
+	controlDB(t, db)
+
+	// objects updated after cutoff while deleting are kept
+	later := base.Add(time.Hour * time.Duration(cutoff+10))
+	older, err := db.olderThan(&testStruct{}, "M", later)
+	tt.CheckErr(err)
+	tt.Assert(older.Len() == 10)
+	o, err := db.Search(&testStruct{}, "M", "<", later).One()
+	tt.CheckErr(err)
+	o.(*testStruct).M = time.Now()
+	tt.CheckErr(db.InsertOrUpdate(o))
+	n, err = older.DeleteInBatches(3)
+	tt.CheckErr(err)
+	tt.Assert(n == 9, n)
+	tt.Assert(db.Search(&testStruct{}, UUIDField, "=", o.UUID()).Len() == 1)
+	controlDB(t, db)
+
+	// nothing older than the oldest Object
+	n, err = db.DeleteOlderThan(&testStruct{}, "M", base)
+	tt.CheckErr(err)
+	tt.Assert(n == 0)
+
+	_, err = db.DeleteOlderThan(&testStruct{}, "A", base)
+	tt.ExpectErr(err, ErrNotTimeField)
+	_, err = db.DeleteOlderThan(&testStruct{}, "Unknown", base)
+	tt.ExpectErr(err, ErrUnkownField)
+	_, err = db.DeleteOlderThan(&person{}, "M", base)
+	tt.ExpectErr(err, ErrSchemaNotCreated)
+}
+
+func TestCompactAndVerify(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+
+	sch, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	all, err := db.All(&testStruct{})
+	tt.CheckErr(err)
+
+	// nothing to do on a consistent collection
+	r, err := db.CompactAndVerify(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(!r.Changed())
+
+	// file written by another encoder
+	data, err := json.MarshalIndent(all[0], "", "  ")
+	tt.CheckErr(err)
+	tt.CheckErr(db.storage.WriteFile(db.oPath(sch, all[0]), data, DefaultPermissions))
+	// file removed out of the DB
+	tt.CheckErr(db.storage.Remove(db.oPath(sch, all[1])))
+
+	r, err = db.CompactAndVerify(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(r.Changed())
+	tt.Assert(r.Compacted == 1 && r.Unindexed == 1 && r.Reindexed == 0, r)
+	controlDBSize(t, db, &testStruct{}, size-1)
+
+	raw, err := db.RawJSON(&testStruct{}, all[0].UUID())
+	tt.CheckErr(err)
+	tt.Assert(!bytes.Contains(raw, []byte("\n")))
+
+	db = closeAndReOpen(db)
+	tt.CheckErr(db.DeepControl())
+	r, err = db.CompactAndVerify(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(!r.Changed())
+}
+
+func TestReplaceAll(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 200
+
+	generation := func(n int, gen uint) chan Object {
+		out := make(chan Object)
+		go func() {
+			defer close(out)
+			for o := range genTestStructs(n) {
+				o.(*testStruct).N = gen
+				out <- o
+			}
+		}()
+		return out
+	}
+
+	for _, st := range []Storage{OSStorage{}, newMemStorage()} {
+		db := OpenWithStorage(randDBPath(), st)
+		tt.CheckErr(db.Create(&testStruct{}, DefaultSchema))
+		_, err := db.InsertOrUpdateBulk(generation(size, 1), size)
+		tt.CheckErr(err)
+
+		// readers never see a collection partially replaced
+		done := make(chan bool)
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				all, err := db.All(&testStruct{})
+				tt.CheckErr(err)
+				tt.Assert(len(all) == size || len(all) == size/2, len(all))
+				for _, o := range all {
+					tt.Assert(o.(*testStruct).N == all[0].(*testStruct).N)
+				}
+				tt.Assert(len(all) == size == (all[0].(*testStruct).N == 1))
+			}
+		}()
+
+		tt.CheckErr(db.ReplaceAll(&testStruct{}, generation(size/2, 2)))
+		close(done)
+		wg.Wait()
+
+		controlDB(t, db)
+		tt.CheckErr(db.DeepControl())
+		controlDBSize(t, db, &testStruct{}, size/2)
+		tt.Assert(db.Search(&testStruct{}, "N", "=", uint(1)).Len() == 0)
+		tt.Assert(!isDirAndExist(st, db.oDir(&testStruct{})+replaceSuffix))
+
+		// Objects are not replaced if new ones are invalid
+		tt.CheckErr(db.Create(&testStructUnique{}, DefaultSchema))
+		tt.CheckErr(db.InsertOrUpdate(&testStructUnique{A: 1, B: 1, C: "1"}))
+		invalid := make(chan Object, 2)
+		invalid <- &testStructUnique{A: 2, B: 2, C: "2"}
+		invalid <- &testStructUnique{A: 2, B: 3, C: "3"}
+		close(invalid)
+		tt.ExpectErr(db.ReplaceAll(&testStructUnique{}, invalid), ErrConstraintUnique)
+		_, err = db.Search(&testStructUnique{}, "A", "=", 1).One()
+		tt.CheckErr(err)
+		controlDBSize(t, db, &testStructUnique{}, 1)
+
+		db = OpenWithStorage(db.root, st)
+		controlDBSize(t, db, &testStruct{}, size/2)
+		tt.CheckErr(db.Drop())
+	}
+}
+
+func TestReplaceAllAsyncWrites(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 10
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s := DefaultSchema
+	s.Asynchrone(1000, time.Hour)
+	tt.CheckErr(db.Create(&testStruct{}, s))
+
+	routines := func() (n int) {
+		db.routines.Range(func(key, value interface{}) bool {
+			n++
+			return true
+		})
+		return
+	}
+
+	pending := func() int {
+		db.RLock()
+		defer db.RUnlock()
+		return db.asyncw.count(&testStruct{})
+	}
+
+	// routine flushing objects is not started again for the reloaded schema
+	for i := 0; i < 5; i++ {
+		tt.CheckErr(db.ReplaceAll(&testStruct{}, genTestStructs(size)))
+		tt.Assert(routines() == 1)
+	}
+	controlDBSize(t, db, &testStruct{}, size)
+
+	// routine uses the parameters of the reloaded schema
+	_, err := db.InsertOrUpdateBulk(genTestStructs(size), size)
+	tt.CheckErr(err)
+	tt.Assert(pending() == size)
+	tt.CheckErr(db.SetAsyncParams(&testStruct{}, size, time.Hour))
+	for start := time.Now(); pending() > 0 && time.Since(start) < 2*time.Second; {
+		time.Sleep(50 * time.Millisecond)
+	}
+	tt.Assert(pending() == 0)
+	controlDBSize(t, db, &testStruct{}, 2*size)
+}
+
+func TestDerivedIndex(t *testing.T) {
+	t.Parallel()
+
+	type user struct {
+		Item
+		First string
+		Last  string
+		Age   int `sod:"index"`
+	}
+
+	tt := toast.FromT(t)
+	size := 20
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	fullName := func(o Object) interface{} {
+		u := o.(*user)
+		return strings.ToLower(u.First + " " + u.Last)
+	}
+
+	s, err := NewSchemaBuilder(&user{}).DerivedIndex("FullName", fullName).Build()
+	tt.CheckErr(err)
+
+	wrong := s
+	wrong.DerivedIndex("Age", func(o Object) interface{} { return 42 })
+	tt.ExpectErr(db.Create(&user{}, wrong), ErrBadDerivedIndex)
+	wrong = s
+	wrong.DerivedIndex("Struct", func(o Object) interface{} { return struct{}{} })
+	tt.ExpectErr(db.Create(&user{}, wrong), ErrBadDerivedIndex)
+
+	tt.CheckErr(db.Create(&user{}, s))
+
+	users := make([]Object, 0, size)
+	for i := 0; i < size; i++ {
+		users = append(users, &user{First: fmt.Sprintf("First%d", i), Last: "Last", Age: i})
+	}
+	_, err = db.InsertOrUpdateMany(users...)
+	tt.CheckErr(err)
+	tt.CheckErr(db.InsertOrUpdate(&user{First: "John", Last: "Doe"}))
+	controlDBSize(t, db, &user{}, size+1)
+
+	o, err := db.Search(&user{}, "FullName", "=", "john doe").One()
+	tt.CheckErr(err)
+	tt.Assert(o.(*user).First == "John")
+	tt.Assert(db.Search(&user{}, "FullName", "~=", "last$").Len() == size)
+	tt.Assert(db.Search(&user{}, "FullName", "~=", "last$").And("Age", "<", 10).Len() == 10)
+	ok, err := db.IsIndexed(&user{}, "FullName")
+	tt.CheckErr(err)
+	tt.Assert(ok)
+
+	// derived values are updated but not stored
+	o.(*user).Last = "Smith"
+	tt.CheckErr(db.InsertOrUpdate(o))
+	tt.Assert(db.Search(&user{}, "FullName", "=", "john doe").Len() == 0)
+	tt.Assert(db.Search(&user{}, "FullName", "=", "john smith").Len() == 1)
+	data, err := db.RawJSON(&user{}, o.UUID())
+	tt.CheckErr(err)
+	tt.Assert(!bytes.Contains(data, []byte("FullName")))
+	tt.CheckErr(db.DeepControl())
+
+	// function must be declared again to write Objects
+	db = closeAndReOpen(db)
+	tt.Assert(db.Search(&user{}, "FullName", "=", "john smith").Len() == 1)
+	tt.ExpectErr(db.InsertOrUpdate(&user{First: "Jane", Last: "Doe"}), ErrMissingDerivation)
+	tt.CheckErr(db.Create(&user{}, s))
+	tt.CheckErr(db.InsertOrUpdate(&user{First: "Jane", Last: "Doe"}))
+	tt.Assert(db.Search(&user{}, "FullName", "=", "jane doe").Len() == 1)
+
+	// derived values are computed when repairing the index
+	sch, err := db.Schema(&user{})
+	tt.CheckErr(err)
+	jane, err := db.Search(&user{}, "FullName", "=", "jane doe").One()
+	tt.CheckErr(err)
+	sch.ObjectIndex.deleteByUUID(jane.UUID())
+	tt.CheckErr(db.Repair(&user{}))
+	tt.Assert(db.Search(&user{}, "FullName", "=", "jane doe").Len() == 1)
+	tt.CheckErr(db.DeepControl())
+
+	// index is rebuilt when the type of derived values changes
+	s2, err := NewSchemaBuilder(&user{}).DerivedIndex("FullName", func(o Object) interface{} {
+		return len(o.(*user).First)
+	}).Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&user{}, s2))
+	tt.Assert(db.Search(&user{}, "FullName", "=", len("Jane")).Len() == 2)
+	tt.CheckErr(db.DeepControl())
+
+	// index is dropped when not declared anymore
+	tt.CheckErr(db.Create(&user{}, DefaultSchema))
+	tt.ExpectErr(db.Search(&user{}, "FullName", "=", 4).Err(), ErrUnkownField)
+	controlDB(t, db)
+}
+
+func TestJSONValidator(t *testing.T) {
+	t.Parallel()
+
+	type account struct {
+		Item
+		Email string `sod:"index"`
+		Age   int
+		At    time.Time
+	}
+
+	errInvalidAge := errors.New("invalid age")
+
+	// validator a JSON Schema library would provide
+	validated := 0
+	validate := func(data []byte) error {
+		var m map[string]interface{}
+
+		validated++
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		// times are encoded as in Object files
+		if _, ok := m["At"].(float64); !ok {
+			return fmt.Errorf("unexpected time encoding %T", m["At"])
+		}
+		if age, ok := m["Age"].(float64); !ok || age < 18 {
+			return errInvalidAge
+		}
+		return nil
+	}
+
+	tt := toast.FromT(t)
+	db := Open(randDBPath())
+	defer db.Drop()
+
+	s, err := NewSchemaBuilder(&account{}).TimeFormat(TimeUnixMilli).JSONValidator(validate).Build()
+	tt.CheckErr(err)
+	tt.CheckErr(db.Create(&account{}, s))
+
+	tt.CheckErr(db.InsertOrUpdate(&account{Email: "alice@example.com", Age: 30}))
+	err = db.InsertOrUpdate(&account{Email: "bob@example.com", Age: 17})
+	tt.ExpectErr(err, ErrInvalidObject)
+	tt.Assert(strings.Contains(err.Error(), errInvalidAge.Error()))
+
+	// nothing is inserted if any Object is invalid
+	_, err = db.InsertOrUpdateMany(&account{Email: "carol@example.com", Age: 40}, &account{Age: 12})
+	tt.ExpectErr(err, ErrInvalidObject)
+	controlDBSize(t, db, &account{}, 1)
+	tt.Assert(validated == 4, validated)
+
+	// validator is not stored in the schema file
+	db = closeAndReOpen(db)
+	s = DefaultSchema
+	s.TimeFormat = TimeUnixMilli
+	tt.CheckErr(db.Create(&account{}, s))
+	tt.CheckErr(db.InsertOrUpdate(&account{Email: "bob@example.com", Age: 17}))
+	tt.Assert(validated == 4, validated)
+	controlDBSize(t, db, &account{}, 2)
+}
+
+func TestSchemaUnknownFields(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 100
+	db := createFreshTestDb(size, DefaultSchema)
+	defer db.Drop()
+	tt.CheckErr(db.Close())
+
+	// setting written by a newer version of sod
+	path := db.schemaPath(db.oDir(&testStruct{}))
+	m := make(map[string]json.RawMessage)
+	tt.CheckErr(unmarshalJsonFile(OSStorage{}, path, &m))
+	m["future-setting"] = json.RawMessage(`{"enable":true,"values":[1,2]}`)
+	data, err := json.Marshal(m)
+	tt.CheckErr(err)
+	tt.CheckErr(ioutil.WriteFile(path, data, 0600))
+
+	// schema saved by this version
+	db = Open(db.root)
+	for o := range genTestStructs(size) {
+		tt.CheckErr(db.InsertOrUpdate(o))
+	}
+	tt.CheckErr(db.Close())
+
+	m = make(map[string]json.RawMessage)
+	tt.CheckErr(unmarshalJsonFile(OSStorage{}, path, &m))
+	tt.Assert(string(m["future-setting"]) == `{"enable":true,"values":[1,2]}`, string(m["future-setting"]))
+
+	db = Open(db.root)
+	tt.CheckErr(db.Control())
+	controlDBSize(t, db, &testStruct{}, size*2)
+
+	// known fields are not duplicated
+	s, err := db.Schema(&testStruct{})
+	tt.CheckErr(err)
+	tt.Assert(len(s.unknown) == 1)
+	tt.Assert(s.unknown["future-setting"] != nil)
+}
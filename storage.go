@@ -0,0 +1,163 @@
+package sod
+
+import (
+	"io/fs"
+	"os"
+)
+
+// Storage abstracts the file system the DB is stored on. Paths are
+// built with path/filepath so an implementation not backed by a
+// local file system must treat them as opaque keys. Errors about
+// missing files or directories must match fs.ErrNotExist.
+type Storage interface {
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte, perm fs.FileMode) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	ReadDir(path string) ([]fs.DirEntry, error)
+	Stat(path string) (fs.FileInfo, error)
+	MkdirAll(path string, perm fs.FileMode) error
+}
+
+// OSStorage is the default Storage using the local file system
+type OSStorage struct{}
+
+func (OSStorage) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (OSStorage) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(path, data, perm)
+}
+
+func (OSStorage) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (OSStorage) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSStorage) ReadDir(path string) ([]fs.DirEntry, error) {
+	return os.ReadDir(path)
+}
+
+func (OSStorage) Stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (OSStorage) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSStorage) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Renamer is an optional interface implemented by the Storages able to
+// rename files and directories atomically. It is used to swap directories
+// rewritten entirely (see DB.RenameField).
+type Renamer interface {
+	Rename(oldpath, newpath string) error
+}
+
+// renamer returns the Renamer implemented by st if any
+func renamer(st Storage) (r Renamer, ok bool) {
+	if ls, limited := st.(*limitedStorage); limited {
+		st = ls.Storage
+	}
+	r, ok = st.(Renamer)
+	return
+}
+
+// Mapper is an optional interface implemented by the Storages able to
+// map files in memory. Object files are decoded from the mapped bytes,
+// which must not be used after unmap is called, instead of being read.
+type Mapper interface {
+	MapFile(path string) (data []byte, unmap func() error, err error)
+}
+
+// mapper returns the Mapper implemented by st if any, files mapped
+// through a limited Storage count in its limit while being mapped
+func mapper(st Storage) (m Mapper, ok bool) {
+	if ls, limited := st.(*limitedStorage); limited {
+		if _, ok = mapper(ls.Storage); ok {
+			return ls, true
+		}
+		return
+	}
+	m, ok = st.(Mapper)
+	return
+}
+
+// MmapStorage is an OSStorage memory mapping Object files to read them,
+// avoiding a read syscall and a buffer allocation every time an Object
+// is decoded. It is meant for read intensive workloads on collections of
+// large Objects not fitting in the Object cache, mapping small files is
+// slower than reading them (see BenchmarkReadFile). Compressed files are
+// read as usual and files are read on platforms not supporting mmap.
+// Object files must not be modified by other processes while the DB is
+// opened as accessing a mapped file truncated meanwhile crashes the
+// program. For the same reason, Object fields implementing
+// json.Unmarshaler must not retain the bytes they decode.
+type MmapStorage struct {
+	OSStorage
+}
+
+// limitedStorage bounds the number of files a Storage opens concurrently
+type limitedStorage struct {
+	Storage
+	sem chan struct{}
+}
+
+// LimitStorage returns a Storage opening at most n files concurrently
+// on st. Operations exceeding the limit wait for others to complete.
+// It prevents a DB read or written concurrently by many goroutines
+// from exhausting the file descriptors of the process.
+func LimitStorage(st Storage, n int) Storage {
+	if n < 1 {
+		n = 1
+	}
+	return &limitedStorage{Storage: st, sem: make(chan struct{}, n)}
+}
+
+func (s *limitedStorage) acquire() {
+	s.sem <- struct{}{}
+}
+
+func (s *limitedStorage) release() {
+	<-s.sem
+}
+
+func (s *limitedStorage) ReadFile(path string) ([]byte, error) {
+	s.acquire()
+	defer s.release()
+	return s.Storage.ReadFile(path)
+}
+
+func (s *limitedStorage) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	s.acquire()
+	defer s.release()
+	return s.Storage.WriteFile(path, data, perm)
+}
+
+func (s *limitedStorage) RemoveAll(path string) error {
+	s.acquire()
+	defer s.release()
+	return s.Storage.RemoveAll(path)
+}
+
+func (s *limitedStorage) ReadDir(path string) ([]fs.DirEntry, error) {
+	s.acquire()
+	defer s.release()
+	return s.Storage.ReadDir(path)
+}
+
+// MapFile maps the file at path with the Mapper of the underlying Storage,
+// see mapper
+func (s *limitedStorage) MapFile(path string) (data []byte, unmap func() error, err error) {
+	m, _ := mapper(s.Storage)
+	s.acquire()
+	defer s.release()
+	return m.MapFile(path)
+}
@@ -0,0 +1,413 @@
+package sod
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0xrawsec/toast"
+)
+
+type memFileInfo struct {
+	name string
+	size int64
+	mode fs.FileMode
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
+
+// memStorage is an in memory Storage
+type memStorage struct {
+	sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string][]byte), dirs: make(map[string]bool)}
+}
+
+func notExist(op, path string) error {
+	return &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+}
+
+func (m *memStorage) ReadFile(path string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if data, ok := m.files[filepath.Clean(path)]; ok {
+		return append([]byte{}, data...), nil
+	}
+	return nil, notExist("open", path)
+}
+
+func (m *memStorage) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	m.Lock()
+	defer m.Unlock()
+
+	path = filepath.Clean(path)
+	if !m.dirs[filepath.Dir(path)] {
+		return notExist("open", path)
+	}
+	m.files[path] = append([]byte{}, data...)
+	return nil
+}
+
+func (m *memStorage) Remove(path string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	path = filepath.Clean(path)
+	if _, ok := m.files[path]; ok {
+		delete(m.files, path)
+		return nil
+	}
+	if m.dirs[path] {
+		delete(m.dirs, path)
+		return nil
+	}
+	return notExist("remove", path)
+}
+
+func (m *memStorage) RemoveAll(path string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	for p := range m.files {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(m.files, p)
+		}
+	}
+	for p := range m.dirs {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(m.dirs, p)
+		}
+	}
+	return nil
+}
+
+func (m *memStorage) ReadDir(path string) (entries []fs.DirEntry, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	path = filepath.Clean(path)
+	if !m.dirs[path] {
+		return nil, notExist("open", path)
+	}
+
+	entries = make([]fs.DirEntry, 0)
+	for p, data := range m.files {
+		if filepath.Dir(p) == path {
+			entries = append(entries, fs.FileInfoToDirEntry(&memFileInfo{filepath.Base(p), int64(len(data)), 0600}))
+		}
+	}
+	for p := range m.dirs {
+		if p != path && filepath.Dir(p) == path {
+			entries = append(entries, fs.FileInfoToDirEntry(&memFileInfo{filepath.Base(p), 0, fs.ModeDir | 0700}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	return
+}
+
+func (m *memStorage) Stat(path string) (fs.FileInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	path = filepath.Clean(path)
+	if data, ok := m.files[path]; ok {
+		return &memFileInfo{filepath.Base(path), int64(len(data)), 0600}, nil
+	}
+	if m.dirs[path] {
+		return &memFileInfo{filepath.Base(path), 0, fs.ModeDir | 0700}, nil
+	}
+	return nil, notExist("stat", path)
+}
+
+func (m *memStorage) MkdirAll(path string, perm fs.FileMode) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for path = filepath.Clean(path); ; path = filepath.Dir(path) {
+		m.dirs[path] = true
+		if path == filepath.Dir(path) {
+			return nil
+		}
+	}
+}
+
+func TestMemStorage(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 1000
+	st := newMemStorage()
+	root := randDBPath()
+
+	for _, schema := range []Schema{DefaultSchema, DefaultSchemaCompress} {
+		db := OpenWithStorage(root, st)
+
+		tt.CheckErr(db.Create(&testStruct{}, schema))
+		_, err := db.InsertOrUpdateBulk(genTestStructs(size), size/10)
+		tt.CheckErr(err)
+		controlDB(t, db)
+
+		// nothing is written on the local file system
+		tt.Assert(!isDirAndExist(OSStorage{}, root))
+
+		o, err := db.Search(&testStruct{}, "A", "<", 21).One()
+		tt.CheckErr(err)
+		tt.CheckErr(db.Delete(o))
+		_, err = db.RawJSON(&testStruct{}, o.UUID())
+		tt.ExpectErr(err, ErrNoObjectFound)
+
+		tt.CheckErr(db.Close())
+		db = OpenWithStorage(root, st)
+		controlDB(t, db)
+		controlDBSize(t, db, &testStruct{}, size-1)
+
+		// index can be repaired
+		sch, err := db.Schema(&testStruct{})
+		tt.CheckErr(err)
+		all, err := db.All(&testStruct{})
+		tt.CheckErr(err)
+		tt.CheckErr(st.Remove(db.oPath(sch, all[0])))
+		tt.ExpectErr(sch.control(), ErrIndexCorrupted)
+		tt.CheckErr(db.Repair(&testStruct{}))
+		controlDB(t, db)
+		controlDBSize(t, db, &testStruct{}, size-2)
+
+		tt.CheckErr(db.Drop())
+		tt.Assert(len(st.files) == 0)
+	}
+}
+
+// countingStorage records the maximum number of files read or written concurrently
+type countingStorage struct {
+	*memStorage
+	mut     sync.Mutex
+	current int
+	max     int
+}
+
+func (c *countingStorage) enter() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+}
+
+func (c *countingStorage) leave() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.current--
+}
+
+func (c *countingStorage) ReadFile(path string) ([]byte, error) {
+	c.enter()
+	defer c.leave()
+	time.Sleep(time.Microsecond * 100)
+	return c.memStorage.ReadFile(path)
+}
+
+func (c *countingStorage) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	c.enter()
+	defer c.leave()
+	time.Sleep(time.Microsecond * 100)
+	return c.memStorage.WriteFile(path, data, perm)
+}
+
+func TestLimitStorage(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 500
+	limit := 2
+	st := &countingStorage{memStorage: newMemStorage()}
+	db := OpenWithStorage(randDBPath(), LimitStorage(st, limit))
+
+	tt.CheckErr(db.Create(&testStruct{}, DefaultSchema))
+	// objects are written by concurrent writers
+	_, err := db.InsertOrUpdateBulk(genTestStructs(size), size)
+	tt.CheckErr(err)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			all, err := db.All(&testStruct{})
+			tt.CheckErr(err)
+			tt.Assert(len(all) == size)
+		}()
+	}
+	wg.Wait()
+
+	controlDB(t, db)
+	tt.Assert(st.max > 0 && st.max <= limit, st.max)
+	tt.CheckErr(db.Drop())
+}
+
+var errFailingWrite = errors.New("failing write")
+
+// failingStorage fails writing the files containing marker
+type failingStorage struct {
+	*memStorage
+	marker []byte
+}
+
+func (f *failingStorage) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	if bytes.Contains(data, f.marker) {
+		return errFailingWrite
+	}
+	return f.memStorage.WriteFile(path, data, perm)
+}
+
+func TestInsertOrUpdateManyWriteFailure(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 10
+
+	for _, keep := range []int{0, 2} {
+		root := randDBPath()
+		st := &failingStorage{memStorage: newMemStorage(), marker: []byte(`"A":4242,`)}
+		db := OpenWithStorage(root, st)
+
+		s := DefaultSchema
+		s.KeepHistory = keep
+		tt.CheckErr(db.Create(&testStruct{}, s))
+		for i := 0; i < size; i++ {
+			tt.CheckErr(db.InsertOrUpdate(&testStruct{A: i}))
+		}
+
+		existing, err := db.Search(&testStruct{}, "A", "<", 2).Collect()
+		tt.CheckErr(err)
+		failed, updated := existing[0].(*testStruct), existing[1].(*testStruct)
+		prevFailed, prevUpdated := failed.A, updated.A
+		history, err := db.History(updated)
+		tt.CheckErr(err)
+		failed.A, updated.A = 4242, 100
+
+		// none of the objects is inserted if any write fails
+		n, err := db.InsertOrUpdateMany(failed, updated, &testStruct{A: 4242}, &testStruct{A: 101})
+		tt.ExpectErr(err, errFailingWrite)
+		tt.Assert(n == 0)
+		tt.Assert(db.Search(&testStruct{}, "A", "=", 4242).Len() == 0)
+		tt.Assert(db.Search(&testStruct{}, "A", ">=", 100).Len() == 0)
+		tt.Assert(db.Search(&testStruct{}, "A", "=", prevFailed).Len() == 1)
+		tt.Assert(db.Search(&testStruct{}, "A", "=", prevUpdated).Len() == 1)
+		controlDBSize(t, db, &testStruct{}, size)
+		controlDB(t, db)
+
+		// files of updated objects are restored and not archived
+		o, err := db.Get(&testStruct{Item: updated.Item})
+		tt.CheckErr(err)
+		tt.Assert(o.(*testStruct).A == prevUpdated)
+		after, err := db.History(updated)
+		tt.CheckErr(err)
+		tt.Assert(len(after) == len(history))
+
+		// new objects indexed at once
+		n, err = db.InsertOrUpdateMany(&testStruct{A: 4242}, &testStruct{A: 102})
+		tt.ExpectErr(err, errFailingWrite)
+		tt.Assert(n == 0)
+		controlDBSize(t, db, &testStruct{}, size)
+		controlDB(t, db)
+
+		// files left on disk are the ones of the objects inserted
+		tt.CheckErr(db.Close())
+		db = OpenWithStorage(root, st)
+		controlDB(t, db)
+		controlDBSize(t, db, &testStruct{}, size)
+		tt.Assert(db.Search(&testStruct{}, "A", "=", prevUpdated).Len() == 1)
+		tt.CheckErr(db.Drop())
+	}
+}
+
+func TestMmapStorage(t *testing.T) {
+	t.Parallel()
+
+	tt := toast.FromT(t)
+	size := 500
+
+	for _, schema := range []Schema{DefaultSchema, DefaultSchemaCompress} {
+		db := OpenWithStorage(randDBPath(), MmapStorage{})
+		m, ok := mapper(LimitStorage(db.storage, 1))
+		tt.Assert(ok)
+		// files are mapped within the limit
+		_, ok = m.(*limitedStorage)
+		tt.Assert(ok)
+		_, ok = mapper(LimitStorage(OSStorage{}, 1))
+		tt.Assert(!ok)
+
+		tt.CheckErr(db.Create(&testStruct{}, schema))
+		_, err := db.InsertOrUpdateBulk(genTestStructs(size), size/10)
+		tt.CheckErr(err)
+		tt.CheckErr(db.DeepControl())
+
+		all, err := db.All(&testStruct{})
+		tt.CheckErr(err)
+		tt.Assert(len(all) == size)
+
+		// Objects are identical to the ones read without mmap
+		other := OpenWithStorage(db.root, OSStorage{})
+		for _, o := range all {
+			read, err := other.GetByUUID(&testStruct{}, o.UUID())
+			tt.CheckErr(err)
+			tt.Assert(reflect.DeepEqual(o, read))
+		}
+
+		tt.CheckErr(db.Drop())
+	}
+}
+
+func BenchmarkReadFile(b *testing.B) {
+	size := 5000
+
+	for _, st := range []Storage{OSStorage{}, MmapStorage{}} {
+		db := OpenWithStorage(randDBPath(), st)
+		if err := db.Create(&testStruct{}, DefaultSchema); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := db.InsertOrUpdateBulk(genTestStructs(size), size/10); err != nil {
+			b.Fatal(err)
+		}
+
+		uuids, err := db.Search(&testStruct{}, "A", ">=", 0).UUIDs()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("%T", st), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.GetByUUID(&testStruct{}, uuids[i%len(uuids)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		if err := db.Drop(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package sod
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrBadSuffixIndex = errors.New("bad suffix index")
+)
+
+// reverse returns s with its runes in reverse order so that
+// the suffixes of s are the prefixes of the reversed string
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+// prefixEnd returns the smallest string greater than any string starting
+// with prefix, ok is false if there is no such string (i.e. empty prefix)
+func prefixEnd(prefix string) (end string, ok bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// validateSuffixIndexes checks that suffix indexes are declared on strings
+func (m FieldDescMap) validateSuffixIndexes() error {
+	for _, fd := range m {
+		if !fd.Constraints.SuffixIndex {
+			continue
+		}
+		if cast, ok := fd.castType(); !ok || cast != "string" {
+			return fmt.Errorf("%w: %s must be a string field", ErrBadSuffixIndex, fd.Path)
+		}
+	}
+	return nil
+}
+
+// reversedField returns the field holding the reversed value
+// of the field indexed for objid in the field index fn
+func (in *objIndex) reversedField(fn string, objid uint64) *IndexedField {
+	f := in.Fields[fn].objectIds[objid]
+	return &IndexedField{Value: reverse(f.Value.(string)), ObjectId: objid}
+}
+
+// buildSuffixIndexes builds the indexes of the reversed values of
+// the string fields having a suffix index constraint
+func (in *objIndex) buildSuffixIndexes() {
+	in.suffixes = make(map[string]*fieldIndex)
+
+	for fn, fi := range in.Fields {
+		if !fi.Constraints.SuffixIndex || fi.Cast != "string" {
+			continue
+		}
+
+		si := newFieldIndex(FieldDescriptor{Path: fn, Type: "string"})
+		reversed := make([]*IndexedField, 0, fi.Len())
+		for _, f := range fi.Index {
+			reversed = append(reversed, in.reversedField(fn, f.ObjectId))
+		}
+		si.replace(si.merged(reversed))
+		in.suffixes[fn] = si
+	}
+}
+
+// indexSuffixes indexes the reversed values of the fields indexed for
+// objid, field indexes must be up to date
+func (in *objIndex) indexSuffixes(objid uint64) {
+	for fn, si := range in.suffixes {
+		si.unindex(objid)
+		// Object not indexed by a partial index
+		if _, ok := in.Fields[fn].objectIds[objid]; ok {
+			si.insert(in.reversedField(fn, objid))
+		}
+	}
+}
+
+// searchSuffix returns the fields of fi (possibly constrained) ending with
+// value. The suffix index of the field is used if there is one.
+func (in *objIndex) searchSuffix(field string, fi *fieldIndex, value *IndexedField) (out []*IndexedField, err error) {
+	var suffix string
+	var ok bool
+	var si *fieldIndex
+	var matches []*IndexedField
+
+	if suffix, ok = value.Value.(string); !ok {
+		return nil, fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, value.Value, value.Value)
+	}
+
+	if si, ok = in.suffixes[field]; !ok {
+		return fi.SearchSuffix(value)
+	}
+
+	// suffix search is a prefix search on reversed values
+	prefix := reverse(suffix)
+	if end, ok := prefixEnd(prefix); ok {
+		matches = si.SearchRange(&IndexedField{Value: prefix}, &IndexedField{Value: end}, true, false)
+	} else {
+		matches = si.SearchGreaterOrEqual(&IndexedField{Value: prefix})
+	}
+
+	out = make([]*IndexedField, 0, len(matches))
+	for _, m := range matches {
+		if f, ok := fi.objectIds[m.ObjectId]; ok {
+			out = append(out, f)
+		}
+	}
+
+	// results are returned in field index order
+	sort.SliceStable(out, func(i, j int) bool { return out[j].less(out[i]) })
+
+	return
+}
+
+// SearchSuffix returns the fields ending with the string value.
+// It returns ErrCasting if value or indexed fields are not strings.
+func (in *fieldIndex) SearchSuffix(value *IndexedField) (out []*IndexedField, err error) {
+	var suffix string
+	var ok bool
+
+	if suffix, ok = value.Value.(string); !ok {
+		return nil, fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, value.Value, value.Value)
+	}
+
+	out = make([]*IndexedField, 0)
+
+	for _, f := range in.Index {
+		if sval, ok := f.Value.(string); ok {
+			if strings.HasSuffix(sval, suffix) {
+				out = append(out, f)
+			}
+		} else {
+			return nil, fmt.Errorf("%w, cannot cast %T(%v) to string", ErrCasting, f.Value, f.Value)
+		}
+	}
+
+	return
+}
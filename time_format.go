@@ -0,0 +1,219 @@
+package sod
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+const (
+	// TimeUnixMilli stores time.Time fields as Unix milliseconds
+	TimeUnixMilli = "unix-milli"
+	// TimeUnixNano stores time.Time fields as Unix nanoseconds
+	TimeUnixNano = "unix-nano"
+)
+
+var (
+	ErrBadTimeFormat      = errors.New("bad time format")
+	ErrTimeFormatMismatch = errors.New("time format mismatch")
+)
+
+// timeLayout returns the time layout used to store time.Time
+// fields or an empty string if they are stored as numbers
+func (s *Schema) timeLayout() string {
+	switch s.TimeFormat {
+	case TimeUnixMilli, TimeUnixNano:
+		return ""
+	}
+	return s.TimeFormat
+}
+
+// controlTimeFormat checks that times can be formatted and
+// parsed back with the time format of the schema
+func (s *Schema) controlTimeFormat() error {
+	layout := s.timeLayout()
+
+	if s.TimeFormat == "" || layout == "" {
+		return nil
+	}
+
+	ref := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	if _, err := time.Parse(layout, ref.Format(layout)); err != nil {
+		return fmt.Errorf("%w %q: %s", ErrBadTimeFormat, s.TimeFormat, err)
+	}
+
+	return nil
+}
+
+// formatTime returns t in the time format of the schema
+func (s *Schema) formatTime(t time.Time) (v interface{}) {
+	switch s.TimeFormat {
+	case TimeUnixMilli:
+		return t.UnixMilli()
+	case TimeUnixNano:
+		return t.UnixNano()
+	}
+	// layouts without time zone must not shift times
+	return t.UTC().Format(s.TimeFormat)
+}
+
+// parseTime parses a JSON value stored in the time format of the schema
+func (s *Schema) parseTime(raw json.RawMessage) (t time.Time, err error) {
+	var str string
+	var n int64
+
+	if layout := s.timeLayout(); layout != "" {
+		if err = json.Unmarshal(raw, &str); err != nil {
+			return
+		}
+		return time.Parse(layout, str)
+	}
+
+	if n, err = strconv.ParseInt(string(raw), 10, 64); err != nil {
+		return
+	}
+
+	if s.TimeFormat == TimeUnixMilli {
+		return time.UnixMilli(n).UTC(), nil
+	}
+	return time.Unix(0, n).UTC(), nil
+}
+
+// timeKeys returns the JSON keys of the time.Time fields of the schema
+func (s *Schema) timeKeys() (keys [][]string) {
+	t := reflect.TypeOf(s.object)
+
+	keys = make([][]string, 0)
+	for fpath, fd := range s.Fields {
+		if fd.Type == timeType.String() {
+			keys = append(keys, jsonFieldKeys(t, fieldPath(fpath)))
+		}
+	}
+	return
+}
+
+// convertTimes applies convert to the value of every time.Time
+// field found in data, the JSON encoding of an Object
+func (s *Schema) convertTimes(data []byte, convert func(json.RawMessage) (json.RawMessage, error)) (out []byte, err error) {
+	var value json.RawMessage
+	var ok bool
+
+	out = data
+	for _, keys := range s.timeKeys() {
+		if out, value, ok, err = popJSON(out, keys); err != nil {
+			return
+		} else if !ok {
+			continue
+		}
+
+		// zero values of pointers to structures
+		if string(value) != "null" {
+			if value, err = convert(value); err != nil {
+				return nil, fmt.Errorf("%w: field %s: %s", ErrBadTimeFormat, keys, err)
+			}
+		}
+
+		if out, err = pushJSON(out, keys, value); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// encodeTimes converts the time.Time fields of data, the JSON
+// encoding of an Object, to the time format of the schema
+func (s *Schema) encodeTimes(data []byte) ([]byte, error) {
+	if s.TimeFormat == "" {
+		return data, nil
+	}
+
+	return s.convertTimes(data, func(raw json.RawMessage) (json.RawMessage, error) {
+		var t time.Time
+
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return nil, err
+		}
+		return json.Marshal(s.formatTime(t))
+	})
+}
+
+// decodeTimes converts the time.Time fields of data, an Object
+// file, from the time format of the schema back to RFC3339
+func (s *Schema) decodeTimes(data []byte) ([]byte, error) {
+	if s.TimeFormat == "" {
+		return data, nil
+	}
+
+	return s.convertTimes(data, func(raw json.RawMessage) (json.RawMessage, error) {
+		t, err := s.parseTime(raw)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(t)
+	})
+}
+
+// truncateTimes sets the time.Time fields of o to the values read back
+// from disk, so that indexed values do not depend on the Object being
+// read from cache or from its file
+func (s *Schema) truncateTimes(o Object) {
+	if s.TimeFormat == "" {
+		return
+	}
+
+	for fpath, fd := range s.Fields {
+		if fd.Type != timeType.String() {
+			continue
+		}
+
+		if v, ok := valueFieldByName(reflect.ValueOf(o), fieldPath(fpath)); ok && v.CanSet() && v.Type() == timeType {
+			var raw []byte
+			var err error
+
+			if raw, err = json.Marshal(s.formatTime(v.Interface().(time.Time))); err != nil {
+				continue
+			}
+
+			if t, err := s.parseTime(raw); err == nil {
+				v.Set(reflect.ValueOf(t))
+			}
+		}
+	}
+}
+
+// decodeObject decodes data, the content of an Object file, into o.
+// Only the top level keys are decoded if keys is not nil.
+func (s *Schema) decodeObject(data []byte, o Object, keys []string) (err error) {
+	if data, err = s.decodeTimes(data); err != nil {
+		return
+	}
+
+	if keys != nil {
+		return unmarshalJsonKeys(data, o, keys)
+	}
+
+	return json.Unmarshal(data, o)
+}
+
+// readObject reads the file of an Object at path and decodes it into o,
+// see Schema.decodeObject
+func (db *DB) readObject(s *Schema, path string, o Object, keys []string) (err error) {
+	var data []byte
+	var unmap func() error
+
+	if data, unmap, err = mapJsonFile(db.storage, path); err != nil {
+		return
+	}
+
+	// encoding/json copies decoded values out of mapped bytes
+	if err = s.decodeObject(data, o, keys); err != nil {
+		unmap()
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return unmap()
+}
@@ -0,0 +1,123 @@
+package sod
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// setField sets field of o to value, value must be assignable to the field
+func setField(o Object, field string, value interface{}) (err error) {
+	v, ok := valueFieldByName(reflect.ValueOf(o), fieldPath(field))
+	if !ok || !v.CanSet() {
+		return fmt.Errorf("%w %s for object %T", ErrUnkownField, field, o)
+	}
+
+	e := reflect.ValueOf(value)
+	switch {
+	case !e.IsValid() && isNillable(v.Type()):
+		e = reflect.Zero(v.Type())
+	case !e.IsValid() || !e.Type().AssignableTo(v.Type()):
+		return fmt.Errorf("%w, cannot assign %T to %s of type %s", ErrCasting, value, field, v.Type())
+	}
+
+	v.Set(e)
+	return
+}
+
+// updateBatch sets field to value for the Objects of uuids still matching the
+// search, validates them all together and writes them as InsertOrUpdateMany
+// does, it returns the number of Objects updated
+func (db *DB) updateBatch(of Object, match *Search, uuids []string, field string, value interface{}) (n int, err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	// objects modified since the search was evaluated might not match anymore
+	if uuids, err = match.matching(s, uuids); err != nil {
+		return
+	}
+
+	objects := make([]Object, 0, len(uuids))
+	for _, uuid := range uuids {
+		var o Object
+
+		if o, err = db.getByUUID(newObject(of), uuid); err != nil {
+			return
+		}
+
+		// stored object might be cached so we must not modify it
+		o = CloneObject(o)
+
+		if err = setField(o, field, value); err != nil {
+			return
+		}
+
+		objects = append(objects, o)
+	}
+
+	// transformers, validation and constraints are checked on all the
+	// objects before any of them is modified
+	return db.insertOrUpdateMany(objects, nil, nil)
+}
+
+/***** Public Methods ******/
+
+// UpdateWhere sets field to value for all the Objects of the same type as of
+// matched by match. Objects are updated as with InsertOrUpdate, transformers
+// run, Objects are validated and unique constraints are enforced on the new
+// value, by batches of UpdateBatchSize Objects committed one after the
+// other. Only the indexes of the fields whose value changed are updated. The
+// search is evaluated again on every batch, while holding the lock, so that
+// Objects modified by someone else and not matching anymore are not updated
+// (see Search.DeleteInBatches). It returns the number of Objects updated.
+// On error, Objects of the batches already committed remain updated, and
+// none of the Objects of the failing batch is updated. Value must be
+// assignable to field otherwise an error wrapping ErrCasting is returned.
+func (db *DB) UpdateWhere(of Object, match *Search, field string, value interface{}) (n int, err error) {
+	var uuids []string
+
+	if db.snapshot != nil {
+		return 0, ErrSnapshotReadOnly
+	}
+
+	if uuids, err = match.resultUUIDs(); err != nil {
+		return
+	}
+
+	if stype(match.object) != stype(of) {
+		return 0, fmt.Errorf("%w: searching %s to update %s", ErrWrongObjectType, stype(match.object), stype(of))
+	}
+
+	// field and value are checked even if nothing matches
+	if err = setField(newObject(of), field, value); err != nil {
+		return
+	}
+
+	size := UpdateBatchSize
+	if size < 1 {
+		size = 1
+	}
+
+	for i := 0; i < len(uuids); i += size {
+		var updated int
+
+		j := i + size
+		if j > len(uuids) {
+			j = len(uuids)
+		}
+
+		updated, err = db.updateBatch(of, match, uuids[i:j], field, value)
+		n += updated
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -4,18 +4,50 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
-	"os"
 	"reflect"
-	"runtime"
 	"strings"
 
 	"github.com/google/uuid"
 )
 
+// sentinelErr is an error matching a sentinel error
+// while wrapping an underlying error
+type sentinelErr struct {
+	sentinel error
+	msg      string
+	err      error
+}
+
+func (e *sentinelErr) Error() string {
+	return fmt.Sprintf("%s: %s", e.msg, e.err)
+}
+
+func (e *sentinelErr) Is(target error) bool {
+	return target == e.sentinel
+}
+
+func (e *sentinelErr) Unwrap() error {
+	return e.err
+}
+
+// assignObject sets v to o. If v is not a pointer but the type o points
+// to, i.e. an element of a []T with *T implementing Object, v is set to
+// a copy of the value pointed by o.
+func assignObject(v reflect.Value, o Object) {
+	ov := reflect.ValueOf(o)
+	if v.Kind() != reflect.Ptr && ov.Kind() == reflect.Ptr && ov.Elem().Type().AssignableTo(v.Type()) {
+		v.Set(ov.Elem())
+		return
+	}
+	// panics naming both types if o cannot be assigned
+	v.Set(ov)
+}
+
 func AssignOne(o Object, target interface{}) {
 	v := reflect.ValueOf(target)
 	if v.Kind() == reflect.Ptr && !v.IsZero() {
@@ -26,9 +58,12 @@ func AssignOne(o Object, target interface{}) {
 			return
 		}
 	}
-	panic("target type must be a *sod.Object")
+	panic(fmt.Sprintf("target type must be a *sod.Object, got %T", target))
 }
 
+// Assign assigns objs to target, a *[]sod.Object. Slice elements can also be
+// values of the types the Objects point to, i.e. a *[]T with *T implementing
+// Object, in which case copies of the Objects are assigned.
 func Assign(objs []Object, target interface{}) (err error) {
 	v := reflect.ValueOf(target)
 	if v.Kind() == reflect.Ptr && !v.IsZero() {
@@ -38,18 +73,81 @@ func Assign(objs []Object, target interface{}) (err error) {
 			// making a new slice for value pointed by target
 			v.Set(reflect.MakeSlice(t.Elem(), len(objs), len(objs)))
 			for i := 0; i < len(objs); i++ {
-				ov := reflect.ValueOf(objs[i])
-				if _, ok := ov.Interface().(Object); ok {
-					v.Index(i).Set(ov)
-					continue
-				}
-				goto freakout
+				assignObject(v.Index(i), objs[i])
+			}
+			return
+		}
+	}
+	panic(fmt.Sprintf("target type must be *[]sod.Object, got %T", target))
+}
+
+// assignIterator assigns Objects read from an iterator to target as they
+// are read, so that Objects are not materialized twice. Target must be
+// a *[]sod.Object, or a *[]T as in Assign, otherwise the function panics.
+func assignIterator(it *iterator, target interface{}) (err error) {
+	var o Object
+
+	v := reflect.ValueOf(target)
+	if v.Kind() == reflect.Ptr && !v.IsZero() && v.Elem().Kind() == reflect.Slice {
+		v = v.Elem()
+		// making a new slice for value pointed by target
+		v.Set(reflect.MakeSlice(v.Type(), it.len(), it.len()))
+		i := 0
+		for o, err = it.next(); err == nil; o, err = it.next() {
+			assignObject(v.Index(i), o)
+			i++
+		}
+
+		// keeping only assigned Objects
+		v.Set(v.Slice(0, i))
+
+		// normal end of iterator
+		if err == ErrEOI {
+			err = nil
+		}
+		return
+	}
+
+	panic(fmt.Sprintf("target type must be *[]sod.Object, got %T", target))
+}
+
+// assignMap assigns Objects read from an iterator to target keyed by the
+// values of field, or by UUID if field is UUIDField. Target must be a
+// *map[K]sod.Object otherwise the function panics.
+func assignMap(it *iterator, field string, target interface{}) (err error) {
+	var o Object
+
+	v := reflect.ValueOf(target)
+	if v.Kind() == reflect.Ptr && !v.IsZero() && v.Elem().Kind() == reflect.Map {
+		m := reflect.MakeMapWithSize(v.Elem().Type(), it.len())
+		fp := fieldPath(field)
+
+		for o, err = it.next(); err == nil; o, err = it.next() {
+			var key reflect.Value
+			var ok bool
+
+			if field == UUIDField {
+				key = reflect.ValueOf(o.UUID())
+			} else if key, ok = valueFieldByName(reflect.ValueOf(o), fp); !ok {
+				return fmt.Errorf("%w %s for object %T", ErrUnkownField, field, o)
+			}
+
+			if m.MapIndex(key).IsValid() {
+				return fmt.Errorf("%w %v for field %s", ErrDuplicateKey, key.Interface(), field)
 			}
+			m.SetMapIndex(key, reflect.ValueOf(o))
+		}
+
+		// normal end of iterator
+		if err != ErrEOI {
 			return
 		}
+
+		v.Elem().Set(m)
+		return nil
 	}
-freakout:
-	panic("target type must be *[]sod.Object")
+
+	panic("target type must be *map[K]sod.Object")
 }
 
 // ToObjectSlice is a convenient function to pre-process arguments passed
@@ -165,6 +263,20 @@ func typeof(i interface{}) reflect.Type {
 	}
 }
 
+// isNillable returns true if nil can be assigned to a value of type t
+func isNillable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map, reflect.Chan, reflect.Func:
+		return true
+	}
+	return false
+}
+
+// newObject returns a new zero Object of the same type as of
+func newObject(of Object) Object {
+	return reflect.New(typeof(of)).Interface().(Object)
+}
+
 func uuidExt(name string) (uuid, ext string) {
 	s := strings.SplitN(name, ".", 2)
 	uuid = s[0]
@@ -172,17 +284,22 @@ func uuidExt(name string) (uuid, ext string) {
 	return
 }
 
-func uuidsFromDir(dir string) (uuids map[string]bool, err error) {
-	var entries []os.DirEntry
+func uuidsFromDir(st Storage, dir string) (uuids map[string]bool, err error) {
+	var entries []fs.DirEntry
 
 	// we read directory where objects are stored
-	if entries, err = os.ReadDir(dir); err != nil {
+	if entries, err = st.ReadDir(dir); err != nil {
 		return
 	}
 
 	// we re-index missing objects in index
 	uuids = make(map[string]bool)
 	for _, entry := range entries {
+		// sub-directories are partitions
+		if entry.IsDir() {
+			continue
+		}
+
 		uuid, _ := uuidExt(entry.Name())
 
 		if !uuidRegexp.MatchString(uuid) {
@@ -194,53 +311,62 @@ func uuidsFromDir(dir string) (uuids map[string]bool, err error) {
 	return
 }
 
-func isFileAndExist(path string) bool {
-	stat, err := os.Stat(path)
-	if os.IsNotExist(err) {
+func isFileAndExist(st Storage, path string) bool {
+	stat, err := st.Stat(path)
+	if err != nil {
 		return false
 	}
-	return stat.Mode().IsRegular() && err == nil
+	return stat.Mode().IsRegular()
 }
 
-func isDirAndExist(path string) bool {
-	stat, err := os.Stat(path)
-	if os.IsNotExist(err) {
+func isDirAndExist(st Storage, path string) bool {
+	stat, err := st.Stat(path)
+	if err != nil {
 		return false
 	}
-	return stat.Mode().IsDir() && err == nil
-}
-
-func dbgLock(lock string) {
-	if pc, _, _, ok := runtime.Caller(2); ok {
-		fn := runtime.FuncForPC(pc).Name()
-		fmt.Fprintf(os.Stderr, "%s: %s\n", lock, fn)
-	} else {
-		fmt.Fprintf(os.Stderr, "%s\n", lock)
-	}
+	return stat.Mode().IsDir()
 }
 
 func fieldPath(path string) []string {
 	return strings.Split(path, ".")
 }
 
-func unmarshalJsonFile(path string, i interface{}) (err error) {
-	var data []byte
-	var in *os.File
+func readJsonFile(st Storage, path string) (data []byte, err error) {
 	var r io.Reader
 
-	if in, err = os.Open(path); err != nil {
+	if data, err = st.ReadFile(path); err != nil {
 		return
 	}
-	defer in.Close()
 
-	r = in
 	if strings.HasSuffix(path, compressedExtension) {
-		if r, err = gzip.NewReader(in); err != nil {
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
 			return
 		}
+		return ioutil.ReadAll(r)
+	}
+
+	return
+}
+
+// mapJsonFile maps the JSON file at path in memory if st is a Mapper
+// and the file is not compressed, it is read otherwise. Data must not
+// be used after unmap is called.
+func mapJsonFile(st Storage, path string) (data []byte, unmap func() error, err error) {
+	if m, ok := mapper(st); ok && !strings.HasSuffix(path, compressedExtension) {
+		return m.MapFile(path)
 	}
 
-	if data, err = ioutil.ReadAll(r); err != nil {
+	if data, err = readJsonFile(st, path); err != nil {
+		return
+	}
+
+	return data, func() error { return nil }, nil
+}
+
+func unmarshalJsonFile(st Storage, path string, i interface{}) (err error) {
+	var data []byte
+
+	if data, err = readJsonFile(st, path); err != nil {
 		return
 	}
 
@@ -251,32 +377,215 @@ func unmarshalJsonFile(path string, i interface{}) (err error) {
 	return
 }
 
-func writeReader(path string, r io.Reader, perms fs.FileMode, compress bool) (err error) {
-	var out *os.File
-	var w io.WriteCloser
+// unmarshalJsonKeys unmarshals only the top level keys of the JSON object data
+// into i, like json.Unmarshal the fields of i not found in data are left
+// untouched. The values of other keys are tokenized to be skipped but they
+// are not decoded into i.
+func unmarshalJsonKeys(data []byte, i interface{}, keys []string) (err error) {
+	var tok json.Token
+	var dec *json.Decoder
 
-	if compress && !strings.HasSuffix(path, compressedExtension) {
-		path = fmt.Sprintf("%s%s", path, compressedExtension)
-	}
+	partial := make(map[string]json.RawMessage)
+	dec = json.NewDecoder(bytes.NewReader(data))
 
-	if out, err = os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, perms); err != nil {
+	// opening of JSON object
+	if tok, err = dec.Token(); err != nil {
 		return
 	}
-	defer out.Close()
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("expecting JSON object")
+	}
 
-	// default value for writer
-	w = out
-	if compress {
-		if w, err = gzip.NewWriterLevel(out, gzip.BestSpeed); err != nil {
+	for dec.More() {
+		var raw json.RawMessage
+
+		if tok, err = dec.Token(); err != nil {
+			return
+		}
+
+		key, _ := tok.(string)
+		if !hasKeyFold(keys, key) {
+			if err = skipJsonValue(dec); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err = dec.Decode(&raw); err != nil {
 			return
 		}
-		defer w.Close()
+		partial[key] = raw
 	}
 
-	if _, err = io.Copy(w, r); err != nil {
+	if data, err = json.Marshal(partial); err != nil {
 		return
 	}
 
-	return w.Close()
+	return json.Unmarshal(data, i)
+}
+
+// skipJsonValue skips the next JSON value of a decoder
+func skipJsonValue(dec *json.Decoder) (err error) {
+	var tok json.Token
+
+	for depth := 0; ; {
+		if tok, err = dec.Token(); err != nil {
+			return
+		}
+
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+
+		if depth == 0 {
+			return
+		}
+	}
+}
+
+// hasKeyFold returns true if key is in keys, comparison is made case insensitively
+// as encoding/json does when unmarshaling
+func hasKeyFold(keys []string, key string) bool {
+	for _, k := range keys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonKeys returns the JSON keys corresponding to the top level
+// fields of the field paths passed as parameter
+func jsonKeys(o Object, fpaths []string) (keys []string, err error) {
+	t := typeof(o)
+	keys = make([]string, 0, len(fpaths))
+
+	for _, fp := range fpaths {
+		name := fieldPath(fp)[0]
+		if sf, ok := t.FieldByName(name); ok && sf.IsExported() {
+			if tag, ok := sf.Tag.Lookup("json"); ok {
+				if tag = strings.Split(tag, ",")[0]; tag == "-" {
+					continue
+				} else if tag != "" {
+					name = tag
+				}
+			}
+			keys = append(keys, name)
+		} else {
+			return nil, fmt.Errorf("%w %s for object %T", ErrUnkownField, fp, o)
+		}
+	}
+
+	return
+}
+
+// structJsonKeys returns all the top level JSON keys of a structure type,
+// including the ones of the fields promoted from embedded structures
+func structJsonKeys(t reflect.Type) (keys []string) {
+	keys = make([]string, 0, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+
+		if tag == "-" {
+			continue
+		}
+
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				keys = append(keys, structJsonKeys(ft)...)
+				continue
+			}
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+		keys = append(keys, name)
+	}
+
+	return
+}
+
+// preserveUnknownFields adds to data, the JSON encoding of o, the top level
+// keys of the JSON object stored at path not known by the structure of o
+func preserveUnknownFields(st Storage, path string, o Object, data []byte) ([]byte, error) {
+	var stored []byte
+	var err error
+
+	if stored, err = readJsonFile(st, path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return data, nil
+		}
+		return nil, err
+	}
+
+	old := make(map[string]json.RawMessage)
+	// a file which cannot be decoded is overwritten
+	if err = json.Unmarshal(stored, &old); err != nil {
+		return data, nil
+	}
+
+	known := structJsonKeys(typeof(o))
+	unknown := make(map[string]json.RawMessage)
+	for key, value := range old {
+		if !hasKeyFold(known, key) {
+			unknown[key] = value
+		}
+	}
+
+	if len(unknown) == 0 {
+		return data, nil
+	}
+
+	new := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(data, &new); err != nil {
+		return nil, err
+	}
+
+	for key, value := range unknown {
+		new[key] = value
+	}
+
+	return json.Marshal(new)
+}
+
+func writeReader(st Storage, path string, r io.Reader, perms fs.FileMode, compress bool) (err error) {
+	var out bytes.Buffer
+	var w io.WriteCloser
+
+	if compress && !strings.HasSuffix(path, compressedExtension) {
+		path = fmt.Sprintf("%s%s", path, compressedExtension)
+	}
+
+	if compress {
+		if w, err = gzip.NewWriterLevel(&out, gzip.BestSpeed); err != nil {
+			return
+		}
+
+		if _, err = io.Copy(w, r); err != nil {
+			return
+		}
+
+		if err = w.Close(); err != nil {
+			return
+		}
+	} else if _, err = io.Copy(&out, r); err != nil {
+		return
+	}
 
+	return st.WriteFile(path, out.Bytes(), perms)
 }
@@ -3,6 +3,8 @@ package sod
 import (
 	"reflect"
 	"testing"
+
+	"github.com/0xrawsec/toast"
 )
 
 func TestObjectName(t *testing.T) {
@@ -10,3 +12,26 @@ func TestObjectName(t *testing.T) {
 	t.Log(reflect.TypeOf(&testStruct{}).Elem().Name())
 	t.Log(reflect.TypeOf(&testStruct{}).Elem().PkgPath())
 }
+
+func TestStructJsonKeys(t *testing.T) {
+	type embedded struct {
+		E int
+	}
+
+	type foo struct {
+		Item
+		*embedded
+		A       int
+		B       int `json:"b,omitempty"`
+		C       int `json:"-"`
+		D       int `json:",omitempty"`
+		private int
+	}
+
+	tt := toast.FromT(t)
+	keys := structJsonKeys(typeof(&foo{}))
+	tt.Assert(len(keys) == 4, keys)
+	for _, k := range []string{"E", "A", "b", "D"} {
+		tt.Assert(hasKeyFold(keys, k))
+	}
+}
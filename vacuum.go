@@ -0,0 +1,119 @@
+package sod
+
+import (
+	"sort"
+)
+
+// remapped returns a copy of the index whose ObjectIds are replaced
+// according to ids, IndexedFields are copied as they are shared
+func (in *fieldIndex) remapped(ids map[uint64]uint64) *fieldIndex {
+	new := *in
+	new.Index = make([]*IndexedField, 0, len(in.Index))
+	new.objectIds = make(map[uint64]*IndexedField, len(in.objectIds))
+
+	// order is kept as index is only sorted by values
+	for _, f := range in.Index {
+		nf := &IndexedField{Value: f.Value, ObjectId: ids[f.ObjectId]}
+		new.Index = append(new.Index, nf)
+		new.objectIds[nf.ObjectId] = nf
+	}
+
+	return &new
+}
+
+// compacted returns a copy of the index where the ObjectIds of the Objects
+// indexed are renumbered from zero, in the same order as the original ones
+func (in *objIndex) compacted() *objIndex {
+	old := make([]uint64, 0, len(in.ObjectIds))
+	for id := range in.ObjectIds {
+		old = append(old, id)
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i] < old[j] })
+
+	ids := make(map[uint64]uint64, len(old))
+	for k, id := range old {
+		ids[id] = uint64(k)
+	}
+
+	new := in.remapped(ids)
+	new.i = uint64(len(old))
+
+	return new
+}
+
+// remapped returns a copy of the index whose ObjectIds are replaced
+// according to ids, partitions included
+func (in *objIndex) remapped(ids map[uint64]uint64) *objIndex {
+	new := &objIndex{
+		uuids:      make(map[string]uint64, len(in.uuids)),
+		Fields:     make(map[string]*fieldIndex, len(in.Fields)),
+		Composites: make(map[string]*compositeIndex, len(in.Composites)),
+		Keys:       make(map[string]*keyIndex, len(in.Keys)),
+		ObjectIds:  make(map[uint64]string, len(in.ObjectIds)),
+		partOf:     make(map[uint64]string, len(in.partOf)),
+		partition:  in.partition,
+	}
+
+	for id, uuid := range in.ObjectIds {
+		new.ObjectIds[ids[id]] = uuid
+		new.uuids[uuid] = ids[id]
+	}
+
+	for fn, fi := range in.Fields {
+		new.Fields[fn] = fi.remapped(ids)
+	}
+
+	for cn, ci := range in.Composites {
+		nci := *ci
+		nci.Index = ci.Index.remapped(ids)
+		new.Composites[cn] = &nci
+	}
+
+	for field, ki := range in.Keys {
+		new.Keys[field] = ki.remapped(ids)
+	}
+
+	if in.Partitions != nil {
+		new.Partitions = make(map[string]*objIndex, len(in.Partitions))
+		for name, part := range in.Partitions {
+			new.Partitions[name] = part.remapped(ids)
+		}
+	}
+
+	for id, name := range in.partOf {
+		new.partOf[ids[id]] = name
+	}
+
+	new.uuidIndex = in.uuidIndex.remapped(ids)
+	new.buildSuffixIndexes()
+
+	return new
+}
+
+/***** Public Methods ******/
+
+// Vacuum renumbers the identifiers given in the index to the Objects of the
+// same type as of. Identifiers are never reused so, after many deletions,
+// the index keeps growing the identifiers of the Objects inserted. Objects
+// files are not modified and the index is replaced at once, only when it
+// is completely renumbered. The results of Searches evaluated before
+// Vacuum must not be used after.
+func (db *DB) Vacuum(of Object) (err error) {
+	db.Lock()
+	defer db.Unlock()
+
+	var s *Schema
+
+	if db.snapshot != nil {
+		return ErrSnapshotReadOnly
+	}
+
+	if s, err = db.schema(of); err != nil {
+		return
+	}
+
+	s.ObjectIndex = s.ObjectIndex.compacted()
+	s.queries.invalidate()
+
+	return db.commit(of)
+}